@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"freedom_bitrix/internal/auth"
+	"freedom_bitrix/internal/repo"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const keysUsage = "keys create <name> <scope>[,<scope>...] | keys list | keys revoke <id>"
+
+func runKeys(ctx context.Context, keys *repo.APIKeysRepository, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", keysUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: %s", keysUsage)
+		}
+		scopes, err := auth.ParseScopes(args[2:])
+		if err != nil {
+			return err
+		}
+		plain, id, hash, err := auth.GenerateKey()
+		if err != nil {
+			return fmt.Errorf("generate key: %w", err)
+		}
+		scopeNames := make([]string, len(scopes))
+		for i, sc := range scopes {
+			scopeNames[i] = string(sc)
+		}
+		if err := keys.CreateAPIKey(ctx, repo.APIKey{
+			ID:      id,
+			Name:    strings.TrimSpace(args[1]),
+			KeyHash: hash,
+			Scopes:  scopeNames,
+		}); err != nil {
+			return fmt.Errorf("store key: %w", err)
+		}
+		fmt.Fprintf(out, "id:     %s\nscopes: %s\nkey:    %s\n", id, strings.Join(scopeNames, ","), plain)
+		fmt.Fprintln(out, "The key is shown only once, store it now.")
+		return nil
+
+	case "list":
+		list, err := keys.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tCREATED\tLAST USED\tREVOKED")
+		for _, k := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				k.ID, k.Name, strings.Join(k.Scopes, ","),
+				k.CreatedAt.UTC().Format(time.RFC3339), fmtTimePtr(k.LastUsedAt), fmtTimePtr(k.RevokedAt))
+		}
+		return tw.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s", keysUsage)
+		}
+		if err := keys.RevokeAPIKey(ctx, strings.TrimSpace(args[1])); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "revoked %s\n", args[1])
+		return nil
+
+	default:
+		return fmt.Errorf("unknown keys command %q (usage: %s)", args[0], keysUsage)
+	}
+}
+
+func fmtTimePtr(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
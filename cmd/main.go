@@ -2,13 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"freedom_bitrix/internal/bitrix"
 	"freedom_bitrix/internal/config"
+	"freedom_bitrix/internal/fields"
+	"freedom_bitrix/internal/gsheets"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"freedom_bitrix/internal/notify"
+	"freedom_bitrix/internal/quality"
 	"freedom_bitrix/internal/repo"
 	"freedom_bitrix/internal/server"
+	"freedom_bitrix/internal/sla"
 	"freedom_bitrix/internal/syncer"
-	"log"
+	"freedom_bitrix/internal/verify"
+	"log/slog"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -23,75 +36,406 @@ const (
 func main() {
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatal(err)
+		fatal("config", err)
 	}
 
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		fatal("logging", err)
+	}
+	slog.SetDefault(logger)
+
 	mode := "delta"
 	if len(os.Args) > 1 {
 		mode = os.Args[1]
 	}
 
-	runCtx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
-	defer cancel()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, cfg, mode, os.Args[min(2, len(os.Args)):]); err != nil {
+		fatal("run "+mode, err)
+	}
+	slog.Info("done", "mode", mode)
+}
 
-	bx := bitrix.NewClient(cfg.BitrixWebhookBaseURL)
+func run(ctx context.Context, cfg config.Config, mode string, args []string) error {
+	var bxOpts []bitrix.Option
+	switch {
+	case cfg.BitrixReplayDir != "":
+		rt, err := bitrix.NewReplayTransport(cfg.BitrixReplayDir)
+		if err != nil {
+			return fmt.Errorf("bitrix replay: %w", err)
+		}
+		slog.Info("bitrix: replaying recorded exchanges", "dir", cfg.BitrixReplayDir)
+		bxOpts = append(bxOpts, bitrix.WithTransport(rt))
+	case cfg.BitrixRecordDir != "":
+		rt, err := bitrix.NewRecordingTransport(cfg.BitrixRecordDir, nil)
+		if err != nil {
+			return fmt.Errorf("bitrix recorder: %w", err)
+		}
+		slog.Info("bitrix: recording exchanges", "dir", cfg.BitrixRecordDir)
+		bxOpts = append(bxOpts, bitrix.WithTransport(rt))
+	}
+	bx := metrics.InstrumentCaller(bitrix.NewClient(cfg.BitrixWebhookBaseURL, bxOpts...))
 
-	pool, err := pgxpool.New(runCtx, cfg.DatabaseURL)
+	// The pool is closed last, after the HTTP server and the delta loop have stopped.
+	pool, err := pgxpool.New(ctx, cfg.DatabaseURL)
 	if err != nil {
-		log.Fatalf("pgxpool.New: %v", err)
+		return fmt.Errorf("pgxpool.New: %w", err)
 	}
 	defer pool.Close()
 
-	repository := repo.NewDealsRepository(pool)
-	if err := repository.Migrate(runCtx); err != nil {
-		log.Fatalf("migrate: %v", err)
+	repository := repo.NewDealsRepository(pool, repo.WithLocation(cfg.PortalLocation))
+	migrateCtx, cancelMigrate := context.WithTimeout(ctx, time.Minute)
+	err = repository.Migrate(migrateCtx)
+	cancelMigrate()
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	apiKeys := repo.NewAPIKeysRepository(pool)
+
+	profiles, err := server.LoadSheetProfiles(cfg.SheetProfilesFile)
+	if err != nil {
+		return err
+	}
+
+	slaRules, err := sla.LoadRules(cfg.SLARulesFile)
+	if err != nil {
+		return err
+	}
+	slaEvaluator := sla.NewEvaluator(repository, slaRules)
+	qualityRules, err := quality.LoadRules(cfg.QualityRulesFile)
+	if err != nil {
+		return err
+	}
+	qualityValidator := quality.NewValidator(repository, qualityRules, cfg.BusinessLocation)
+	fieldWatcher := fields.NewWatcher(bx, repository)
+
+	entities, err := syncer.LoadEntities(cfg.EntitiesFile)
+	if err != nil {
+		return err
+	}
+	tablesCtx, cancelTables := context.WithTimeout(ctx, time.Minute)
+	err = repository.EnsureItemTables(tablesCtx, syncer.ItemTables(entities))
+	cancelTables()
+	if err != nil {
+		return fmt.Errorf("item tables: %w", err)
+	}
+	verifySince, err := time.ParseInLocation(time.DateOnly, syncer.FullSyncFrom, cfg.PortalLocation)
+	if err != nil {
+		return fmt.Errorf("full sync start: %w", err)
+	}
+	verifier := verify.NewVerifier(bx, repository, syncer.DealFilter(entities), verifySince, cfg.PortalLocation)
+
+	serverOpts := []server.Option{
+		server.WithReadiness(repository, server.ReadinessConfig{
+			SyncMaxAge:  cfg.ReadySyncMaxAge,
+			CheckBitrix: cfg.ReadyCheckBitrix,
+		}),
+		server.WithSheetProfiles(profiles),
+		server.WithLocation(cfg.BusinessLocation),
+		server.WithAlerts(repository),
+		server.WithLeads(repository),
+		server.WithFields(repository),
+		server.WithParseErrors(repository),
+		server.WithQuality(repository),
+		server.WithVerify(verifier),
+	}
+	if cfg.APIAuthDisabled {
+		slog.Warn("API authentication is disabled (API_AUTH=disabled)")
+	} else {
+		serverOpts = append(serverOpts, server.WithAuth(apiKeys))
+	}
+	httpServer := server.New(repository, bx, stateKey, serverOpts...)
+
+	notifier, err := newNotifier(cfg, repository)
+	if err != nil {
+		return fmt.Errorf("notifier: %w", err)
+	}
+
+	var exporter *gsheets.Exporter
+	if cfg.SheetsSpreadsheetID != "" {
+		exporter, err = newSheetsExporter(ctx, cfg, httpServer)
+		if err != nil {
+			return fmt.Errorf("google sheets: %w", err)
+		}
 	}
 
-	syncService := syncer.NewService(bx, repository, stateKey, overlap)
-	httpServer := server.New(repository, bx, stateKey)
+	syncService := syncer.NewService(bx, repository, repository, stateKey, overlap,
+		syncer.WithRunStore(repository),
+		syncer.WithRelated(repository),
+		syncer.WithLeads(repository),
+		syncer.WithProducts(repository),
+		syncer.WithActivities(repository),
+		syncer.WithItems(repository, entities...),
+		syncer.WithResyncQueue(repository),
+		syncer.WithAfterSync(func(ctx context.Context, res syncer.Result) {
+			if res.Items > 0 {
+				httpServer.InvalidateSheetsCache()
+			}
+		}),
+		syncer.WithAfterSync(func(ctx context.Context, res syncer.Result) {
+			// Deals upserted before a failed page are validated too. Runs
+			// without deals still re-check open not_future violations.
+			if res.Entity != syncer.EntityDeal {
+				return
+			}
+			qRes, err := qualityValidator.Validate(ctx, res.DealIDs, time.Now())
+			if err != nil {
+				logging.FromContext(ctx).Error("quality validation failed", "err", err)
+				return
+			}
+			if len(qRes.Opened) > 0 || qRes.Cleared > 0 {
+				httpServer.InvalidateSheetsCache()
+			}
+		}),
+		syncer.WithAfterSync(func(ctx context.Context, res syncer.Result) {
+			if exporter == nil || res.Err != nil || (res.Mode != "delta" && res.Mode != "resync") || len(res.DealIDs) == 0 {
+				return
+			}
+			pushCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			defer cancel()
+			if err := exporter.Push(pushCtx, res.DealIDs); err != nil {
+				logging.FromContext(ctx).Error("sheets push failed", "err", err)
+			}
+		}),
+		syncer.WithAfterSync(func(ctx context.Context, res syncer.Result) {
+			if len(slaRules) == 0 || res.Err != nil || res.Mode != "delta" || res.Entity != syncer.EntityDeal {
+				return
+			}
+			slaRes, err := slaEvaluator.Evaluate(ctx, time.Now())
+			if err != nil {
+				logging.FromContext(ctx).Error("sla evaluation failed", "err", err)
+				return
+			}
+			if notifier != nil {
+				notifier.SLABreaches(ctx, slaRes.Opened)
+			}
+		}),
+		syncer.WithAfterSync(func(ctx context.Context, res syncer.Result) {
+			if notifier == nil || errors.Is(res.Err, syncer.ErrStopped) {
+				return
+			}
+			notifier.SyncFinished(ctx, res.StateKey, res.Mode, res.Err)
+		}))
 
 	switch mode {
 	case "full":
-		if err := syncService.FullSync(runCtx); err != nil {
-			log.Fatal(err)
+		syncCtx, cancel := context.WithTimeout(syncer.StopAfterPage(ctx), 30*time.Minute)
+		defer cancel()
+		if err := syncService.FullSync(syncCtx); err != nil {
+			return err
 		}
+		return syncService.SyncRelatedFull(syncCtx)
 	case "delta":
-		if err := syncService.DeltaSync(runCtx); err != nil {
-			log.Fatal(err)
-		}
+		syncCtx, cancel := context.WithTimeout(syncer.StopAfterPage(ctx), 30*time.Minute)
+		defer cancel()
+		return deltaAll(syncCtx, syncService)
 	case "serve-delta":
-		if err := syncService.DeltaSync(runCtx); err != nil {
-			log.Fatal(err)
+		syncCtx, cancel := context.WithTimeout(syncer.StopAfterPage(ctx), 30*time.Minute)
+		err := syncService.DeltaSync(syncCtx)
+		if err == nil {
+			// The delta loop retries related entities and resyncs, their
+			// failures do not keep the server from starting.
+			err = syncRelatedAndResyncs(syncCtx, syncService)
+			if err != nil && !errors.Is(err, syncer.ErrStopped) {
+				slog.Error("initial related sync failed", "err", err)
+				err = nil
+			}
+		}
+		cancel()
+		if errors.Is(err, syncer.ErrStopped) {
+			// Shutdown was requested during the initial delta.
+			return nil
+		}
+		if errors.Is(err, syncer.ErrNoWatermark) {
+			// Serve anyway: /readyz stays not ready until a full sync.
+			slog.Warn("initial delta skipped", "err", err)
+		} else if err != nil {
+			return err
+		}
+
+		// The loops stop with the HTTP server, also when it fails to start.
+		runCtx, cancelRun := context.WithCancel(ctx)
+		defer cancelRun()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runDeltaLoop(runCtx, syncService, deltaInterval)
+		}()
+		if notifier != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				notifier.Run(runCtx, stateKey, time.Minute)
+			}()
 		}
-		startDeltaLoop(syncService, deltaInterval)
-		if err := httpServer.Start(":8080"); err != nil {
-			log.Fatal(err)
+		if cfg.FieldsCheckInterval > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runFieldsLoop(runCtx, fieldWatcher, notifier, cfg.FieldsCheckInterval)
+			}()
 		}
-		return
+
+		err = httpServer.Run(ctx, ":8080")
+		cancelRun()
+		wg.Wait()
+		return err
 	case "serve":
-		if err := httpServer.Start(":8080"); err != nil {
-			log.Fatal(err)
+		// Syncs run elsewhere (e.g. cron); still watch the watermark.
+		runCtx, cancelRun := context.WithCancel(ctx)
+		defer cancelRun()
+		var wg sync.WaitGroup
+		if notifier != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				notifier.Run(runCtx, stateKey, time.Minute)
+			}()
+		}
+		err := httpServer.Run(ctx, ":8080")
+		cancelRun()
+		wg.Wait()
+		return err
+	case "keys":
+		return runKeys(ctx, apiKeys, args, os.Stdout)
+	case "fields":
+		return checkFields(ctx, fieldWatcher, notifier)
+	case "verify":
+		return runVerify(ctx, verifier, args, os.Stdout)
+	case "sheets-push":
+		if exporter == nil {
+			return fmt.Errorf("GOOGLE_SHEETS_SPREADSHEET_ID is not set")
 		}
-		return
+		return exporter.PushAll(ctx)
 	default:
-		log.Fatalf("unknown mode: %s (use: full | delta | serve | serve-delta)", mode)
+		return fmt.Errorf("unknown mode: %s (use: full | delta | serve | serve-delta | keys | sheets-push | fields | verify)", mode)
 	}
-
-	log.Println("DONE")
 }
 
-func startDeltaLoop(syncService *syncer.Service, interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
+func runDeltaLoop(ctx context.Context, syncService *syncer.Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		for tickAt := range ticker.C {
-			ctx, cancel := context.WithTimeout(context.Background(), 25*time.Minute)
-			err := syncService.DeltaSync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("delta loop stopped")
+			return
+		case tickAt := <-ticker.C:
+			syncCtx, cancel := context.WithTimeout(syncer.StopAfterPage(ctx), 25*time.Minute)
+			err := deltaAll(syncCtx, syncService)
 			cancel()
-			if err != nil {
-				log.Printf("periodic delta at %s failed: %v", tickAt.UTC().Format(time.RFC3339), err)
+			if err != nil && !errors.Is(err, syncer.ErrStopped) {
+				slog.Error("periodic delta failed", "tick_at", tickAt.UTC().Format(time.RFC3339), "err", err)
 			}
 		}
-	}()
+	}
+}
+
+// runFieldsLoop checks the deal field catalog on start and every interval.
+func runFieldsLoop(ctx context.Context, watcher *fields.Watcher, notifier *notify.Notifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := checkFields(ctx, watcher, notifier); err != nil && ctx.Err() == nil {
+			slog.Error("deal field check failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkFields(ctx context.Context, watcher *fields.Watcher, notifier *notify.Notifier) error {
+	checkCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	res, err := watcher.Check(checkCtx, time.Now())
+	if err != nil {
+		return err
+	}
+	if notifier != nil {
+		notifier.FieldChanges(ctx, res.Changes)
+	}
+	return nil
+}
+
+// deltaAll runs the deal delta, the contact, company, lead and activity
+// syncs and then the queued deal resyncs.
+func deltaAll(ctx context.Context, syncService *syncer.Service) error {
+	if err := syncService.DeltaSync(ctx); err != nil {
+		return err
+	}
+	return syncRelatedAndResyncs(ctx, syncService)
+}
+
+// syncRelatedAndResyncs runs the related entity syncs and then the queued
+// deal resyncs, also when a related entity failed; the errors are joined.
+func syncRelatedAndResyncs(ctx context.Context, syncService *syncer.Service) error {
+	err := syncService.SyncRelated(ctx)
+	if errors.Is(err, syncer.ErrStopped) {
+		return err
+	}
+	return errors.Join(err, syncService.ProcessResyncs(ctx))
+}
+
+func newSheetsExporter(ctx context.Context, cfg config.Config, rows gsheets.RowSource) (*gsheets.Exporter, error) {
+	if _, _, err := rows.ProfileLayout(ctx, cfg.SheetsProfile); err != nil {
+		return nil, err
+	}
+	account, err := gsheets.LoadServiceAccount(cfg.SheetsCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := gsheets.NewTokenSource(account, cfg.SheetsTokenURL)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("google sheets push enabled",
+		"spreadsheet_id", cfg.SheetsSpreadsheetID, "sheet", cfg.SheetsSheet, "profile", cfg.SheetsProfile)
+	return gsheets.NewExporter(gsheets.NewClient(cfg.SheetsBaseURL, tokens), rows, gsheets.Target{
+		SpreadsheetID: cfg.SheetsSpreadsheetID,
+		Sheet:         cfg.SheetsSheet,
+		Profile:       cfg.SheetsProfile,
+	}), nil
+}
+
+func newNotifier(cfg config.Config, store notify.SyncStore) (*notify.Notifier, error) {
+	var senders []notify.Sender
+	if cfg.NotifyTelegramToken != "" {
+		senders = append(senders, notify.NewTelegram(cfg.NotifyTelegramBaseURL, cfg.NotifyTelegramToken, cfg.NotifyTelegramChatID))
+	}
+	if cfg.NotifySlackWebhookURL != "" {
+		senders = append(senders, notify.NewSlack(cfg.NotifySlackWebhookURL))
+	}
+	if cfg.NotifyWebhookURL != "" {
+		senders = append(senders, notify.NewWebhook(cfg.NotifyWebhookURL))
+	}
+	if len(senders) == 0 {
+		return nil, nil
+	}
+
+	quiet, err := notify.ParseQuietHours(cfg.NotifyQuietHours)
+	if err != nil {
+		return nil, err
+	}
+	return notify.New(senders, store, notify.Config{
+		FailureThreshold: cfg.NotifyFailureThreshold,
+		StaleAfter:       cfg.NotifyStaleAfter,
+		DedupWindow:      cfg.NotifyDedupWindow,
+		Quiet:            quiet,
+		Location:         cfg.BusinessLocation,
+	}), nil
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"freedom_bitrix/internal/verify"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runVerify compares bitrix_deals with Bitrix and prints the report. It fails
+// when mismatches are found, so cron can alert on the exit code.
+func runVerify(ctx context.Context, v *verify.Verifier, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(out)
+	months := fs.Int("months", verify.DefaultMonths, "calendar months of DATE_CREATE to compare, up to the current one")
+	sample := fs.Int("sample", verify.DefaultSample, "random deals whose DATE_MODIFY is compared, 0 to skip")
+	resync := fs.Bool("resync", false, "queue a resync of the mismatching ranges for the next delta run")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rep, err := v.Run(ctx, verify.Options{Months: *months, Sample: *sample, Resync: *resync}, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			return err
+		}
+	} else if err := printVerifyReport(out, rep); err != nil {
+		return err
+	}
+
+	if !rep.OK() {
+		return fmt.Errorf("%d count and %d sample mismatches", len(rep.Counts), len(rep.Samples))
+	}
+	return nil
+}
+
+func printVerifyReport(out io.Writer, rep verify.Report) error {
+	categories := make([]string, len(rep.Categories))
+	for i, c := range rep.Categories {
+		categories[i] = fmt.Sprint(c)
+	}
+	fmt.Fprintf(out, "DATE_CREATE %s .. %s, categories %s: %d cells, bitrix %d, local %d\n",
+		rep.From.Format(time.DateOnly), rep.To.Format(time.DateOnly), strings.Join(categories, ","),
+		rep.Cells, rep.BitrixTotal, rep.LocalTotal)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if len(rep.Counts) > 0 {
+		fmt.Fprintln(tw, "CATEGORY\tMONTH\tBITRIX\tLOCAL\tDIFF\tPROBLEM")
+		for _, c := range rep.Counts {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%+d\t%s\n", c.CategoryID, c.Month, c.Bitrix, c.Local, c.Bitrix-c.Local, c.Problem)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "DATE_MODIFY sample: %d deals, %d mismatches\n", rep.Sampled, len(rep.Samples))
+	if len(rep.Samples) > 0 {
+		fmt.Fprintln(tw, "DEAL\tPROBLEM\tLOCAL\tBITRIX")
+		for _, s := range rep.Samples {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.DealID, s.Problem, fmtTimePtr(s.Local), fmtTimePtr(s.Bitrix))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range rep.Resyncs {
+		fmt.Fprintf(out, "queued resync %d: %s\n", r.ID, r.Reason)
+	}
+	return nil
+}
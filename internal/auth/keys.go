@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const keyPrefix = "fbk"
+
+type Scope string
+
+const (
+	ScopeSheetsRead  Scope = "sheets:read"
+	ScopeReportsRead Scope = "reports:read"
+	ScopeSyncAdmin   Scope = "sync:admin"
+)
+
+var AllScopes = []Scope{ScopeSheetsRead, ScopeReportsRead, ScopeSyncAdmin}
+
+func ParseScopes(values []string) ([]Scope, error) {
+	out := make([]Scope, 0, len(values))
+	seen := make(map[Scope]struct{})
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			sc := Scope(strings.TrimSpace(part))
+			if sc == "" {
+				continue
+			}
+			if !validScope(sc) {
+				return nil, fmt.Errorf("unknown scope %q (use: %s)", sc, joinScopes(AllScopes))
+			}
+			if _, ok := seen[sc]; ok {
+				continue
+			}
+			seen[sc] = struct{}{}
+			out = append(out, sc)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("at least one scope is required (use: %s)", joinScopes(AllScopes))
+	}
+	return out, nil
+}
+
+func HasScope(granted []string, want Scope) bool {
+	for _, g := range granted {
+		if Scope(g) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateKey returns the plaintext key shown once to the operator, its public
+// id and the hash to store. Keys look like fbk_<id>_<secret>.
+func GenerateKey() (plaintext, id, hash string, err error) {
+	idBytes := make([]byte, 6)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+	id = hex.EncodeToString(idBytes)
+	plaintext = fmt.Sprintf("%s_%s_%s", keyPrefix, id, hex.EncodeToString(secret))
+	return plaintext, id, HashKey(plaintext), nil
+}
+
+func ParseKeyID(key string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(key), "_")
+	if len(parts) != 3 || parts[0] != keyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(key)))
+	return hex.EncodeToString(sum[:])
+}
+
+func VerifyKey(key, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashKey(key)), []byte(hash)) == 1
+}
+
+func validScope(sc Scope) bool {
+	for _, s := range AllScopes {
+		if s == sc {
+			return true
+		}
+	}
+	return false
+}
+
+func joinScopes(scopes []Scope) string {
+	parts := make([]string, len(scopes))
+	for i, s := range scopes {
+		parts[i] = string(s)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,37 @@
+package auth
+
+import "testing"
+
+func TestGenerateAndVerifyKey(t *testing.T) {
+	plain, id, hash, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotID, ok := ParseKeyID(plain)
+	if !ok || gotID != id {
+		t.Fatalf("ParseKeyID(%q) = %q, %v; want %q", plain, gotID, ok, id)
+	}
+	if !VerifyKey(plain, hash) {
+		t.Fatal("generated key does not verify against its hash")
+	}
+	if VerifyKey(plain+"x", hash) {
+		t.Fatal("tampered key verified")
+	}
+	if _, ok := ParseKeyID("not-a-key"); ok {
+		t.Fatal("expected malformed key to be rejected")
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	got, err := ParseScopes([]string{"sheets:read,reports:read", "sheets:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != ScopeSheetsRead || got[1] != ScopeReportsRead {
+		t.Fatalf("unexpected scopes: %v", got)
+	}
+	if _, err := ParseScopes([]string{"admin"}); err == nil {
+		t.Fatal("expected error for unknown scope")
+	}
+}
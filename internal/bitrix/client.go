@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"freedom_bitrix/internal/logging"
 	"io"
 	"net/http"
 	"strings"
@@ -16,20 +17,40 @@ type Client struct {
 	httpClient *http.Client
 }
 
-func NewClient(baseURL string) *Client {
+type Option func(*Client)
+
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.httpClient.Transport = rt
+	}
+}
+
+func NewClient(baseURL string, opts ...Option) *Client {
 	baseURL = strings.TrimSpace(baseURL)
 	if !strings.HasSuffix(baseURL, "/") {
 		baseURL += "/"
 	}
-	return &Client{
+	c := &Client{
 		baseURL: baseURL,
 		httpClient: &http.Client{
 			Timeout: time.Duration(25) * time.Second,
 		},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *Client) Call(ctx context.Context, method string, payload any, out any) error {
+	started := time.Now()
+	err := c.call(ctx, method, payload, out)
+	logging.FromContext(ctx).Debug("bitrix call",
+		"method", method, "duration_ms", time.Since(started).Milliseconds(), "err", err)
+	return err
+}
+
+func (c *Client) call(ctx context.Context, method string, payload any, out any) error {
 	method = strings.TrimSpace(method)
 	if method == "" {
 		return fmt.Errorf("method is empty")
@@ -39,7 +60,7 @@ func (c *Client) Call(ctx context.Context, method string, payload any, out any)
 		method += ".json"
 	}
 
-	url := c.baseURL + method
+	endpoint := c.baseURL + method
 
 	var bodyBytes []byte
 	var err error
@@ -52,16 +73,16 @@ func (c *Client) Call(ctx context.Context, method string, payload any, out any)
 		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(bodyBytes))
 	if err != nil {
-		return fmt.Errorf("new request: %w", err)
+		return fmt.Errorf("new request: %w", redactURLError(err))
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("do request: %w", err)
+		return fmt.Errorf("do request: %w", redactURLError(err))
 	}
 	defer resp.Body.Close()
 
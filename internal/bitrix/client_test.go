@@ -0,0 +1,22 @@
+package bitrix
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransportErrorsHideWebhookToken(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	base := srv.URL + "/rest/7/secret-webhook/"
+	srv.Close()
+
+	err := NewClient(base).Call(context.Background(), "server.time", nil, nil)
+	if err == nil {
+		t.Fatal("expected a transport error")
+	}
+	if strings.Contains(err.Error(), "secret-webhook") || !strings.Contains(err.Error(), "/rest/7/***/server.time.json") {
+		t.Fatalf("error = %v", err)
+	}
+}
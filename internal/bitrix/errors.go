@@ -1,6 +1,30 @@
 package bitrix
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// webhookPathRe matches the secret part of an inbound webhook URL,
+// /rest/<user id>/<token>.
+var webhookPathRe = regexp.MustCompile(`(/rest/\d+/)[^/\s"']+`)
+
+// RedactWebhook replaces the webhook token in every URL within s.
+func RedactWebhook(s string) string {
+	return webhookPathRe.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactURLError removes the webhook token from the URL net/http puts into
+// its errors, which end up in logs, sync_runs and notifications.
+func redactURLError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = RedactWebhook(ue.URL)
+	}
+	return err
+}
 
 type APIError struct {
 	Errors           string `json:"error"`
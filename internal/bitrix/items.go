@@ -0,0 +1,126 @@
+package bitrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// The crm.item API names fields in camelCase; the classic list methods use
+// upper-case names. Most names convert word by word (CATEGORY_ID is
+// categoryId), these do not.
+var itemFieldExceptions = map[string]string{
+	"DATE_CREATE":   "createdTime",
+	"DATE_MODIFY":   "updatedTime",
+	"CREATED_BY_ID": "createdBy",
+	"MODIFY_BY_ID":  "updatedBy",
+	"CLOSEDATE":     "closedate",
+	"BEGINDATE":     "begindate",
+}
+
+var (
+	// UF_CRM_5_1700000000 of a smart process is ufCrm5_1700000000, UF_CRM_1700000000
+	// of a deal is ufCrm_1700000000.
+	upperTypedUFRe = regexp.MustCompile(`^UF_CRM_(\d+)_(\w+)$`)
+	upperUFRe      = regexp.MustCompile(`^UF_CRM_(\w+)$`)
+	itemTypedUFRe  = regexp.MustCompile(`^ufCrm(\d+)_(\w+)$`)
+	itemUFRe       = regexp.MustCompile(`^ufCrm_(\w+)$`)
+)
+
+// ItemFieldName returns the crm.item name of an upper-case field name.
+// Names that are already camelCase are returned unchanged.
+func ItemFieldName(name string) string {
+	if strings.IndexFunc(name, unicode.IsLower) >= 0 {
+		return name
+	}
+	if v, ok := itemFieldExceptions[name]; ok {
+		return v
+	}
+	if m := upperTypedUFRe.FindStringSubmatch(name); m != nil {
+		return "ufCrm" + m[1] + "_" + m[2]
+	}
+	if m := upperUFRe.FindStringSubmatch(name); m != nil {
+		return "ufCrm_" + m[1]
+	}
+	words := strings.Split(strings.ToLower(name), "_")
+	for i := 1; i < len(words); i++ {
+		if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// ItemFilter returns filter with its keys renamed by ItemFieldName; operator
+// prefixes such as @, >= and ! are kept.
+func ItemFilter(filter map[string]any) map[string]any {
+	if filter == nil {
+		return nil
+	}
+	out := make(map[string]any, len(filter))
+	for k, v := range filter {
+		field := strings.TrimLeft(k, "!@<>=%")
+		out[k[:len(k)-len(field)]+ItemFieldName(field)] = v
+	}
+	return out
+}
+
+// upperFieldName is the reverse of ItemFieldName.
+func upperFieldName(name string) string {
+	for upper, item := range itemFieldExceptions {
+		if item == name {
+			return upper
+		}
+	}
+	if m := itemTypedUFRe.FindStringSubmatch(name); m != nil {
+		return "UF_CRM_" + m[1] + "_" + strings.ToUpper(m[2])
+	}
+	if m := itemUFRe.FindStringSubmatch(name); m != nil {
+		return "UF_CRM_" + strings.ToUpper(m[1])
+	}
+	var b strings.Builder
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// DealFromItem maps a crm.item.list deal (entityTypeId 2) onto the
+// crm.deal.list shape, so that it is stored like a deal of that method.
+// Scalar fields become text and user fields keep every value; other arrays
+// and objects (contactIds, observers) have no deal field and are dropped.
+func DealFromItem(it Item) (Deal, error) {
+	fields := make(map[string]json.RawMessage, len(it))
+	for k, v := range it {
+		name := upperFieldName(k)
+		var raw []byte
+		var err error
+		if strings.HasPrefix(name, "UF_") {
+			raw, err = json.Marshal(v)
+		} else {
+			switch v.(type) {
+			case map[string]any, []any:
+				continue
+			}
+			raw, err = json.Marshal(it.String(k))
+		}
+		if err != nil {
+			return Deal{}, fmt.Errorf("%s: %w", k, err)
+		}
+		fields[name] = raw
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return Deal{}, err
+	}
+	var d Deal
+	if err := json.Unmarshal(b, &d); err != nil {
+		return Deal{}, fmt.Errorf("deal %s: %w", it.String("id"), err)
+	}
+	return d, nil
+}
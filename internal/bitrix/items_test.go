@@ -0,0 +1,66 @@
+package bitrix
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestItemFieldName(t *testing.T) {
+	cases := map[string]string{
+		"ID":                   "id",
+		"CATEGORY_ID":          "categoryId",
+		"ASSIGNED_BY_ID":       "assignedById",
+		"DATE_CREATE":          "createdTime",
+		"DATE_MODIFY":          "updatedTime",
+		"CLOSEDATE":            "closedate",
+		"UTM_SOURCE":           "utmSource",
+		"UF_CRM_1699841388494": "ufCrm_1699841388494",
+		"UF_CRM_5_1700000000":  "ufCrm5_1700000000",
+		"stageId":              "stageId",
+	}
+	for in, want := range cases {
+		if got := ItemFieldName(in); got != want {
+			t.Errorf("ItemFieldName(%q) = %q, want %q", in, got, want)
+		}
+		if in != want {
+			if back := upperFieldName(want); back != in {
+				t.Errorf("upperFieldName(%q) = %q, want %q", want, back, in)
+			}
+		}
+	}
+
+	filter := ItemFilter(map[string]any{"@CATEGORY_ID": []int{1}, ">=DATE_CREATE": "2024-01-01", "!STAGE_ID": "C1:LOSE"})
+	if filter["@categoryId"] == nil || filter[">=createdTime"] != "2024-01-01" || filter["!stageId"] != "C1:LOSE" {
+		t.Fatalf("ItemFilter = %v", filter)
+	}
+}
+
+func TestDealFromItem(t *testing.T) {
+	var it Item
+	body := `{"id":10,"categoryId":31,"stageId":"C31:NEW","assignedById":5,"createdTime":"2026-03-01T09:00:00+05:00",
+		"updatedTime":"2026-03-02T10:00:00+05:00","opportunity":150000.5,"currencyId":"KZT","closed":"N","contactId":7,
+		"contactIds":[7,8],"utmSource":"instagram","ufCrm_1699841388494":[45,46],"ufCrm_1647265424537":"12","ufCrm_1650279712660":null}`
+	if err := json.Unmarshal([]byte(body), &it); err != nil {
+		t.Fatal(err)
+	}
+	d, err := DealFromItem(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ID != "10" || d.CategoryID != "31" || d.StageID != "C31:NEW" || d.AssignedByID != "5" || d.ContactID != "7" {
+		t.Fatalf("deal = %+v", d)
+	}
+	if d.DateCreate != "2026-03-01T09:00:00+05:00" || d.DateModify != "2026-03-02T10:00:00+05:00" {
+		t.Fatalf("dates = %q %q", d.DateCreate, d.DateModify)
+	}
+	if d.Opportunity != "150000.5" || d.Closed != "N" || d.UTMSource != "instagram" {
+		t.Fatalf("deal = %+v", d)
+	}
+	if !slices.Equal(d.UFCRM1699841388494, Value{"45", "46"}) || !slices.Equal(d.UFClientType, Value{"12"}) {
+		t.Fatalf("user fields = %v %v", d.UFCRM1699841388494, d.UFClientType)
+	}
+	if _, ok := d.UserFields["UF_CRM_1650279712660"]; !ok || len(d.UserFields["UF_CRM_1650279712660"]) != 0 {
+		t.Fatalf("user fields = %v", d.UserFields)
+	}
+}
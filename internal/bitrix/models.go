@@ -1,5 +1,13 @@
 package bitrix
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type ListResponse[T any] struct {
 	Result []T  `json:"result"`
 	Next   *int `json:"next,omitempty"`
@@ -7,10 +15,45 @@ type ListResponse[T any] struct {
 }
 
 type Status struct {
-	EntityID   string `json:"ENTITY_ID"`
-	StatusID   string `json:"STATUS_ID"`
-	Name       string `json:"NAME"`
-	CategoryID string `json:"CATEGORY_ID"`
+	EntityID   string      `json:"ENTITY_ID"`
+	StatusID   string      `json:"STATUS_ID"`
+	Name       string      `json:"NAME"`
+	CategoryID string      `json:"CATEGORY_ID"`
+	Extra      StatusExtra `json:"EXTRA"`
+}
+
+// StatusExtra carries the stage semantics ("process", "success", "failure").
+// Bitrix sends EXTRA only for stages and may send it as an empty array or
+// null; any other shape is a decode error.
+type StatusExtra struct {
+	Semantics string `json:"SEMANTICS"`
+}
+
+func (e *StatusExtra) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("null")) {
+		*e = StatusExtra{}
+		return nil
+	}
+	if len(b) > 0 && b[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(b, &items); err != nil {
+			return err
+		}
+		if len(items) > 0 {
+			return fmt.Errorf("status EXTRA: unexpected array %s", b)
+		}
+		*e = StatusExtra{}
+		return nil
+	}
+	var v struct {
+		Semantics string `json:"SEMANTICS"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("status EXTRA: %w", err)
+	}
+	e.Semantics = v.Semantics
+	return nil
 }
 
 type DealCategory struct {
@@ -35,26 +78,378 @@ type DealUserFieldListItem struct {
 }
 
 type DealUserField struct {
-	FieldName string                  `json:"FIELD_NAME"`
-	List      []DealUserFieldListItem `json:"LIST"`
+	FieldName       string                  `json:"FIELD_NAME"`
+	UserTypeID      string                  `json:"USER_TYPE_ID"`
+	Multiple        string                  `json:"MULTIPLE"`
+	EditFormLabel   Labels                  `json:"EDIT_FORM_LABEL"`
+	ListColumnLabel Labels                  `json:"LIST_COLUMN_LABEL"`
+	List            []DealUserFieldListItem `json:"LIST"`
+}
+
+// Labels holds a user field label by language. Without a LANG filter Bitrix
+// sends an object keyed by language, with it a plain string, stored under "".
+type Labels map[string]string
+
+func (l *Labels) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = Labels{"": s}
+		return nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		// Empty labels come as [] or null.
+		*l = nil
+		return nil
+	}
+	*l = m
+	return nil
+}
+
+// Get returns the label in lang, falling back to a language-less label.
+func (l Labels) Get(lang string) string {
+	if v := l[lang]; v != "" {
+		return v
+	}
+	return l[""]
+}
+
+// FieldInfo is one entry of crm.deal.fields. For user fields title is the
+// field code and the labels are in listLabel / formLabel.
+type FieldInfo struct {
+	Type       string                  `json:"type"`
+	IsMultiple bool                    `json:"isMultiple"`
+	Title      string                  `json:"title"`
+	ListLabel  string                  `json:"listLabel"`
+	FormLabel  string                  `json:"formLabel"`
+	Items      []DealUserFieldListItem `json:"items"`
+}
+
+type FieldsResponse struct {
+	Result map[string]FieldInfo `json:"result"`
 }
 
 type Deal struct {
-	ID                 string `json:"ID"`
-	CategoryID         string `json:"CATEGORY_ID"`
-	StageID            string `json:"STAGE_ID"`
-	AssignedByID       string `json:"ASSIGNED_BY_ID"`
-	SourceID           string `json:"SOURCE_ID"`
-	DateCreate         string `json:"DATE_CREATE"`
-	DateModify         string `json:"DATE_MODIFY"`
-	UTMSource          string `json:"UTM_SOURCE"`
-	UTMCampaign        string `json:"UTM_CAMPAIGN"`
-	UFClientType       string `json:"UF_CRM_1647265424537"`
-	UFCoopType         string `json:"UF_CRM_1740477560309"`
-	UFCRM1650279712660 string `json:"UF_CRM_1650279712660"`
-	UFCRM1699841388494 string `json:"UF_CRM_1699841388494"`
-	UFCRM1699863367472 string `json:"UF_CRM_1699863367472"`
-	UFCRM1752578793696 string `json:"UF_CRM_1752578793696"`
-	UFCRM1753169789836 string `json:"UF_CRM_1753169789836"`
-	UFCRM1771313479555 string `json:"UF_CRM_1771313479555"`
+	ID                 string  `json:"ID"`
+	CategoryID         string  `json:"CATEGORY_ID"`
+	StageID            string  `json:"STAGE_ID"`
+	AssignedByID       string  `json:"ASSIGNED_BY_ID"`
+	SourceID           string  `json:"SOURCE_ID"`
+	DateCreate         string  `json:"DATE_CREATE"`
+	DateModify         string  `json:"DATE_MODIFY"`
+	MovedTime          string  `json:"MOVED_TIME"`
+	ContactID          string  `json:"CONTACT_ID"`
+	CompanyID          string  `json:"COMPANY_ID"`
+	LeadID             string  `json:"LEAD_ID"`
+	Opportunity        Decimal `json:"OPPORTUNITY"`
+	CurrencyID         string  `json:"CURRENCY_ID"`
+	Closed             string  `json:"CLOSED"`
+	CloseDate          string  `json:"CLOSEDATE"`
+	BeginDate          string  `json:"BEGINDATE"`
+	UTMSource          string  `json:"UTM_SOURCE"`
+	UTMCampaign        string  `json:"UTM_CAMPAIGN"`
+	UFClientType       Value   `json:"UF_CRM_1647265424537"`
+	UFCoopType         Value   `json:"UF_CRM_1740477560309"`
+	UFCRM1650279712660 Value   `json:"UF_CRM_1650279712660"`
+	UFCRM1699841388494 Value   `json:"UF_CRM_1699841388494"`
+	UFCRM1699863367472 Value   `json:"UF_CRM_1699863367472"`
+	UFCRM1752578793696 Value   `json:"UF_CRM_1752578793696"`
+	UFCRM1753169789836 Value   `json:"UF_CRM_1753169789836"`
+	UFCRM1771313479555 Value   `json:"UF_CRM_1771313479555"`
+
+	// UserFields holds every UF_* field of the response, including the
+	// typed ones above and those added to the select through ENTITIES_FILE.
+	UserFields map[string]Value `json:"-"`
+}
+
+func (d *Deal) UnmarshalJSON(b []byte) error {
+	type plain Deal
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	for k, raw := range fields {
+		if !strings.HasPrefix(k, "UF_") {
+			continue
+		}
+		var v Value
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		if p.UserFields == nil {
+			p.UserFields = make(map[string]Value)
+		}
+		p.UserFields[k] = v
+	}
+	*d = Deal(p)
+	return nil
+}
+
+// MultiField is one value of a multi-value communication field (PHONE, EMAIL).
+type MultiField struct {
+	ValueType string `json:"VALUE_TYPE"`
+	Value     string `json:"VALUE"`
+}
+
+type Contact struct {
+	ID           string       `json:"ID"`
+	Name         string       `json:"NAME"`
+	LastName     string       `json:"LAST_NAME"`
+	SecondName   string       `json:"SECOND_NAME"`
+	CompanyID    string       `json:"COMPANY_ID"`
+	AssignedByID string       `json:"ASSIGNED_BY_ID"`
+	DateCreate   string       `json:"DATE_CREATE"`
+	DateModify   string       `json:"DATE_MODIFY"`
+	Phone        []MultiField `json:"PHONE"`
+	Email        []MultiField `json:"EMAIL"`
+}
+
+type Company struct {
+	ID           string       `json:"ID"`
+	Title        string       `json:"TITLE"`
+	AssignedByID string       `json:"ASSIGNED_BY_ID"`
+	DateCreate   string       `json:"DATE_CREATE"`
+	DateModify   string       `json:"DATE_MODIFY"`
+	Phone        []MultiField `json:"PHONE"`
+	Email        []MultiField `json:"EMAIL"`
+}
+
+// Lead is a crm.lead.list item. STATUS_SEMANTIC_ID is "S" for converted,
+// "F" for junk and "P" (or empty) for leads still in work.
+type Lead struct {
+	ID               string `json:"ID"`
+	Title            string `json:"TITLE"`
+	StatusID         string `json:"STATUS_ID"`
+	StatusSemanticID string `json:"STATUS_SEMANTIC_ID"`
+	SourceID         string `json:"SOURCE_ID"`
+	AssignedByID     string `json:"ASSIGNED_BY_ID"`
+	ContactID        string `json:"CONTACT_ID"`
+	CompanyID        string `json:"COMPANY_ID"`
+	DateCreate       string `json:"DATE_CREATE"`
+	DateModify       string `json:"DATE_MODIFY"`
+	DateClosed       string `json:"DATE_CLOSED"`
+	UTMSource        string `json:"UTM_SOURCE"`
+	UTMCampaign      string `json:"UTM_CAMPAIGN"`
+}
+
+// Activity is a crm.activity.list item. TYPE_ID is 1 meeting, 2 call, 3 task,
+// 4 email; OWNER_TYPE_ID 2 is a deal. DIRECTION is 1 incoming, 2 outgoing.
+type Activity struct {
+	ID            string `json:"ID"`
+	OwnerTypeID   string `json:"OWNER_TYPE_ID"`
+	OwnerID       string `json:"OWNER_ID"`
+	TypeID        string `json:"TYPE_ID"`
+	ProviderID    string `json:"PROVIDER_ID"`
+	Direction     string `json:"DIRECTION"`
+	Subject       string `json:"SUBJECT"`
+	Completed     string `json:"COMPLETED"`
+	ResponsibleID string `json:"RESPONSIBLE_ID"`
+	Created       string `json:"CREATED"`
+	LastUpdated   string `json:"LAST_UPDATED"`
+	StartTime     string `json:"START_TIME"`
+	EndTime       string `json:"END_TIME"`
+	Deadline      string `json:"DEADLINE"`
+}
+
+// Item is one crm.item.list item of any entity type. Field names are the
+// camelCase ones of the crm.item API (id, title, stageId, updatedTime, ufCrm...).
+type Item map[string]any
+
+// String returns the field as text; numbers are formatted without exponent.
+func (it Item) String(key string) string {
+	switch v := it[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "Y"
+		}
+		return "N"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Int returns the field as an integer, 0 when it is missing or not numeric.
+func (it Item) Int(key string) int64 {
+	n, _ := strconv.ParseInt(it.String(key), 10, 64)
+	return n
+}
+
+// ItemListResponse is a crm.item.list page; items are wrapped in result.items.
+type ItemListResponse struct {
+	Result struct {
+		Items []Item `json:"items"`
+	} `json:"result"`
+	Next  *int `json:"next,omitempty"`
+	Total *int `json:"total,omitempty"`
+}
+
+// DealContact is one item of crm.deal.contact.items.get.
+type DealContact struct {
+	ContactID FlexInt `json:"CONTACT_ID"`
+	Sort      FlexInt `json:"SORT"`
+	IsPrimary string  `json:"IS_PRIMARY"`
+}
+
+// ProductRow is one item of crm.deal.productrows.get.
+type ProductRow struct {
+	ID          FlexInt `json:"ID"`
+	ProductID   FlexInt `json:"PRODUCT_ID"`
+	ProductName string  `json:"PRODUCT_NAME"`
+	Price       Decimal `json:"PRICE"`
+	Quantity    Decimal `json:"QUANTITY"`
+	DiscountSum Decimal `json:"DISCOUNT_SUM"`
+	TaxRate     Decimal `json:"TAX_RATE"`
+	MeasureName string  `json:"MEASURE_NAME"`
+	Sort        FlexInt `json:"SORT"`
+}
+
+// Decimal keeps a money or quantity value exactly as Bitrix sent it, whether
+// as a JSON number or a string; an empty or null value is "".
+type Decimal string
+
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(strings.TrimSpace(string(b)), `"`)
+	if s == "" || s == "null" {
+		*d = ""
+		return nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return fmt.Errorf("not a decimal: %s", b)
+	}
+	*d = Decimal(s)
+	return nil
+}
+
+// FlexInt accepts integers sent either as JSON numbers or as strings.
+type FlexInt int64
+
+func (f *FlexInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(strings.TrimSpace(string(b)), `"`)
+	if s == "" || s == "null" {
+		*f = 0
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("not an integer: %s", b)
+	}
+	*f = FlexInt(n)
+	return nil
+}
+
+// Value is a user field value. Bitrix sends single fields as a string, a
+// number or a bool and multiple fields as an array; every form is kept as a
+// list of strings. Numbers keep their JSON text, bools become "1" / "0" like
+// boolean user fields, objects (file fields) their compact JSON. Null, "" and
+// [] are an empty Value.
+type Value []string
+
+func (v *Value) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(b, &items); err != nil {
+			return err
+		}
+		out := make(Value, 0, len(items))
+		for _, it := range items {
+			s, err := scalarText(it)
+			if err != nil {
+				return err
+			}
+			if s != "" {
+				out = append(out, s)
+			}
+		}
+		*v = out
+		return nil
+	}
+	s, err := scalarText(b)
+	if err != nil {
+		return err
+	}
+	if s == "" {
+		*v = nil
+		return nil
+	}
+	*v = Value{s}
+	return nil
+}
+
+func scalarText(b json.RawMessage) (string, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return "", nil
+	}
+	switch b[0] {
+	case 'n':
+		return "", nil
+	case 't':
+		return "1", nil
+	case 'f':
+		return "0", nil
+	case '"':
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	case '{', '[':
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, b); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	default:
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return "", fmt.Errorf("not a user field value: %s", b)
+		}
+		return n.String(), nil
+	}
+}
+
+// String returns the first value, which is the whole value of a single field.
+func (v Value) String() string {
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+// BatchResponse is the result of the batch method; results are keyed by
+// command name, failed commands are reported in ResultError.
+type BatchResponse[T any] struct {
+	Result struct {
+		Result      BatchMap[T]   `json:"result"`
+		ResultError BatchMap[any] `json:"result_error"`
+	} `json:"result"`
+}
+
+// BatchMap decodes a keyed batch section; Bitrix sends an empty section as [].
+type BatchMap[T any] map[string]T
+
+func (m *BatchMap[T]) UnmarshalJSON(b []byte) error {
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "[") {
+		*m = BatchMap[T]{}
+		return nil
+	}
+	var v map[string]T
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*m = v
+	return nil
 }
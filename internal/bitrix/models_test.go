@@ -0,0 +1,73 @@
+package bitrix
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestDealUserFieldValues(t *testing.T) {
+	raw := `{
+		"ID": "7",
+		"UF_CRM_1699841388494": [45, "46", ""],
+		"UF_CRM_1740477560309": 12,
+		"UF_CRM_1647265424537": null,
+		"UF_CRM_1650279712660": "2026-02-03T00:00:00+03:00",
+		"UF_CRM_1700000000001": true,
+		"UF_CRM_1700000000002": {"id": 5, "showUrl": "/file"},
+		"UF_CRM_1700000000003": []
+	}`
+	var d Deal
+	if err := json.Unmarshal([]byte(raw), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(d.UFCRM1699841388494, Value{"45", "46"}) {
+		t.Fatalf("multiple enum = %q", d.UFCRM1699841388494)
+	}
+	if d.UFCoopType.String() != "12" || d.UFClientType != nil {
+		t.Fatalf("coop = %q, client = %q", d.UFCoopType, d.UFClientType)
+	}
+	if d.UFCRM1650279712660.String() != "2026-02-03T00:00:00+03:00" {
+		t.Fatalf("date = %q", d.UFCRM1650279712660)
+	}
+	if got := d.UserFields["UF_CRM_1700000000001"]; !slices.Equal(got, Value{"1"}) {
+		t.Fatalf("bool = %q", got)
+	}
+	if got := d.UserFields["UF_CRM_1700000000002"].String(); got != `{"id":5,"showUrl":"/file"}` {
+		t.Fatalf("object = %q", got)
+	}
+	if got, ok := d.UserFields["UF_CRM_1700000000003"]; !ok || len(got) != 0 {
+		t.Fatalf("empty array = %q, %v", got, ok)
+	}
+	if len(d.UserFields) != 7 {
+		t.Fatalf("user fields = %v", d.UserFields)
+	}
+}
+
+func TestStatusExtra(t *testing.T) {
+	cases := []struct {
+		raw       string
+		semantics string
+		wantErr   bool
+	}{
+		{raw: `{"EXTRA": {"SEMANTICS": "success"}}`, semantics: "success"},
+		{raw: `{"EXTRA": []}`},
+		{raw: `{"EXTRA": null}`},
+		{raw: `{}`},
+		{raw: `{"EXTRA": "success"}`, wantErr: true},
+		{raw: `{"EXTRA": ["success"]}`, wantErr: true},
+		{raw: `{"EXTRA": {"SEMANTICS": 1}}`, wantErr: true},
+	}
+	for _, c := range cases {
+		var st Status
+		err := json.Unmarshal([]byte(c.raw), &st)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: err = %v, want error %v", c.raw, err, c.wantErr)
+			continue
+		}
+		if err == nil && st.Extra.Semantics != c.semantics {
+			t.Errorf("%s: semantics = %q, want %q", c.raw, st.Extra.Semantics, c.semantics)
+		}
+	}
+}
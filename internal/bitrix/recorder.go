@@ -0,0 +1,254 @@
+package bitrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/logging"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "***"
+
+var secretKeys = map[string]struct{}{
+	"auth":              {},
+	"access_token":      {},
+	"refresh_token":     {},
+	"password":          {},
+	"application_token": {},
+}
+
+type Exchange struct {
+	Seq          int             `json:"seq"`
+	Method       string          `json:"method"`
+	RecordedAt   time.Time       `json:"recorded_at"`
+	RequestBody  json.RawMessage `json:"request_body"`
+	StatusCode   int             `json:"status_code"`
+	ResponseBody json.RawMessage `json:"response_body"`
+}
+
+// RecordingTransport writes every Bitrix request/response pair into dir as a
+// separate JSON file. The webhook path (user id and token) is never written.
+// Responses carry personal data (names, phones, emails), so the directory and
+// the files are readable by the owner only.
+type RecordingTransport struct {
+	dir  string
+	next http.RoundTripper
+
+	mu  sync.Mutex
+	seq int
+}
+
+func NewRecordingTransport(dir string, next http.RoundTripper) (*RecordingTransport, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create record dir: %w", err)
+	}
+	// MkdirAll keeps the mode of an existing directory.
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("restrict record dir: %w", err)
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RecordingTransport{dir: dir, next: next, seq: len(existing)}, nil
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readAndRestore(&req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("record request body: %w", err)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := readAndRestore(&resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("record response body: %w", err)
+	}
+
+	t.mu.Lock()
+	t.seq++
+	ex := Exchange{
+		Seq:          t.seq,
+		Method:       methodFromPath(req.URL.Path),
+		RecordedAt:   time.Now().UTC(),
+		RequestBody:  redactJSON(reqBody),
+		StatusCode:   resp.StatusCode,
+		ResponseBody: redactJSON(respBody),
+	}
+	t.mu.Unlock()
+
+	if err := writeExchange(t.dir, ex); err != nil {
+		logging.FromContext(req.Context()).Warn("bitrix recorder: write exchange", "err", err)
+	}
+	return resp, nil
+}
+
+// ReplayTransport serves previously recorded exchanges. Requests are matched
+// by method and request body; a request without an unused recorded match is
+// an error, so a replay never silently answers with another request's data.
+type ReplayTransport struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	used      []bool
+}
+
+func NewReplayTransport(dir string) (*ReplayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded exchanges in %s", dir)
+	}
+
+	exchanges := make([]Exchange, 0, len(files))
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var ex Exchange
+		if err := json.Unmarshal(raw, &ex); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f, err)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	sort.SliceStable(exchanges, func(i, j int) bool { return exchanges[i].Seq < exchanges[j].Seq })
+
+	return &ReplayTransport{exchanges: exchanges, used: make([]bool, len(exchanges))}, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readAndRestore(&req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("replay request body: %w", err)
+	}
+	method := methodFromPath(req.URL.Path)
+	body := canonicalJSON(redactJSON(reqBody))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := -1
+	for i, ex := range t.exchanges {
+		if !t.used[i] && ex.Method == method && bytes.Equal(canonicalJSON(ex.RequestBody), body) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("bitrix replay: no recorded exchange left for %s with body %s", method, body)
+	}
+	t.used[idx] = true
+
+	ex := t.exchanges[idx]
+	return &http.Response{
+		StatusCode:    ex.StatusCode,
+		Status:        fmt.Sprintf("%d %s", ex.StatusCode, http.StatusText(ex.StatusCode)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(ex.ResponseBody)),
+		ContentLength: int64(len(ex.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+func readAndRestore(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	raw, err := io.ReadAll(*body)
+	_ = (*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = io.NopCloser(bytes.NewReader(raw))
+	return raw, nil
+}
+
+func methodFromPath(p string) string {
+	return strings.TrimSuffix(path.Base(p), ".json")
+}
+
+func writeExchange(dir string, ex Exchange) error {
+	raw, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal exchange: %w", err)
+	}
+	name := fmt.Sprintf("%05d_%s.json", ex.Seq, ex.Method)
+	return os.WriteFile(filepath.Join(dir, name), raw, 0o600)
+}
+
+func redactJSON(raw []byte) json.RawMessage {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return json.RawMessage(`null`)
+	}
+	v, err := decodeJSON(raw)
+	if err != nil {
+		quoted, _ := json.Marshal(string(raw))
+		return quoted
+	}
+	out, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return json.RawMessage(`null`)
+	}
+	return out
+}
+
+func redactValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if _, ok := secretKeys[strings.ToLower(k)]; ok {
+				t[k] = redacted
+				continue
+			}
+			t[k] = redactValue(val)
+		}
+		return t
+	case []any:
+		for i := range t {
+			t[i] = redactValue(t[i])
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func canonicalJSON(raw []byte) []byte {
+	v, err := decodeJSON(raw)
+	if err != nil {
+		return raw
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return raw
+	}
+	return out
+}
+
+func decodeJSON(raw []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,77 @@
+package bitrix
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"result":[{"ID":"42","STAGE_ID":"C1:NEW"}],"total":1}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	rec, err := NewRecordingTransport(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := map[string]any{"FILTER": map[string]any{"ID": 42}, "auth": "secret-token"}
+	live := NewClient(srv.URL+"/rest/7/secret-webhook/", WithTransport(rec))
+	var got ListResponse[Deal]
+	if err := live.Call(context.Background(), "crm.deal.list", payload, &got); err != nil {
+		t.Fatalf("live call: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 recorded file, got %d", len(files))
+	}
+	raw, _ := os.ReadFile(files[0])
+	if strings.Contains(string(raw), "secret") {
+		t.Fatalf("recorded exchange leaks secrets: %s", raw)
+	}
+	for _, path := range []string{dir, files[0]} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm&0o077 != 0 {
+			t.Fatalf("%s is accessible by others: %v", path, perm)
+		}
+	}
+
+	replay, err := NewReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline := NewClient("http://bitrix-replay.invalid/", WithTransport(replay))
+	var replayed ListResponse[Deal]
+	if err := offline.Call(context.Background(), "crm.deal.list", payload, &replayed); err != nil {
+		t.Fatalf("replay call: %v", err)
+	}
+	if len(replayed.Result) != 1 || replayed.Result[0].ID != "42" {
+		t.Fatalf("unexpected replayed result: %+v", replayed)
+	}
+
+	if err := offline.Call(context.Background(), "crm.deal.list", payload, &replayed); err == nil {
+		t.Fatal("expected error once recorded exchanges are exhausted")
+	}
+
+	replay, err = NewReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline = NewClient("http://bitrix-replay.invalid/", WithTransport(replay))
+	other := map[string]any{"FILTER": map[string]any{"ID": 43}}
+	if err := offline.Call(context.Background(), "crm.deal.list", other, &replayed); err == nil {
+		t.Fatal("expected error for a request that was not recorded")
+	}
+}
@@ -3,16 +3,59 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	BitrixWebhookBaseURL string
 	DatabaseURL          string
+	BitrixRecordDir      string
+	BitrixReplayDir      string
+	LogFormat            string
+	LogLevel             string
+	ReadySyncMaxAge      time.Duration
+	ReadyCheckBitrix     bool
+	APIAuthDisabled      bool
+	SheetProfilesFile    string
+	BusinessLocation     *time.Location
+	PortalLocation       *time.Location
+	SLARulesFile         string
+	QualityRulesFile     string
+	EntitiesFile         string
+	FieldsCheckInterval  time.Duration
+
+	NotifyTelegramBaseURL  string
+	NotifyTelegramToken    string
+	NotifyTelegramChatID   string
+	NotifySlackWebhookURL  string
+	NotifyWebhookURL       string
+	NotifyFailureThreshold int
+	NotifyStaleAfter       time.Duration
+	NotifyDedupWindow      time.Duration
+	NotifyQuietHours       string
+
+	// Google Sheets push is enabled when SheetsSpreadsheetID is set.
+	SheetsSpreadsheetID   string
+	SheetsSheet           string
+	SheetsProfile         string
+	SheetsCredentialsFile string
+	SheetsBaseURL         string
+	SheetsTokenURL        string
 }
 
 func Load() (Config, error) {
+	recordDir := strings.TrimSpace(os.Getenv("BITRIX_RECORD_DIR"))
+	replayDir := strings.TrimSpace(os.Getenv("BITRIX_REPLAY_DIR"))
+	if recordDir != "" && replayDir != "" {
+		return Config{}, fmt.Errorf("BITRIX_RECORD_DIR and BITRIX_REPLAY_DIR are mutually exclusive")
+	}
+
 	base := strings.TrimSpace(os.Getenv("BITRIX_WEBHOOK_BASE_URL"))
+	if base == "" && replayDir != "" {
+		base = "http://bitrix-replay.invalid/"
+	}
 	if base == "" {
 		return Config{}, fmt.Errorf("BITRIX_WEBHOOK_BASE_URL is empty")
 	}
@@ -24,9 +67,152 @@ func Load() (Config, error) {
 	if dbURL == "" {
 		return Config{}, fmt.Errorf("DATABASE_URL is empty")
 	}
+	if replayDir != "" {
+		// A replay writes old Bitrix data into DATABASE_URL like a live sync.
+		allowDB, err := envBool("BITRIX_REPLAY_ALLOW_DB", false)
+		if err != nil {
+			return Config{}, err
+		}
+		if !allowDB {
+			return Config{}, fmt.Errorf("BITRIX_REPLAY_DIR writes replayed deals into DATABASE_URL: point it at a scratch database and set BITRIX_REPLAY_ALLOW_DB=true")
+		}
+	}
+
+	readyMaxAge, err := envDuration("READY_SYNC_MAX_AGE", time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+	readyBitrix, err := envBool("READY_CHECK_BITRIX", false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var authDisabled bool
+	switch mode := strings.ToLower(envOr("API_AUTH", "required")); mode {
+	case "required":
+	case "disabled":
+		authDisabled = true
+	default:
+		return Config{}, fmt.Errorf("API_AUTH: unknown value %q (use: required | disabled)", mode)
+	}
+
+	spreadsheetID := strings.TrimSpace(os.Getenv("GOOGLE_SHEETS_SPREADSHEET_ID"))
+	credentialsFile := strings.TrimSpace(os.Getenv("GOOGLE_SHEETS_CREDENTIALS_FILE"))
+	if spreadsheetID != "" && credentialsFile == "" {
+		return Config{}, fmt.Errorf("GOOGLE_SHEETS_CREDENTIALS_FILE is required when GOOGLE_SHEETS_SPREADSHEET_ID is set")
+	}
+
+	tzName := envOr("BUSINESS_TIMEZONE", "Asia/Almaty")
+	loc, err := time.LoadLocation(tzName)
+	if err != nil {
+		return Config{}, fmt.Errorf("BUSINESS_TIMEZONE: %w", err)
+	}
+	// Bitrix sends some dates without an offset, in the portal timezone.
+	portalLoc, err := time.LoadLocation(envOr("BITRIX_TIMEZONE", tzName))
+	if err != nil {
+		return Config{}, fmt.Errorf("BITRIX_TIMEZONE: %w", err)
+	}
+
+	fieldsInterval, err := envDuration("FIELDS_CHECK_INTERVAL", time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+
+	notifyThreshold, err := envInt("NOTIFY_FAILURE_THRESHOLD", 3)
+	if err != nil {
+		return Config{}, err
+	}
+	notifyStale, err := envDuration("NOTIFY_STALE_AFTER", 2*time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+	notifyDedup, err := envDuration("NOTIFY_DEDUP_WINDOW", time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+	tgToken := strings.TrimSpace(os.Getenv("NOTIFY_TELEGRAM_BOT_TOKEN"))
+	tgChat := strings.TrimSpace(os.Getenv("NOTIFY_TELEGRAM_CHAT_ID"))
+	if (tgToken == "") != (tgChat == "") {
+		return Config{}, fmt.Errorf("NOTIFY_TELEGRAM_BOT_TOKEN and NOTIFY_TELEGRAM_CHAT_ID must be set together")
+	}
 
 	return Config{
-		BitrixWebhookBaseURL: base,
-		DatabaseURL:          dbURL,
+		BitrixWebhookBaseURL:   base,
+		DatabaseURL:            dbURL,
+		BitrixRecordDir:        recordDir,
+		BitrixReplayDir:        replayDir,
+		LogFormat:              envOr("LOG_FORMAT", "text"),
+		LogLevel:               envOr("LOG_LEVEL", "info"),
+		ReadySyncMaxAge:        readyMaxAge,
+		ReadyCheckBitrix:       readyBitrix,
+		APIAuthDisabled:        authDisabled,
+		SheetProfilesFile:      strings.TrimSpace(os.Getenv("SHEET_PROFILES_FILE")),
+		BusinessLocation:       loc,
+		PortalLocation:         portalLoc,
+		SLARulesFile:           strings.TrimSpace(os.Getenv("SLA_RULES_FILE")),
+		QualityRulesFile:       strings.TrimSpace(os.Getenv("QUALITY_RULES_FILE")),
+		EntitiesFile:           strings.TrimSpace(os.Getenv("ENTITIES_FILE")),
+		FieldsCheckInterval:    fieldsInterval,
+		NotifyTelegramBaseURL:  envOr("NOTIFY_TELEGRAM_BASE_URL", "https://api.telegram.org/"),
+		NotifyTelegramToken:    tgToken,
+		NotifyTelegramChatID:   tgChat,
+		NotifySlackWebhookURL:  strings.TrimSpace(os.Getenv("NOTIFY_SLACK_WEBHOOK_URL")),
+		NotifyWebhookURL:       strings.TrimSpace(os.Getenv("NOTIFY_WEBHOOK_URL")),
+		NotifyFailureThreshold: notifyThreshold,
+		NotifyStaleAfter:       notifyStale,
+		NotifyDedupWindow:      notifyDedup,
+		NotifyQuietHours:       strings.TrimSpace(os.Getenv("NOTIFY_QUIET_HOURS")),
+		SheetsSpreadsheetID:    spreadsheetID,
+		SheetsSheet:            strings.TrimSpace(os.Getenv("GOOGLE_SHEETS_SHEET")),
+		SheetsProfile:          envOr("GOOGLE_SHEETS_PROFILE", "default"),
+		SheetsCredentialsFile:  credentialsFile,
+		SheetsBaseURL:          envOr("GOOGLE_SHEETS_BASE_URL", "https://sheets.googleapis.com/"),
+		SheetsTokenURL:         strings.TrimSpace(os.Getenv("GOOGLE_TOKEN_URL")),
 	}, nil
 }
+
+func envOr(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	if v == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,167 @@
+package fields
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"freedom_bitrix/internal/repo"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Source interface {
+	Call(ctx context.Context, method string, payload any, out any) error
+}
+
+type Store interface {
+	ListDealFields(ctx context.Context) ([]repo.DealField, error)
+	ReplaceDealFields(ctx context.Context, fields []repo.DealField, changes []repo.FieldChange) error
+}
+
+// Watcher keeps the deal field catalog and detects drift between snapshots.
+type Watcher struct {
+	source Source
+	store  Store
+}
+
+type Result struct {
+	Fields  int
+	Changes []repo.FieldChange
+	// Initial is set when there was no previous snapshot to compare with.
+	Initial bool
+}
+
+func NewWatcher(source Source, store Store) *Watcher {
+	return &Watcher{source: source, store: store}
+}
+
+// Check loads the current catalog from Bitrix, diffs it against the stored
+// snapshot and replaces the snapshot. The first snapshot reports no changes.
+func (w *Watcher) Check(ctx context.Context, now time.Time) (Result, error) {
+	current, err := Discover(ctx, w.source)
+	if err != nil {
+		return Result{}, err
+	}
+	prev, err := w.store.ListDealFields(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("load field catalog: %w", err)
+	}
+
+	res := Result{Fields: len(current), Initial: len(prev) == 0}
+	if !res.Initial {
+		res.Changes = Diff(prev, current, now)
+	}
+	if err := w.store.ReplaceDealFields(ctx, current, res.Changes); err != nil {
+		return Result{}, fmt.Errorf("store field catalog: %w", err)
+	}
+
+	for _, c := range res.Changes {
+		metrics.DealFieldChanges.WithLabelValues(c.Change).Inc()
+	}
+	logging.FromContext(ctx).Info("deal fields checked", "fields", res.Fields, "changes", len(res.Changes), "initial", res.Initial)
+	return res, nil
+}
+
+// Discover reads crm.deal.fields and adds the ru / en labels and enum items
+// of user fields from crm.deal.userfield.list.
+func Discover(ctx context.Context, source Source) ([]repo.DealField, error) {
+	var resp bitrix.FieldsResponse
+	if err := source.Call(ctx, "crm.deal.fields", map[string]any{}, &resp); err != nil {
+		return nil, fmt.Errorf("bitrix crm.deal.fields: %w", err)
+	}
+	userFields, err := listUserFields(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]repo.DealField, 0, len(resp.Result))
+	for code, info := range resp.Result {
+		f := repo.DealField{
+			Code:     code,
+			Type:     info.Type,
+			Title:    cmp.Or(info.FormLabel, info.ListLabel, info.Title),
+			Multiple: info.IsMultiple,
+			Items:    enumItems(info.Items),
+		}
+		if uf, ok := userFields[code]; ok {
+			f.LabelRU = cmp.Or(uf.EditFormLabel.Get("ru"), uf.ListColumnLabel.Get("ru"))
+			f.LabelEN = cmp.Or(uf.EditFormLabel["en"], uf.ListColumnLabel["en"])
+			if len(f.Items) == 0 {
+				f.Items = enumItems(uf.List)
+			}
+		}
+		out = append(out, f)
+	}
+	slices.SortFunc(out, func(a, b repo.DealField) int { return cmp.Compare(a.Code, b.Code) })
+	return out, nil
+}
+
+func listUserFields(ctx context.Context, source Source) (map[string]bitrix.DealUserField, error) {
+	out := make(map[string]bitrix.DealUserField)
+	start := 0
+	for {
+		var page bitrix.ListResponse[bitrix.DealUserField]
+		if err := source.Call(ctx, "crm.deal.userfield.list", map[string]any{"start": start}, &page); err != nil {
+			return nil, fmt.Errorf("bitrix crm.deal.userfield.list start=%d: %w", start, err)
+		}
+		for _, uf := range page.Result {
+			out[uf.FieldName] = uf
+		}
+		if page.Next == nil {
+			return out, nil
+		}
+		start = *page.Next
+	}
+}
+
+func enumItems(list []bitrix.DealUserFieldListItem) []repo.FieldEnumItem {
+	if len(list) == 0 {
+		return nil
+	}
+	out := make([]repo.FieldEnumItem, 0, len(list))
+	for _, it := range list {
+		out = append(out, repo.FieldEnumItem{ID: strings.TrimSpace(it.ID), Value: it.Value})
+	}
+	return out
+}
+
+// Diff reports fields added or removed between the snapshots, fields whose
+// type or multiple flag changed, and fields whose labels changed.
+func Diff(prev, next []repo.DealField, now time.Time) []repo.FieldChange {
+	old := make(map[string]repo.DealField, len(prev))
+	for _, f := range prev {
+		old[f.Code] = f
+	}
+
+	var out []repo.FieldChange
+	for _, f := range next {
+		p, ok := old[f.Code]
+		delete(old, f.Code)
+		switch {
+		case !ok:
+			out = append(out, repo.FieldChange{Code: f.Code, Change: repo.FieldAdded, NewType: typeOf(f), NewLabel: f.Label("ru"), DetectedAt: now})
+		case typeOf(p) != typeOf(f):
+			out = append(out, repo.FieldChange{Code: f.Code, Change: repo.FieldRetyped, OldType: typeOf(p), NewType: typeOf(f), NewLabel: f.Label("ru"), DetectedAt: now})
+		case p.Title != f.Title || p.LabelRU != f.LabelRU || p.LabelEN != f.LabelEN:
+			out = append(out, repo.FieldChange{Code: f.Code, Change: repo.FieldRelabeled, OldLabel: p.Label("ru"), NewLabel: f.Label("ru"), DetectedAt: now})
+		}
+	}
+	for _, p := range old {
+		out = append(out, repo.FieldChange{Code: p.Code, Change: repo.FieldRemoved, OldType: typeOf(p), OldLabel: p.Label("ru"), DetectedAt: now})
+	}
+	slices.SortFunc(out, func(a, b repo.FieldChange) int { return cmp.Compare(a.Code, b.Code) })
+	return out
+}
+
+// typeOf is the field type with a [] suffix for multiple fields, so that a
+// switch to multiple values counts as a retype.
+func typeOf(f repo.DealField) string {
+	if f.Multiple {
+		return f.Type + "[]"
+	}
+	return f.Type
+}
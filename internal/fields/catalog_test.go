@@ -0,0 +1,84 @@
+package fields
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/repo"
+	"testing"
+	"time"
+)
+
+type fakeSource map[string]string
+
+func (f fakeSource) Call(ctx context.Context, method string, payload any, out any) error {
+	body, ok := f[method]
+	if !ok {
+		return fmt.Errorf("unexpected method %s", method)
+	}
+	return json.Unmarshal([]byte(body), out)
+}
+
+func TestWatcherReportsDriftAgainstPreviousSnapshot(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	first := fakeSource{
+		"crm.deal.fields": `{"result":{
+			"STAGE_ID":{"type":"crm_status","title":"Стадия сделки"},
+			"UF_CRM_1":{"type":"string","title":"UF_CRM_1","formLabel":"Город"},
+			"UF_CRM_2":{"type":"enumeration","title":"UF_CRM_2","listLabel":"Формат","items":[{"ID":"45","VALUE":"Офлайн"}]}
+		}}`,
+		"crm.deal.userfield.list": `{"result":[
+			{"FIELD_NAME":"UF_CRM_1","USER_TYPE_ID":"string","EDIT_FORM_LABEL":{"ru":"Город","en":"City"}},
+			{"FIELD_NAME":"UF_CRM_2","USER_TYPE_ID":"enumeration","EDIT_FORM_LABEL":[],"LIST_COLUMN_LABEL":"Формат"}
+		]}`,
+	}
+	res, err := NewWatcher(first, store).Check(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Initial || res.Fields != 3 || len(res.Changes) != 0 {
+		t.Fatalf("unexpected first check: %+v", res)
+	}
+	catalog, _ := store.ListDealFields(ctx)
+	if uf := catalog[1]; uf.Code != "UF_CRM_1" || uf.LabelEN != "City" || uf.Label("en") != "City" {
+		t.Fatalf("unexpected field: %+v", uf)
+	}
+	if uf := catalog[2]; uf.LabelRU != "Формат" || len(uf.Items) != 1 || uf.Items[0].ID != "45" {
+		t.Fatalf("unexpected field: %+v", uf)
+	}
+
+	second := fakeSource{
+		"crm.deal.fields": `{"result":{
+			"STAGE_ID":{"type":"crm_status","title":"Стадия"},
+			"UF_CRM_2":{"type":"enumeration","isMultiple":true,"title":"UF_CRM_2","listLabel":"Формат"},
+			"UF_CRM_3":{"type":"date","title":"UF_CRM_3","formLabel":"Дата выхода"}
+		}}`,
+		"crm.deal.userfield.list": `{"result":[]}`,
+	}
+	res, err = NewWatcher(second, store).Check(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ code, change string }{
+		{"STAGE_ID", repo.FieldRelabeled},
+		{"UF_CRM_1", repo.FieldRemoved},
+		{"UF_CRM_2", repo.FieldRetyped},
+		{"UF_CRM_3", repo.FieldAdded},
+	}
+	if len(res.Changes) != len(want) {
+		t.Fatalf("changes = %+v", res.Changes)
+	}
+	for i, w := range want {
+		if c := res.Changes[i]; c.Code != w.code || c.Change != w.change {
+			t.Fatalf("change %d = %+v, want %s %s", i, c, w.code, w.change)
+		}
+	}
+	if c := res.Changes[2]; c.OldType != "enumeration" || c.NewType != "enumeration[]" {
+		t.Fatalf("unexpected retype: %+v", c)
+	}
+	stored, _ := store.ListFieldChanges(ctx, time.Now().Add(-time.Hour), 10)
+	if len(stored) != 4 {
+		t.Fatalf("stored %d changes", len(stored))
+	}
+}
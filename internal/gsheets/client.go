@@ -0,0 +1,150 @@
+package gsheets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/logging"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultBaseURL = "https://sheets.googleapis.com/"
+
+type Tokens interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// Client is a minimal Sheets API v4 client for the values endpoints.
+type Client struct {
+	baseURL    string
+	tokens     Tokens
+	httpClient *http.Client
+}
+
+func NewClient(baseURL string, tokens Tokens) *Client {
+	baseURL = strings.TrimSpace(baseURL)
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &Client{
+		baseURL:    baseURL,
+		tokens:     tokens,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+type ValueRange struct {
+	Range          string  `json:"range"`
+	MajorDimension string  `json:"majorDimension,omitempty"`
+	Values         [][]any `json:"values"`
+}
+
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("sheets api: %d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// GetValues reads rng with unformatted values, so numbers come back as numbers.
+func (c *Client) GetValues(ctx context.Context, spreadsheetID, rng, majorDimension string) (ValueRange, error) {
+	q := url.Values{"valueRenderOption": {"UNFORMATTED_VALUE"}}
+	if majorDimension != "" {
+		q.Set("majorDimension", majorDimension)
+	}
+	path := "v4/spreadsheets/" + url.PathEscape(spreadsheetID) + "/values/" + url.PathEscape(rng) + "?" + q.Encode()
+
+	var out ValueRange
+	err := c.do(ctx, http.MethodGet, path, nil, &out)
+	return out, err
+}
+
+func (c *Client) BatchUpdate(ctx context.Context, spreadsheetID string, data []ValueRange) error {
+	body := map[string]any{
+		"valueInputOption": "RAW",
+		"data":             data,
+	}
+	path := "v4/spreadsheets/" + url.PathEscape(spreadsheetID) + "/values:batchUpdate"
+	return c.do(ctx, http.MethodPost, path, body, nil)
+}
+
+func (c *Client) BatchClear(ctx context.Context, spreadsheetID string, ranges []string) error {
+	path := "v4/spreadsheets/" + url.PathEscape(spreadsheetID) + "/values:batchClear"
+	return c.do(ctx, http.MethodPost, path, map[string]any{"ranges": ranges}, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, payload any, out any) error {
+	started := time.Now()
+	err := c.roundTrip(ctx, method, path, payload, out)
+	logging.FromContext(ctx).Debug("sheets call",
+		"method", method, "path", strings.SplitN(path, "?", 2)[0], "duration_ms", time.Since(started).Milliseconds(), "err", err)
+	return err
+}
+
+func (c *Client) roundTrip(ctx context.Context, method, path string, payload any, out any) error {
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("sheets token: %w", err)
+	}
+
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("marshal payload: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error APIError `json:"error"`
+		}
+		if json.Unmarshal(raw, &apiErr) == nil && apiErr.Error.Code != 0 {
+			return apiErr.Error
+		}
+		return fmt.Errorf("http status %d: %s", resp.StatusCode, string(raw))
+	}
+
+	if out == nil {
+		return nil
+	}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(out); err != nil {
+		return fmt.Errorf("unmarshal response: %w; raw=%s", err, string(raw))
+	}
+	return nil
+}
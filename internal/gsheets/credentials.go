@@ -0,0 +1,186 @@
+package gsheets
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scopeSpreadsheets = "https://www.googleapis.com/auth/spreadsheets"
+	defaultTokenURL   = "https://oauth2.googleapis.com/token"
+)
+
+// ServiceAccount holds the fields of a Google service account JSON key that
+// the JWT bearer flow needs.
+type ServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+func LoadServiceAccount(path string) (ServiceAccount, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return ServiceAccount{}, fmt.Errorf("read service account: %w", err)
+	}
+	var sa ServiceAccount
+	if err := json.Unmarshal(raw, &sa); err != nil {
+		return ServiceAccount{}, fmt.Errorf("parse service account %s: %w", path, err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return ServiceAccount{}, fmt.Errorf("service account %s: client_email and private_key are required", path)
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = defaultTokenURL
+	}
+	return sa, nil
+}
+
+// TokenSource exchanges a signed service account assertion for an access
+// token and caches it until shortly before it expires.
+type TokenSource struct {
+	account    ServiceAccount
+	key        *rsa.PrivateKey
+	tokenURL   string
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewTokenSource uses tokenURL instead of the key's token_uri when it is set.
+func NewTokenSource(account ServiceAccount, tokenURL string) (*TokenSource, error) {
+	key, err := parsePrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(tokenURL) == "" {
+		tokenURL = account.TokenURI
+	}
+	return &TokenSource{
+		account:    account,
+		key:        key,
+		tokenURL:   tokenURL,
+		httpClient: &http.Client{Timeout: 20 * time.Second},
+	}, nil
+}
+
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Until(ts.expires) > time.Minute {
+		return ts.token, nil
+	}
+
+	assertion, err := ts.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("new token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: http status %d: %s", resp.StatusCode, string(raw))
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(raw, &tok); err != nil {
+		return "", fmt.Errorf("unmarshal token response: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("token response has no access_token")
+	}
+
+	ts.token = tok.AccessToken
+	ts.expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+func (ts *TokenSource) assertion(now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if ts.account.PrivateKeyID != "" {
+		header["kid"] = ts.account.PrivateKeyID
+	}
+	claims := map[string]any{
+		"iss":   ts.account.ClientEmail,
+		"scope": scopeSpreadsheets,
+		"aud":   ts.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("sign assertion: %w", err)
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("service account private_key is not PEM")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("service account private_key is not RSA")
+		}
+		return rsaKey, nil
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse service account private_key: %w", err)
+	}
+	return key, nil
+}
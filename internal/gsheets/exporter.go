@@ -0,0 +1,227 @@
+package gsheets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxRangesPerBatch = 500
+	rowsPerBlock      = 1000
+)
+
+// RowSource renders deals through a sheet profile.
+type RowSource interface {
+	ProfileLayout(ctx context.Context, profile string) (headers []string, idColumn int, err error)
+	RenderProfileRows(ctx context.Context, profile string, ids []int64, fn func(id int64, row []any) error) error
+}
+
+type Target struct {
+	SpreadsheetID string
+	Sheet         string
+	Profile       string
+}
+
+type Exporter struct {
+	client *Client
+	rows   RowSource
+	target Target
+}
+
+func NewExporter(client *Client, rows RowSource, target Target) *Exporter {
+	return &Exporter{client: client, rows: rows, target: target}
+}
+
+// Push rewrites the rows of the given deals in place, matching them by the
+// profile's ID column, and appends deals the sheet does not have yet. Deals
+// that no longer match the profile filters are blanked. An empty sheet gets
+// a full export instead.
+func (e *Exporter) Push(ctx context.Context, ids []int64) (err error) {
+	if len(ids) == 0 {
+		return nil
+	}
+	started := time.Now()
+	defer func() { observePush("incremental", started, err) }()
+
+	headers, idCol, err := e.rows.ProfileLayout(ctx, e.target.Profile)
+	if err != nil {
+		return err
+	}
+
+	col := columnName(idCol)
+	existing, err := e.client.GetValues(ctx, e.target.SpreadsheetID, e.a1(col+":"+col), "COLUMNS")
+	if err != nil {
+		return fmt.Errorf("read sheet ids: %w", err)
+	}
+	if len(existing.Values) == 0 || len(existing.Values[0]) == 0 {
+		return e.pushAll(ctx, headers)
+	}
+
+	rowByID := make(map[int64]int, len(existing.Values[0]))
+	for i, v := range existing.Values[0][1:] {
+		if id, ok := cellID(v); ok {
+			rowByID[id] = i + 2
+		}
+	}
+	nextRow := len(existing.Values[0]) + 1
+
+	data := []ValueRange{{Range: e.a1("A1"), Values: [][]any{stringsToCells(headers)}}}
+	rendered := make(map[int64]struct{}, len(ids))
+	appended := 0
+	err = e.rows.RenderProfileRows(ctx, e.target.Profile, ids, func(id int64, row []any) error {
+		rendered[id] = struct{}{}
+		n, ok := rowByID[id]
+		if !ok {
+			n = nextRow
+			nextRow++
+			appended++
+		}
+		data = append(data, ValueRange{Range: e.a1(fmt.Sprintf("A%d", n)), Values: [][]any{row}})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	blanked := 0
+	for _, id := range ids {
+		if _, ok := rendered[id]; ok {
+			continue
+		}
+		if n, ok := rowByID[id]; ok {
+			data = append(data, ValueRange{Range: e.a1(fmt.Sprintf("A%d", n)), Values: [][]any{blankRow(len(headers))}})
+			blanked++
+		}
+	}
+
+	for start := 0; start < len(data); start += maxRangesPerBatch {
+		end := min(start+maxRangesPerBatch, len(data))
+		if err := e.client.BatchUpdate(ctx, e.target.SpreadsheetID, data[start:end]); err != nil {
+			return fmt.Errorf("sheets batchUpdate: %w", err)
+		}
+	}
+
+	metrics.SheetsPushRows.Add(float64(len(data) - 1))
+	logging.FromContext(ctx).Info("sheets push",
+		"profile", e.target.Profile, "updated", len(data)-1-appended-blanked, "appended", appended, "blanked", blanked)
+	return nil
+}
+
+// PushAll clears the sheet and writes every row of the profile.
+func (e *Exporter) PushAll(ctx context.Context) (err error) {
+	started := time.Now()
+	defer func() { observePush("full", started, err) }()
+
+	headers, _, err := e.rows.ProfileLayout(ctx, e.target.Profile)
+	if err != nil {
+		return err
+	}
+	return e.pushAll(ctx, headers)
+}
+
+func (e *Exporter) pushAll(ctx context.Context, headers []string) error {
+	if err := e.client.BatchClear(ctx, e.target.SpreadsheetID, []string{e.a1("A:ZZ")}); err != nil {
+		return fmt.Errorf("sheets batchClear: %w", err)
+	}
+
+	block := [][]any{stringsToCells(headers)}
+	blockStart, total := 1, 0
+	flush := func() error {
+		if len(block) == 0 {
+			return nil
+		}
+		vr := ValueRange{Range: e.a1(fmt.Sprintf("A%d", blockStart)), Values: block}
+		if err := e.client.BatchUpdate(ctx, e.target.SpreadsheetID, []ValueRange{vr}); err != nil {
+			return fmt.Errorf("sheets batchUpdate: %w", err)
+		}
+		blockStart += len(block)
+		block = block[:0:0]
+		return nil
+	}
+
+	err := e.rows.RenderProfileRows(ctx, e.target.Profile, nil, func(id int64, row []any) error {
+		block = append(block, row)
+		total++
+		if len(block) >= rowsPerBlock {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	metrics.SheetsPushRows.Add(float64(total))
+	logging.FromContext(ctx).Info("sheets full push", "profile", e.target.Profile, "rows", total)
+	return nil
+}
+
+// a1 prefixes a range with the quoted sheet name.
+func (e *Exporter) a1(rng string) string {
+	if e.target.Sheet == "" {
+		return rng
+	}
+	return "'" + strings.ReplaceAll(e.target.Sheet, "'", "''") + "'!" + rng
+}
+
+func observePush(mode string, started time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metrics.SheetsPushes.WithLabelValues(mode, result).Inc()
+	metrics.SheetsPushDuration.WithLabelValues(mode).Observe(time.Since(started).Seconds())
+}
+
+// columnName converts a zero-based column index to its A1 letters.
+func columnName(idx int) string {
+	name := ""
+	for idx >= 0 {
+		name = string(rune('A'+idx%26)) + name
+		idx = idx/26 - 1
+	}
+	return name
+}
+
+func cellID(v any) (int64, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		if id, err := t.Int64(); err == nil {
+			return id, true
+		}
+		f, err := t.Float64()
+		return int64(f), err == nil
+	case float64:
+		return int64(t), true
+	case string:
+		id, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+		return id, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func stringsToCells(s []string) []any {
+	out := make([]any, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func blankRow(n int) []any {
+	out := make([]any, n)
+	for i := range out {
+		out[i] = ""
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+package gsheets
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSheets is a stand-in for the Sheets values API backed by a grid.
+type fakeSheets struct {
+	mu      sync.Mutex
+	grid    map[int][]any // 1-based row -> cells
+	updates int
+}
+
+var cellRe = regexp.MustCompile(`^'Deals'!A(\d+)$`)
+
+func (f *fakeSheets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, `{"error":{"code":401,"message":"no auth","status":"UNAUTHENTICATED"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/values/"):
+		// The exporter only reads the id column.
+		col := []any{}
+		for n := 1; n <= len(f.grid); n++ {
+			row := f.grid[n]
+			if len(row) == 0 {
+				col = append(col, "")
+				continue
+			}
+			col = append(col, row[0])
+		}
+		resp := ValueRange{}
+		if len(col) > 0 {
+			resp.Values = [][]any{col}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	case strings.HasSuffix(r.URL.Path, "values:batchClear"):
+		f.grid = map[int][]any{}
+		_, _ = w.Write([]byte(`{}`))
+	case strings.HasSuffix(r.URL.Path, "values:batchUpdate"):
+		var body struct {
+			Data []ValueRange `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.updates++
+		for _, vr := range body.Data {
+			m := cellRe.FindStringSubmatch(vr.Range)
+			if m == nil {
+				http.Error(w, "bad range "+vr.Range, http.StatusBadRequest)
+				return
+			}
+			start, _ := strconv.Atoi(m[1])
+			for i, row := range vr.Values {
+				f.grid[start+i] = row
+			}
+		}
+		_, _ = w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type staticToken string
+
+func (t staticToken) Token(context.Context) (string, error) { return string(t), nil }
+
+type fakeRows struct {
+	rows map[int64]string
+}
+
+func (f *fakeRows) ProfileLayout(context.Context, string) ([]string, int, error) {
+	return []string{"ID", "Стадия"}, 0, nil
+}
+
+func (f *fakeRows) RenderProfileRows(ctx context.Context, profile string, ids []int64, fn func(int64, []any) error) error {
+	keys := make([]int64, 0, len(f.rows))
+	for id := range f.rows {
+		if len(ids) == 0 || slices.Contains(ids, id) {
+			keys = append(keys, id)
+		}
+	}
+	slices.Sort(keys)
+	for _, id := range keys {
+		if err := fn(id, []any{id, f.rows[id]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExporterPushUpdatesRowsByID(t *testing.T) {
+	fake := &fakeSheets{grid: map[int][]any{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	rows := &fakeRows{rows: map[int64]string{1: "NEW", 2: "NEW", 3: "NEW"}}
+	exp := NewExporter(NewClient(srv.URL, staticToken("test-token")), rows, Target{
+		SpreadsheetID: "sheet-1", Sheet: "Deals", Profile: "default",
+	})
+	ctx := context.Background()
+
+	// An empty sheet gets a full export.
+	if err := exp.Push(ctx, []int64{2}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.grid) != 4 || fake.grid[1][0] != "ID" {
+		t.Fatalf("full export grid = %v", fake.grid)
+	}
+
+	rows.rows[2] = "WON"
+	rows.rows[4] = "NEW"
+	delete(rows.rows, 3) // left the profile filter
+	if err := exp.Push(ctx, []int64{2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[int]string{}
+	for n, row := range fake.grid {
+		got[n] = fmt.Sprintf("%v", row)
+	}
+	want := map[int]string{1: "[ID Стадия]", 2: "[1 NEW]", 3: "[2 WON]", 4: "[ ]", 5: "[4 NEW]"}
+	for n, w := range want {
+		if got[n] != w {
+			t.Errorf("row %d = %q, want %q", n, got[n], w)
+		}
+	}
+}
+
+func TestTokenSourceExchangesSignedAssertion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("grant_type = %q", r.PostForm.Get("grant_type"))
+		}
+		if parts := strings.Split(r.PostForm.Get("assertion"), "."); len(parts) != 3 {
+			t.Errorf("assertion has %d parts", len(parts))
+		}
+		_, _ = w.Write([]byte(`{"access_token":"tok","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	ts, err := NewTokenSource(ServiceAccount{ClientEmail: "svc@example.iam", PrivateKey: pemKey}, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		tok, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok != "tok" {
+			t.Fatalf("token = %q", tok)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("token endpoint called %d times, want 1 (cached)", calls)
+	}
+}
@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"freedom_bitrix/internal/bitrix"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	BitrixCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bitrix_calls_total",
+		Help: "Bitrix REST calls by method.",
+	}, []string{"method"})
+
+	BitrixCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bitrix_call_duration_seconds",
+		Help:    "Bitrix REST call latency by method.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 25},
+	}, []string{"method"})
+
+	BitrixCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bitrix_call_errors_total",
+		Help: "Failed Bitrix REST calls by method and error kind.",
+	}, []string{"method", "kind"})
+
+	SyncRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sync_retries_total",
+		Help: "Retried Bitrix calls during sync.",
+	})
+
+	SyncRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_runs_total",
+		Help: "Sync runs by mode and result.",
+	}, []string{"state_key", "mode", "result"})
+
+	SyncPages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_pages_total",
+		Help: "Bitrix list pages processed by sync.",
+	}, []string{"state_key", "mode"})
+
+	SyncDeals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_deals_total",
+		Help: "Deals upserted by sync.",
+	}, []string{"state_key", "mode"})
+
+	SyncEntities = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_entities_total",
+		Help: "Contacts, companies and other related records upserted by sync.",
+	}, []string{"state_key", "entity"})
+
+	SyncDealLinkErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_deal_link_errors_total",
+		Help: "Failed refreshes of the contact links or product rows of a stored deal page, by kind (contacts, products).",
+	}, []string{"state_key", "kind"})
+
+	ParseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_parse_errors_total",
+		Help: "Date values of contacts, companies, leads, activities and smart process items stored as NULL because they did not parse, by table and field.",
+	}, []string{"table", "field"})
+
+	SyncLastRunPages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sync_last_run_pages",
+		Help: "Pages processed by the last sync run.",
+	}, []string{"state_key", "mode"})
+
+	SyncLastRunDeals = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sync_last_run_deals",
+		Help: "Deals upserted by the last sync run.",
+	}, []string{"state_key", "mode"})
+
+	SyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sync_duration_seconds",
+		Help:    "Sync run duration.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+	}, []string{"state_key", "mode"})
+
+	SyncLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sync_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful sync run.",
+	}, []string{"state_key"})
+
+	WatermarkLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sync_watermark_lag_seconds",
+		Help: "Age of the sync watermark at the end of the last run.",
+	}, []string{"state_key"})
+
+	UpsertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "repo_upsert_duration_seconds",
+		Help:    "Latency of upserting one page of deals.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"state_key"})
+
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"route", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"route"})
+
+	MappingCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_mapping_cache_total",
+		Help: "Mapping cache lookups by result (hit, refresh, partial).",
+	}, []string{"result"})
+
+	SheetsPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sheets_pushes_total",
+		Help: "Google Sheets pushes by mode (incremental, full) and result.",
+	}, []string{"mode", "result"})
+
+	SheetsPushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sheets_push_duration_seconds",
+		Help:    "Google Sheets push duration by mode.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 30, 60, 120},
+	}, []string{"mode"})
+
+	SheetsPushRows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sheets_push_rows_total",
+		Help: "Rows written to Google Sheets.",
+	})
+
+	SLABreachesOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sla_breaches_open",
+		Help: "Open SLA breaches after the last evaluation.",
+	})
+
+	DealFieldChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deal_field_changes_total",
+		Help: "Deal field catalog changes by kind (added, removed, retyped, relabeled).",
+	}, []string{"change"})
+
+	QualityViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deal_quality_violations_total",
+		Help: "Newly detected deal data quality violations by rule.",
+	}, []string{"rule"})
+
+	VerifyMismatches = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "deal_verify_mismatches",
+		Help: "Mismatches found by the last bitrix_deals verification by kind (count, sample).",
+	}, []string{"kind"})
+
+	NotificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_sent_total",
+		Help: "Notifications by channel and result.",
+	}, []string{"channel", "result"})
+
+	NotificationsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_suppressed_total",
+		Help: "Notifications not sent immediately, by reason (duplicate, quiet_hours).",
+	}, []string{"reason"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		BitrixCalls, BitrixCallDuration, BitrixCallErrors,
+		SyncRetries, SyncRuns, SyncPages, SyncDeals, SyncEntities, SyncDealLinkErrors, ParseErrors, SyncLastRunPages, SyncLastRunDeals,
+		SyncDuration, SyncLastSuccess, WatermarkLag, UpsertDuration,
+		HTTPRequests, HTTPDuration, MappingCache,
+		SheetsPushes, SheetsPushDuration, SheetsPushRows,
+		SLABreachesOpen, DealFieldChanges, QualityViolations, VerifyMismatches, NotificationsSent, NotificationsSuppressed,
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+type Caller interface {
+	Call(ctx context.Context, method string, payload any, out any) error
+}
+
+type InstrumentedCaller struct {
+	next Caller
+}
+
+func InstrumentCaller(next Caller) *InstrumentedCaller {
+	return &InstrumentedCaller{next: next}
+}
+
+func (c *InstrumentedCaller) Call(ctx context.Context, method string, payload any, out any) error {
+	started := time.Now()
+	err := c.next.Call(ctx, method, payload, out)
+
+	BitrixCalls.WithLabelValues(method).Inc()
+	BitrixCallDuration.WithLabelValues(method).Observe(time.Since(started).Seconds())
+	if err != nil {
+		BitrixCallErrors.WithLabelValues(method, ErrorKind(err)).Inc()
+	}
+	return err
+}
+
+func ErrorKind(err error) string {
+	var apiErr bitrix.APIError
+	var ne net.Error
+	switch {
+	case errors.As(err, &apiErr):
+		return "api"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.As(err, &ne):
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+func ObserveHTTP(route string, code int, d time.Duration) {
+	HTTPRequests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+	HTTPDuration.WithLabelValues(route).Observe(d.Seconds())
+}
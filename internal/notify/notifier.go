@@ -0,0 +1,334 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"freedom_bitrix/internal/repo"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// Message is one notification. Messages with the same Key are sent at most
+// once per dedup window.
+type Message struct {
+	Key      string
+	Severity string
+	Title    string
+	Text     string
+}
+
+func (m Message) plain() string {
+	if m.Text == "" {
+		return m.Title
+	}
+	return m.Title + "\n" + m.Text
+}
+
+type Config struct {
+	FailureThreshold int
+	StaleAfter       time.Duration
+	DedupWindow      time.Duration
+	Quiet            QuietHours
+	Location         *time.Location
+}
+
+type SyncStore interface {
+	GetSyncRun(ctx context.Context, key string) (repo.SyncRun, bool, error)
+	GetWatermark(ctx context.Context, key string) (time.Time, error)
+}
+
+type Notifier struct {
+	senders []Sender
+	cfg     Config
+	store   SyncStore
+	now     func() time.Time
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+	held     []Message
+}
+
+func New(senders []Sender, store SyncStore, cfg Config) *Notifier {
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 1
+	}
+	return &Notifier{
+		senders:  senders,
+		cfg:      cfg,
+		store:    store,
+		now:      time.Now,
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// Notify sends msg to every channel unless it is a duplicate. During quiet
+// hours messages are held and sent as one digest once the quiet period ends.
+func (n *Notifier) Notify(ctx context.Context, msg Message) {
+	now := n.now()
+
+	n.mu.Lock()
+	if msg.Key != "" {
+		if last, ok := n.lastSent[msg.Key]; ok && now.Sub(last) < n.cfg.DedupWindow {
+			n.mu.Unlock()
+			metrics.NotificationsSuppressed.WithLabelValues("duplicate").Inc()
+			return
+		}
+		n.lastSent[msg.Key] = now
+	}
+	if n.cfg.Quiet.Contains(now.In(n.cfg.Location)) {
+		n.held = append(n.held, msg)
+		n.mu.Unlock()
+		metrics.NotificationsSuppressed.WithLabelValues("quiet_hours").Inc()
+		return
+	}
+	held := n.takeHeldLocked()
+	n.mu.Unlock()
+
+	if len(held) > 0 {
+		n.send(ctx, digest(held))
+	}
+	n.send(ctx, msg)
+}
+
+// Flush sends held messages if the quiet period is over.
+func (n *Notifier) Flush(ctx context.Context) {
+	n.mu.Lock()
+	if n.cfg.Quiet.Contains(n.now().In(n.cfg.Location)) {
+		n.mu.Unlock()
+		return
+	}
+	held := n.takeHeldLocked()
+	n.mu.Unlock()
+
+	if len(held) > 0 {
+		n.send(ctx, digest(held))
+	}
+}
+
+func (n *Notifier) takeHeldLocked() []Message {
+	held := n.held
+	n.held = nil
+	return held
+}
+
+func (n *Notifier) send(ctx context.Context, msg Message) {
+	for _, s := range n.senders {
+		sendCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+		err := s.Send(sendCtx, msg)
+		cancel()
+		if err != nil {
+			metrics.NotificationsSent.WithLabelValues(s.Name(), "error").Inc()
+			logging.FromContext(ctx).Warn("notification failed", "channel", s.Name(), "key", msg.Key, "err", err)
+			continue
+		}
+		metrics.NotificationsSent.WithLabelValues(s.Name(), "success").Inc()
+	}
+}
+
+// SyncFinished alerts once a sync key reaches the failure threshold and again
+// when it recovers. Both are read from the run recorded in the store, so a
+// process that only runs one sync (delta by cron) reports recovery too.
+func (n *Notifier) SyncFinished(ctx context.Context, stateKey, mode string, runErr error) {
+	run, ok, err := n.store.GetSyncRun(ctx, stateKey)
+	if err != nil {
+		logging.FromContext(ctx).Warn("notifier: read sync run", "err", err)
+		return
+	}
+	failingKey := "sync-failing:" + stateKey
+
+	if runErr == nil {
+		if !ok || run.RecoveredFailures < n.cfg.FailureThreshold {
+			return
+		}
+		// A new failure streak is alerted at once, not after the dedup window.
+		n.mu.Lock()
+		delete(n.lastSent, failingKey)
+		n.mu.Unlock()
+		n.Notify(ctx, Message{
+			Severity: SeverityInfo,
+			Title:    fmt.Sprintf("✅ Sync %s recovered", stateKey),
+			Text:     fmt.Sprintf("%s sync succeeded again after %d failures.", mode, run.RecoveredFailures),
+		})
+		return
+	}
+
+	failures := 1
+	if ok {
+		failures = run.ConsecutiveFailures
+	}
+	if failures < n.cfg.FailureThreshold {
+		return
+	}
+	n.Notify(ctx, Message{
+		Key:      failingKey,
+		Severity: SeverityCritical,
+		Title:    fmt.Sprintf("❌ Sync %s failed %d times in a row", stateKey, failures),
+		Text:     fmt.Sprintf("Last %s error: %s", mode, bitrix.RedactWebhook(runErr.Error())),
+	})
+}
+
+// CheckWatermark alerts when the watermark has not advanced for StaleAfter.
+func (n *Notifier) CheckWatermark(ctx context.Context, stateKey string) {
+	if n.cfg.StaleAfter <= 0 {
+		return
+	}
+	wm, err := n.store.GetWatermark(ctx, stateKey)
+	if err != nil {
+		logging.FromContext(ctx).Warn("notifier: read watermark", "err", err)
+		return
+	}
+	if wm.IsZero() {
+		return
+	}
+	age := n.now().Sub(wm)
+	if age <= n.cfg.StaleAfter {
+		return
+	}
+	n.Notify(ctx, Message{
+		Key:      "watermark-stale:" + stateKey,
+		Severity: SeverityWarning,
+		Title:    fmt.Sprintf("⚠️ Watermark %s is stale", stateKey),
+		Text:     fmt.Sprintf("Last watermark %s (%s ago), threshold %s.", wm.UTC().Format(time.RFC3339), age.Round(time.Minute), n.cfg.StaleAfter),
+	})
+}
+
+// SLABreaches reports newly opened breaches in one message.
+func (n *Notifier) SLABreaches(ctx context.Context, opened []repo.SLABreach) {
+	if len(opened) == 0 {
+		return
+	}
+	const maxListed = 20
+
+	var b strings.Builder
+	for i, br := range opened {
+		if i == maxListed {
+			fmt.Fprintf(&b, "… and %d more\n", len(opened)-maxListed)
+			break
+		}
+		fmt.Fprintf(&b, "deal %d: %s, stage %s since %s\n", br.DealID, br.Rule, br.StageID, br.EnteredAt.In(n.cfg.Location).Format("2006-01-02 15:04"))
+	}
+	n.Notify(ctx, Message{
+		Severity: SeverityWarning,
+		Title:    fmt.Sprintf("⏱ %d new SLA breach(es)", len(opened)),
+		Text:     strings.TrimRight(b.String(), "\n"),
+	})
+}
+
+// FieldChanges reports deal field catalog drift in one message.
+func (n *Notifier) FieldChanges(ctx context.Context, changes []repo.FieldChange) {
+	if len(changes) == 0 {
+		return
+	}
+	const maxListed = 30
+
+	var b strings.Builder
+	for i, c := range changes {
+		if i == maxListed {
+			fmt.Fprintf(&b, "… and %d more\n", len(changes)-maxListed)
+			break
+		}
+		switch c.Change {
+		case repo.FieldAdded:
+			fmt.Fprintf(&b, "+ %s (%s) %s\n", c.Code, c.NewType, c.NewLabel)
+		case repo.FieldRemoved:
+			fmt.Fprintf(&b, "- %s (%s) %s\n", c.Code, c.OldType, c.OldLabel)
+		case repo.FieldRetyped:
+			fmt.Fprintf(&b, "~ %s: %s → %s\n", c.Code, c.OldType, c.NewType)
+		default:
+			fmt.Fprintf(&b, "~ %s: «%s» → «%s»\n", c.Code, c.OldLabel, c.NewLabel)
+		}
+	}
+	n.Notify(ctx, Message{
+		Severity: SeverityWarning,
+		Title:    fmt.Sprintf("🧩 %d deal field change(s) in Bitrix", len(changes)),
+		Text:     strings.TrimRight(b.String(), "\n"),
+	})
+}
+
+// Run checks the watermark and flushes held messages every interval.
+func (n *Notifier) Run(ctx context.Context, stateKey string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.CheckWatermark(ctx, stateKey)
+			n.Flush(ctx)
+		}
+	}
+}
+
+func digest(held []Message) Message {
+	if len(held) == 1 {
+		return held[0]
+	}
+	var b strings.Builder
+	for _, m := range held {
+		b.WriteString("• " + m.plain() + "\n")
+	}
+	return Message{
+		Severity: SeverityInfo,
+		Title:    fmt.Sprintf("%d notifications held during quiet hours", len(held)),
+		Text:     strings.TrimRight(b.String(), "\n"),
+	}
+}
+
+// QuietHours is a daily window such as 22:00-08:00; an empty window is never quiet.
+type QuietHours struct {
+	start, end int // minutes since midnight
+	set        bool
+}
+
+func ParseQuietHours(s string) (QuietHours, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return QuietHours{}, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return QuietHours{}, fmt.Errorf("quiet hours %q: use HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return QuietHours{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return QuietHours{}, err
+	}
+	return QuietHours{start: start, end: end, set: start != end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("quiet hours: invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q QuietHours) Contains(t time.Time) bool {
+	if !q.set {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
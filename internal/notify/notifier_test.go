@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"freedom_bitrix/internal/repo"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSender struct {
+	mu   sync.Mutex
+	msgs []Message
+}
+
+func (r *recordingSender) Name() string { return "test" }
+
+func (r *recordingSender) Send(ctx context.Context, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg)
+	return nil
+}
+
+func TestNotifierFailureThresholdDedupAndRecovery(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	sender := &recordingSender{}
+	n := New([]Sender{sender}, store, Config{FailureThreshold: 2, DedupWindow: time.Hour})
+
+	boom := errors.New("bitrix unavailable")
+	for i := 0; i < 3; i++ {
+		_ = store.RecordSyncRun(ctx, "deals_sync", "delta", boom)
+		n.SyncFinished(ctx, "deals_sync", "delta", boom)
+	}
+	// The first failure is below the threshold, the third is a duplicate.
+	if len(sender.msgs) != 1 || !strings.Contains(sender.msgs[0].Title, "2 times") {
+		t.Fatalf("after failures: %+v", sender.msgs)
+	}
+
+	_ = store.RecordSyncRun(ctx, "deals_sync", "delta", nil)
+	n.SyncFinished(ctx, "deals_sync", "delta", nil)
+	if len(sender.msgs) != 2 || !strings.Contains(sender.msgs[1].Title, "recovered") {
+		t.Fatalf("after recovery: %+v", sender.msgs)
+	}
+}
+
+func TestNotifierRecoveryFromStoredRunsAndRedaction(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	sender := &recordingSender{}
+	cfg := Config{FailureThreshold: 2, DedupWindow: time.Hour}
+
+	boom := errors.New(`do request: Post "https://portal.bitrix24.kz/rest/7/tok123/crm.item.list.json": i/o timeout`)
+	// Every cron delta is a new process with a new notifier.
+	for i := 0; i < 2; i++ {
+		_ = store.RecordSyncRun(ctx, "deals_sync", "delta", boom)
+		New([]Sender{sender}, store, cfg).SyncFinished(ctx, "deals_sync", "delta", boom)
+	}
+	if len(sender.msgs) != 1 || strings.Contains(sender.msgs[0].Text, "tok123") || !strings.Contains(sender.msgs[0].Text, "/rest/7/***/") {
+		t.Fatalf("failure alert = %+v", sender.msgs)
+	}
+
+	_ = store.RecordSyncRun(ctx, "deals_sync", "delta", nil)
+	New([]Sender{sender}, store, cfg).SyncFinished(ctx, "deals_sync", "delta", nil)
+	if len(sender.msgs) != 2 || !strings.Contains(sender.msgs[1].Title, "recovered") {
+		t.Fatalf("after recovery: %+v", sender.msgs)
+	}
+
+	// A long-running notifier alerts a new streak within the dedup window.
+	n := New([]Sender{sender}, store, cfg)
+	for i := 0; i < 2; i++ {
+		_ = store.RecordSyncRun(ctx, "deals_sync", "delta", boom)
+		n.SyncFinished(ctx, "deals_sync", "delta", boom)
+	}
+	_ = store.RecordSyncRun(ctx, "deals_sync", "delta", nil)
+	n.SyncFinished(ctx, "deals_sync", "delta", nil)
+	for i := 0; i < 2; i++ {
+		_ = store.RecordSyncRun(ctx, "deals_sync", "delta", boom)
+		n.SyncFinished(ctx, "deals_sync", "delta", boom)
+	}
+	if len(sender.msgs) != 5 || !strings.Contains(sender.msgs[4].Title, "failed") {
+		t.Fatalf("second streak: %+v", sender.msgs)
+	}
+}
+
+func TestNotifierHoldsMessagesDuringQuietHours(t *testing.T) {
+	ctx := context.Background()
+	quiet, err := ParseQuietHours("22:00-08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &recordingSender{}
+	n := New([]Sender{sender}, repo.NewMemoryRepository(), Config{Quiet: quiet, DedupWindow: time.Hour})
+
+	clock := time.Date(2026, 3, 1, 23, 30, 0, 0, time.UTC)
+	n.now = func() time.Time { return clock }
+
+	n.Notify(ctx, Message{Key: "a", Title: "first"})
+	n.Notify(ctx, Message{Key: "b", Title: "second"})
+	n.Flush(ctx)
+	if len(sender.msgs) != 0 {
+		t.Fatalf("sent during quiet hours: %+v", sender.msgs)
+	}
+
+	clock = time.Date(2026, 3, 2, 8, 1, 0, 0, time.UTC)
+	n.Flush(ctx)
+	if len(sender.msgs) != 1 || !strings.Contains(sender.msgs[0].Text, "first") || !strings.Contains(sender.msgs[0].Text, "second") {
+		t.Fatalf("digest = %+v", sender.msgs)
+	}
+}
+
+func TestCheckWatermarkAlertsWhenStale(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	sender := &recordingSender{}
+	n := New([]Sender{sender}, store, Config{StaleAfter: 2 * time.Hour, DedupWindow: time.Hour})
+
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+	_ = store.SetWatermark(ctx, "deals_sync", now.Add(-time.Hour))
+	n.CheckWatermark(ctx, "deals_sync")
+	if len(sender.msgs) != 0 {
+		t.Fatalf("fresh watermark alerted: %+v", sender.msgs)
+	}
+
+	_ = store.SetWatermark(ctx, "deals_sync", now.Add(-3*time.Hour))
+	n.CheckWatermark(ctx, "deals_sync")
+	n.CheckWatermark(ctx, "deals_sync")
+	if len(sender.msgs) != 1 || sender.msgs[0].Key != "watermark-stale:deals_sync" {
+		t.Fatalf("stale watermark: %+v", sender.msgs)
+	}
+}
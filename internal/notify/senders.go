@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultTelegramBaseURL = "https://api.telegram.org/"
+
+type Sender interface {
+	Name() string
+	Send(ctx context.Context, msg Message) error
+}
+
+type Telegram struct {
+	baseURL    string
+	token      string
+	chatID     string
+	httpClient *http.Client
+}
+
+func NewTelegram(baseURL, token, chatID string) *Telegram {
+	baseURL = strings.TrimSpace(baseURL)
+	if baseURL == "" {
+		baseURL = DefaultTelegramBaseURL
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &Telegram{baseURL: baseURL, token: token, chatID: chatID, httpClient: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (t *Telegram) Name() string { return "telegram" }
+
+func (t *Telegram) Send(ctx context.Context, msg Message) error {
+	return postJSON(ctx, t.httpClient, t.baseURL+"bot"+t.token+"/sendMessage", map[string]any{
+		"chat_id":                  t.chatID,
+		"text":                     msg.plain(),
+		"disable_web_page_preview": true,
+	})
+}
+
+// Slack posts to an incoming webhook URL.
+type Slack struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewSlack(url string) *Slack {
+	return &Slack{url: url, httpClient: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (s *Slack) Name() string { return "slack" }
+
+func (s *Slack) Send(ctx context.Context, msg Message) error {
+	return postJSON(ctx, s.httpClient, s.url, map[string]any{"text": msg.plain()})
+}
+
+// Webhook posts the message as JSON to an arbitrary endpoint.
+type Webhook struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{url: url, httpClient: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (w *Webhook) Name() string { return "webhook" }
+
+func (w *Webhook) Send(ctx context.Context, msg Message) error {
+	return postJSON(ctx, w.httpClient, w.url, map[string]any{
+		"key":      msg.Key,
+		"severity": msg.Severity,
+		"title":    msg.Title,
+		"text":     msg.Text,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error text would include the URL, which carries the bot token or webhook secret.
+		return fmt.Errorf("do request: %w", unwrapURLError(err))
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("http status %d: %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+	return nil
+}
+
+func unwrapURLError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Err
+	}
+	return err
+}
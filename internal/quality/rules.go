@@ -0,0 +1,180 @@
+package quality
+
+import (
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/repo"
+	"freedom_bitrix/internal/sla"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CheckRequired flags deals where Field is empty; IDs must not be 0.
+	CheckRequired = "required"
+	// CheckNotFuture flags dates in Field later than now plus MaxAhead.
+	CheckNotFuture = "not_future"
+	// CheckOrder flags deals where the date in Field is earlier than the
+	// date in NotBefore. Deals missing either date pass.
+	CheckOrder = "order"
+	// CheckStageInCategory flags stages that do not belong to the deal's
+	// category: C<n>:* stages for category n, unprefixed ones for 0.
+	CheckStageInCategory = "stage_in_category"
+)
+
+// Rule is one data quality check. CategoryIDs limits it to deals of the
+// given categories.
+type Rule struct {
+	Name        string       `json:"name"`
+	Check       string       `json:"check"`
+	Field       string       `json:"field,omitempty"`
+	NotBefore   string       `json:"not_before,omitempty"`
+	MaxAhead    sla.Duration `json:"max_ahead,omitempty"`
+	CategoryIDs []int        `json:"category_ids,omitempty"`
+}
+
+// field reads one bitrix_deals column of a deal. Calendar dates (date) are
+// compared by day, instants by time.
+type field struct {
+	date  bool
+	time  func(d repo.DealRow) *time.Time
+	value func(d repo.DealRow) string
+}
+
+func timeField(date bool, fn func(d repo.DealRow) *time.Time) field {
+	return field{date: date, time: fn}
+}
+
+func textField(fn func(d repo.DealRow) *string) field {
+	return field{value: func(d repo.DealRow) string {
+		if v := fn(d); v != nil {
+			return strings.TrimSpace(*v)
+		}
+		return ""
+	}}
+}
+
+func idField(fn func(d repo.DealRow) int64) field {
+	return field{value: func(d repo.DealRow) string {
+		if id := fn(d); id != 0 {
+			return strconv.FormatInt(id, 10)
+		}
+		return ""
+	}}
+}
+
+func idPtrField(fn func(d repo.DealRow) *int64) field {
+	return idField(func(d repo.DealRow) int64 {
+		if v := fn(d); v != nil {
+			return *v
+		}
+		return 0
+	})
+}
+
+var fields = map[string]field{
+	"date_create": timeField(false, func(d repo.DealRow) *time.Time {
+		if d.DateCreate.IsZero() {
+			return nil
+		}
+		return &d.DateCreate
+	}),
+	"close_date":                timeField(true, func(d repo.DealRow) *time.Time { return d.CloseDate }),
+	"begin_date":                timeField(true, func(d repo.DealRow) *time.Time { return d.BeginDate }),
+	"uf_crm_1650279712660_date": timeField(true, func(d repo.DealRow) *time.Time { return d.UFCRM1650279712660Date }),
+	"uf_crm_1699863367472_date": timeField(true, func(d repo.DealRow) *time.Time { return d.UFCRM1699863367472Date }),
+	"uf_crm_1752578793696_date": timeField(true, func(d repo.DealRow) *time.Time { return d.UFCRM1752578793696Date }),
+	"uf_crm_1753169789836_at":   timeField(false, func(d repo.DealRow) *time.Time { return d.UFCRM1753169789836At }),
+	"uf_crm_1771313479555_date": timeField(true, func(d repo.DealRow) *time.Time { return d.UFCRM1771313479555Date }),
+	"assigned_by_id":            idField(func(d repo.DealRow) int64 { return d.AssignedByID }),
+	"contact_id":                idPtrField(func(d repo.DealRow) *int64 { return d.ContactID }),
+	"company_id":                idPtrField(func(d repo.DealRow) *int64 { return d.CompanyID }),
+	"stage_id":                  textField(func(d repo.DealRow) *string { return &d.StageID }),
+	"source_id":                 textField(func(d repo.DealRow) *string { return &d.SourceID }),
+	"utm_source":                textField(func(d repo.DealRow) *string { return d.UTMSource }),
+	"utm_campaign":              textField(func(d repo.DealRow) *string { return d.UTMCampaign }),
+	"uf_coop_type":              textField(func(d repo.DealRow) *string { return d.CoopType }),
+	"uf_client_type":            textField(func(d repo.DealRow) *string { return d.ClientType }),
+	"uf_crm_1699841388494":      textField(func(d repo.DealRow) *string { return d.UFCRM1699841388494 }),
+	"opportunity":               textField(func(d repo.DealRow) *string { return d.Opportunity }),
+	"currency_id":               textField(func(d repo.DealRow) *string { return d.CurrencyID }),
+}
+
+// DefaultRules are used when no rules file is configured.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "date_create_missing", Check: CheckRequired, Field: "date_create"},
+		{Name: "date_create_in_future", Check: CheckNotFuture, Field: "date_create"},
+		{Name: "assigned_by_missing", Check: CheckRequired, Field: "assigned_by_id"},
+		{Name: "stage_outside_category", Check: CheckStageInCategory},
+		{Name: "interview_held_in_future", Check: CheckNotFuture, Field: "uf_crm_1650279712660_date"},
+		{Name: "interview_held_before_scheduled", Check: CheckOrder, Field: "uf_crm_1650279712660_date", NotBefore: "uf_crm_1699863367472_date"},
+		{Name: "meeting_held_in_future", Check: CheckNotFuture, Field: "uf_crm_1753169789836_at"},
+		{Name: "meeting_held_before_scheduled", Check: CheckOrder, Field: "uf_crm_1753169789836_at", NotBefore: "uf_crm_1752578793696_date"},
+	}
+}
+
+// LoadRules reads the rules from a JSON file; an empty path means the
+// default rules and an empty list disables validation.
+func LoadRules(path string) ([]Rule, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return DefaultRules(), nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read quality rules: %w", err)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("parse quality rules %s: %w", path, err)
+	}
+
+	seen := make(map[string]struct{}, len(rules))
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("quality rule %q: %w", rules[i].Name, err)
+		}
+		if _, ok := seen[rules[i].Name]; ok {
+			return nil, fmt.Errorf("duplicate quality rule %q", rules[i].Name)
+		}
+		seen[rules[i].Name] = struct{}{}
+	}
+	return rules, nil
+}
+
+func (r *Rule) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Field = strings.TrimSpace(r.Field)
+	r.NotBefore = strings.TrimSpace(r.NotBefore)
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch r.Check {
+	case CheckRequired:
+		if _, ok := fields[r.Field]; !ok {
+			return fmt.Errorf("unknown field %q", r.Field)
+		}
+	case CheckNotFuture:
+		if f, ok := fields[r.Field]; !ok || f.time == nil {
+			return fmt.Errorf("field %q is not a date", r.Field)
+		}
+	case CheckOrder:
+		if f, ok := fields[r.Field]; !ok || f.time == nil {
+			return fmt.Errorf("field %q is not a date", r.Field)
+		}
+		if f, ok := fields[r.NotBefore]; !ok || f.time == nil {
+			return fmt.Errorf("not_before %q is not a date", r.NotBefore)
+		}
+	case CheckStageInCategory:
+	default:
+		return fmt.Errorf("unknown check %q (use: %s, %s, %s, %s)", r.Check, CheckRequired, CheckNotFuture, CheckOrder, CheckStageInCategory)
+	}
+	if r.MaxAhead < 0 {
+		return fmt.Errorf("max_ahead must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package quality
+
+import (
+	"context"
+	"fmt"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"freedom_bitrix/internal/repo"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// batchSize bounds the deal IDs loaded and synced in one query.
+const batchSize = 1000
+
+type Store interface {
+	StreamDeals(ctx context.Context, q repo.DealQuery, fn func(repo.DealRow) error) error
+	SyncQualityViolations(ctx context.Context, dealIDs []int64, current []repo.QualityViolation) ([]repo.QualityViolation, int, error)
+	QualityViolationDealIDs(ctx context.Context, rules []string) ([]int64, error)
+}
+
+type Validator struct {
+	store Store
+	rules []Rule
+	loc   *time.Location
+}
+
+type Result struct {
+	Checked int
+	Opened  []repo.QualityViolation
+	Cleared int
+}
+
+// NewValidator checks deals against rules; loc is the business timezone in
+// which calendar dates are compared with instants.
+func NewValidator(store Store, rules []Rule, loc *time.Location) *Validator {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &Validator{store: store, rules: rules, loc: loc}
+}
+
+// Validate checks the given deals and replaces their stored violations.
+// Deals with an open not_future violation are checked again too, so it is
+// cleared once the date has passed. Violations of deals that no longer exist
+// are cleared.
+func (v *Validator) Validate(ctx context.Context, dealIDs []int64, now time.Time) (Result, error) {
+	var res Result
+	if len(v.rules) == 0 {
+		return res, nil
+	}
+	if rules := v.timeDependentRules(); len(rules) > 0 {
+		open, err := v.store.QualityViolationDealIDs(ctx, rules)
+		if err != nil {
+			return res, fmt.Errorf("open quality violations: %w", err)
+		}
+		dealIDs = slices.Concat(dealIDs, open)
+		slices.Sort(dealIDs)
+		dealIDs = slices.Compact(dealIDs)
+	}
+	if len(dealIDs) == 0 {
+		return res, nil
+	}
+
+	for batch := range slices.Chunk(dealIDs, batchSize) {
+		var current []repo.QualityViolation
+		err := v.store.StreamDeals(ctx, repo.DealQuery{Filter: repo.DealFilter{IDs: batch}}, func(d repo.DealRow) error {
+			res.Checked++
+			current = append(current, v.check(d, now)...)
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+		opened, cleared, err := v.store.SyncQualityViolations(ctx, batch, current)
+		if err != nil {
+			return res, err
+		}
+		res.Opened = append(res.Opened, opened...)
+		res.Cleared += cleared
+	}
+
+	for _, o := range res.Opened {
+		metrics.QualityViolations.WithLabelValues(o.Rule).Inc()
+	}
+	if len(res.Opened) > 0 || res.Cleared > 0 {
+		logging.FromContext(ctx).Info("quality validated", "checked", res.Checked, "opened", len(res.Opened), "cleared", res.Cleared)
+	}
+	return res, nil
+}
+
+// timeDependentRules returns the names of the rules whose result changes
+// with now alone.
+func (v *Validator) timeDependentRules() []string {
+	var names []string
+	for _, r := range v.rules {
+		if r.Check == CheckNotFuture {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+func (v *Validator) check(d repo.DealRow, now time.Time) []repo.QualityViolation {
+	var out []repo.QualityViolation
+	for _, r := range v.rules {
+		if len(r.CategoryIDs) > 0 && !slices.Contains(r.CategoryIDs, d.CategoryID) {
+			continue
+		}
+		msg, failed := v.apply(r, d, now)
+		if !failed {
+			continue
+		}
+		out = append(out, repo.QualityViolation{
+			DealID:       d.ID,
+			Rule:         r.Name,
+			Message:      msg,
+			CategoryID:   d.CategoryID,
+			StageID:      d.StageID,
+			AssignedByID: d.AssignedByID,
+		})
+	}
+	return out
+}
+
+// apply reports whether d fails r and why.
+func (v *Validator) apply(r Rule, d repo.DealRow, now time.Time) (string, bool) {
+	switch r.Check {
+	case CheckRequired:
+		f := fields[r.Field]
+		if f.time != nil {
+			if f.time(d) == nil {
+				return r.Field + " is empty", true
+			}
+			return "", false
+		}
+		if f.value(d) == "" {
+			return r.Field + " is empty", true
+		}
+	case CheckNotFuture:
+		f := fields[r.Field]
+		t := f.time(d)
+		if t == nil {
+			return "", false
+		}
+		limit := now.Add(time.Duration(r.MaxAhead))
+		if f.date {
+			if v.day(*t, true).After(v.day(limit, false)) {
+				return fmt.Sprintf("%s %s is in the future", r.Field, t.Format(time.DateOnly)), true
+			}
+			return "", false
+		}
+		if t.After(limit) {
+			return fmt.Sprintf("%s %s is in the future", r.Field, t.In(v.loc).Format(time.RFC3339)), true
+		}
+	case CheckOrder:
+		f, nb := fields[r.Field], fields[r.NotBefore]
+		t, before := f.time(d), nb.time(d)
+		if t == nil || before == nil {
+			return "", false
+		}
+		a, b := *t, *before
+		if f.date || nb.date {
+			a, b = v.day(a, f.date), v.day(b, nb.date)
+		}
+		if a.Before(b) {
+			return fmt.Sprintf("%s %s is before %s %s", r.Field, a.Format(time.DateOnly), r.NotBefore, b.Format(time.DateOnly)), true
+		}
+	case CheckStageInCategory:
+		if want := stageCategory(d.StageID); d.StageID != "" && want != d.CategoryID {
+			return fmt.Sprintf("stage %s does not belong to category %d", d.StageID, d.CategoryID), true
+		}
+	}
+	return "", false
+}
+
+// day returns the calendar day of t as midnight UTC. Stored dates already
+// are; instants are taken in the business timezone.
+func (v *Validator) day(t time.Time, date bool) time.Time {
+	if !date {
+		t = t.In(v.loc)
+	}
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// stageCategory returns the category a stage ID belongs to: C12:NEW is a
+// stage of category 12, NEW of the default category 0.
+func stageCategory(stageID string) int {
+	prefix, _, ok := strings.Cut(stageID, ":")
+	if !ok || !strings.HasPrefix(prefix, "C") {
+		return 0
+	}
+	n, err := strconv.Atoi(prefix[1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,142 @@
+package quality
+
+import (
+	"context"
+	"encoding/json"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidateStoresAndClearsViolations(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(ctx, []bitrix.Deal{
+		{ID: "1", CategoryID: "1", StageID: "C1:NEW", AssignedByID: "5", DateCreate: "2026-03-01T09:00:00+05:00"},
+		{ID: "2", CategoryID: "1", StageID: "C3:NEW", AssignedByID: "0"},
+		{ID: "3", CategoryID: "0", StageID: "NEW", AssignedByID: "5", DateCreate: "2026-03-20T09:00:00+05:00",
+			UFCRM1752578793696: bitrix.Value{"2026-03-05T00:00:00+05:00"}, UFCRM1753169789836: bitrix.Value{"2026-03-04T12:00:00+05:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loc := time.FixedZone("ALMT", 5*3600)
+	v := NewValidator(store, DefaultRules(), loc)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	res, err := v.Validate(ctx, []int64{1, 2, 3}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Checked != 3 {
+		t.Fatalf("checked = %d", res.Checked)
+	}
+	got := map[int64][]string{}
+	for _, o := range res.Opened {
+		got[o.DealID] = append(got[o.DealID], o.Rule)
+	}
+	want := map[int64][]string{
+		2: {"assigned_by_missing", "date_create_missing", "stage_outside_category"},
+		3: {"date_create_in_future", "meeting_held_before_scheduled"},
+	}
+	for id, rules := range want {
+		slices.Sort(got[id])
+		if !slices.Equal(got[id], rules) {
+			t.Fatalf("deal %d violations = %v, want %v", id, got[id], rules)
+		}
+	}
+	if len(got[1]) != 0 {
+		t.Fatalf("deal 1 violations = %v", got[1])
+	}
+
+	// Deal 2 is fixed; re-validating keeps deal 3's violations open.
+	err = store.UpsertDeals(ctx, []bitrix.Deal{
+		{ID: "2", CategoryID: "3", StageID: "C3:NEW", AssignedByID: "7", DateCreate: "2026-03-02T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = v.Validate(ctx, []int64{2, 3}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Opened) != 0 || res.Cleared != 3 {
+		t.Fatalf("second validation = %+v", res)
+	}
+	open, _ := store.ListQualityViolations(ctx)
+	if len(open) != 2 || open[0].DealID != 3 {
+		t.Fatalf("open violations = %+v", open)
+	}
+
+	var rows []repo.DealRow
+	err = store.StreamDeals(ctx, repo.DealQuery{Filter: repo.DealFilter{WithViolations: true}, WithViolationRules: true}, func(d repo.DealRow) error {
+		rows = append(rows, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].ID != 3 || len(rows[0].QualityViolations) != 2 {
+		t.Fatalf("rows with violations = %+v", rows)
+	}
+}
+
+func TestValidateRechecksOpenNotFutureViolations(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(ctx, []bitrix.Deal{
+		{ID: "1", CategoryID: "1", StageID: "C1:NEW", AssignedByID: "5", DateCreate: "2026-03-20T09:00:00+05:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewValidator(store, DefaultRules(), time.FixedZone("ALMT", 5*3600))
+
+	res, err := v.Validate(ctx, []int64{1}, time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Opened) != 1 || res.Opened[0].Rule != "date_create_in_future" {
+		t.Fatalf("opened = %+v", res.Opened)
+	}
+
+	// A later run without changed deals clears the violation once the date
+	// has passed.
+	res, err = v.Validate(ctx, nil, time.Date(2026, 3, 21, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Checked != 1 || res.Cleared != 1 {
+		t.Fatalf("recheck = %+v", res)
+	}
+	if open, _ := store.ListQualityViolations(ctx); len(open) != 0 {
+		t.Fatalf("open violations = %+v", open)
+	}
+}
+
+func TestRuleValidation(t *testing.T) {
+	cases := []string{
+		`{"name":"x","check":"required","field":"nope"}`,
+		`{"name":"x","check":"not_future","field":"assigned_by_id"}`,
+		`{"name":"x","check":"order","field":"date_create"}`,
+		`{"name":"x","check":"unknown"}`,
+		`{"check":"stage_in_category"}`,
+	}
+	for _, c := range cases {
+		var r Rule
+		if err := json.Unmarshal([]byte(c), &r); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.validate(); err == nil {
+			t.Fatalf("%s: expected an error", c)
+		}
+	}
+	for _, r := range DefaultRules() {
+		if err := r.validate(); err != nil {
+			t.Fatalf("default rule %s: %v", r.Name, err)
+		}
+	}
+}
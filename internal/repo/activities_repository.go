@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+)
+
+// Activity types and owner types used in bitrix_activities.
+const (
+	ActivityTypeMeeting = 1
+	ActivityTypeCall    = 2
+	ActivityTypeTask    = 3
+	ActivityTypeEmail   = 4
+
+	OwnerTypeDeal = 2
+)
+
+func (r *DealsRepository) UpsertActivities(ctx context.Context, activities []bitrix.Activity) error {
+	if len(activities) == 0 {
+		return nil
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql := `
+INSERT INTO bitrix_activities (
+  id, owner_type_id, owner_id, type_id, provider_id, direction, subject, completed,
+  responsible_id, created, last_updated, start_time, end_time, deadline, raw, updated_at
+) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15, now())
+ON CONFLICT (id) DO UPDATE SET
+  owner_type_id = EXCLUDED.owner_type_id,
+  owner_id = EXCLUDED.owner_id,
+  type_id = EXCLUDED.type_id,
+  provider_id = EXCLUDED.provider_id,
+  direction = EXCLUDED.direction,
+  subject = EXCLUDED.subject,
+  completed = EXCLUDED.completed,
+  responsible_id = EXCLUDED.responsible_id,
+  created = EXCLUDED.created,
+  last_updated = EXCLUDED.last_updated,
+  start_time = EXCLUDED.start_time,
+  end_time = EXCLUDED.end_time,
+  deadline = EXCLUDED.deadline,
+  raw = EXCLUDED.raw,
+  updated_at = now();
+`
+
+	for _, a := range activities {
+		id := toInt64(a.ID)
+		created := r.times.recordTime("bitrix_activities", id, "CREATED", a.Created)
+		updated := r.times.recordTime("bitrix_activities", id, "LAST_UPDATED", a.LastUpdated)
+		start := r.times.recordTime("bitrix_activities", id, "START_TIME", a.StartTime)
+		end := r.times.recordTime("bitrix_activities", id, "END_TIME", a.EndTime)
+		deadline := r.times.recordTime("bitrix_activities", id, "DEADLINE", a.Deadline)
+		raw, _ := json.Marshal(a)
+
+		_, err := tx.Exec(ctx, sql,
+			id, toInt(a.OwnerTypeID), toInt64(a.OwnerID), nullID(a.TypeID), emptyToNull(a.ProviderID),
+			nullID(a.Direction), emptyToNull(a.Subject), nullFlag(a.Completed), nullID(a.ResponsibleID),
+			nullTime(created), nullTime(updated), nullTime(start), nullTime(end), nullTime(deadline), raw,
+		)
+		if err != nil {
+			return fmt.Errorf("upsert activity %d: %w", id, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
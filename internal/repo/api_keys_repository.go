@@ -0,0 +1,91 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type APIKeysRepository struct {
+	pool *pgxpool.Pool
+}
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func NewAPIKeysRepository(pool *pgxpool.Pool) *APIKeysRepository {
+	return &APIKeysRepository{pool: pool}
+}
+
+func (r *APIKeysRepository) CreateAPIKey(ctx context.Context, key APIKey) error {
+	_, err := r.pool.Exec(ctx, `
+INSERT INTO api_keys(id, name, key_hash, scopes) VALUES($1, $2, $3, $4)
+`, key.ID, key.Name, key.KeyHash, key.Scopes)
+	return err
+}
+
+func (r *APIKeysRepository) GetAPIKey(ctx context.Context, id string) (APIKey, bool, error) {
+	var k APIKey
+	err := r.pool.QueryRow(ctx, `
+SELECT id, name, key_hash, scopes, created_at, revoked_at, last_used_at
+FROM api_keys WHERE id=$1
+`, id).Scan(&k.ID, &k.Name, &k.KeyHash, &k.Scopes, &k.CreatedAt, &k.RevokedAt, &k.LastUsedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return APIKey{}, false, nil
+		}
+		return APIKey{}, false, err
+	}
+	return k, true, nil
+}
+
+func (r *APIKeysRepository) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT id, name, key_hash, scopes, created_at, revoked_at, last_used_at
+FROM api_keys ORDER BY created_at
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]APIKey, 0)
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.KeyHash, &k.Scopes, &k.CreatedAt, &k.RevokedAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, k)
+	}
+	return result, rows.Err()
+}
+
+func (r *APIKeysRepository) RevokeAPIKey(ctx context.Context, id string) error {
+	tag, err := r.pool.Exec(ctx, `UPDATE api_keys SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("api key %s not found or already revoked", id)
+	}
+	return nil
+}
+
+func (r *APIKeysRepository) TouchAPIKey(ctx context.Context, id string) error {
+	_, err := r.pool.Exec(ctx, `
+UPDATE api_keys SET last_used_at=now()
+WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')
+`, id)
+	return err
+}
@@ -0,0 +1,166 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"strings"
+)
+
+func (r *DealsRepository) UpsertContacts(ctx context.Context, contacts []bitrix.Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql := `
+INSERT INTO bitrix_contacts (
+  id, full_name, name, last_name, second_name, phone, email,
+  company_id, assigned_by_id, date_create, date_modify, raw, updated_at
+) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12, now())
+ON CONFLICT (id) DO UPDATE SET
+  full_name = EXCLUDED.full_name,
+  name = EXCLUDED.name,
+  last_name = EXCLUDED.last_name,
+  second_name = EXCLUDED.second_name,
+  phone = EXCLUDED.phone,
+  email = EXCLUDED.email,
+  company_id = EXCLUDED.company_id,
+  assigned_by_id = EXCLUDED.assigned_by_id,
+  date_create = EXCLUDED.date_create,
+  date_modify = EXCLUDED.date_modify,
+  raw = EXCLUDED.raw,
+  updated_at = now();
+`
+
+	for _, c := range contacts {
+		id := toInt64(c.ID)
+		dc := r.times.recordTime("bitrix_contacts", id, "DATE_CREATE", c.DateCreate)
+		dm := r.times.recordTime("bitrix_contacts", id, "DATE_MODIFY", c.DateModify)
+		raw, _ := json.Marshal(c)
+
+		_, err := tx.Exec(ctx, sql,
+			id, emptyToNull(contactFullName(c)), emptyToNull(c.Name), emptyToNull(c.LastName), emptyToNull(c.SecondName),
+			multiValues(c.Phone), multiValues(c.Email),
+			nullID(c.CompanyID), nullID(c.AssignedByID), nullTime(dc), nullTime(dm), raw,
+		)
+		if err != nil {
+			return fmt.Errorf("upsert contact %d: %w", id, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *DealsRepository) UpsertCompanies(ctx context.Context, companies []bitrix.Company) error {
+	if len(companies) == 0 {
+		return nil
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql := `
+INSERT INTO bitrix_companies (
+  id, title, phone, email, assigned_by_id, date_create, date_modify, raw, updated_at
+) VALUES ($1,$2,$3,$4,$5,$6,$7,$8, now())
+ON CONFLICT (id) DO UPDATE SET
+  title = EXCLUDED.title,
+  phone = EXCLUDED.phone,
+  email = EXCLUDED.email,
+  assigned_by_id = EXCLUDED.assigned_by_id,
+  date_create = EXCLUDED.date_create,
+  date_modify = EXCLUDED.date_modify,
+  raw = EXCLUDED.raw,
+  updated_at = now();
+`
+
+	for _, c := range companies {
+		id := toInt64(c.ID)
+		dc := r.times.recordTime("bitrix_companies", id, "DATE_CREATE", c.DateCreate)
+		dm := r.times.recordTime("bitrix_companies", id, "DATE_MODIFY", c.DateModify)
+		raw, _ := json.Marshal(c)
+
+		_, err := tx.Exec(ctx, sql,
+			id, emptyToNull(c.Title), multiValues(c.Phone), multiValues(c.Email),
+			nullID(c.AssignedByID), nullTime(dc), nullTime(dm), raw,
+		)
+		if err != nil {
+			return fmt.Errorf("upsert company %d: %w", id, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ReplaceDealContacts stores the full contact list of every deal in links;
+// deals absent from links keep their stored contacts.
+func (r *DealsRepository) ReplaceDealContacts(ctx context.Context, links map[int64][]bitrix.DealContact) error {
+	if len(links) == 0 {
+		return nil
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	dealIDs := make([]int64, 0, len(links))
+	for id := range links {
+		dealIDs = append(dealIDs, id)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM bitrix_deal_contacts WHERE deal_id = ANY($1)`, dealIDs); err != nil {
+		return err
+	}
+
+	for dealID, items := range links {
+		for _, it := range items {
+			_, err := tx.Exec(ctx, `
+INSERT INTO bitrix_deal_contacts (deal_id, contact_id, is_primary, sort)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (deal_id, contact_id) DO NOTHING`,
+				dealID, int64(it.ContactID), it.IsPrimary == "Y", int(it.Sort))
+			if err != nil {
+				return fmt.Errorf("link deal %d: %w", dealID, err)
+			}
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// contactFullName follows the Bitrix display order: last name, name, second name.
+func contactFullName(c bitrix.Contact) string {
+	parts := make([]string, 0, 3)
+	for _, p := range []string{c.LastName, c.Name, c.SecondName} {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func multiValues(fields []bitrix.MultiField) []string {
+	out := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if v := strings.TrimSpace(f.Value); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// nullID maps Bitrix's "" and "0" references to NULL.
+func nullID(s string) any {
+	if id := toInt64(s); id > 0 {
+		return id
+	}
+	return nil
+}
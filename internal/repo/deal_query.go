@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type DealFilter struct {
+	IDs            []int64
+	CategoryIDs    []int
+	StageIDs       []string
+	AssignedByIDs  []int64
+	DateCreateFrom *time.Time
+	DateCreateTo   *time.Time
+	// WithViolations keeps deals with open data quality violations.
+	WithViolations bool
+}
+
+type DealSort struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc"`
+}
+
+type DealQuery struct {
+	Filter DealFilter
+	Sort   []DealSort
+	// WithActivities fills the activity counters and dates of each row and
+	// WithViolationRules its QualityViolations. Both cost a lookup per deal,
+	// so rows leave them zero unless asked.
+	WithActivities     bool
+	WithViolationRules bool
+}
+
+var sortableDealColumns = map[string]struct{}{
+	"id":                        {},
+	"category_id":               {},
+	"stage_id":                  {},
+	"assigned_by_id":            {},
+	"source_id":                 {},
+	"date_create":               {},
+	"date_modify":               {},
+	"utm_source":                {},
+	"utm_campaign":              {},
+	"uf_crm_1650279712660_date": {},
+	"uf_crm_1699863367472_date": {},
+	"uf_crm_1752578793696_date": {},
+	"uf_crm_1753169789836_at":   {},
+	"uf_crm_1771313479555_date": {},
+	"opportunity":               {},
+	"close_date":                {},
+	"begin_date":                {},
+}
+
+func IsSortableDealColumn(column string) bool {
+	_, ok := sortableDealColumns[column]
+	return ok
+}
+
+func SortableDealColumns() []string {
+	out := make([]string, 0, len(sortableDealColumns))
+	for c := range sortableDealColumns {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// clauses renders the WHERE and ORDER BY parts; args are numbered from 1.
+// Columns are qualified with prefix (e.g. "d.") when the query joins tables.
+func (q DealQuery) clauses(prefix string) (where string, order string, args []any, err error) {
+	var conds []string
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, prefix+fmt.Sprintf(cond, len(args)))
+	}
+
+	f := q.Filter
+	if len(f.IDs) > 0 {
+		add("id = ANY($%d)", f.IDs)
+	}
+	if len(f.CategoryIDs) > 0 {
+		add("category_id = ANY($%d)", f.CategoryIDs)
+	}
+	if len(f.StageIDs) > 0 {
+		add("stage_id = ANY($%d)", f.StageIDs)
+	}
+	if len(f.AssignedByIDs) > 0 {
+		add("assigned_by_id = ANY($%d)", f.AssignedByIDs)
+	}
+	if f.DateCreateFrom != nil {
+		add("date_create >= $%d", *f.DateCreateFrom)
+	}
+	if f.DateCreateTo != nil {
+		add("date_create < $%d", *f.DateCreateTo)
+	}
+	if f.WithViolations {
+		conds = append(conds, "EXISTS (SELECT 1 FROM deal_quality_violations qv WHERE qv.deal_id = "+prefix+"id)")
+	}
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	orderParts := make([]string, 0, len(q.Sort)+1)
+	hasID := false
+	for _, s := range q.Sort {
+		if !IsSortableDealColumn(s.Column) {
+			return "", "", nil, fmt.Errorf("column %q is not sortable", s.Column)
+		}
+		dir := "ASC"
+		if s.Desc {
+			dir = "DESC"
+		}
+		orderParts = append(orderParts, prefix+s.Column+" "+dir+" NULLS LAST")
+		hasID = hasID || s.Column == "id"
+	}
+	if !hasID {
+		orderParts = append(orderParts, prefix+"id DESC")
+	}
+	order = "ORDER BY " + strings.Join(orderParts, ", ")
+
+	return where, order, args, nil
+}
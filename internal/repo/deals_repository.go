@@ -14,7 +14,28 @@ import (
 )
 
 type DealsRepository struct {
-	pool *pgxpool.Pool
+	pool  *pgxpool.Pool
+	times TimeParser
+}
+
+type options struct {
+	loc *time.Location
+}
+
+// Option configures DealsRepository and MemoryRepository.
+type Option func(*options)
+
+// WithLocation sets the portal timezone for date values without an offset.
+func WithLocation(loc *time.Location) Option {
+	return func(o *options) { o.loc = loc }
+}
+
+func applyOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
 type SyncStatus struct {
@@ -22,6 +43,36 @@ type SyncStatus struct {
 	LastDealModify *time.Time `json:"last_deal_modify"`
 }
 
+type DealRefs struct {
+	CategoryIDs []int
+	UserIDs     []int64
+}
+
+// SheetsVersion changes whenever data rendered into sheets changes. Link and
+// violation tables have no updated_at; their row counts are part of it, and
+// MaxUpdatedAt covers the detection time of violations.
+type SheetsVersion struct {
+	Watermark    *time.Time
+	MaxUpdatedAt *time.Time
+	Rows         int64
+	Violations   int64
+	DealContacts int64
+	DealProducts int64
+}
+
+type SyncRun struct {
+	Key                 string     `json:"key"`
+	LastMode            string     `json:"last_mode"`
+	LastRunAt           time.Time  `json:"last_run_at"`
+	LastSuccessAt       *time.Time `json:"last_success_at"`
+	LastSuccessMode     *string    `json:"last_success_mode"`
+	LastError           *string    `json:"last_error"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	// RecoveredFailures is the number of failures in a row before the last
+	// run when that run succeeded, 0 otherwise.
+	RecoveredFailures int `json:"recovered_failures"`
+}
+
 type DealRow struct {
 	ID                     int64      `json:"id"`
 	CategoryID             int        `json:"category_id"`
@@ -44,51 +95,33 @@ type DealRow struct {
 	UFCRM1752578793696Date *time.Time `json:"-"`
 	UFCRM1753169789836At   *time.Time `json:"-"`
 	UFCRM1771313479555Date *time.Time `json:"-"`
+	ContactID              *int64     `json:"contact_id"`
+	CompanyID              *int64     `json:"company_id"`
+	LeadID                 *int64     `json:"lead_id"`
+	Opportunity            *string    `json:"opportunity"`
+	CurrencyID             *string    `json:"currency_id"`
+	Closed                 *bool      `json:"closed"`
+	CloseDate              *time.Time `json:"close_date"`
+	BeginDate              *time.Time `json:"begin_date"`
+	ActivityCount          int        `json:"activity_count"`
+	CallCount              int        `json:"call_count"`
+	EmailCount             int        `json:"email_count"`
+	TaskCount              int        `json:"task_count"`
+	FirstActivityAt        *time.Time `json:"first_activity_at"`
+	LastActivityAt         *time.Time `json:"last_activity_at"`
+	ContactName            *string    `json:"contact_name"`
+	ContactPhone           *string    `json:"contact_phone"`
+	CompanyTitle           *string    `json:"company_title"`
+	// UserFields holds every UF_* value as a list; the single-value columns
+	// above keep the first value of a multiple field.
+	UserFields map[string][]string `json:"user_fields,omitempty"`
+	// QualityViolations are the rules the deal currently fails.
+	QualityViolations []string `json:"quality_violations,omitempty"`
 }
 
-func NewDealsRepository(pool *pgxpool.Pool) *DealsRepository {
-	return &DealsRepository{pool: pool}
-}
-
-func (r *DealsRepository) Migrate(ctx context.Context) error {
-	ddl := `
-CREATE TABLE IF NOT EXISTS bitrix_deals (
-  id               bigint PRIMARY KEY,
-  category_id      int,
-  stage_id         text,
-  assigned_by_id   bigint,
-  source_id        text,
-  date_create      timestamptz,
-  date_modify      timestamptz,
-  utm_source       text,
-  utm_campaign     text,
-  uf_coop_type     text,
-  uf_client_type   text,
-  uf_crm_1650279712660 text,
-  uf_crm_1699841388494 text,
-  uf_crm_1699863367472 text,
-  uf_crm_1752578793696 text,
-  uf_crm_1753169789836 text,
-  uf_crm_1771313479555 text,
-  uf_crm_1650279712660_date date,
-  uf_crm_1699863367472_date date,
-  uf_crm_1752578793696_date date,
-  uf_crm_1753169789836_at timestamptz,
-  uf_crm_1771313479555_date date,
-  raw              jsonb,
-  updated_at       timestamptz DEFAULT now()
-);
-
-CREATE INDEX IF NOT EXISTS bitrix_deals_date_modify_idx ON bitrix_deals(date_modify);
-
-CREATE TABLE IF NOT EXISTS sync_state (
-  key         text PRIMARY KEY,
-  watermark   timestamptz NOT NULL,
-  updated_at  timestamptz NOT NULL DEFAULT now()
-);
-`
-	_, err := r.pool.Exec(ctx, ddl)
-	return err
+func NewDealsRepository(pool *pgxpool.Pool, opts ...Option) *DealsRepository {
+	o := applyOptions(opts)
+	return &DealsRepository{pool: pool, times: NewTimeParser(o.loc)}
 }
 
 func (r *DealsRepository) UpsertDeals(ctx context.Context, deals []bitrix.Deal) error {
@@ -109,14 +142,18 @@ INSERT INTO bitrix_deals (
   uf_coop_type, uf_client_type,
   uf_crm_1650279712660, uf_crm_1699841388494, uf_crm_1699863367472, uf_crm_1752578793696, uf_crm_1753169789836, uf_crm_1771313479555,
   uf_crm_1650279712660_date, uf_crm_1699863367472_date, uf_crm_1752578793696_date, uf_crm_1753169789836_at, uf_crm_1771313479555_date,
-  raw, updated_at
+  contact_id, company_id, lead_id,
+  opportunity, currency_id, closed, close_date, begin_date,
+  uf_values, raw, updated_at
 ) VALUES (
   $1,$2,$3,$4,$5,
   $6,$7,$8,$9,
   $10,$11,
   $12,$13,$14,$15,$16,$17,
   $18,$19,$20,$21,$22,
-  $23, now()
+  $23,$24,$25,
+  $26,$27,$28,$29,$30,
+  $31,$32, now()
 )
 ON CONFLICT (id) DO UPDATE SET
   category_id = EXCLUDED.category_id,
@@ -140,40 +177,69 @@ ON CONFLICT (id) DO UPDATE SET
   uf_crm_1752578793696_date = EXCLUDED.uf_crm_1752578793696_date,
   uf_crm_1753169789836_at = EXCLUDED.uf_crm_1753169789836_at,
   uf_crm_1771313479555_date = EXCLUDED.uf_crm_1771313479555_date,
+  contact_id = EXCLUDED.contact_id,
+  company_id = EXCLUDED.company_id,
+  lead_id = EXCLUDED.lead_id,
+  opportunity = EXCLUDED.opportunity,
+  currency_id = EXCLUDED.currency_id,
+  closed = EXCLUDED.closed,
+  close_date = EXCLUDED.close_date,
+  begin_date = EXCLUDED.begin_date,
+  uf_values = EXCLUDED.uf_values,
   raw = EXCLUDED.raw,
   updated_at = now();
 `
 
+	// A history row is added when a deal is new or its stage differs from the
+	// stored one, before the upsert overwrites it.
+	historySQL := `
+INSERT INTO bitrix_deal_stage_history (deal_id, stage_id, entered_at)
+SELECT $1, $2::text, $3
+WHERE NOT EXISTS (
+  SELECT 1 FROM bitrix_deals WHERE id = $1 AND stage_id IS NOT DISTINCT FROM $2::text
+)`
+
 	for _, d := range deals {
 		id := toInt64(d.ID)
 		cat := toInt(d.CategoryID)
 		ass := toInt64(d.AssignedByID)
 
-		dc, _ := parseRFC3339(d.DateCreate)
-		dm, _ := parseRFC3339(d.DateModify)
-		uf165Date, _ := parseBitrixDateOnly(d.UFCRM1650279712660)
-		uf169Date, _ := parseBitrixDateOnly(d.UFCRM1699863367472)
-		uf171Date, _ := parseBitrixDateOnly(d.UFCRM1752578793696)
-		uf175At, _ := parseBitrixDateTime(d.UFCRM1753169789836)
-		uf177Date, _ := parseBitrixDateOnly(d.UFCRM1771313479555)
+		dt := r.times.parseDeal(d)
+
+		if _, err := tx.Exec(ctx, historySQL, id, d.StageID, stageEnteredAt(dt)); err != nil {
+			return fmt.Errorf("stage history for deal %d: %w", id, err)
+		}
+		if err := replaceParseErrors(ctx, tx, id, dt.errs); err != nil {
+			return fmt.Errorf("parse errors for deal %d: %w", id, err)
+		}
 
 		raw, _ := json.Marshal(d)
+		ufValues, _ := json.Marshal(dealUserFields(d))
 
 		_, err := tx.Exec(ctx, sql,
 			id, cat, d.StageID, ass, d.SourceID,
-			nullTime(dc), nullTime(dm), d.UTMSource, d.UTMCampaign,
-			emptyToNull(d.UFCoopType), emptyToNull(d.UFClientType),
-			emptyToNull(d.UFCRM1650279712660),
-			emptyToNull(d.UFCRM1699841388494),
-			emptyToNull(d.UFCRM1699863367472),
-			emptyToNull(d.UFCRM1752578793696),
-			emptyToNull(d.UFCRM1753169789836),
-			emptyToNull(d.UFCRM1771313479555),
-			nullTime(uf165Date),
-			nullTime(uf169Date),
-			nullTime(uf171Date),
-			nullTime(uf175At),
-			nullTime(uf177Date),
+			nullTime(dt.dateCreate), nullTime(dt.dateModify), d.UTMSource, d.UTMCampaign,
+			emptyToNull(d.UFCoopType.String()), emptyToNull(d.UFClientType.String()),
+			emptyToNull(d.UFCRM1650279712660.String()),
+			emptyToNull(d.UFCRM1699841388494.String()),
+			emptyToNull(d.UFCRM1699863367472.String()),
+			emptyToNull(d.UFCRM1752578793696.String()),
+			emptyToNull(d.UFCRM1753169789836.String()),
+			emptyToNull(d.UFCRM1771313479555.String()),
+			nullTime(dt.uf165Date),
+			nullTime(dt.uf169Date),
+			nullTime(dt.uf171Date),
+			nullTime(dt.uf175At),
+			nullTime(dt.uf177Date),
+			nullID(d.ContactID),
+			nullID(d.CompanyID),
+			nullID(d.LeadID),
+			emptyToNull(string(d.Opportunity)),
+			emptyToNull(d.CurrencyID),
+			nullFlag(d.Closed),
+			nullTime(dt.closeDate),
+			nullTime(dt.beginDate),
+			ufValues,
 			raw,
 		)
 		if err != nil {
@@ -204,6 +270,55 @@ ON CONFLICT (key) DO UPDATE SET watermark=EXCLUDED.watermark, updated_at=now()
 	return err
 }
 
+func (r *DealsRepository) RecordSyncRun(ctx context.Context, key, mode string, runErr error) error {
+	if runErr == nil {
+		_, err := r.pool.Exec(ctx, `
+INSERT INTO sync_runs(key, last_mode, last_run_at, last_success_at, last_success_mode, last_error, consecutive_failures, recovered_failures)
+VALUES($1, $2, now(), now(), $2, NULL, 0, 0)
+ON CONFLICT (key) DO UPDATE SET
+  last_mode = EXCLUDED.last_mode,
+  last_run_at = EXCLUDED.last_run_at,
+  last_success_at = EXCLUDED.last_success_at,
+  last_success_mode = EXCLUDED.last_success_mode,
+  last_error = NULL,
+  recovered_failures = sync_runs.consecutive_failures,
+  consecutive_failures = 0
+`, key, mode)
+		return err
+	}
+
+	_, err := r.pool.Exec(ctx, `
+INSERT INTO sync_runs(key, last_mode, last_run_at, last_error, consecutive_failures)
+VALUES($1, $2, now(), $3, 1)
+ON CONFLICT (key) DO UPDATE SET
+  last_mode = EXCLUDED.last_mode,
+  last_run_at = EXCLUDED.last_run_at,
+  last_error = EXCLUDED.last_error,
+  consecutive_failures = sync_runs.consecutive_failures + 1,
+  recovered_failures = 0
+`, key, mode, runErr.Error())
+	return err
+}
+
+func (r *DealsRepository) GetSyncRun(ctx context.Context, key string) (SyncRun, bool, error) {
+	var run SyncRun
+	err := r.pool.QueryRow(ctx, `
+SELECT key, last_mode, last_run_at, last_success_at, last_success_mode, last_error, consecutive_failures, recovered_failures
+FROM sync_runs WHERE key=$1
+`, key).Scan(&run.Key, &run.LastMode, &run.LastRunAt, &run.LastSuccessAt, &run.LastSuccessMode, &run.LastError, &run.ConsecutiveFailures, &run.RecoveredFailures)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return SyncRun{}, false, nil
+		}
+		return SyncRun{}, false, err
+	}
+	return run, true, nil
+}
+
+func (r *DealsRepository) Ping(ctx context.Context) error {
+	return r.pool.Ping(ctx)
+}
+
 func (r *DealsRepository) GetSyncStatus(ctx context.Context, key string) (SyncStatus, error) {
 	var st SyncStatus
 	err := r.pool.QueryRow(ctx, `
@@ -217,48 +332,138 @@ SELECT
 	return st, nil
 }
 
+func (r *DealsRepository) GetSheetsVersion(ctx context.Context, key string) (SheetsVersion, error) {
+	var v SheetsVersion
+	err := r.pool.QueryRow(ctx, `
+SELECT
+  (SELECT watermark FROM sync_state WHERE key=$1),
+  greatest(
+    (SELECT max(updated_at) FROM bitrix_deals),
+    (SELECT max(updated_at) FROM bitrix_contacts),
+    (SELECT max(updated_at) FROM bitrix_companies),
+    (SELECT max(updated_at) FROM bitrix_activities),
+    (SELECT max(detected_at) FROM deal_quality_violations)
+  ),
+  (SELECT count(*) FROM bitrix_deals),
+  (SELECT count(*) FROM deal_quality_violations),
+  (SELECT count(*) FROM bitrix_deal_contacts),
+  (SELECT count(*) FROM bitrix_deal_products)
+`, key).Scan(&v.Watermark, &v.MaxUpdatedAt, &v.Rows, &v.Violations, &v.DealContacts, &v.DealProducts)
+	if err != nil {
+		return SheetsVersion{}, err
+	}
+	return v, nil
+}
+
 func (r *DealsRepository) ListDeals(ctx context.Context) ([]DealRow, error) {
+	result := make([]DealRow, 0)
+	err := r.StreamDeals(ctx, DealQuery{WithActivities: true, WithViolationRules: true}, func(d DealRow) error {
+		result = append(result, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// StreamDeals calls fn for every deal matching q straight from the cursor,
+// without materializing the result set. Iteration stops at the first error from fn.
+func (r *DealsRepository) StreamDeals(ctx context.Context, q DealQuery, fn func(DealRow) error) error {
+	where, order, args, err := q.clauses("d.")
+	if err != nil {
+		return err
+	}
+
+	// The aggregates are joined only when asked for; otherwise constants keep
+	// the column list, and so the Scan below, the same.
+	activityCols := "0, 0, 0, 0, NULL::timestamptz, NULL::timestamptz"
+	violationCols := "NULL::text[]"
+	var joins string
+	if q.WithActivities {
+		activityCols = "a.n, a.calls, a.emails, a.tasks, a.first_at, a.last_at"
+		joins += `
+		LEFT JOIN LATERAL (
+		  SELECT
+		    count(*) AS n,
+		    count(*) FILTER (WHERE type_id = 2) AS calls,
+		    count(*) FILTER (WHERE type_id = 4) AS emails,
+		    count(*) FILTER (WHERE type_id = 3) AS tasks,
+		    min(created) AS first_at,
+		    max(created) AS last_at
+		  FROM bitrix_activities
+		  WHERE owner_type_id = 2 AND owner_id = d.id
+		) a ON true`
+	}
+	if q.WithViolationRules {
+		violationCols = "qv.rules"
+		joins += `
+		LEFT JOIN LATERAL (
+		  SELECT array_agg(rule ORDER BY rule) AS rules
+		  FROM deal_quality_violations
+		  WHERE deal_id = d.id
+		) qv ON true`
+	}
+
 	rows, err := r.pool.Query(ctx, `
 		SELECT
-		  id,
-		  category_id,
-		  stage_id,
-		  assigned_by_id,
-		  source_id,
-		  date_create,
-		  utm_source,
-		  utm_campaign,
-		  uf_coop_type,
-		  uf_client_type,
-		  uf_crm_1650279712660,
-		  uf_crm_1699841388494,
-		  uf_crm_1699863367472,
-		  uf_crm_1752578793696,
-		  uf_crm_1753169789836,
-		  uf_crm_1771313479555,
-		  uf_crm_1650279712660_date,
-		  uf_crm_1699863367472_date,
-		  uf_crm_1752578793696_date,
-		  uf_crm_1753169789836_at,
-		  uf_crm_1771313479555_date
-		FROM bitrix_deals
-		ORDER BY id DESC
-	`)
+		  d.id,
+		  d.category_id,
+		  d.stage_id,
+		  d.assigned_by_id,
+		  d.source_id,
+		  d.date_create,
+		  d.utm_source,
+		  d.utm_campaign,
+		  d.uf_coop_type,
+		  d.uf_client_type,
+		  d.uf_crm_1650279712660,
+		  d.uf_crm_1699841388494,
+		  d.uf_crm_1699863367472,
+		  d.uf_crm_1752578793696,
+		  d.uf_crm_1753169789836,
+		  d.uf_crm_1771313479555,
+		  d.uf_crm_1650279712660_date,
+		  d.uf_crm_1699863367472_date,
+		  d.uf_crm_1752578793696_date,
+		  d.uf_crm_1753169789836_at,
+		  d.uf_crm_1771313479555_date,
+		  d.contact_id,
+		  d.company_id,
+		  d.lead_id,
+		  d.opportunity::text,
+		  d.currency_id,
+		  d.closed,
+		  d.close_date,
+		  d.begin_date,
+		  d.uf_values,
+		  c.full_name,
+		  c.phone[1],
+		  co.title,
+		  `+activityCols+`,
+		  `+violationCols+`
+		FROM bitrix_deals d
+		LEFT JOIN bitrix_contacts c ON c.id = d.contact_id
+		LEFT JOIN bitrix_companies co ON co.id = d.company_id
+		`+joins+`
+		`+where+`
+		`+order, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	result := make([]DealRow, 0)
 	for rows.Next() {
 		var r DealRow
+		// date_create is NULL when Bitrix sent no or an unparsable value.
+		var dateCreate *time.Time
 		if err := rows.Scan(
 			&r.ID,
 			&r.CategoryID,
 			&r.StageID,
 			&r.AssignedByID,
 			&r.SourceID,
-			&r.DateCreate,
+			&dateCreate,
 			&r.UTMSource,
 			&r.UTMCampaign,
 			&r.CoopType,
@@ -274,54 +479,78 @@ func (r *DealsRepository) ListDeals(ctx context.Context) ([]DealRow, error) {
 			&r.UFCRM1752578793696Date,
 			&r.UFCRM1753169789836At,
 			&r.UFCRM1771313479555Date,
+			&r.ContactID,
+			&r.CompanyID,
+			&r.LeadID,
+			&r.Opportunity,
+			&r.CurrencyID,
+			&r.Closed,
+			&r.CloseDate,
+			&r.BeginDate,
+			&r.UserFields,
+			&r.ContactName,
+			&r.ContactPhone,
+			&r.CompanyTitle,
+			&r.ActivityCount,
+			&r.CallCount,
+			&r.EmailCount,
+			&r.TaskCount,
+			&r.FirstActivityAt,
+			&r.LastActivityAt,
+			&r.QualityViolations,
 		); err != nil {
-			return nil, err
+			return err
+		}
+		if dateCreate != nil {
+			r.DateCreate = *dateCreate
+		}
+		if err := fn(r); err != nil {
+			return err
 		}
-		result = append(result, r)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
 	}
 
-	return result, nil
+	return rows.Err()
 }
 
-func parseRFC3339(s string) (time.Time, error) {
-	if s == "" {
-		return time.Time{}, fmt.Errorf("empty time")
-	}
-	return time.Parse(time.RFC3339, s)
-}
-
-func parseBitrixDateOnly(s string) (time.Time, error) {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return time.Time{}, fmt.Errorf("empty date")
-	}
-	if len(s) >= 10 {
-		s = s[:10]
+func (r *DealsRepository) ListDealRefs(ctx context.Context) (DealRefs, error) {
+	var refs DealRefs
+	err := r.pool.QueryRow(ctx, `
+SELECT
+  coalesce(array_agg(DISTINCT category_id) FILTER (WHERE category_id IS NOT NULL), '{}'),
+  coalesce(array_agg(DISTINCT assigned_by_id) FILTER (WHERE assigned_by_id IS NOT NULL), '{}')
+FROM bitrix_deals
+`).Scan(&refs.CategoryIDs, &refs.UserIDs)
+	if err != nil {
+		return DealRefs{}, err
 	}
-	return time.Parse("2006-01-02", s)
+	return refs, nil
 }
 
-func parseBitrixDateTime(s string) (time.Time, error) {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return time.Time{}, fmt.Errorf("empty datetime")
+// dealUserFields collects the UF_* values of d. The typed fields are set
+// explicitly so that deals built in code without UserFields are stored too.
+func dealUserFields(d bitrix.Deal) map[string][]string {
+	out := make(map[string][]string, len(d.UserFields)+8)
+	for code, v := range d.UserFields {
+		if len(v) > 0 {
+			out[code] = v
+		}
 	}
-	layouts := []string{
-		time.RFC3339,
-		"2006-01-02 15:04:05",
-		"2006-01-02T15:04:05",
-		"2006-01-02",
+	typed := map[string]bitrix.Value{
+		"UF_CRM_1647265424537": d.UFClientType,
+		"UF_CRM_1740477560309": d.UFCoopType,
+		"UF_CRM_1650279712660": d.UFCRM1650279712660,
+		"UF_CRM_1699841388494": d.UFCRM1699841388494,
+		"UF_CRM_1699863367472": d.UFCRM1699863367472,
+		"UF_CRM_1752578793696": d.UFCRM1752578793696,
+		"UF_CRM_1753169789836": d.UFCRM1753169789836,
+		"UF_CRM_1771313479555": d.UFCRM1771313479555,
 	}
-	for _, layout := range layouts {
-		if t, err := time.Parse(layout, s); err == nil {
-			return t, nil
+	for code, v := range typed {
+		if len(v) > 0 {
+			out[code] = v
 		}
 	}
-	return time.Time{}, fmt.Errorf("unsupported datetime: %s", s)
+	return out
 }
 
 func toInt(s string) int {
@@ -343,6 +572,18 @@ func emptyToNull(s string) any {
 	return s
 }
 
+// nullFlag maps Bitrix "Y" / "N" flags to a boolean, anything else to NULL.
+func nullFlag(s string) any {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "Y":
+		return true
+	case "N":
+		return false
+	default:
+		return nil
+	}
+}
+
 func nullTime(t time.Time) any {
 	if t.IsZero() {
 		return nil
@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Field change kinds stored in bitrix_deal_field_changes.
+const (
+	FieldAdded     = "added"
+	FieldRemoved   = "removed"
+	FieldRetyped   = "retyped"
+	FieldRelabeled = "relabeled"
+)
+
+// DealField is one entry of the deal field catalog (crm.deal.fields with the
+// labels of crm.deal.userfield.list).
+type DealField struct {
+	Code     string          `json:"code"`
+	Type     string          `json:"type"`
+	Title    string          `json:"title"`
+	LabelRU  string          `json:"label_ru"`
+	LabelEN  string          `json:"label_en"`
+	Multiple bool            `json:"multiple"`
+	Items    []FieldEnumItem `json:"items"`
+}
+
+type FieldEnumItem struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// Label returns the field label in lang ("ru" or "en"), falling back to the
+// title Bitrix reports in the portal language.
+func (f DealField) Label(lang string) string {
+	switch {
+	case lang == "ru" && f.LabelRU != "":
+		return f.LabelRU
+	case lang == "en" && f.LabelEN != "":
+		return f.LabelEN
+	}
+	return f.Title
+}
+
+type FieldChange struct {
+	Code       string    `json:"code"`
+	Change     string    `json:"change"`
+	OldType    string    `json:"old_type,omitempty"`
+	NewType    string    `json:"new_type,omitempty"`
+	OldLabel   string    `json:"old_label,omitempty"`
+	NewLabel   string    `json:"new_label,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+func (r *DealsRepository) ListDealFields(ctx context.Context) ([]DealField, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT code, type, coalesce(title, ''), coalesce(label_ru, ''), coalesce(label_en, ''), multiple, items
+FROM bitrix_deal_fields
+ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []DealField
+	for rows.Next() {
+		var f DealField
+		var items []byte
+		if err := rows.Scan(&f.Code, &f.Type, &f.Title, &f.LabelRU, &f.LabelEN, &f.Multiple, &items); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(items, &f.Items); err != nil {
+			return nil, fmt.Errorf("field %s items: %w", f.Code, err)
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+// ReplaceDealFields stores a new catalog snapshot together with the changes
+// detected against the previous one.
+func (r *DealsRepository) ReplaceDealFields(ctx context.Context, fields []DealField, changes []FieldChange) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `DELETE FROM bitrix_deal_fields`); err != nil {
+		return fmt.Errorf("clear deal fields: %w", err)
+	}
+	for _, f := range fields {
+		items, _ := json.Marshal(f.Items)
+		if f.Items == nil {
+			items = []byte("[]")
+		}
+		_, err := tx.Exec(ctx, `
+INSERT INTO bitrix_deal_fields (code, type, title, label_ru, label_en, multiple, items, updated_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7, now())`,
+			f.Code, f.Type, emptyToNull(f.Title), emptyToNull(f.LabelRU), emptyToNull(f.LabelEN), f.Multiple, items)
+		if err != nil {
+			return fmt.Errorf("insert deal field %s: %w", f.Code, err)
+		}
+	}
+	for _, c := range changes {
+		_, err := tx.Exec(ctx, `
+INSERT INTO bitrix_deal_field_changes (code, change, old_type, new_type, old_label, new_label, detected_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7)`,
+			c.Code, c.Change, emptyToNull(c.OldType), emptyToNull(c.NewType),
+			emptyToNull(c.OldLabel), emptyToNull(c.NewLabel), c.DetectedAt)
+		if err != nil {
+			return fmt.Errorf("insert field change %s: %w", c.Code, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ListFieldChanges returns the changes detected since the given time, newest
+// first.
+func (r *DealsRepository) ListFieldChanges(ctx context.Context, since time.Time, limit int) ([]FieldChange, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT code, change, coalesce(old_type, ''), coalesce(new_type, ''),
+       coalesce(old_label, ''), coalesce(new_label, ''), detected_at
+FROM bitrix_deal_field_changes
+WHERE detected_at >= $1
+ORDER BY detected_at DESC, id DESC
+LIMIT $2`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []FieldChange
+	for rows.Next() {
+		var c FieldChange
+		if err := rows.Scan(&c.Code, &c.Change, &c.OldType, &c.NewType, &c.OldLabel, &c.NewLabel, &c.DetectedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
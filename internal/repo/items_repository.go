@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// EnsureItemTables creates the custom item tables with the layout of
+// bitrix_items. It runs once at startup, after Migrate.
+func (r *DealsRepository) EnsureItemTables(ctx context.Context, tables []string) error {
+	for _, table := range tables {
+		ident := pgx.Identifier{table}.Sanitize()
+		if _, err := r.pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+ident+` (LIKE bitrix_items INCLUDING ALL)`); err != nil {
+			return fmt.Errorf("create %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// UpsertItems stores crm.item.list items of one entity type in table, which
+// is bitrix_items or a custom table created by EnsureItemTables.
+func (r *DealsRepository) UpsertItems(ctx context.Context, table string, entityTypeID int, items []bitrix.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	ident := pgx.Identifier{table}.Sanitize()
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql := `
+INSERT INTO ` + ident + ` (
+  entity_type_id, id, title, category_id, stage_id, assigned_by_id,
+  date_create, date_modify, raw, updated_at
+) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9, now())
+ON CONFLICT (entity_type_id, id) DO UPDATE SET
+  title = EXCLUDED.title,
+  category_id = EXCLUDED.category_id,
+  stage_id = EXCLUDED.stage_id,
+  assigned_by_id = EXCLUDED.assigned_by_id,
+  date_create = EXCLUDED.date_create,
+  date_modify = EXCLUDED.date_modify,
+  raw = EXCLUDED.raw,
+  updated_at = now();
+`
+
+	for _, it := range items {
+		id := it.Int("id")
+		dc := r.times.recordTime(table, id, "createdTime", it.String("createdTime"))
+		dm := r.times.recordTime(table, id, "updatedTime", it.String("updatedTime"))
+		raw, _ := json.Marshal(it)
+
+		_, err := tx.Exec(ctx, sql,
+			entityTypeID, id, emptyToNull(it.String("title")), nullID(it.String("categoryId")),
+			emptyToNull(it.String("stageId")), nullID(it.String("assignedById")),
+			nullTime(dc), nullTime(dm), raw,
+		)
+		if err != nil {
+			return fmt.Errorf("upsert %s item %d: %w", table, id, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
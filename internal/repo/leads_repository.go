@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"strings"
+	"time"
+)
+
+type LeadFilter struct {
+	DateCreateFrom *time.Time
+	DateCreateTo   *time.Time
+}
+
+// LeadRow is a stored lead with the deals converted from it (bitrix_deals.lead_id).
+type LeadRow struct {
+	ID               int64      `json:"id"`
+	Title            *string    `json:"title"`
+	StatusID         string     `json:"status_id"`
+	StatusSemanticID string     `json:"status_semantic_id"`
+	SourceID         string     `json:"source_id"`
+	AssignedByID     int64      `json:"assigned_by_id"`
+	UTMSource        *string    `json:"utm_source"`
+	UTMCampaign      *string    `json:"utm_campaign"`
+	DateCreate       time.Time  `json:"date_create"`
+	DateClosed       *time.Time `json:"date_closed"`
+	DealIDs          []int64    `json:"deal_ids"`
+	DealStageIDs     []string   `json:"-"`
+}
+
+func (r *DealsRepository) UpsertLeads(ctx context.Context, leads []bitrix.Lead) error {
+	if len(leads) == 0 {
+		return nil
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql := `
+INSERT INTO bitrix_leads (
+  id, title, status_id, status_semantic_id, source_id, assigned_by_id,
+  contact_id, company_id, utm_source, utm_campaign,
+  date_create, date_modify, date_closed, raw, updated_at
+) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14, now())
+ON CONFLICT (id) DO UPDATE SET
+  title = EXCLUDED.title,
+  status_id = EXCLUDED.status_id,
+  status_semantic_id = EXCLUDED.status_semantic_id,
+  source_id = EXCLUDED.source_id,
+  assigned_by_id = EXCLUDED.assigned_by_id,
+  contact_id = EXCLUDED.contact_id,
+  company_id = EXCLUDED.company_id,
+  utm_source = EXCLUDED.utm_source,
+  utm_campaign = EXCLUDED.utm_campaign,
+  date_create = EXCLUDED.date_create,
+  date_modify = EXCLUDED.date_modify,
+  date_closed = EXCLUDED.date_closed,
+  raw = EXCLUDED.raw,
+  updated_at = now();
+`
+
+	for _, l := range leads {
+		id := toInt64(l.ID)
+		dc := r.times.recordTime("bitrix_leads", id, "DATE_CREATE", l.DateCreate)
+		dm := r.times.recordTime("bitrix_leads", id, "DATE_MODIFY", l.DateModify)
+		closed := r.times.recordTime("bitrix_leads", id, "DATE_CLOSED", l.DateClosed)
+		raw, _ := json.Marshal(l)
+
+		_, err := tx.Exec(ctx, sql,
+			id, emptyToNull(l.Title), emptyToNull(l.StatusID), emptyToNull(l.StatusSemanticID), emptyToNull(l.SourceID),
+			nullID(l.AssignedByID), nullID(l.ContactID), nullID(l.CompanyID),
+			emptyToNull(l.UTMSource), emptyToNull(l.UTMCampaign),
+			nullTime(dc), nullTime(dm), nullTime(closed), raw,
+		)
+		if err != nil {
+			return fmt.Errorf("upsert lead %d: %w", id, err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// StreamLeads calls fn for every lead created in the filter window, oldest
+// first, together with the deals converted from it.
+func (r *DealsRepository) StreamLeads(ctx context.Context, f LeadFilter, fn func(LeadRow) error) error {
+	var conds []string
+	var args []any
+	if f.DateCreateFrom != nil {
+		args = append(args, *f.DateCreateFrom)
+		conds = append(conds, fmt.Sprintf("l.date_create >= $%d", len(args)))
+	}
+	if f.DateCreateTo != nil {
+		args = append(args, *f.DateCreateTo)
+		conds = append(conds, fmt.Sprintf("l.date_create < $%d", len(args)))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	rows, err := r.pool.Query(ctx, `
+SELECT l.id, l.title, coalesce(l.status_id, ''), coalesce(l.status_semantic_id, ''), coalesce(l.source_id, ''),
+       coalesce(l.assigned_by_id, 0), l.utm_source, l.utm_campaign, l.date_create, l.date_closed,
+       coalesce(d.ids, '{}'), coalesce(d.stages, '{}')
+FROM bitrix_leads l
+LEFT JOIN LATERAL (
+  SELECT array_agg(id ORDER BY id) AS ids, array_agg(coalesce(stage_id, '') ORDER BY id) AS stages
+  FROM bitrix_deals WHERE lead_id = l.id
+) d ON true
+`+where+`
+ORDER BY l.date_create, l.id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l LeadRow
+		if err := rows.Scan(&l.ID, &l.Title, &l.StatusID, &l.StatusSemanticID, &l.SourceID,
+			&l.AssignedByID, &l.UTMSource, &l.UTMCampaign, &l.DateCreate, &l.DateClosed,
+			&l.DealIDs, &l.DealStageIDs); err != nil {
+			return err
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,963 @@
+package repo
+
+import (
+	"cmp"
+	"context"
+	"freedom_bitrix/internal/bitrix"
+	"math/big"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MemoryRepository struct {
+	mu         sync.RWMutex
+	deals      map[int64]memoryDeal
+	watermarks map[string]time.Time
+	runs       map[string]SyncRun
+	breaches   map[slaKey]SLABreach
+	contacts   map[int64]bitrix.Contact
+	companies  map[int64]bitrix.Company
+	links      map[int64][]bitrix.DealContact
+	leads      map[int64]bitrix.Lead
+	products   map[int64][]bitrix.ProductRow
+	activities map[int64]bitrix.Activity
+	items      map[itemKey]bitrix.Item
+	fields     []DealField
+	changes    []FieldChange
+	parseErrs  map[int64][]ParseError
+	violations map[int64][]QualityViolation
+	resyncs    []ResyncRequest
+	times      TimeParser
+}
+
+type itemKey struct {
+	table        string
+	entityTypeID int
+	id           int64
+}
+
+type memoryDeal struct {
+	row            DealRow
+	dateModify     time.Time
+	updatedAt      time.Time
+	stageEnteredAt time.Time
+}
+
+type slaKey struct {
+	dealID int64
+	rule   string
+}
+
+func NewMemoryRepository(opts ...Option) *MemoryRepository {
+	o := applyOptions(opts)
+	return &MemoryRepository{
+		deals:      make(map[int64]memoryDeal),
+		watermarks: make(map[string]time.Time),
+		runs:       make(map[string]SyncRun),
+		breaches:   make(map[slaKey]SLABreach),
+		contacts:   make(map[int64]bitrix.Contact),
+		companies:  make(map[int64]bitrix.Company),
+		links:      make(map[int64][]bitrix.DealContact),
+		leads:      make(map[int64]bitrix.Lead),
+		products:   make(map[int64][]bitrix.ProductRow),
+		activities: make(map[int64]bitrix.Activity),
+		items:      make(map[itemKey]bitrix.Item),
+		parseErrs:  make(map[int64][]ParseError),
+		violations: make(map[int64][]QualityViolation),
+		times:      NewTimeParser(o.loc),
+	}
+}
+
+func (r *MemoryRepository) UpsertDeals(ctx context.Context, deals []bitrix.Deal) error {
+	if len(deals) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range deals {
+		dt := r.times.parseDeal(d)
+		row := dealRowFromBitrix(d, dt)
+		entered := stageEnteredAt(dt)
+		if prev, ok := r.deals[row.ID]; ok && prev.row.StageID == row.StageID {
+			entered = prev.stageEnteredAt
+		}
+		r.deals[row.ID] = memoryDeal{row: row, dateModify: dt.dateModify, updatedAt: now, stageEnteredAt: entered}
+		delete(r.parseErrs, row.ID)
+		for _, e := range dt.errs {
+			e.DetectedAt = now.UTC()
+			r.parseErrs[row.ID] = append(r.parseErrs[row.ID], e)
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) GetWatermark(ctx context.Context, key string) (time.Time, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.watermarks[key], nil
+}
+
+func (r *MemoryRepository) SetWatermark(ctx context.Context, key string, wm time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watermarks[key] = wm
+	return nil
+}
+
+func (r *MemoryRepository) RecordSyncRun(ctx context.Context, key, mode string, runErr error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	run := r.runs[key]
+	run.Key = key
+	run.LastMode = mode
+	run.LastRunAt = now
+	if runErr == nil {
+		run.LastSuccessAt = &now
+		run.LastSuccessMode = &mode
+		run.LastError = nil
+		run.RecoveredFailures = run.ConsecutiveFailures
+		run.ConsecutiveFailures = 0
+	} else {
+		msg := runErr.Error()
+		run.LastError = &msg
+		run.ConsecutiveFailures++
+		run.RecoveredFailures = 0
+	}
+	r.runs[key] = run
+	return nil
+}
+
+func (r *MemoryRepository) GetSyncRun(ctx context.Context, key string) (SyncRun, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	run, ok := r.runs[key]
+	return run, ok, nil
+}
+
+func (r *MemoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (r *MemoryRepository) GetMigrationStatus(ctx context.Context) (MigrationStatus, error) {
+	return MigrationStatus{Current: len(migrations), Latest: len(migrations)}, nil
+}
+
+func (r *MemoryRepository) GetSyncStatus(ctx context.Context, key string) (SyncStatus, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var st SyncStatus
+	if wm, ok := r.watermarks[key]; ok {
+		st.Watermark = &wm
+	}
+
+	var last time.Time
+	for _, d := range r.deals {
+		if d.dateModify.After(last) {
+			last = d.dateModify
+		}
+	}
+	if !last.IsZero() {
+		st.LastDealModify = &last
+	}
+	return st, nil
+}
+
+func (r *MemoryRepository) GetSheetsVersion(ctx context.Context, key string) (SheetsVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	v := SheetsVersion{Rows: int64(len(r.deals))}
+	if wm, ok := r.watermarks[key]; ok {
+		v.Watermark = &wm
+	}
+	var last time.Time
+	for _, d := range r.deals {
+		if d.updatedAt.After(last) {
+			last = d.updatedAt
+		}
+	}
+	for _, vs := range r.violations {
+		v.Violations += int64(len(vs))
+		for _, q := range vs {
+			if q.DetectedAt.After(last) {
+				last = q.DetectedAt
+			}
+		}
+	}
+	for _, l := range r.links {
+		v.DealContacts += int64(len(l))
+	}
+	for _, p := range r.products {
+		v.DealProducts += int64(len(p))
+	}
+	if !last.IsZero() {
+		v.MaxUpdatedAt = &last
+	}
+	return v, nil
+}
+
+func (r *MemoryRepository) ListDeals(ctx context.Context) ([]DealRow, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make([]DealRow, 0, len(r.deals))
+	for _, d := range r.deals {
+		result = append(result, d.row)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID > result[j].ID })
+	return result, nil
+}
+
+func (r *MemoryRepository) StreamDeals(ctx context.Context, q DealQuery, fn func(DealRow) error) error {
+	if _, _, _, err := q.clauses(""); err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	matched := make([]memoryDeal, 0, len(r.deals))
+	for _, d := range r.deals {
+		if q.Filter.matches(d.row) && (!q.Filter.WithViolations || len(r.violations[d.row.ID]) > 0) {
+			d.row = r.withRelated(d.row, q)
+			matched = append(matched, d)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, s := range q.Sort {
+			// NULLS LAST holds in both directions, as in the SQL query.
+			if an, bn := memoryDealIsNull(matched[i], s.Column), memoryDealIsNull(matched[j], s.Column); an != bn {
+				return bn
+			}
+			c := compareMemoryDeals(matched[i], matched[j], s.Column)
+			if c == 0 {
+				continue
+			}
+			if s.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return matched[i].row.ID > matched[j].row.ID
+	})
+
+	for _, d := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(d.row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withRelated fills the joined contact and company columns, and the activity
+// and violation columns q asks for; callers hold r.mu.
+func (r *MemoryRepository) withRelated(row DealRow, q DealQuery) DealRow {
+	if row.ContactID != nil {
+		if c, ok := r.contacts[*row.ContactID]; ok {
+			row.ContactName = nonEmptyPtr(contactFullName(c))
+			if phones := multiValues(c.Phone); len(phones) > 0 {
+				row.ContactPhone = &phones[0]
+			}
+		}
+	}
+	if row.CompanyID != nil {
+		if c, ok := r.companies[*row.CompanyID]; ok {
+			row.CompanyTitle = nonEmptyPtr(c.Title)
+		}
+	}
+	if q.WithViolationRules {
+		for _, v := range r.violations[row.ID] {
+			row.QualityViolations = append(row.QualityViolations, v.Rule)
+		}
+	}
+	if !q.WithActivities {
+		return row
+	}
+	for _, a := range r.activities {
+		if toInt(a.OwnerTypeID) != OwnerTypeDeal || toInt64(a.OwnerID) != row.ID {
+			continue
+		}
+		row.ActivityCount++
+		switch toInt(a.TypeID) {
+		case ActivityTypeCall:
+			row.CallCount++
+		case ActivityTypeEmail:
+			row.EmailCount++
+		case ActivityTypeTask:
+			row.TaskCount++
+		}
+		created, err := r.times.DateTime(a.Created)
+		if err != nil || created.IsZero() {
+			continue
+		}
+		if row.FirstActivityAt == nil || created.Before(*row.FirstActivityAt) {
+			row.FirstActivityAt = &created
+		}
+		if row.LastActivityAt == nil || created.After(*row.LastActivityAt) {
+			row.LastActivityAt = &created
+		}
+	}
+	return row
+}
+
+func (r *MemoryRepository) UpsertActivities(ctx context.Context, activities []bitrix.Activity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range activities {
+		r.activities[toInt64(a.ID)] = a
+	}
+	return nil
+}
+
+func (r *MemoryRepository) EnsureItemTables(ctx context.Context, tables []string) error {
+	return nil
+}
+
+func (r *MemoryRepository) UpsertItems(ctx context.Context, table string, entityTypeID int, items []bitrix.Item) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, it := range items {
+		r.items[itemKey{table: table, entityTypeID: entityTypeID, id: it.Int("id")}] = it
+	}
+	return nil
+}
+
+// Item returns a stored crm.item.list item.
+func (r *MemoryRepository) Item(table string, entityTypeID int, id int64) (bitrix.Item, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	it, ok := r.items[itemKey{table: table, entityTypeID: entityTypeID, id: id}]
+	return it, ok
+}
+
+func (r *MemoryRepository) ListDealFields(ctx context.Context) ([]DealField, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.fields), nil
+}
+
+func (r *MemoryRepository) ReplaceDealFields(ctx context.Context, fields []DealField, changes []FieldChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fields = slices.Clone(fields)
+	slices.SortFunc(r.fields, func(a, b DealField) int { return cmp.Compare(a.Code, b.Code) })
+	r.changes = append(r.changes, changes...)
+	return nil
+}
+
+func (r *MemoryRepository) ListFieldChanges(ctx context.Context, since time.Time, limit int) ([]FieldChange, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []FieldChange
+	for i := len(r.changes) - 1; i >= 0 && len(out) < limit; i-- {
+		if !r.changes[i].DetectedAt.Before(since) {
+			out = append(out, r.changes[i])
+		}
+	}
+	return out, nil
+}
+
+func (r *MemoryRepository) UpsertContacts(ctx context.Context, contacts []bitrix.Contact) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range contacts {
+		r.contacts[toInt64(c.ID)] = c
+	}
+	return nil
+}
+
+func (r *MemoryRepository) UpsertCompanies(ctx context.Context, companies []bitrix.Company) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range companies {
+		r.companies[toInt64(c.ID)] = c
+	}
+	return nil
+}
+
+func (r *MemoryRepository) ReplaceDealContacts(ctx context.Context, links map[int64][]bitrix.DealContact) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for dealID, items := range links {
+		r.links[dealID] = slices.Clone(items)
+	}
+	return nil
+}
+
+// DealContacts returns the stored contact links of a deal.
+func (r *MemoryRepository) DealContacts(dealID int64) []bitrix.DealContact {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.links[dealID])
+}
+
+func (r *MemoryRepository) ReplaceDealProducts(ctx context.Context, products map[int64][]bitrix.ProductRow) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for dealID, rows := range products {
+		r.products[dealID] = slices.Clone(rows)
+	}
+	return nil
+}
+
+// DealProducts returns the stored product rows of a deal.
+func (r *MemoryRepository) DealProducts(dealID int64) []bitrix.ProductRow {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.products[dealID])
+}
+
+func (r *MemoryRepository) UpsertLeads(ctx context.Context, leads []bitrix.Lead) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range leads {
+		r.leads[toInt64(l.ID)] = l
+	}
+	return nil
+}
+
+func (r *MemoryRepository) StreamLeads(ctx context.Context, f LeadFilter, fn func(LeadRow) error) error {
+	r.mu.RLock()
+	out := make([]LeadRow, 0, len(r.leads))
+	for _, l := range r.leads {
+		dc, _ := r.times.DateTime(l.DateCreate)
+		if f.DateCreateFrom != nil && dc.Before(*f.DateCreateFrom) {
+			continue
+		}
+		if f.DateCreateTo != nil && !dc.Before(*f.DateCreateTo) {
+			continue
+		}
+		row := LeadRow{
+			ID:               toInt64(l.ID),
+			Title:            nonEmptyPtr(l.Title),
+			StatusID:         l.StatusID,
+			StatusSemanticID: l.StatusSemanticID,
+			SourceID:         l.SourceID,
+			AssignedByID:     toInt64(l.AssignedByID),
+			UTMSource:        nonEmptyPtr(l.UTMSource),
+			UTMCampaign:      nonEmptyPtr(l.UTMCampaign),
+			DateCreate:       dc,
+			DateClosed:       timePtr(r.times.DateTime(l.DateClosed)),
+			DealIDs:          []int64{},
+			DealStageIDs:     []string{},
+		}
+		for _, d := range r.deals {
+			if d.row.LeadID != nil && *d.row.LeadID == row.ID {
+				row.DealIDs = append(row.DealIDs, d.row.ID)
+			}
+		}
+		slices.Sort(row.DealIDs)
+		for _, id := range row.DealIDs {
+			row.DealStageIDs = append(row.DealStageIDs, r.deals[id].row.StageID)
+		}
+		out = append(out, row)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].DateCreate.Equal(out[j].DateCreate) {
+			return out[i].DateCreate.Before(out[j].DateCreate)
+		}
+		return out[i].ID < out[j].ID
+	})
+	for _, l := range out {
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f DealFilter) matches(d DealRow) bool {
+	if len(f.IDs) > 0 && !slices.Contains(f.IDs, d.ID) {
+		return false
+	}
+	if len(f.CategoryIDs) > 0 && !slices.Contains(f.CategoryIDs, d.CategoryID) {
+		return false
+	}
+	if len(f.StageIDs) > 0 && !slices.Contains(f.StageIDs, d.StageID) {
+		return false
+	}
+	if len(f.AssignedByIDs) > 0 && !slices.Contains(f.AssignedByIDs, d.AssignedByID) {
+		return false
+	}
+	if f.DateCreateFrom != nil && d.DateCreate.Before(*f.DateCreateFrom) {
+		return false
+	}
+	if f.DateCreateTo != nil && !d.DateCreate.Before(*f.DateCreateTo) {
+		return false
+	}
+	return true
+}
+
+func compareMemoryDeals(a, b memoryDeal, column string) int {
+	switch column {
+	case "id":
+		return cmp.Compare(a.row.ID, b.row.ID)
+	case "category_id":
+		return cmp.Compare(a.row.CategoryID, b.row.CategoryID)
+	case "stage_id":
+		return cmp.Compare(a.row.StageID, b.row.StageID)
+	case "assigned_by_id":
+		return cmp.Compare(a.row.AssignedByID, b.row.AssignedByID)
+	case "source_id":
+		return cmp.Compare(a.row.SourceID, b.row.SourceID)
+	case "date_create":
+		return a.row.DateCreate.Compare(b.row.DateCreate)
+	case "date_modify":
+		return a.dateModify.Compare(b.dateModify)
+	case "utm_source":
+		return cmp.Compare(derefString(a.row.UTMSource), derefString(b.row.UTMSource))
+	case "utm_campaign":
+		return cmp.Compare(derefString(a.row.UTMCampaign), derefString(b.row.UTMCampaign))
+	case "uf_crm_1650279712660_date":
+		return compareTimePtr(a.row.UFCRM1650279712660Date, b.row.UFCRM1650279712660Date)
+	case "uf_crm_1699863367472_date":
+		return compareTimePtr(a.row.UFCRM1699863367472Date, b.row.UFCRM1699863367472Date)
+	case "uf_crm_1752578793696_date":
+		return compareTimePtr(a.row.UFCRM1752578793696Date, b.row.UFCRM1752578793696Date)
+	case "uf_crm_1753169789836_at":
+		return compareTimePtr(a.row.UFCRM1753169789836At, b.row.UFCRM1753169789836At)
+	case "uf_crm_1771313479555_date":
+		return compareTimePtr(a.row.UFCRM1771313479555Date, b.row.UFCRM1771313479555Date)
+	case "opportunity":
+		return compareDecimalPtr(a.row.Opportunity, b.row.Opportunity)
+	case "close_date":
+		return compareTimePtr(a.row.CloseDate, b.row.CloseDate)
+	case "begin_date":
+		return compareTimePtr(a.row.BeginDate, b.row.BeginDate)
+	default:
+		return 0
+	}
+}
+
+func memoryDealIsNull(d memoryDeal, column string) bool {
+	switch column {
+	case "utm_source":
+		return d.row.UTMSource == nil
+	case "utm_campaign":
+		return d.row.UTMCampaign == nil
+	case "uf_crm_1650279712660_date":
+		return d.row.UFCRM1650279712660Date == nil
+	case "uf_crm_1699863367472_date":
+		return d.row.UFCRM1699863367472Date == nil
+	case "uf_crm_1752578793696_date":
+		return d.row.UFCRM1752578793696Date == nil
+	case "uf_crm_1753169789836_at":
+		return d.row.UFCRM1753169789836At == nil
+	case "uf_crm_1771313479555_date":
+		return d.row.UFCRM1771313479555Date == nil
+	case "opportunity":
+		return d.row.Opportunity == nil
+	case "close_date":
+		return d.row.CloseDate == nil
+	case "begin_date":
+		return d.row.BeginDate == nil
+	default:
+		return false
+	}
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func compareTimePtr(a, b *time.Time) int {
+	if a == nil || b == nil {
+		return 0
+	}
+	return a.Compare(*b)
+}
+
+func compareDecimalPtr(a, b *string) int {
+	if a == nil || b == nil {
+		return 0
+	}
+	ra, okA := new(big.Rat).SetString(*a)
+	rb, okB := new(big.Rat).SetString(*b)
+	if !okA || !okB {
+		return 0
+	}
+	return ra.Cmp(rb)
+}
+
+func (r *MemoryRepository) ListDealStageStates(ctx context.Context, stageIDs []string) ([]DealStageState, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var out []DealStageState
+	for _, d := range r.deals {
+		if !slices.Contains(stageIDs, d.row.StageID) {
+			continue
+		}
+		st := DealStageState{
+			DealID:       d.row.ID,
+			CategoryID:   d.row.CategoryID,
+			StageID:      d.row.StageID,
+			AssignedByID: d.row.AssignedByID,
+			EnteredAt:    d.stageEnteredAt,
+		}
+		if !d.dateModify.IsZero() {
+			dm := d.dateModify
+			st.DateModify = &dm
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+func (r *MemoryRepository) SyncSLABreaches(ctx context.Context, current []SLABreach) ([]SLABreach, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keep := make(map[slaKey]struct{}, len(current))
+	var opened []SLABreach
+	for _, b := range current {
+		k := slaKey{b.DealID, b.Rule}
+		keep[k] = struct{}{}
+		if prev, ok := r.breaches[k]; ok {
+			b.DetectedAt = prev.DetectedAt
+		} else {
+			b.DetectedAt = time.Now().UTC()
+			opened = append(opened, b)
+		}
+		r.breaches[k] = b
+	}
+
+	cleared := 0
+	for k := range r.breaches {
+		if _, ok := keep[k]; !ok {
+			delete(r.breaches, k)
+			cleared++
+		}
+	}
+	return opened, cleared, nil
+}
+
+func (r *MemoryRepository) ListSLABreaches(ctx context.Context) ([]SLABreach, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make([]SLABreach, 0, len(r.breaches))
+	for _, b := range r.breaches {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].EnteredAt.Equal(out[j].EnteredAt) {
+			return out[i].EnteredAt.Before(out[j].EnteredAt)
+		}
+		if out[i].DealID != out[j].DealID {
+			return out[i].DealID < out[j].DealID
+		}
+		return out[i].Rule < out[j].Rule
+	})
+	return out, nil
+}
+
+func (r *MemoryRepository) ListDealRefs(ctx context.Context) (DealRefs, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cats := make(map[int]struct{})
+	users := make(map[int64]struct{})
+	var refs DealRefs
+	for _, d := range r.deals {
+		if _, ok := cats[d.row.CategoryID]; !ok {
+			cats[d.row.CategoryID] = struct{}{}
+			refs.CategoryIDs = append(refs.CategoryIDs, d.row.CategoryID)
+		}
+		if _, ok := users[d.row.AssignedByID]; !ok {
+			users[d.row.AssignedByID] = struct{}{}
+			refs.UserIDs = append(refs.UserIDs, d.row.AssignedByID)
+		}
+	}
+	return refs, nil
+}
+
+func dealRowFromBitrix(d bitrix.Deal, dt dealTimes) DealRow {
+
+	return DealRow{
+		ID:                     toInt64(d.ID),
+		CategoryID:             toInt(d.CategoryID),
+		StageID:                d.StageID,
+		AssignedByID:           toInt64(d.AssignedByID),
+		SourceID:               d.SourceID,
+		DateCreate:             dt.dateCreate,
+		UTMSource:              strPtr(d.UTMSource),
+		UTMCampaign:            strPtr(d.UTMCampaign),
+		CoopType:               nonEmptyPtr(d.UFCoopType.String()),
+		ClientType:             nonEmptyPtr(d.UFClientType.String()),
+		UFCRM1650279712660:     nonEmptyPtr(d.UFCRM1650279712660.String()),
+		UFCRM1699841388494:     nonEmptyPtr(d.UFCRM1699841388494.String()),
+		UFCRM1699863367472:     nonEmptyPtr(d.UFCRM1699863367472.String()),
+		UFCRM1752578793696:     nonEmptyPtr(d.UFCRM1752578793696.String()),
+		UFCRM1753169789836:     nonEmptyPtr(d.UFCRM1753169789836.String()),
+		UFCRM1771313479555:     nonEmptyPtr(d.UFCRM1771313479555.String()),
+		UFCRM1650279712660Date: timePtr(dt.uf165Date, nil),
+		UFCRM1699863367472Date: timePtr(dt.uf169Date, nil),
+		UFCRM1752578793696Date: timePtr(dt.uf171Date, nil),
+		UFCRM1753169789836At:   timePtr(dt.uf175At, nil),
+		UFCRM1771313479555Date: timePtr(dt.uf177Date, nil),
+		ContactID:              idPtr(d.ContactID),
+		CompanyID:              idPtr(d.CompanyID),
+		LeadID:                 idPtr(d.LeadID),
+		Opportunity:            nonEmptyPtr(normalizeDecimal(string(d.Opportunity))),
+		CurrencyID:             nonEmptyPtr(d.CurrencyID),
+		Closed:                 flagPtr(d.Closed),
+		CloseDate:              timePtr(dt.closeDate, nil),
+		BeginDate:              timePtr(dt.beginDate, nil),
+		UserFields:             dealUserFields(d),
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func nonEmptyPtr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func timePtr(t time.Time, err error) *time.Time {
+	if err != nil || t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func idPtr(s string) *int64 {
+	if id := toInt64(s); id > 0 {
+		return &id
+	}
+	return nil
+}
+
+func flagPtr(s string) *bool {
+	if v, ok := nullFlag(s).(bool); ok {
+		return &v
+	}
+	return nil
+}
+
+// normalizeDecimal renders a decimal with two fraction digits, as the
+// numeric(18,2) column does.
+func normalizeDecimal(s string) string {
+	if s == "" {
+		return ""
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return ""
+	}
+	return r.FloatString(2)
+}
+
+func (r *MemoryRepository) ListParseErrors(ctx context.Context, field string, limit int) ([]ParseError, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []ParseError
+	for _, errs := range r.parseErrs {
+		for _, e := range errs {
+			if field == "" || e.Field == field {
+				out = append(out, e)
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b ParseError) int {
+		if c := b.DetectedAt.Compare(a.DetectedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.DealID, a.DealID)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (r *MemoryRepository) SyncQualityViolations(ctx context.Context, dealIDs []int64, current []QualityViolation) ([]QualityViolation, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byDeal := make(map[int64][]QualityViolation, len(dealIDs))
+	for _, v := range current {
+		byDeal[v.DealID] = append(byDeal[v.DealID], v)
+	}
+	now := time.Now().UTC()
+	var opened []QualityViolation
+	cleared := 0
+	for _, id := range dealIDs {
+		prev := make(map[string]QualityViolation, len(r.violations[id]))
+		for _, v := range r.violations[id] {
+			prev[v.Rule] = v
+		}
+		next := byDeal[id]
+		for i := range next {
+			if p, ok := prev[next[i].Rule]; ok {
+				next[i].DetectedAt = p.DetectedAt
+				delete(prev, next[i].Rule)
+				continue
+			}
+			next[i].DetectedAt = now
+			opened = append(opened, next[i])
+		}
+		cleared += len(prev)
+		slices.SortFunc(next, func(a, b QualityViolation) int { return cmp.Compare(a.Rule, b.Rule) })
+		if len(next) == 0 {
+			delete(r.violations, id)
+		} else {
+			r.violations[id] = next
+		}
+	}
+	return opened, cleared, nil
+}
+
+func (r *MemoryRepository) QualityViolationDealIDs(ctx context.Context, rules []string) ([]int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []int64
+	for id, vs := range r.violations {
+		if slices.ContainsFunc(vs, func(v QualityViolation) bool { return slices.Contains(rules, v.Rule) }) {
+			out = append(out, id)
+		}
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+func (r *MemoryRepository) ListQualityViolations(ctx context.Context) ([]QualityViolation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []QualityViolation
+	for _, vs := range r.violations {
+		out = append(out, vs...)
+	}
+	slices.SortFunc(out, func(a, b QualityViolation) int {
+		if c := cmp.Compare(b.DealID, a.DealID); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Rule, b.Rule)
+	})
+	return out, nil
+}
+
+func (r *MemoryRepository) CountDealsByMonth(ctx context.Context, from, to time.Time, loc *time.Location) ([]MonthCount, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	type key struct {
+		category int
+		month    time.Time
+	}
+	r.mu.RLock()
+	counts := make(map[key]int)
+	for _, d := range r.deals {
+		created := d.row.DateCreate
+		if created.IsZero() || created.Before(from) || !created.Before(to) {
+			continue
+		}
+		local := created.In(loc)
+		counts[key{d.row.CategoryID, time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)}]++
+	}
+	r.mu.RUnlock()
+
+	out := make([]MonthCount, 0, len(counts))
+	for k, n := range counts {
+		out = append(out, MonthCount{CategoryID: k.category, Month: k.month, Deals: n})
+	}
+	slices.SortFunc(out, func(a, b MonthCount) int {
+		if c := cmp.Compare(a.CategoryID, b.CategoryID); c != 0 {
+			return c
+		}
+		return a.Month.Compare(b.Month)
+	})
+	return out, nil
+}
+
+func (r *MemoryRepository) SampleDeals(ctx context.Context, n int) ([]DealStamp, error) {
+	r.mu.RLock()
+	out := make([]DealStamp, 0, len(r.deals))
+	for _, d := range r.deals {
+		out = append(out, DealStamp{ID: d.row.ID, DateModify: timePtr(d.dateModify, nil)})
+	}
+	r.mu.RUnlock()
+
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out, nil
+}
+
+func (r *MemoryRepository) EnqueueResyncs(ctx context.Context, reqs []ResyncRequest) ([]ResyncRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var queued []ResyncRequest
+	for _, req := range reqs {
+		if slices.ContainsFunc(r.resyncs, func(p ResyncRequest) bool {
+			return p.FinishedAt == nil && p.CategoryID == req.CategoryID &&
+				equalTimePtr(p.DateFrom, req.DateFrom) && equalTimePtr(p.DateTo, req.DateTo) &&
+				slices.Equal(p.DealIDs, req.DealIDs)
+		}) {
+			continue
+		}
+		req.ID = int64(len(r.resyncs) + 1)
+		req.RequestedAt = time.Now().UTC()
+		r.resyncs = append(r.resyncs, req)
+		queued = append(queued, req)
+	}
+	return queued, nil
+}
+
+func (r *MemoryRepository) PendingResyncs(ctx context.Context, limit int) ([]ResyncRequest, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []ResyncRequest
+	for _, req := range r.resyncs {
+		if req.FinishedAt == nil && len(out) < limit {
+			out = append(out, req)
+		}
+	}
+	return out, nil
+}
+
+func (r *MemoryRepository) FinishResync(ctx context.Context, id int64, runErr error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.resyncs {
+		if r.resyncs[i].ID != id {
+			continue
+		}
+		now := time.Now().UTC()
+		r.resyncs[i].FinishedAt = &now
+		if runErr != nil {
+			r.resyncs[i].Error = runErr.Error()
+		}
+	}
+	return nil
+}
+
+func equalTimePtr(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
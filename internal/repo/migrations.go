@@ -0,0 +1,384 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+)
+
+const migrationLockID = 7_341_102
+
+// migrations are applied in order; the index+1 is the schema version.
+// Never edit an applied entry, append a new one instead.
+var migrations = []string{
+	// 1: initial schema, same as 0001_create_db.sql
+	`
+CREATE TABLE IF NOT EXISTS bitrix_deals (
+  id               bigint PRIMARY KEY,
+  category_id      int,
+  stage_id         text,
+  assigned_by_id   bigint,
+  source_id        text,
+  date_create      timestamptz,
+  date_modify      timestamptz,
+  utm_source       text,
+  utm_campaign     text,
+  uf_coop_type     text,
+  uf_client_type   text,
+  uf_crm_1650279712660 text,
+  uf_crm_1699841388494 text,
+  uf_crm_1699863367472 text,
+  uf_crm_1752578793696 text,
+  uf_crm_1753169789836 text,
+  uf_crm_1771313479555 text,
+  uf_crm_1650279712660_date date,
+  uf_crm_1699863367472_date date,
+  uf_crm_1752578793696_date date,
+  uf_crm_1753169789836_at timestamptz,
+  uf_crm_1771313479555_date date,
+  raw              jsonb,
+  updated_at       timestamptz DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_deals_date_modify_idx ON bitrix_deals(date_modify);
+
+CREATE TABLE IF NOT EXISTS sync_state (
+  key         text PRIMARY KEY,
+  watermark   timestamptz NOT NULL,
+  updated_at  timestamptz NOT NULL DEFAULT now()
+);
+`,
+	// 2: sync run bookkeeping for readiness checks
+	`
+CREATE TABLE IF NOT EXISTS sync_runs (
+  key                  text PRIMARY KEY,
+  last_mode            text NOT NULL,
+  last_run_at          timestamptz NOT NULL,
+  last_success_at      timestamptz,
+  last_error           text,
+  consecutive_failures int NOT NULL DEFAULT 0
+);
+`,
+	// 3: hashed API keys for the HTTP API
+	`
+CREATE TABLE IF NOT EXISTS api_keys (
+  id            text PRIMARY KEY,
+  name          text NOT NULL,
+  key_hash      text NOT NULL,
+  scopes        text[] NOT NULL,
+  created_at    timestamptz NOT NULL DEFAULT now(),
+  revoked_at    timestamptz,
+  last_used_at  timestamptz
+);
+`,
+	// 4: stage history for time-in-stage and SLA breaches
+	`
+CREATE TABLE IF NOT EXISTS bitrix_deal_stage_history (
+  id          bigserial PRIMARY KEY,
+  deal_id     bigint NOT NULL,
+  stage_id    text,
+  entered_at  timestamptz NOT NULL,
+  recorded_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_deal_stage_history_deal_idx ON bitrix_deal_stage_history(deal_id, id);
+
+INSERT INTO bitrix_deal_stage_history (deal_id, stage_id, entered_at)
+SELECT id, stage_id, coalesce(date_modify, date_create, now()) FROM bitrix_deals;
+
+CREATE TABLE IF NOT EXISTS sla_breaches (
+  deal_id        bigint NOT NULL,
+  rule           text NOT NULL,
+  category_id    int,
+  stage_id       text,
+  assigned_by_id bigint,
+  entered_at     timestamptz NOT NULL,
+  last_modify    timestamptz,
+  detected_at    timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (deal_id, rule)
+);
+`,
+	// 5: contacts, companies and deal-contact links
+	`
+CREATE TABLE IF NOT EXISTS bitrix_contacts (
+  id             bigint PRIMARY KEY,
+  full_name      text,
+  name           text,
+  last_name      text,
+  second_name    text,
+  phone          text[] NOT NULL DEFAULT '{}',
+  email          text[] NOT NULL DEFAULT '{}',
+  company_id     bigint,
+  assigned_by_id bigint,
+  date_create    timestamptz,
+  date_modify    timestamptz,
+  raw            jsonb NOT NULL,
+  updated_at     timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS bitrix_companies (
+  id             bigint PRIMARY KEY,
+  title          text,
+  phone          text[] NOT NULL DEFAULT '{}',
+  email          text[] NOT NULL DEFAULT '{}',
+  assigned_by_id bigint,
+  date_create    timestamptz,
+  date_modify    timestamptz,
+  raw            jsonb NOT NULL,
+  updated_at     timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS bitrix_deal_contacts (
+  deal_id    bigint NOT NULL,
+  contact_id bigint NOT NULL,
+  is_primary boolean NOT NULL DEFAULT false,
+  sort       int NOT NULL DEFAULT 0,
+  PRIMARY KEY (deal_id, contact_id)
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_deal_contacts_contact_idx ON bitrix_deal_contacts(contact_id);
+
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS contact_id bigint;
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS company_id bigint;
+`,
+	// 6: leads and the lead a deal was converted from
+	`
+CREATE TABLE IF NOT EXISTS bitrix_leads (
+  id                 bigint PRIMARY KEY,
+  title              text,
+  status_id          text,
+  status_semantic_id text,
+  source_id          text,
+  assigned_by_id     bigint,
+  contact_id         bigint,
+  company_id         bigint,
+  utm_source         text,
+  utm_campaign       text,
+  date_create        timestamptz,
+  date_modify        timestamptz,
+  date_closed        timestamptz,
+  raw                jsonb NOT NULL,
+  updated_at         timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_leads_date_create_idx ON bitrix_leads(date_create);
+
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS lead_id bigint;
+CREATE INDEX IF NOT EXISTS bitrix_deals_lead_id_idx ON bitrix_deals(lead_id) WHERE lead_id IS NOT NULL;
+`,
+	// 7: deal money fields and product rows
+	`
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS opportunity numeric(18,2);
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS currency_id text;
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS closed boolean;
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS close_date date;
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS begin_date date;
+
+CREATE TABLE IF NOT EXISTS bitrix_deal_products (
+  id           bigint PRIMARY KEY,
+  deal_id      bigint NOT NULL,
+  product_id   bigint,
+  product_name text,
+  price        numeric(18,4),
+  quantity     numeric(18,4),
+  discount_sum numeric(18,4),
+  tax_rate     numeric(9,4),
+  measure_name text,
+  sort         int NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_deal_products_deal_idx ON bitrix_deal_products(deal_id);
+`,
+	// 8: activities (calls, emails, tasks) of deals
+	`
+CREATE TABLE IF NOT EXISTS bitrix_activities (
+  id             bigint PRIMARY KEY,
+  owner_type_id  int NOT NULL,
+  owner_id       bigint NOT NULL,
+  type_id        int,
+  provider_id    text,
+  direction      int,
+  subject        text,
+  completed      boolean,
+  responsible_id bigint,
+  created        timestamptz,
+  last_updated   timestamptz,
+  start_time     timestamptz,
+  end_time       timestamptz,
+  deadline       timestamptz,
+  raw            jsonb NOT NULL,
+  updated_at     timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_activities_owner_idx ON bitrix_activities(owner_type_id, owner_id);
+`,
+	// 9: crm.item.list entities (smart processes); custom entity tables are
+	// created LIKE bitrix_items at startup by EnsureItemTables.
+	`
+CREATE TABLE IF NOT EXISTS bitrix_items (
+  entity_type_id int NOT NULL,
+  id             bigint NOT NULL,
+  title          text NULL,
+  category_id    int NULL,
+  stage_id       text NULL,
+  assigned_by_id bigint NULL,
+  date_create    timestamptz NULL,
+  date_modify    timestamptz NULL,
+  raw            jsonb NOT NULL,
+  updated_at     timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (entity_type_id, id)
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_items_stage_idx ON bitrix_items(entity_type_id, stage_id);
+`,
+	// 10: deal field catalog and detected schema drift
+	`
+CREATE TABLE IF NOT EXISTS bitrix_deal_fields (
+  code       text PRIMARY KEY,
+  type       text NOT NULL,
+  title      text NULL,
+  label_ru   text NULL,
+  label_en   text NULL,
+  multiple   boolean NOT NULL DEFAULT false,
+  items      jsonb NOT NULL DEFAULT '[]',
+  updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS bitrix_deal_field_changes (
+  id          bigserial PRIMARY KEY,
+  code        text NOT NULL,
+  change      text NOT NULL,
+  old_type    text NULL,
+  new_type    text NULL,
+  old_label   text NULL,
+  new_label   text NULL,
+  detected_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_deal_field_changes_detected_idx ON bitrix_deal_field_changes(detected_at);
+`,
+	// 11: every UF_* value of a deal as a list, for multiple fields
+	`
+ALTER TABLE bitrix_deals ADD COLUMN IF NOT EXISTS uf_values jsonb NOT NULL DEFAULT '{}';
+`,
+	// 12: deal field values that failed to parse
+	`
+CREATE TABLE IF NOT EXISTS bitrix_deal_parse_errors (
+  deal_id     bigint NOT NULL,
+  field       text NOT NULL,
+  value       text NOT NULL,
+  error       text NOT NULL,
+  detected_at timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (deal_id, field)
+);
+
+CREATE INDEX IF NOT EXISTS bitrix_deal_parse_errors_detected_idx ON bitrix_deal_parse_errors(detected_at);
+`,
+	// 13: deals failing data quality rules
+	`
+CREATE TABLE IF NOT EXISTS deal_quality_violations (
+  deal_id        bigint NOT NULL,
+  rule           text NOT NULL,
+  message        text NOT NULL,
+  category_id    int NOT NULL DEFAULT 0,
+  stage_id       text NOT NULL DEFAULT '',
+  assigned_by_id bigint NOT NULL DEFAULT 0,
+  detected_at    timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (deal_id, rule)
+);
+
+CREATE INDEX IF NOT EXISTS deal_quality_violations_rule_idx ON deal_quality_violations(rule);
+`,
+	// 14: targeted deal resyncs requested by verification
+	`
+CREATE TABLE IF NOT EXISTS deal_resync_queue (
+  id           bigserial PRIMARY KEY,
+  category_id  int NOT NULL DEFAULT 0,
+  date_from    timestamptz,
+  date_to      timestamptz,
+  deal_ids     bigint[] NOT NULL DEFAULT '{}',
+  reason       text NOT NULL DEFAULT '',
+  requested_at timestamptz NOT NULL DEFAULT now(),
+  finished_at  timestamptz,
+  error        text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS deal_resync_queue_pending_idx ON deal_resync_queue(id) WHERE finished_at IS NULL;
+`,
+	// 15: mode of the last successful run, for readiness
+	`
+ALTER TABLE sync_runs ADD COLUMN IF NOT EXISTS last_success_mode text;
+UPDATE sync_runs SET last_success_mode = last_mode WHERE last_success_at IS NOT NULL AND last_error IS NULL;
+`,
+	// 16: reload deals stored before the contact, lead and money columns
+	// (5-7) existed, 500 deals per resync request
+	`
+INSERT INTO deal_resync_queue (deal_ids, reason)
+SELECT array_agg(id ORDER BY id), 'backfill contact, lead and money columns'
+FROM (
+  SELECT id, (row_number() OVER (ORDER BY id) - 1) / 500 AS chunk
+  FROM bitrix_deals
+  WHERE updated_at IS NULL
+     OR updated_at < (SELECT max(applied_at) FROM schema_migrations WHERE version IN (5, 6, 7))
+) stale
+GROUP BY chunk;
+`,
+	// 17: length of the failure streak the last success ended, for recovery
+	// notifications from any process
+	`
+ALTER TABLE sync_runs ADD COLUMN IF NOT EXISTS recovered_failures int NOT NULL DEFAULT 0;
+`,
+}
+
+type MigrationStatus struct {
+	Current int `json:"current"`
+	Latest  int `json:"latest"`
+}
+
+func (s MigrationStatus) UpToDate() bool {
+	return s.Current >= s.Latest
+}
+
+func (r *DealsRepository) Migrate(ctx context.Context) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("migration lock: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version     int PRIMARY KEY,
+  applied_at  timestamptz NOT NULL DEFAULT now()
+)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := tx.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if _, err := tx.Exec(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations(version) VALUES($1)`, version); err != nil {
+			return fmt.Errorf("record migration %d: %w", version, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *DealsRepository) GetMigrationStatus(ctx context.Context) (MigrationStatus, error) {
+	st := MigrationStatus{Latest: len(migrations)}
+	err := r.pool.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&st.Current)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	return st, nil
+}
@@ -0,0 +1,60 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ParseError is a deal field value that could not be parsed and was stored
+// as NULL.
+type ParseError struct {
+	DealID     int64     `json:"deal_id"`
+	Field      string    `json:"field"`
+	Value      string    `json:"value"`
+	Error      string    `json:"error"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// replaceParseErrors keeps the parse errors of a deal in line with its last
+// upsert: values fixed in Bitrix drop out, new failures are added.
+func replaceParseErrors(ctx context.Context, tx pgx.Tx, dealID int64, errs []ParseError) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM bitrix_deal_parse_errors WHERE deal_id = $1`, dealID); err != nil {
+		return err
+	}
+	for _, e := range errs {
+		_, err := tx.Exec(ctx, `
+INSERT INTO bitrix_deal_parse_errors (deal_id, field, value, error, detected_at)
+VALUES ($1, $2, $3, $4, now())`, dealID, e.Field, e.Value, e.Error)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListParseErrors returns the current parse errors, newest first; an empty
+// field lists every field.
+func (r *DealsRepository) ListParseErrors(ctx context.Context, field string, limit int) ([]ParseError, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT deal_id, field, value, error, detected_at
+FROM bitrix_deal_parse_errors
+WHERE $1 = '' OR field = $1
+ORDER BY detected_at DESC, deal_id DESC
+LIMIT $2`, field, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ParseError
+	for rows.Next() {
+		var e ParseError
+		if err := rows.Scan(&e.DealID, &e.Field, &e.Value, &e.Error, &e.DetectedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
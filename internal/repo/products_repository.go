@@ -0,0 +1,61 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+)
+
+// ReplaceDealProducts stores the full product list of every deal in products;
+// deals absent from products keep their stored rows. Prices are in the
+// currency of the deal (bitrix_deals.currency_id).
+func (r *DealsRepository) ReplaceDealProducts(ctx context.Context, products map[int64][]bitrix.ProductRow) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	dealIDs := make([]int64, 0, len(products))
+	for id := range products {
+		dealIDs = append(dealIDs, id)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM bitrix_deal_products WHERE deal_id = ANY($1)`, dealIDs); err != nil {
+		return err
+	}
+
+	for dealID, rows := range products {
+		for _, p := range rows {
+			var productID any
+			if p.ProductID > 0 {
+				productID = int64(p.ProductID)
+			}
+			_, err := tx.Exec(ctx, `
+INSERT INTO bitrix_deal_products (
+  id, deal_id, product_id, product_name, price, quantity, discount_sum, tax_rate, measure_name, sort
+) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+ON CONFLICT (id) DO UPDATE SET
+  deal_id = EXCLUDED.deal_id,
+  product_id = EXCLUDED.product_id,
+  product_name = EXCLUDED.product_name,
+  price = EXCLUDED.price,
+  quantity = EXCLUDED.quantity,
+  discount_sum = EXCLUDED.discount_sum,
+  tax_rate = EXCLUDED.tax_rate,
+  measure_name = EXCLUDED.measure_name,
+  sort = EXCLUDED.sort`,
+				int64(p.ID), dealID, productID, emptyToNull(p.ProductName),
+				emptyToNull(string(p.Price)), emptyToNull(string(p.Quantity)),
+				emptyToNull(string(p.DiscountSum)), emptyToNull(string(p.TaxRate)),
+				emptyToNull(p.MeasureName), int(p.Sort))
+			if err != nil {
+				return fmt.Errorf("product row %d of deal %d: %w", int64(p.ID), dealID, err)
+			}
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,115 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// QualityViolation is a deal failing a data quality rule.
+type QualityViolation struct {
+	DealID       int64     `json:"deal_id"`
+	Rule         string    `json:"rule"`
+	Message      string    `json:"message"`
+	CategoryID   int       `json:"category_id"`
+	StageID      string    `json:"stage_id"`
+	AssignedByID int64     `json:"assigned_by_id"`
+	DetectedAt   time.Time `json:"detected_at"`
+}
+
+// SyncQualityViolations makes the stored violations of the checked deals
+// equal to current; violations of other deals are kept. It returns the
+// violations that were not open before and the number of cleared ones.
+func (r *DealsRepository) SyncQualityViolations(ctx context.Context, dealIDs []int64, current []QualityViolation) ([]QualityViolation, int, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ids := make([]int64, len(current))
+	rules := make([]string, len(current))
+	for i, v := range current {
+		ids[i] = v.DealID
+		rules[i] = v.Rule
+	}
+	tag, err := tx.Exec(ctx, `
+DELETE FROM deal_quality_violations
+WHERE deal_id = ANY($1)
+  AND (deal_id, rule) NOT IN (SELECT * FROM unnest($2::bigint[], $3::text[]))`, dealIDs, ids, rules)
+	if err != nil {
+		return nil, 0, fmt.Errorf("clear quality violations: %w", err)
+	}
+
+	var opened []QualityViolation
+	for _, v := range current {
+		var inserted bool
+		err := tx.QueryRow(ctx, `
+INSERT INTO deal_quality_violations (deal_id, rule, message, category_id, stage_id, assigned_by_id)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (deal_id, rule) DO UPDATE SET
+  message = EXCLUDED.message,
+  category_id = EXCLUDED.category_id,
+  stage_id = EXCLUDED.stage_id,
+  assigned_by_id = EXCLUDED.assigned_by_id
+RETURNING detected_at, (xmax = 0)`,
+			v.DealID, v.Rule, v.Message, v.CategoryID, v.StageID, v.AssignedByID,
+		).Scan(&v.DetectedAt, &inserted)
+		if err != nil {
+			return nil, 0, fmt.Errorf("upsert quality violation %d/%s: %w", v.DealID, v.Rule, err)
+		}
+		if inserted {
+			opened = append(opened, v)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, 0, err
+	}
+	return opened, int(tag.RowsAffected()), nil
+}
+
+// QualityViolationDealIDs returns the deals with an open violation of one of
+// rules.
+func (r *DealsRepository) QualityViolationDealIDs(ctx context.Context, rules []string) ([]int64, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT DISTINCT deal_id
+FROM deal_quality_violations
+WHERE rule = ANY($1)
+ORDER BY deal_id`, rules)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+func (r *DealsRepository) ListQualityViolations(ctx context.Context) ([]QualityViolation, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT deal_id, rule, message, category_id, stage_id, assigned_by_id, detected_at
+FROM deal_quality_violations
+ORDER BY deal_id DESC, rule`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []QualityViolation
+	for rows.Next() {
+		var v QualityViolation
+		if err := rows.Scan(&v.DealID, &v.Rule, &v.Message, &v.CategoryID, &v.StageID, &v.AssignedByID, &v.DetectedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,140 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DealStageState is a deal's current stage with the time it entered it.
+type DealStageState struct {
+	DealID       int64
+	CategoryID   int
+	StageID      string
+	AssignedByID int64
+	EnteredAt    time.Time
+	DateModify   *time.Time
+}
+
+type SLABreach struct {
+	DealID       int64      `json:"deal_id"`
+	Rule         string     `json:"rule"`
+	CategoryID   int        `json:"category_id"`
+	StageID      string     `json:"stage_id"`
+	AssignedByID int64      `json:"assigned_by_id"`
+	EnteredAt    time.Time  `json:"entered_at"`
+	LastModify   *time.Time `json:"last_modify"`
+	DetectedAt   time.Time  `json:"detected_at"`
+}
+
+// stageEnteredAt prefers Bitrix MOVED_TIME and falls back to DATE_MODIFY,
+// which is when the sync first saw the new stage at the latest.
+func stageEnteredAt(dt dealTimes) time.Time {
+	if !dt.movedTime.IsZero() {
+		return dt.movedTime
+	}
+	if !dt.dateModify.IsZero() {
+		return dt.dateModify
+	}
+	return time.Now().UTC()
+}
+
+func (r *DealsRepository) ListDealStageStates(ctx context.Context, stageIDs []string) ([]DealStageState, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT d.id, coalesce(d.category_id, 0), d.stage_id, coalesce(d.assigned_by_id, 0),
+       coalesce(h.entered_at, d.date_modify, d.date_create), d.date_modify
+FROM bitrix_deals d
+LEFT JOIN LATERAL (
+  SELECT entered_at FROM bitrix_deal_stage_history
+  WHERE deal_id = d.id AND stage_id IS NOT DISTINCT FROM d.stage_id
+  ORDER BY id DESC LIMIT 1
+) h ON true
+WHERE d.stage_id = ANY($1)`, stageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []DealStageState
+	for rows.Next() {
+		var st DealStageState
+		if err := rows.Scan(&st.DealID, &st.CategoryID, &st.StageID, &st.AssignedByID, &st.EnteredAt, &st.DateModify); err != nil {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	return out, rows.Err()
+}
+
+// SyncSLABreaches makes sla_breaches equal to current. It returns the breaches
+// that were not open before and the number of breaches that were cleared.
+func (r *DealsRepository) SyncSLABreaches(ctx context.Context, current []SLABreach) ([]SLABreach, int, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	dealIDs := make([]int64, len(current))
+	rules := make([]string, len(current))
+	for i, b := range current {
+		dealIDs[i] = b.DealID
+		rules[i] = b.Rule
+	}
+	tag, err := tx.Exec(ctx, `
+DELETE FROM sla_breaches
+WHERE (deal_id, rule) NOT IN (SELECT * FROM unnest($1::bigint[], $2::text[]))`, dealIDs, rules)
+	if err != nil {
+		return nil, 0, fmt.Errorf("clear sla breaches: %w", err)
+	}
+
+	var opened []SLABreach
+	for _, b := range current {
+		var inserted bool
+		err := tx.QueryRow(ctx, `
+INSERT INTO sla_breaches (deal_id, rule, category_id, stage_id, assigned_by_id, entered_at, last_modify)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (deal_id, rule) DO UPDATE SET
+  category_id = EXCLUDED.category_id,
+  assigned_by_id = EXCLUDED.assigned_by_id,
+  entered_at = EXCLUDED.entered_at,
+  last_modify = EXCLUDED.last_modify
+RETURNING detected_at, (xmax = 0)`,
+			b.DealID, b.Rule, b.CategoryID, b.StageID, b.AssignedByID, b.EnteredAt, b.LastModify,
+		).Scan(&b.DetectedAt, &inserted)
+		if err != nil {
+			return nil, 0, fmt.Errorf("upsert sla breach %d/%s: %w", b.DealID, b.Rule, err)
+		}
+		if inserted {
+			opened = append(opened, b)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, 0, err
+	}
+	return opened, int(tag.RowsAffected()), nil
+}
+
+func (r *DealsRepository) ListSLABreaches(ctx context.Context) ([]SLABreach, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT deal_id, rule, coalesce(category_id, 0), coalesce(stage_id, ''), coalesce(assigned_by_id, 0),
+       entered_at, last_modify, detected_at
+FROM sla_breaches
+ORDER BY entered_at, deal_id, rule`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []SLABreach
+	for rows.Next() {
+		var b SLABreach
+		if err := rows.Scan(&b.DealID, &b.Rule, &b.CategoryID, &b.StageID, &b.AssignedByID,
+			&b.EnteredAt, &b.LastModify, &b.DetectedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/metrics"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// offsetLayouts carry their own offset; localLayouts are read in the portal
+// timezone. Besides ISO values Bitrix sends values formatted for the portal
+// locale: dd.mm.yyyy (ru) and mm/dd/yyyy (en).
+var (
+	offsetLayouts = []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05-0700",
+		"2006-01-02 15:04:05-07:00",
+	}
+	localLayouts = []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04",
+		"02.01.2006 15:04:05",
+		"02.01.2006 15:04",
+		"01/02/2006 03:04:05 pm",
+		"01/02/2006 03:04:05 PM",
+		"01/02/2006 15:04:05",
+		"2006-01-02",
+		"02.01.2006",
+		"01/02/2006",
+	}
+)
+
+// TimeParser parses Bitrix date and datetime values. Values without an offset
+// are taken in the portal timezone; the zero value uses UTC.
+type TimeParser struct {
+	loc *time.Location
+}
+
+func NewTimeParser(loc *time.Location) TimeParser {
+	return TimeParser{loc: loc}
+}
+
+// DateTime parses an instant. An empty value is the zero time without error.
+func (p TimeParser) DateTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range offsetLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	loc := p.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range localLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported datetime %q", s)
+}
+
+// Date parses a calendar date. A value with a time keeps the date as written,
+// in its own offset; the result is midnight UTC of that date.
+func (p TimeParser) Date(s string) (time.Time, error) {
+	t, err := p.DateTime(s)
+	if err != nil || t.IsZero() {
+		return time.Time{}, err
+	}
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), nil
+}
+
+// dealTimes are the parsed date fields of a deal together with the values
+// that failed to parse.
+type dealTimes struct {
+	dateCreate, dateModify, movedTime time.Time
+	uf165Date, uf169Date, uf171Date   time.Time
+	uf175At, uf177Date                time.Time
+	closeDate, beginDate              time.Time
+	errs                              []ParseError
+}
+
+func (p TimeParser) parseDeal(d bitrix.Deal) dealTimes {
+	var dt dealTimes
+	id := toInt64(d.ID)
+	parse := func(field, value string, fn func(string) (time.Time, error)) time.Time {
+		t, err := fn(value)
+		if err != nil {
+			dt.errs = append(dt.errs, ParseError{DealID: id, Field: field, Value: value, Error: err.Error()})
+		}
+		return t
+	}
+	dt.dateCreate = parse("DATE_CREATE", d.DateCreate, p.DateTime)
+	dt.dateModify = parse("DATE_MODIFY", d.DateModify, p.DateTime)
+	dt.movedTime = parse("MOVED_TIME", d.MovedTime, p.DateTime)
+	dt.uf165Date = parse("UF_CRM_1650279712660", d.UFCRM1650279712660.String(), p.Date)
+	dt.uf169Date = parse("UF_CRM_1699863367472", d.UFCRM1699863367472.String(), p.Date)
+	dt.uf171Date = parse("UF_CRM_1752578793696", d.UFCRM1752578793696.String(), p.Date)
+	dt.uf175At = parse("UF_CRM_1753169789836", d.UFCRM1753169789836.String(), p.DateTime)
+	dt.uf177Date = parse("UF_CRM_1771313479555", d.UFCRM1771313479555.String(), p.Date)
+	dt.closeDate = parse("CLOSEDATE", d.CloseDate, p.Date)
+	dt.beginDate = parse("BEGINDATE", d.BeginDate, p.Date)
+	return dt
+}
+
+// recordTime parses a datetime field of a related record (contact, company,
+// lead, activity, smart process item). Only deals keep their parse errors in
+// bitrix_deal_parse_errors; a related record stores the value as NULL, and
+// the failure is logged and counted by table and field.
+func (p TimeParser) recordTime(table string, id int64, field, value string) time.Time {
+	t, err := p.DateTime(value)
+	if err != nil {
+		metrics.ParseErrors.WithLabelValues(table, field).Inc()
+		slog.Warn("bitrix time not parsed", "table", table, "id", id, "field", field, "value", value, "err", err)
+	}
+	return t
+}
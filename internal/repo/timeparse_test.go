@@ -0,0 +1,109 @@
+package repo
+
+import (
+	"freedom_bitrix/internal/metrics"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTimeParserDateTime(t *testing.T) {
+	almaty := time.FixedZone("ALMT", 5*3600)
+	p := NewTimeParser(almaty)
+
+	cases := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "", want: time.Time{}},
+		{in: "2026-03-01T10:00:00+03:00", want: time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)},
+		{in: "2026-03-01T10:00:00+0300", want: time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)},
+		{in: "2026-03-01 10:00:00+03:00", want: time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC)},
+		{in: "2026-03-01T10:00:00Z", want: time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{in: "2026-03-01 10:00:00", want: time.Date(2026, 3, 1, 10, 0, 0, 0, almaty)},
+		{in: "2026-03-01", want: time.Date(2026, 3, 1, 0, 0, 0, 0, almaty)},
+		{in: "01.03.2026", want: time.Date(2026, 3, 1, 0, 0, 0, 0, almaty)},
+		{in: "01.03.2026 18:30:15", want: time.Date(2026, 3, 1, 18, 30, 15, 0, almaty)},
+		{in: "01.03.2026 18:30", want: time.Date(2026, 3, 1, 18, 30, 0, 0, almaty)},
+		{in: "03/01/2026", want: time.Date(2026, 3, 1, 0, 0, 0, 0, almaty)},
+		{in: "03/01/2026 06:30:15 pm", want: time.Date(2026, 3, 1, 18, 30, 15, 0, almaty)},
+		{in: "03/01/2026 06:30:15 PM", want: time.Date(2026, 3, 1, 18, 30, 15, 0, almaty)},
+		{in: "03/01/2026 12:05:00 am", want: time.Date(2026, 3, 1, 0, 5, 0, 0, almaty)},
+		{in: "03/01/2026 18:30:15", want: time.Date(2026, 3, 1, 18, 30, 15, 0, almaty)},
+		{in: "  2026-03-01  ", want: time.Date(2026, 3, 1, 0, 0, 0, 0, almaty)},
+		{in: "31.02.2026", wantErr: true},
+		{in: "yesterday", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := p.DateTime(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("DateTime(%q): err = %v, want error %v", c.in, err, c.wantErr)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("DateTime(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestTimeParserZeroValueUsesUTC(t *testing.T) {
+	got, err := TimeParser{}.DateTime("2026-03-01 10:00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestTimeParserDateKeepsWrittenDay(t *testing.T) {
+	p := NewTimeParser(time.FixedZone("ALMT", 5*3600))
+
+	cases := []struct {
+		in   string
+		want time.Time
+	}{
+		{in: "", want: time.Time{}},
+		// Midnight in +03:00 is the previous day in UTC, the date stays.
+		{in: "2026-02-03T00:00:00+03:00", want: time.Date(2026, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{in: "2026-02-03T23:30:00-05:00", want: time.Date(2026, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{in: "2026-02-03 00:30:00", want: time.Date(2026, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{in: "03.02.2026", want: time.Date(2026, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{in: "02/03/2026 11:45:00 pm", want: time.Date(2026, 2, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got, err := p.Date(c.in)
+		if err != nil {
+			t.Errorf("Date(%q): %v", c.in, err)
+			continue
+		}
+		if !got.Equal(c.want) || got.Location() != time.UTC {
+			t.Errorf("Date(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+
+	if _, err := p.Date("03-02-2026"); err == nil {
+		t.Error("Date(03-02-2026): expected an error")
+	}
+}
+
+func TestRecordTimeCountsFailures(t *testing.T) {
+	p := NewTimeParser(time.FixedZone("ALMT", 5*3600))
+	failed := metrics.ParseErrors.WithLabelValues("bitrix_contacts", "DATE_CREATE")
+	before := testutil.ToFloat64(failed)
+
+	if got := p.recordTime("bitrix_contacts", 1, "DATE_CREATE", "01.03.2026 10:00"); !got.Equal(time.Date(2026, 3, 1, 5, 0, 0, 0, time.UTC)) {
+		t.Fatalf("dd.mm.yyyy = %v", got)
+	}
+	if got := p.recordTime("bitrix_contacts", 1, "DATE_CREATE", ""); !got.IsZero() {
+		t.Fatalf("empty = %v", got)
+	}
+	if got := p.recordTime("bitrix_contacts", 1, "DATE_CREATE", "soon"); !got.IsZero() {
+		t.Fatalf("unparsable = %v", got)
+	}
+	if n := testutil.ToFloat64(failed) - before; n != 1 {
+		t.Fatalf("counted %v failures, want 1", n)
+	}
+}
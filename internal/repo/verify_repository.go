@@ -0,0 +1,172 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// MonthCount is the number of deals of a category created in one month.
+// Month is the first day of the month at midnight in the requested timezone.
+type MonthCount struct {
+	CategoryID int       `json:"category_id"`
+	Month      time.Time `json:"month"`
+	Deals      int       `json:"deals"`
+}
+
+// DealStamp is the stored modification time of a deal.
+type DealStamp struct {
+	ID         int64      `json:"id"`
+	DateModify *time.Time `json:"date_modify"`
+}
+
+// ResyncRequest asks the syncer to reload deals from Bitrix: the deals in
+// DealIDs or, without them, the deals of CategoryID created in
+// [DateFrom, DateTo).
+type ResyncRequest struct {
+	ID          int64      `json:"id"`
+	CategoryID  int        `json:"category_id"`
+	DateFrom    *time.Time `json:"date_from,omitempty"`
+	DateTo      *time.Time `json:"date_to,omitempty"`
+	DealIDs     []int64    `json:"deal_ids,omitempty"`
+	Reason      string     `json:"reason"`
+	RequestedAt time.Time  `json:"requested_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// CountDealsByMonth counts the deals created in [from, to) per category and
+// month of date_create in loc.
+func (r *DealsRepository) CountDealsByMonth(ctx context.Context, from, to time.Time, loc *time.Location) ([]MonthCount, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	rows, err := r.pool.Query(ctx, `
+SELECT coalesce(category_id, 0), date_trunc('month', date_create AT TIME ZONE $3), count(*)
+FROM bitrix_deals
+WHERE date_create >= $1 AND date_create < $2
+GROUP BY 1, 2
+ORDER BY 1, 2`, from, to, loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []MonthCount
+	for rows.Next() {
+		var c MonthCount
+		var month time.Time
+		if err := rows.Scan(&c.CategoryID, &month, &c.Deals); err != nil {
+			return nil, err
+		}
+		c.Month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, loc)
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// SampleDeals returns up to n random deals with their stored modification
+// time.
+func (r *DealsRepository) SampleDeals(ctx context.Context, n int) ([]DealStamp, error) {
+	rows, err := r.pool.Query(ctx, `SELECT id, date_modify FROM bitrix_deals ORDER BY random() LIMIT $1`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []DealStamp
+	for rows.Next() {
+		var s DealStamp
+		if err := rows.Scan(&s.ID, &s.DateModify); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// EnqueueResyncs adds the requests to the resync queue, skipping those equal
+// to a request that is still pending. It returns the queued requests.
+func (r *DealsRepository) EnqueueResyncs(ctx context.Context, reqs []ResyncRequest) ([]ResyncRequest, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var queued []ResyncRequest
+	for _, req := range reqs {
+		ids := req.DealIDs
+		if ids == nil {
+			ids = []int64{}
+		}
+		rows, err := tx.Query(ctx, `
+INSERT INTO deal_resync_queue (category_id, date_from, date_to, deal_ids, reason)
+SELECT $1, $2, $3, $4, $5
+WHERE NOT EXISTS (
+  SELECT 1 FROM deal_resync_queue
+  WHERE finished_at IS NULL
+    AND category_id = $1
+    AND date_from IS NOT DISTINCT FROM $2
+    AND date_to IS NOT DISTINCT FROM $3
+    AND deal_ids = $4
+)
+RETURNING id, requested_at`, req.CategoryID, req.DateFrom, req.DateTo, ids, req.Reason)
+		if err != nil {
+			return nil, fmt.Errorf("enqueue resync: %w", err)
+		}
+		for rows.Next() {
+			if err := rows.Scan(&req.ID, &req.RequestedAt); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("enqueue resync: %w", err)
+			}
+			queued = append(queued, req)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("enqueue resync: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return queued, nil
+}
+
+// PendingResyncs returns up to limit unfinished requests, oldest first.
+func (r *DealsRepository) PendingResyncs(ctx context.Context, limit int) ([]ResyncRequest, error) {
+	rows, err := r.pool.Query(ctx, `
+SELECT id, category_id, date_from, date_to, deal_ids, reason, requested_at
+FROM deal_resync_queue
+WHERE finished_at IS NULL
+ORDER BY id
+LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []ResyncRequest
+	for rows.Next() {
+		var req ResyncRequest
+		if err := rows.Scan(&req.ID, &req.CategoryID, &req.DateFrom, &req.DateTo, &req.DealIDs, &req.Reason, &req.RequestedAt); err != nil {
+			return nil, err
+		}
+		if len(req.DealIDs) == 0 {
+			req.DealIDs = nil
+		}
+		out = append(out, req)
+	}
+	return out, rows.Err()
+}
+
+// FinishResync marks a request as done; runErr, if any, is kept with it.
+func (r *DealsRepository) FinishResync(ctx context.Context, id int64, runErr error) error {
+	msg := ""
+	if runErr != nil {
+		msg = runErr.Error()
+	}
+	_, err := r.pool.Exec(ctx, `UPDATE deal_resync_queue SET finished_at = now(), error = $2 WHERE id = $1`, id, msg)
+	return err
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type AlertStore interface {
+	ListSLABreaches(ctx context.Context) ([]repo.SLABreach, error)
+}
+
+func WithAlerts(store AlertStore) Option {
+	return func(s *Server) {
+		s.alerts = store
+	}
+}
+
+type slaBreachJSON struct {
+	repo.SLABreach
+	Category     string  `json:"category"`
+	Stage        string  `json:"stage"`
+	AssignedBy   string  `json:"assigned_by"`
+	HoursInStage float64 `json:"hours_in_stage"`
+}
+
+type slaAlertsResponse struct {
+	NowUTC   string          `json:"now_utc"`
+	Breaches []slaBreachJSON `json:"breaches"`
+}
+
+func (s *Server) handleSLAAlerts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.alerts == nil {
+		http.Error(w, "sla alerts are not configured", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	var categoryIDs []int
+	if v := q["category_id"]; len(v) > 0 {
+		ids, err := parseIntList[int](v)
+		if err != nil {
+			http.Error(w, "category_id: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		categoryIDs = ids
+	}
+	stageIDs := splitList(q["stage_id"])
+
+	breaches, err := s.alerts.ListSLABreaches(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maps := s.loadMappings(ctx, refs)
+
+	now := time.Now().UTC()
+	resp := slaAlertsResponse{NowUTC: now.Format(time.RFC3339), Breaches: make([]slaBreachJSON, 0, len(breaches))}
+	for _, b := range breaches {
+		if len(categoryIDs) > 0 && !slices.Contains(categoryIDs, b.CategoryID) {
+			continue
+		}
+		if len(stageIDs) > 0 && !slices.Contains(stageIDs, b.StageID) {
+			continue
+		}
+		resp.Breaches = append(resp.Breaches, slaBreachJSON{
+			SLABreach:    b,
+			Category:     mapInt(maps.categoryNames, b.CategoryID),
+			Stage:        mapString(maps.stageNames, b.StageID),
+			AssignedBy:   mapInt64(maps.assignedNames, b.AssignedByID),
+			HoursInStage: now.Sub(b.EnteredAt).Hours(),
+		})
+	}
+
+	writeJSON(w, resp)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"freedom_bitrix/internal/auth"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type KeyStore interface {
+	GetAPIKey(ctx context.Context, id string) (repo.APIKey, bool, error)
+	TouchAPIKey(ctx context.Context, id string) error
+}
+
+func WithAuth(keys KeyStore) Option {
+	return func(s *Server) {
+		s.keys = keys
+	}
+}
+
+// authorize checks the API key for scope and records the key id for the access
+// log. It writes the error response itself and returns false when access is denied.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, scope auth.Scope, info *requestInfo) bool {
+	if s.keys == nil || scope == "" {
+		return true
+	}
+
+	key := apiKeyFromRequest(r)
+	if key == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="freedom_bitrix"`)
+		http.Error(w, "missing api key", http.StatusUnauthorized)
+		return false
+	}
+
+	id, ok := auth.ParseKeyID(key)
+	if !ok {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return false
+	}
+	info.keyID = id
+
+	stored, found, err := s.keys.GetAPIKey(r.Context(), id)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("load api key", "key_id", id, "err", err)
+		http.Error(w, "auth backend unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	if !found || stored.RevokedAt != nil || !auth.VerifyKey(key, stored.KeyHash) {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+		return false
+	}
+	if !auth.HasScope(stored.Scopes, scope) {
+		http.Error(w, "api key lacks scope "+string(scope), http.StatusForbidden)
+		return false
+	}
+
+	touchCtx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 2*time.Second)
+	defer cancel()
+	if err := s.keys.TouchAPIKey(touchCtx, id); err != nil {
+		logging.FromContext(r.Context()).Warn("touch api key", "key_id", id, "err", err)
+	}
+	return true
+}
+
+// keyHasScope reports whether the request carries a valid API key with scope,
+// without writing a response. Without a key store every request passes, as in
+// authorize.
+func (s *Server) keyHasScope(r *http.Request, scope auth.Scope) bool {
+	if s.keys == nil {
+		return true
+	}
+	key := apiKeyFromRequest(r)
+	id, ok := auth.ParseKeyID(key)
+	if !ok {
+		return false
+	}
+	stored, found, err := s.keys.GetAPIKey(r.Context(), id)
+	if err != nil || !found || stored.RevokedAt != nil || !auth.VerifyKey(key, stored.KeyHash) {
+		return false
+	}
+	return auth.HasScope(stored.Scopes, scope)
+}
+
+// apiKeyFromRequest accepts "Authorization: Bearer", "X-API-Key" or the
+// api_key query parameter (Google Sheets IMPORTDATA cannot set headers).
+func apiKeyFromRequest(r *http.Request) string {
+	if h := strings.TrimSpace(r.Header.Get("Authorization")); h != "" {
+		if token, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	if h := strings.TrimSpace(r.Header.Get("X-API-Key")); h != "" {
+		return h
+	}
+	return strings.TrimSpace(r.URL.Query().Get("api_key"))
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"freedom_bitrix/internal/auth"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeKeyStore map[string]repo.APIKey
+
+func (f fakeKeyStore) GetAPIKey(ctx context.Context, id string) (repo.APIKey, bool, error) {
+	k, ok := f[id]
+	return k, ok, nil
+}
+
+func (f fakeKeyStore) TouchAPIKey(ctx context.Context, id string) error {
+	return nil
+}
+
+func TestSheetsRequireScopedKey(t *testing.T) {
+	sheetsKey, sheetsID, sheetsHash, _ := auth.GenerateKey()
+	reportsKey, reportsID, reportsHash, _ := auth.GenerateKey()
+	keys := fakeKeyStore{
+		sheetsID:  {ID: sheetsID, KeyHash: sheetsHash, Scopes: []string{string(auth.ScopeSheetsRead)}},
+		reportsID: {ID: reportsID, KeyHash: reportsHash, Scopes: []string{string(auth.ScopeReportsRead)}},
+	}
+	handler := New(repo.NewMemoryRepository(), nil, "deals_sync", WithAuth(keys)).routes()
+
+	cases := []struct {
+		name   string
+		target string
+		header string
+		want   int
+	}{
+		{"no key", "/deals/sheets", "", http.StatusUnauthorized},
+		{"wrong scope", "/deals/sheets", "Bearer " + reportsKey, http.StatusForbidden},
+		{"bearer", "/deals/sheets", "Bearer " + sheetsKey, http.StatusOK},
+		{"query param", "/deals/sheets?api_key=" + sheetsKey, "", http.StatusOK},
+		{"tampered", "/deals/sheets?api_key=" + sheetsKey + "0", "", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Fatalf("status %d, want %d; body=%s", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+}
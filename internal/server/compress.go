@@ -0,0 +1,118 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const minCompressSize = 1024
+
+func negotiateEncoding(r *http.Request) string {
+	var br, gz bool
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "br":
+			br = true
+		case "gzip":
+			gz = true
+		}
+	}
+	switch {
+	case br:
+		return "br"
+	case gz:
+		return "gzip"
+	default:
+		return ""
+	}
+}
+
+func newEncoder(w io.Writer, encoding string) io.WriteCloser {
+	switch encoding {
+	case "br":
+		return brotli.NewWriterLevel(w, 5)
+	case "gzip":
+		zw, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		return zw
+	default:
+		return nil
+	}
+}
+
+// compressWriter compresses the response body on the fly unless the handler
+// has already set Content-Encoding (e.g. when serving pre-encoded cached bytes).
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         io.WriteCloser
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if w.encoding != "" && code == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err != nil || n >= minCompressSize {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", w.encoding)
+			w.enc = newEncoder(w.ResponseWriter, w.encoding)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Close() error {
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	return strings.HasPrefix(ct, "application/json") ||
+		strings.HasPrefix(ct, "text/") ||
+		strings.Contains(ct, "+json")
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type FieldStore interface {
+	ListDealFields(ctx context.Context) ([]repo.DealField, error)
+	ListFieldChanges(ctx context.Context, since time.Time, limit int) ([]repo.FieldChange, error)
+}
+
+func WithFields(store FieldStore) Option {
+	return func(s *Server) {
+		s.fields = store
+	}
+}
+
+const (
+	defaultFieldChangesLimit = 200
+	maxFieldChangesLimit     = 1000
+)
+
+type fieldsResponse struct {
+	Fields []repo.DealField `json:"fields"`
+}
+
+type fieldChangesResponse struct {
+	Since   string             `json:"since"`
+	Changes []repo.FieldChange `json:"changes"`
+}
+
+// handleFields returns the stored deal field catalog.
+func (s *Server) handleFields(w http.ResponseWriter, r *http.Request) {
+	if s.fields == nil {
+		http.Error(w, "field catalog is not configured", http.StatusNotFound)
+		return
+	}
+	fields, err := s.fields.ListDealFields(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fields == nil {
+		fields = []repo.DealField{}
+	}
+	writeJSON(w, fieldsResponse{Fields: fields})
+}
+
+// handleFieldChanges returns the detected field changes since the given date
+// (30 days back by default), newest first.
+func (s *Server) handleFieldChanges(w http.ResponseWriter, r *http.Request) {
+	if s.fields == nil {
+		http.Error(w, "field catalog is not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	since := time.Now().AddDate(0, 0, -30)
+	if from, err := parseDateIn(q.Get("since"), s.sheetsLoc); err != nil {
+		http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if from != nil {
+		since = *from
+	}
+	limit := defaultFieldChangesLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxFieldChangesLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	changes, err := s.fields.ListFieldChanges(r.Context(), since, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = []repo.FieldChange{}
+	}
+	writeJSON(w, fieldChangesResponse{Since: since.UTC().Format(time.RFC3339), Changes: changes})
+}
+
+// profileHeaders returns the profile headers; with header_labels set,
+// columns without an own label take the Bitrix label of their field.
+func (s *Server) profileHeaders(ctx context.Context, p SheetProfile) []string {
+	headers := p.headers()
+	if p.HeaderLabels == "" || s.fields == nil {
+		return headers
+	}
+	fields, err := s.fields.ListDealFields(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Warn("field labels for sheet headers", "profile", p.Name, "err", err)
+		return headers
+	}
+	labels := make(map[string]string, len(fields))
+	for _, f := range fields {
+		labels[f.Code] = f.Label(p.HeaderLabels)
+	}
+	for i, c := range p.Columns {
+		if c.customLabel {
+			continue
+		}
+		if l := labels[dealColumns[c.Field].code]; l != "" {
+			headers[i] = l
+		}
+	}
+	return headers
+}
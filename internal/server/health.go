@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/auth"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"time"
+)
+
+type ReadinessStore interface {
+	Ping(ctx context.Context) error
+	GetMigrationStatus(ctx context.Context) (repo.MigrationStatus, error)
+	GetSyncRun(ctx context.Context, key string) (repo.SyncRun, bool, error)
+}
+
+type ReadinessConfig struct {
+	SyncMaxAge  time.Duration
+	CheckBitrix bool
+}
+
+func WithReadiness(store ReadinessStore, cfg ReadinessConfig) Option {
+	return func(s *Server) {
+		s.readiness = store
+		s.readinessCfg = cfg
+	}
+}
+
+type checkResult struct {
+	OK         bool   `json:"ok"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type readyResponse struct {
+	Status string                 `json:"status"`
+	NowUTC string                 `json:"now_utc"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	resp := readyResponse{
+		Status: "ready",
+		NowUTC: time.Now().UTC().Format(time.RFC3339),
+		Checks: map[string]checkResult{},
+	}
+
+	if s.readiness == nil {
+		resp.Checks["postgres"] = checkResult{Error: "readiness store is not configured"}
+	} else {
+		resp.Checks["postgres"] = runCheck(ctx, func(ctx context.Context) (string, error) {
+			return "", s.readiness.Ping(ctx)
+		})
+		resp.Checks["migrations"] = runCheck(ctx, s.checkMigrations)
+		if s.readinessCfg.SyncMaxAge > 0 {
+			resp.Checks["sync"] = runCheck(ctx, s.checkLastSync)
+		}
+	}
+	if s.readinessCfg.CheckBitrix && s.bitrix != nil {
+		resp.Checks["bitrix"] = runCheck(ctx, s.checkBitrix)
+	}
+
+	status := http.StatusOK
+	for _, c := range resp.Checks {
+		if !c.OK {
+			resp.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	// /readyz is public: error texts and details (sync errors, Bitrix
+	// responses) are shown only to keys with sync:admin.
+	if !s.keyHasScope(r, auth.ScopeSyncAdmin) {
+		for name, c := range resp.Checks {
+			c.Detail = ""
+			if !c.OK {
+				c.Error = "check failed"
+			}
+			resp.Checks[name] = c
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func runCheck(ctx context.Context, fn func(context.Context) (string, error)) checkResult {
+	started := time.Now()
+	detail, err := fn(ctx)
+	res := checkResult{
+		OK:         err == nil,
+		Detail:     detail,
+		DurationMS: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		res.Error = bitrix.RedactWebhook(err.Error())
+	}
+	res.Detail = bitrix.RedactWebhook(res.Detail)
+	return res
+}
+
+func (s *Server) checkMigrations(ctx context.Context) (string, error) {
+	st, err := s.readiness.GetMigrationStatus(ctx)
+	if err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("version %d of %d", st.Current, st.Latest)
+	if !st.UpToDate() {
+		return detail, fmt.Errorf("schema is behind")
+	}
+	return detail, nil
+}
+
+func (s *Server) checkLastSync(ctx context.Context) (string, error) {
+	run, ok, err := s.readiness.GetSyncRun(ctx, s.syncStateKey)
+	if err != nil {
+		return "", err
+	}
+	// Only a deal full or delta run proves the deals are loaded.
+	if !ok || run.LastSuccessAt == nil || run.LastSuccessMode == nil ||
+		(*run.LastSuccessMode != "full" && *run.LastSuccessMode != "delta") {
+		return "", fmt.Errorf("no successful full or delta sync recorded for %s", s.syncStateKey)
+	}
+
+	age := time.Since(*run.LastSuccessAt)
+	detail := fmt.Sprintf("last success %s ago (%s)", age.Round(time.Second), *run.LastSuccessMode)
+	if age > s.readinessCfg.SyncMaxAge {
+		return detail, fmt.Errorf("last successful sync is older than %s", s.readinessCfg.SyncMaxAge)
+	}
+	if run.LastError != nil {
+		detail += fmt.Sprintf("; %d failure(s) since: %s", run.ConsecutiveFailures, *run.LastError)
+	}
+	return detail, nil
+}
+
+func (s *Server) checkBitrix(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var resp struct {
+		Result string `json:"result"`
+	}
+	if err := s.bitrix.Call(ctx, "server.time", nil, &resp); err != nil {
+		return "", err
+	}
+	return "server.time " + resp.Result, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"freedom_bitrix/internal/auth"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyzReflectsLastSync(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	srv := New(store, nil, "deals_sync", WithReadiness(store, ReadinessConfig{SyncMaxAge: time.Hour}))
+	handler := srv.routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz without sync: status %d, want 503; body=%s", rec.Code, rec.Body)
+	}
+
+	// Other modes do not count as a deal sync.
+	if err := store.RecordSyncRun(context.Background(), "deals_sync", "resync", nil); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz after resync: status %d, want 503; body=%s", rec.Code, rec.Body)
+	}
+
+	if err := store.RecordSyncRun(context.Background(), "deals_sync", "delta", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("readyz after sync: status %d, want 200; body=%s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("healthz: status %d", rec.Code)
+	}
+}
+
+func TestReadyzHidesErrorsFromPublicCallers(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.RecordSyncRun(ctx, "deals_sync", "delta", nil); err != nil {
+		t.Fatal(err)
+	}
+	runErr := errors.New(`do request: Post "https://portal.bitrix24.kz/rest/7/tok123/crm.deal.list.json": i/o timeout`)
+	if err := store.RecordSyncRun(ctx, "deals_sync", "delta", runErr); err != nil {
+		t.Fatal(err)
+	}
+
+	adminKey, adminID, adminHash, _ := auth.GenerateKey()
+	keys := fakeKeyStore{adminID: {ID: adminID, KeyHash: adminHash, Scopes: []string{string(auth.ScopeSyncAdmin)}}}
+	handler := New(store, nil, "deals_sync", WithAuth(keys),
+		WithReadiness(store, ReadinessConfig{SyncMaxAge: time.Hour})).routes()
+
+	get := func(key string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d; body=%s", rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+
+	if body := get(""); strings.Contains(body, "tok123") || strings.Contains(body, "failure") {
+		t.Fatalf("public readyz exposes details: %s", body)
+	}
+	body := get(adminKey)
+	if !strings.Contains(body, "failure") || !strings.Contains(body, "/rest/7/***/") || strings.Contains(body, "tok123") {
+		t.Fatalf("admin readyz = %s", body)
+	}
+}
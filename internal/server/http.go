@@ -3,10 +3,16 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"freedom_bitrix/internal/auth"
 	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
 	"freedom_bitrix/internal/repo"
-	"log"
+	"log/slog"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,41 +25,128 @@ const (
 	ufSource1    = "UF_CRM_1699841388494"
 )
 
+type DealStore interface {
+	StreamDeals(ctx context.Context, q repo.DealQuery, fn func(repo.DealRow) error) error
+	ListDealRefs(ctx context.Context) (repo.DealRefs, error)
+	GetSyncStatus(ctx context.Context, key string) (repo.SyncStatus, error)
+	GetSheetsVersion(ctx context.Context, key string) (repo.SheetsVersion, error)
+}
+
+type DictionarySource interface {
+	Call(ctx context.Context, method string, payload any, out any) error
+}
+
 type Server struct {
-	repo         *repo.DealsRepository
-	bitrix       *bitrix.Client
+	repo         DealStore
+	bitrix       DictionarySource
 	syncStateKey string
 	mappingTTL   time.Duration
 	sheetsLoc    *time.Location
 
-	mu            sync.RWMutex
-	cachedMapping dealMappings
-	cacheUpdated  time.Time
+	keys         KeyStore
+	readiness    ReadinessStore
+	alerts       AlertStore
+	leads        LeadStore
+	fields       FieldStore
+	parseErrors  ParseErrorStore
+	quality      QualityStore
+	verifier     Verifier
+	readinessCfg ReadinessConfig
+
+	mu             sync.RWMutex
+	cachedMapping  dealMappings
+	cacheUpdated   time.Time
+	mappingVersion uint64
+
+	sheets   sheetsCache
+	profiles map[string]SheetProfile
+
+	verifying sync.Mutex
+}
+
+type Option func(*Server)
+
+// WithLocation sets the business timezone used for sheet dates and report
+// buckets (Asia/Almaty by default).
+func WithLocation(loc *time.Location) Option {
+	return func(s *Server) {
+		if loc != nil {
+			s.sheetsLoc = loc
+		}
+	}
 }
 
-func New(repository *repo.DealsRepository, bitrixClient *bitrix.Client, syncStateKey string) *Server {
+func New(repository DealStore, dictionary DictionarySource, syncStateKey string, opts ...Option) *Server {
 	loc, err := time.LoadLocation("Asia/Almaty")
 	if err != nil {
 		loc = time.FixedZone("UTC+5", 5*60*60)
 	}
 
-	return &Server{
+	s := &Server{
 		repo:          repository,
-		bitrix:        bitrixClient,
+		bitrix:        dictionary,
 		syncStateKey:  strings.TrimSpace(syncStateKey),
 		mappingTTL:    10 * time.Minute,
 		sheetsLoc:     loc,
 		cachedMapping: newDealMappings(),
+		profiles:      map[string]SheetProfile{defaultProfileName: defaultSheetProfile()},
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
-func (s *Server) Start(addr string) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/deals/sheets", s.handleDealsSheets)
-	mux.HandleFunc("/health/sync", s.handleSyncHealth)
+func (s *Server) Run(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("HTTP server listening", "addr", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
 
-	log.Printf("HTTP server on %s", addr)
-	return http.ListenAndServe(addr, mux)
+	slog.Info("HTTP server shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 20*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("http shutdown: %w", err)
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deals/sheets", s.route("/deals/sheets", auth.ScopeSheetsRead, s.handleDealsSheets))
+	mux.HandleFunc("GET /sheets/{profile}", s.route("/sheets/{profile}", auth.ScopeSheetsRead, s.handleProfileSheets))
+	mux.HandleFunc("GET /reports/managers", s.route("/reports/managers", auth.ScopeReportsRead, s.handleManagersReport))
+	mux.HandleFunc("GET /reports/attribution", s.route("/reports/attribution", auth.ScopeReportsRead, s.handleAttributionReport))
+	mux.HandleFunc("GET /reports/revenue", s.route("/reports/revenue", auth.ScopeReportsRead, s.handleRevenueReport))
+	mux.HandleFunc("GET /reports/leads", s.route("/reports/leads", auth.ScopeReportsRead, s.handleLeadConversionReport))
+	mux.HandleFunc("GET /alerts/sla", s.route("/alerts/sla", auth.ScopeReportsRead, s.handleSLAAlerts))
+	mux.HandleFunc("GET /quality/violations", s.route("/quality/violations", auth.ScopeReportsRead, s.handleQualityViolations))
+	mux.HandleFunc("GET /fields", s.route("/fields", auth.ScopeSyncAdmin, s.handleFields))
+	mux.HandleFunc("GET /fields/changes", s.route("/fields/changes", auth.ScopeSyncAdmin, s.handleFieldChanges))
+	mux.HandleFunc("GET /deals/parse-errors", s.route("/deals/parse-errors", auth.ScopeSyncAdmin, s.handleParseErrors))
+	mux.HandleFunc("POST /deals/verify", s.route("/deals/verify", auth.ScopeSyncAdmin, s.handleVerify))
+	mux.HandleFunc("/health/sync", s.route("/health/sync", "", s.handleSyncHealth))
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.route("/readyz", "", s.handleReadyz))
+	mux.HandleFunc("/metrics", s.route("/metrics", auth.ScopeSyncAdmin, metrics.Handler().ServeHTTP))
+	return mux
 }
 
 type syncHealthResponse struct {
@@ -110,110 +203,44 @@ func (s *Server) handleSyncHealth(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-type dealsSheetsResponse struct {
-	Headers []string `json:"headers"`
-	Rows    [][]any  `json:"rows"`
-}
-
-func (s *Server) handleDealsSheets(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	result, err := s.repo.ListDeals(ctx)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	maps := s.loadMappings(ctx, result)
-
-	headers := []string{
-		"Воронка",
-		"Стадия сделки",
-		"Ответственный",
-		"Источник",
-		"Дата создания",
-		"UTM Source",
-		"Тип сотрудничества",
-		"UTM Campaign",
-		"Тип клиента",
-		"Собеседование проведено (дата когда фактически кандидат пришел)",
-		"Источник1",
-		"Дата КОГДА назначено собеседование",
-		"Дата КОГДА назначена встреча",
-		"Дата/ время КОГДА прошла встреча",
-		"Вторичный собес УЦ",
-		"ID",
-	}
-
-	rows := make([][]any, 0, len(result))
-	for _, d := range result {
-		row := []any{
-			mapInt(maps.categoryNames, d.CategoryID),
-			mapString(maps.stageNames, d.StageID),
-			mapInt64(maps.assignedNames, d.AssignedByID),
-			mapString(maps.sourceNames, d.SourceID),
-			toSheetsDateTimeSerialInLocation(d.DateCreate, s.sheetsLoc),
-			strOrEmpty(d.UTMSource),
-			mapNullableString(maps.coopTypeNames, d.CoopType),
-			strOrEmpty(d.UTMCampaign),
-			mapNullableString(maps.clientTypeNames, d.ClientType),
-			toSheetsDateSerialPtr(d.UFCRM1650279712660Date),
-			mapNullableEnumStrict(maps.source1Names, d.UFCRM1699841388494),
-			toSheetsDateSerialPtr(d.UFCRM1699863367472Date),
-			toSheetsDateSerialPtr(d.UFCRM1752578793696Date),
-			toSheetsDateTimeSerialPtrInLocation(d.UFCRM1753169789836At, s.sheetsLoc),
-			toSheetsDateSerialPtr(d.UFCRM1771313479555Date),
-			d.ID,
-		}
-		rows = append(rows, row)
-	}
-
-	resp := dealsSheetsResponse{
-		Headers: headers,
-		Rows:    rows,
-	}
-
-	// Force clients (including Sheets bridges) to fetch fresh data every time.
-	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
 type dealMappings struct {
 	categoryNames   map[int]string
 	stageNames      map[string]string
+	stageSemantics  map[string]string
 	assignedNames   map[int64]string
 	sourceNames     map[string]string
 	coopTypeNames   map[string]string
 	clientTypeNames map[string]string
 	source1Names    map[string]string
+	leadStatusNames map[string]string
+	leadSemantics   map[string]string
 }
 
-func (s *Server) loadMappings(ctx context.Context, deals []repo.DealRow) dealMappings {
+func (s *Server) loadMappings(ctx context.Context, refs repo.DealRefs) dealMappings {
 	if s.bitrix == nil {
 		return newDealMappings()
 	}
 
 	m, updatedAt := s.getCachedMappings()
-	catIDs, userIDs := collectIDs(deals)
+	catIDs, userIDs := collectIDs(refs)
 	stale := updatedAt.IsZero() || time.Since(updatedAt) > s.mappingTTL
+	cacheResult := "hit"
+	if stale {
+		cacheResult = "refresh"
+	}
 
 	if stale {
 		if cats, err := s.fetchCategoryNames(ctx, catIDs); err != nil {
-			log.Printf("mapping category names: %v", err)
+			logging.FromContext(ctx).Warn("mapping category names", "err", err)
 		} else {
 			m.categoryNames = cats
 		}
 	} else {
 		missingCats := missingCategoryIDs(m.categoryNames, catIDs)
 		if len(missingCats) > 0 {
+			cacheResult = "partial"
 			if cats, err := s.fetchCategoryNames(ctx, missingCats); err != nil {
-				log.Printf("mapping missing category names: %v", err)
+				logging.FromContext(ctx).Warn("mapping missing category names", "err", err)
 			} else {
 				for id, name := range cats {
 					m.categoryNames[id] = name
@@ -223,26 +250,30 @@ func (s *Server) loadMappings(ctx context.Context, deals []repo.DealRow) dealMap
 	}
 
 	if stale || len(m.stageNames) == 0 || len(m.sourceNames) == 0 {
-		if stages, sources, source1FromStatus, err := s.fetchStatusMaps(ctx); err != nil {
-			log.Printf("mapping status/source names: %v", err)
+		if st, err := s.fetchStatusMaps(ctx); err != nil {
+			logging.FromContext(ctx).Warn("mapping status/source names", "err", err)
 		} else {
-			m.stageNames = stages
-			m.sourceNames = sources
-			m.source1Names = source1FromStatus
+			m.stageNames = st.stages
+			m.stageSemantics = st.stageSemantics
+			m.sourceNames = st.sources
+			m.source1Names = st.source1
+			m.leadStatusNames = st.leadStatuses
+			m.leadSemantics = st.leadSemantics
 		}
 	}
 
 	if stale {
 		if users, err := s.fetchAssignedNames(ctx, userIDs); err != nil {
-			log.Printf("mapping assigned names: %v", err)
+			logging.FromContext(ctx).Warn("mapping assigned names", "err", err)
 		} else {
 			m.assignedNames = users
 		}
 	} else {
 		missingUsers := missingUserIDs(m.assignedNames, userIDs)
 		if len(missingUsers) > 0 {
+			cacheResult = "partial"
 			if users, err := s.fetchAssignedNames(ctx, missingUsers); err != nil {
-				log.Printf("mapping missing assigned names: %v", err)
+				logging.FromContext(ctx).Warn("mapping missing assigned names", "err", err)
 			} else {
 				for id, name := range users {
 					m.assignedNames[id] = name
@@ -253,7 +284,7 @@ func (s *Server) loadMappings(ctx context.Context, deals []repo.DealRow) dealMap
 
 	if stale || len(m.coopTypeNames) == 0 {
 		if coop, err := s.fetchDealUserFieldEnum(ctx, ufCoopType); err != nil {
-			log.Printf("mapping coop type names: %v", err)
+			logging.FromContext(ctx).Warn("mapping coop type names", "err", err)
 		} else {
 			m.coopTypeNames = coop
 		}
@@ -261,7 +292,7 @@ func (s *Server) loadMappings(ctx context.Context, deals []repo.DealRow) dealMap
 
 	if stale || len(m.clientTypeNames) == 0 {
 		if clients, err := s.fetchDealUserFieldEnum(ctx, ufClientType); err != nil {
-			log.Printf("mapping client type names: %v", err)
+			logging.FromContext(ctx).Warn("mapping client type names", "err", err)
 		} else {
 			m.clientTypeNames = clients
 		}
@@ -269,12 +300,13 @@ func (s *Server) loadMappings(ctx context.Context, deals []repo.DealRow) dealMap
 
 	if stale || len(m.source1Names) == 0 {
 		if source1, err := s.fetchDealUserFieldEnum(ctx, ufSource1); err != nil {
-			log.Printf("mapping source1 names: %v", err)
+			logging.FromContext(ctx).Warn("mapping source1 names", "err", err)
 		} else if len(source1) > 0 {
 			m.source1Names = source1
 		}
 	}
 
+	metrics.MappingCache.WithLabelValues(cacheResult).Inc()
 	s.setCachedMappings(m)
 	return m
 }
@@ -283,11 +315,14 @@ func newDealMappings() dealMappings {
 	return dealMappings{
 		categoryNames:   map[int]string{},
 		stageNames:      map[string]string{},
+		stageSemantics:  map[string]string{},
 		assignedNames:   map[int64]string{},
 		sourceNames:     map[string]string{},
 		coopTypeNames:   map[string]string{},
 		clientTypeNames: map[string]string{},
 		source1Names:    map[string]string{},
+		leadStatusNames: map[string]string{},
+		leadSemantics:   map[string]string{},
 	}
 }
 
@@ -300,10 +335,28 @@ func (s *Server) getCachedMappings() (dealMappings, time.Time) {
 func (s *Server) setCachedMappings(m dealMappings) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if !reflect.DeepEqual(s.cachedMapping, m) {
+		s.mappingVersion++
+	}
 	s.cachedMapping = cloneDealMappings(m)
 	s.cacheUpdated = time.Now()
 }
 
+func (s *Server) mappingsStale() bool {
+	if s.bitrix == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cacheUpdated.IsZero() || time.Since(s.cacheUpdated) > s.mappingTTL
+}
+
+func (s *Server) currentMappingVersion() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mappingVersion
+}
+
 func cloneDealMappings(src dealMappings) dealMappings {
 	dst := newDealMappings()
 	for k, v := range src.categoryNames {
@@ -312,6 +365,9 @@ func cloneDealMappings(src dealMappings) dealMappings {
 	for k, v := range src.stageNames {
 		dst.stageNames[k] = v
 	}
+	for k, v := range src.stageSemantics {
+		dst.stageSemantics[k] = v
+	}
 	for k, v := range src.assignedNames {
 		dst.assignedNames[k] = v
 	}
@@ -327,6 +383,12 @@ func cloneDealMappings(src dealMappings) dealMappings {
 	for k, v := range src.source1Names {
 		dst.source1Names[k] = v
 	}
+	for k, v := range src.leadStatusNames {
+		dst.leadStatusNames[k] = v
+	}
+	for k, v := range src.leadSemantics {
+		dst.leadSemantics[k] = v
+	}
 	return dst
 }
 
@@ -358,23 +420,15 @@ func missingUserIDs(existing map[int64]string, ids []string) []string {
 	return missing
 }
 
-func collectIDs(deals []repo.DealRow) (categoryIDs []string, userIDs []string) {
-	cats := make(map[string]struct{})
-	users := make(map[string]struct{})
-
-	for _, d := range deals {
-		cats[strconv.Itoa(d.CategoryID)] = struct{}{}
-		users[strconv.FormatInt(d.AssignedByID, 10)] = struct{}{}
-	}
-
-	categoryIDs = make([]string, 0, len(cats))
-	for id := range cats {
-		categoryIDs = append(categoryIDs, id)
+func collectIDs(refs repo.DealRefs) (categoryIDs []string, userIDs []string) {
+	categoryIDs = make([]string, 0, len(refs.CategoryIDs))
+	for _, id := range refs.CategoryIDs {
+		categoryIDs = append(categoryIDs, strconv.Itoa(id))
 	}
 
-	userIDs = make([]string, 0, len(users))
-	for id := range users {
-		userIDs = append(userIDs, id)
+	userIDs = make([]string, 0, len(refs.UserIDs))
+	for _, id := range refs.UserIDs {
+		userIDs = append(userIDs, strconv.FormatInt(id, 10))
 	}
 
 	return categoryIDs, userIDs
@@ -402,15 +456,31 @@ func (s *Server) fetchCategoryNames(ctx context.Context, ids []string) (map[int]
 	return out, nil
 }
 
-func (s *Server) fetchStatusMaps(ctx context.Context) (map[string]string, map[string]string, map[string]string, error) {
+// statusMaps holds the crm.status.list entities the server maps: deal stages
+// (all pipelines), sources, Источник1 and lead statuses (STATUS).
+type statusMaps struct {
+	stages         map[string]string
+	stageSemantics map[string]string
+	sources        map[string]string
+	source1        map[string]string
+	leadStatuses   map[string]string
+	leadSemantics  map[string]string
+}
+
+func (s *Server) fetchStatusMaps(ctx context.Context) (statusMaps, error) {
 	var resp bitrix.ListResponse[bitrix.Status]
 	if err := s.bitrix.Call(ctx, "crm.status.list", map[string]any{}, &resp); err != nil {
-		return nil, nil, nil, err
+		return statusMaps{}, err
 	}
 
-	stages := make(map[string]string)
-	sources := make(map[string]string)
-	source1 := make(map[string]string)
+	out := statusMaps{
+		stages:         make(map[string]string),
+		stageSemantics: make(map[string]string),
+		sources:        make(map[string]string),
+		source1:        make(map[string]string),
+		leadStatuses:   make(map[string]string),
+		leadSemantics:  make(map[string]string),
+	}
 
 	for _, st := range resp.Result {
 		e := strings.ToUpper(strings.TrimSpace(st.EntityID))
@@ -421,15 +491,23 @@ func (s *Server) fetchStatusMaps(ctx context.Context) (map[string]string, map[st
 
 		switch {
 		case strings.HasPrefix(e, "DEAL_STAGE"):
-			stages[sid] = st.Name
+			out.stages[sid] = st.Name
+			if st.Extra.Semantics != "" {
+				out.stageSemantics[sid] = strings.ToLower(st.Extra.Semantics)
+			}
+		case e == "STATUS":
+			out.leadStatuses[sid] = st.Name
+			if st.Extra.Semantics != "" {
+				out.leadSemantics[sid] = strings.ToLower(st.Extra.Semantics)
+			}
 		case e == "SOURCE":
-			sources[sid] = st.Name
+			out.sources[sid] = st.Name
 		case e == "SOURCE1", e == "SOURCE_1":
-			source1[sid] = st.Name
+			out.source1[sid] = st.Name
 		}
 	}
 
-	return stages, sources, source1, nil
+	return out, nil
 }
 
 func (s *Server) fetchAssignedNames(ctx context.Context, ids []string) (map[int64]string, error) {
@@ -505,26 +583,43 @@ func mapString(m map[string]string, v string) string {
 	return v
 }
 
-func mapNullableString(m map[string]string, v *string) string {
-	if v == nil {
-		return ""
+// ufValues returns the values of a user field; rows stored before the
+// multi-value column existed fall back to the single-value column.
+func ufValues(d repo.DealRow, code string, single *string) []string {
+	if v, ok := d.UserFields[code]; ok {
+		return v
 	}
-	normalized := strings.TrimSpace(*v)
-	return mapString(m, normalized)
+	if single == nil || strings.TrimSpace(*single) == "" {
+		return nil
+	}
+	return []string{*single}
 }
 
-func mapNullableEnumStrict(m map[string]string, v *string) string {
-	if v == nil {
-		return ""
-	}
-	normalized := strings.TrimSpace(*v)
-	if normalized == "" {
-		return ""
+func joinValues(values []string) string {
+	return strings.Join(values, ", ")
+}
+
+// mapStringValues maps every value like mapString and joins the labels.
+func mapStringValues(m map[string]string, values []string) string {
+	labels := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			labels = append(labels, mapString(m, v))
+		}
 	}
-	if s, ok := m[normalized]; ok {
-		return s
+	return joinValues(labels)
+}
+
+// mapEnumValuesStrict maps every value to its enum label, leaving out unknown
+// IDs, and joins the labels.
+func mapEnumValuesStrict(m map[string]string, values []string) string {
+	labels := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := m[strings.TrimSpace(v)]; ok {
+			labels = append(labels, s)
+		}
 	}
-	return ""
+	return joinValues(labels)
 }
 
 func strOrEmpty(v *string) string {
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type LeadStore interface {
+	StreamLeads(ctx context.Context, f repo.LeadFilter, fn func(repo.LeadRow) error) error
+}
+
+func WithLeads(store LeadStore) Option {
+	return func(s *Server) {
+		s.leads = store
+	}
+}
+
+var leadDimensions = map[string]func(m dealMappings, l repo.LeadRow) string{
+	"source":       func(m dealMappings, l repo.LeadRow) string { return mapString(m.sourceNames, l.SourceID) },
+	"utm_source":   func(m dealMappings, l repo.LeadRow) string { return strOrEmpty(l.UTMSource) },
+	"utm_campaign": func(m dealMappings, l repo.LeadRow) string { return strOrEmpty(l.UTMCampaign) },
+	"status":       func(m dealMappings, l repo.LeadRow) string { return mapString(m.leadStatusNames, l.StatusID) },
+}
+
+// leadGroup classifies a lead by STATUS_SEMANTIC_ID, falling back to the
+// semantics of its status from crm.status.list and to the CONVERTED / JUNK ids.
+func leadGroup(maps dealMappings, l repo.LeadRow) string {
+	sem := strings.ToLower(l.StatusSemanticID)
+	if sem == "" {
+		sem = maps.leadSemantics[l.StatusID]
+	}
+	switch sem {
+	case "s", "success":
+		return stageWon
+	case "f", "failure":
+		return stageLost
+	case "p", "process":
+		return stageInProgress
+	}
+	switch strings.ToUpper(l.StatusID) {
+	case "CONVERTED":
+		return stageWon
+	case "JUNK":
+		return stageLost
+	default:
+		return stageInProgress
+	}
+}
+
+type leadConversionRow struct {
+	Bucket         string            `json:"bucket,omitempty"`
+	Dimensions     map[string]string `json:"dimensions"`
+	Leads          int               `json:"leads"`
+	InWork         int               `json:"in_work"`
+	Converted      int               `json:"converted"`
+	Junk           int               `json:"junk"`
+	WithDeal       int               `json:"with_deal"`
+	Deals          int               `json:"deals"`
+	WonDeals       int               `json:"won_deals"`
+	ConversionRate float64           `json:"conversion_rate"`
+	WonRate        float64           `json:"won_rate"`
+
+	key string
+}
+
+type leadConversionReport struct {
+	reportWindowJSON
+	GroupBy []string             `json:"group_by"`
+	Bucket  string               `json:"bucket"`
+	Rows    []*leadConversionRow `json:"rows"`
+	Totals  *leadConversionRow   `json:"totals"`
+}
+
+func (row *leadConversionRow) add(maps dealMappings, l repo.LeadRow) {
+	row.Leads++
+	switch leadGroup(maps, l) {
+	case stageWon:
+		row.Converted++
+	case stageLost:
+		row.Junk++
+	default:
+		row.InWork++
+	}
+	if len(l.DealIDs) > 0 {
+		row.WithDeal++
+	}
+	row.Deals += len(l.DealIDs)
+	for _, stageID := range l.DealStageIDs {
+		if stageGroup(maps, stageID) == stageWon {
+			row.WonDeals++
+		}
+	}
+}
+
+func (row *leadConversionRow) finish() {
+	if row.Leads == 0 {
+		return
+	}
+	n := float64(row.Leads)
+	row.ConversionRate = float64(row.WithDeal) / n
+	row.WonRate = float64(row.WonDeals) / n
+}
+
+// handleLeadConversionReport groups leads created in the window by source and
+// UTM; a lead counts as converted to a deal when a deal carries its LEAD_ID.
+func (s *Server) handleLeadConversionReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.leads == nil {
+		http.Error(w, "lead reports are not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	window, err := s.parseReportWindow(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := []string{"source"}
+	if v := q["group_by"]; len(v) > 0 {
+		groupBy = splitList(v)
+	}
+	for _, dim := range groupBy {
+		if _, ok := leadDimensions[dim]; !ok {
+			http.Error(w, fmt.Sprintf("group_by: unknown dimension %q (use: source, utm_source, utm_campaign, status)", dim), http.StatusBadRequest)
+			return
+		}
+	}
+	bucket := strings.ToLower(strings.TrimSpace(q.Get("bucket")))
+	switch bucket {
+	case "":
+		bucket = "none"
+	case "none", "week", "month":
+	default:
+		http.Error(w, "bucket must be none, week or month", http.StatusBadRequest)
+		return
+	}
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maps := s.loadMappings(ctx, refs)
+
+	rows := make(map[string]*leadConversionRow)
+	totals := &leadConversionRow{Dimensions: map[string]string{}}
+	filter := repo.LeadFilter{DateCreateFrom: window.From, DateCreateTo: window.To}
+	err = s.leads.StreamLeads(ctx, filter, func(l repo.LeadRow) error {
+		row := &leadConversionRow{Bucket: s.bucketOf(l.DateCreate, bucket), Dimensions: make(map[string]string, len(groupBy))}
+		var key strings.Builder
+		key.WriteString(row.Bucket)
+		for _, dim := range groupBy {
+			v := leadDimensions[dim](maps, l)
+			row.Dimensions[dim] = v
+			key.WriteString("\x00" + v)
+		}
+		row.key = key.String()
+
+		if existing, ok := rows[row.key]; ok {
+			row = existing
+		} else {
+			rows[row.key] = row
+		}
+		row.add(maps, l)
+		totals.add(maps, l)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	window.CategoryIDs = nil
+	resp := leadConversionReport{reportWindowJSON: window.echo(), GroupBy: groupBy, Bucket: bucket, Rows: make([]*leadConversionRow, 0, len(rows)), Totals: totals}
+	for _, row := range rows {
+		row.finish()
+		resp.Rows = append(resp.Rows, row)
+	}
+	totals.finish()
+	slices.SortFunc(resp.Rows, func(a, b *leadConversionRow) int {
+		if c := cmp.Compare(a.Bucket, b.Bucket); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.Leads, a.Leads); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.key, b.key)
+	})
+
+	writeJSON(w, resp)
+}
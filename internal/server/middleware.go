@@ -0,0 +1,90 @@
+package server
+
+import (
+	"freedom_bitrix/internal/auth"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestInfo struct {
+	keyID string
+}
+
+func (s *Server) route(name string, scope auth.Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+
+		reqID := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if reqID == "" || len(reqID) > 64 {
+			reqID = logging.NewID()
+		}
+		ctx, logger := logging.With(r.Context(), "request_id", reqID)
+		w.Header().Set(requestIDHeader, reqID)
+		r = r.WithContext(ctx)
+
+		info := &requestInfo{}
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r)}
+		rec := &statusRecorder{ResponseWriter: cw, status: http.StatusOK}
+
+		// A handler that panics, including one that aborts a streamed
+		// response with http.ErrAbortHandler, is still closed, counted and
+		// logged, as a 500; the panic then goes on to net/http, which drops
+		// the connection.
+		defer func() {
+			p := recover()
+			if err := cw.Close(); err != nil {
+				logger.Warn("close response encoder", "err", err)
+			}
+
+			status := rec.status
+			level := slog.LevelInfo
+			if p != nil {
+				status = http.StatusInternalServerError
+				level = slog.LevelError
+			}
+			elapsed := time.Since(started)
+			metrics.ObserveHTTP(name, status, elapsed)
+			logger.Log(ctx, level, "http request",
+				"method", r.Method, "route", name, "path", r.URL.Path,
+				"status", status, "bytes", rec.bytes, "duration_ms", elapsed.Milliseconds(),
+				"key_id", info.keyID, "remote", r.RemoteAddr)
+			if p != nil {
+				panic(p)
+			}
+		}()
+
+		if s.authorize(rec, r, scope, info) {
+			if info.keyID != "" {
+				r = r.WithContext(logging.WithLogger(ctx, logger.With("key_id", info.keyID)))
+			}
+			h(rec, r)
+		}
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type ParseErrorStore interface {
+	ListParseErrors(ctx context.Context, field string, limit int) ([]repo.ParseError, error)
+}
+
+func WithParseErrors(store ParseErrorStore) Option {
+	return func(s *Server) {
+		s.parseErrors = store
+	}
+}
+
+const (
+	defaultParseErrorsLimit = 200
+	maxParseErrorsLimit     = 1000
+)
+
+type parseErrorsResponse struct {
+	Errors []repo.ParseError `json:"errors"`
+}
+
+// handleParseErrors returns the deal field values that failed to parse on
+// the last sync of their deal, newest first, optionally for one field.
+func (s *Server) handleParseErrors(w http.ResponseWriter, r *http.Request) {
+	if s.parseErrors == nil {
+		http.Error(w, "parse errors are not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultParseErrorsLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxParseErrorsLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	errs, err := s.parseErrors.ListParseErrors(r.Context(), strings.ToUpper(strings.TrimSpace(q.Get("field"))), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if errs == nil {
+		errs = []repo.ParseError{}
+	}
+	writeJSON(w, parseErrorsResponse{Errors: errs})
+}
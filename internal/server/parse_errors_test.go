@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseErrorsUsePortalTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Almaty")
+	if err != nil {
+		t.Skip(err)
+	}
+	ctx := context.Background()
+	store := repo.NewMemoryRepository(repo.WithLocation(loc))
+	err = store.UpsertDeals(ctx, []bitrix.Deal{{
+		ID: "1", DateCreate: "2026-02-01 09:00:00", CloseDate: "03.02.2026",
+		UFCRM1650279712660: bitrix.Value{"31.02.2026"}, UFCRM1753169789836: bitrix.Value{"04.02.2026 18:30"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var row repo.DealRow
+	if err := store.StreamDeals(ctx, repo.DealQuery{}, func(d repo.DealRow) error {
+		row = d
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 2, 1, 4, 0, 0, 0, time.UTC); !row.DateCreate.Equal(want) {
+		t.Fatalf("date_create = %s, want %s", row.DateCreate, want)
+	}
+	if row.CloseDate == nil || row.CloseDate.Format(time.DateOnly) != "2026-02-03" {
+		t.Fatalf("close_date = %v", row.CloseDate)
+	}
+	if want := time.Date(2026, 2, 4, 13, 30, 0, 0, time.UTC); row.UFCRM1753169789836At == nil || !row.UFCRM1753169789836At.Equal(want) {
+		t.Fatalf("meeting at = %v, want %s", row.UFCRM1753169789836At, want)
+	}
+	if row.UFCRM1650279712660Date != nil {
+		t.Fatalf("invalid date stored as %v", row.UFCRM1650279712660Date)
+	}
+
+	handler := New(store, nil, "deals_sync", WithParseErrors(store)).routes()
+	list := func() []repo.ParseError {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/deals/parse-errors?field=uf_crm_1650279712660", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp parseErrorsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Errors
+	}
+	if errs := list(); len(errs) != 1 || errs[0].DealID != 1 || errs[0].Value != "31.02.2026" {
+		t.Fatalf("errors = %+v", errs)
+	}
+
+	// A fixed value clears the error on the next sync.
+	if err := store.UpsertDeals(ctx, []bitrix.Deal{{ID: "1", DateCreate: "2026-02-01 09:00:00", UFCRM1650279712660: bitrix.Value{"28.02.2026"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if errs := list(); len(errs) != 0 {
+		t.Fatalf("errors after fix = %+v", errs)
+	}
+}
@@ -0,0 +1,547 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/repo"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const defaultProfileName = "default"
+
+const (
+	formatName   = "name"
+	formatRaw    = "raw"
+	formatSerial = "serial"
+	formatISO    = "iso"
+)
+
+type SheetProfile struct {
+	Name    string          `json:"name"`
+	Columns []ProfileColumn `json:"columns"`
+	Filters ProfileFilters  `json:"filters"`
+	Sort    []repo.DealSort `json:"sort"`
+	// HeaderLabels ("ru" or "en") takes the headers of columns without an
+	// own label from the Bitrix field catalog.
+	HeaderLabels string `json:"header_labels,omitempty"`
+}
+
+type ProfileColumn struct {
+	Field  string `json:"field"`
+	Label  string `json:"label,omitempty"`
+	Format string `json:"format,omitempty"`
+
+	customLabel bool
+}
+
+type ProfileFilters struct {
+	CategoryIDs    []int    `json:"category_ids,omitempty"`
+	StageIDs       []string `json:"stage_ids,omitempty"`
+	AssignedByIDs  []int64  `json:"assigned_by_ids,omitempty"`
+	DateCreateFrom string   `json:"date_create_from,omitempty"`
+	DateCreateTo   string   `json:"date_create_to,omitempty"`
+	// WithQualityViolations keeps only deals failing data quality rules.
+	WithQualityViolations bool `json:"with_quality_violations,omitempty"`
+}
+
+type columnKind int
+
+const (
+	kindText columnKind = iota
+	kindMapped
+	kindDate
+	kindDateTime
+)
+
+type columnDef struct {
+	label string
+	// code is the crm.deal.fields name the column is stored from.
+	code  string
+	kind  columnKind
+	raw   func(d repo.DealRow) any
+	named func(m dealMappings, d repo.DealRow) any
+	time  func(d repo.DealRow) *time.Time
+	// activities and violations mark columns read from the per-deal
+	// aggregates, which StreamDeals joins only on request.
+	activities bool
+	violations bool
+}
+
+// dealColumns is the catalog of fields a profile may select, keyed by the
+// bitrix_deals column name; contact_* and company_* come from joined tables.
+var dealColumns = map[string]columnDef{
+	"category_id": {
+		label: "Воронка", code: "CATEGORY_ID", kind: kindMapped,
+		raw:   func(d repo.DealRow) any { return d.CategoryID },
+		named: func(m dealMappings, d repo.DealRow) any { return mapInt(m.categoryNames, d.CategoryID) },
+	},
+	"stage_id": {
+		label: "Стадия сделки", code: "STAGE_ID", kind: kindMapped,
+		raw:   func(d repo.DealRow) any { return d.StageID },
+		named: func(m dealMappings, d repo.DealRow) any { return mapString(m.stageNames, d.StageID) },
+	},
+	"assigned_by_id": {
+		label: "Ответственный", code: "ASSIGNED_BY_ID", kind: kindMapped,
+		raw:   func(d repo.DealRow) any { return d.AssignedByID },
+		named: func(m dealMappings, d repo.DealRow) any { return mapInt64(m.assignedNames, d.AssignedByID) },
+	},
+	"source_id": {
+		label: "Источник", code: "SOURCE_ID", kind: kindMapped,
+		raw:   func(d repo.DealRow) any { return d.SourceID },
+		named: func(m dealMappings, d repo.DealRow) any { return mapString(m.sourceNames, d.SourceID) },
+	},
+	"date_create": {
+		label: "Дата создания", code: "DATE_CREATE", kind: kindDateTime,
+		time: func(d repo.DealRow) *time.Time { return &d.DateCreate },
+	},
+	"utm_source": {
+		label: "UTM Source", code: "UTM_SOURCE", kind: kindText,
+		raw: func(d repo.DealRow) any { return strOrEmpty(d.UTMSource) },
+	},
+	"uf_coop_type": {
+		label: "Тип сотрудничества", code: "UF_CRM_1740477560309", kind: kindMapped,
+		raw: func(d repo.DealRow) any { return joinValues(ufValues(d, ufCoopType, d.CoopType)) },
+		named: func(m dealMappings, d repo.DealRow) any {
+			return mapStringValues(m.coopTypeNames, ufValues(d, ufCoopType, d.CoopType))
+		},
+	},
+	"utm_campaign": {
+		label: "UTM Campaign", code: "UTM_CAMPAIGN", kind: kindText,
+		raw: func(d repo.DealRow) any { return strOrEmpty(d.UTMCampaign) },
+	},
+	"uf_client_type": {
+		label: "Тип клиента", code: "UF_CRM_1647265424537", kind: kindMapped,
+		raw: func(d repo.DealRow) any { return joinValues(ufValues(d, ufClientType, d.ClientType)) },
+		named: func(m dealMappings, d repo.DealRow) any {
+			return mapStringValues(m.clientTypeNames, ufValues(d, ufClientType, d.ClientType))
+		},
+	},
+	"uf_crm_1650279712660_date": {
+		label: "Собеседование проведено (дата когда фактически кандидат пришел)", code: "UF_CRM_1650279712660", kind: kindDate,
+		time: func(d repo.DealRow) *time.Time { return d.UFCRM1650279712660Date },
+	},
+	"uf_crm_1699841388494": {
+		label: "Источник1", code: "UF_CRM_1699841388494", kind: kindMapped,
+		raw: func(d repo.DealRow) any { return joinValues(ufValues(d, ufSource1, d.UFCRM1699841388494)) },
+		named: func(m dealMappings, d repo.DealRow) any {
+			return mapEnumValuesStrict(m.source1Names, ufValues(d, ufSource1, d.UFCRM1699841388494))
+		},
+	},
+	"uf_crm_1699863367472_date": {
+		label: "Дата КОГДА назначено собеседование", code: "UF_CRM_1699863367472", kind: kindDate,
+		time: func(d repo.DealRow) *time.Time { return d.UFCRM1699863367472Date },
+	},
+	"uf_crm_1752578793696_date": {
+		label: "Дата КОГДА назначена встреча", code: "UF_CRM_1752578793696", kind: kindDate,
+		time: func(d repo.DealRow) *time.Time { return d.UFCRM1752578793696Date },
+	},
+	"uf_crm_1753169789836_at": {
+		label: "Дата/ время КОГДА прошла встреча", code: "UF_CRM_1753169789836", kind: kindDateTime,
+		time: func(d repo.DealRow) *time.Time { return d.UFCRM1753169789836At },
+	},
+	"uf_crm_1771313479555_date": {
+		label: "Вторичный собес УЦ", code: "UF_CRM_1771313479555", kind: kindDate,
+		time: func(d repo.DealRow) *time.Time { return d.UFCRM1771313479555Date },
+	},
+	"id": {
+		label: "ID", code: "ID", kind: kindText,
+		raw: func(d repo.DealRow) any { return d.ID },
+	},
+	"contact_id": {
+		label: "ID контакта", code: "CONTACT_ID", kind: kindText,
+		raw: func(d repo.DealRow) any { return int64OrEmpty(d.ContactID) },
+	},
+	"contact_name": {
+		label: "Контакт", kind: kindText,
+		raw: func(d repo.DealRow) any { return strOrEmpty(d.ContactName) },
+	},
+	"contact_phone": {
+		label: "Телефон контакта", kind: kindText,
+		raw: func(d repo.DealRow) any { return strOrEmpty(d.ContactPhone) },
+	},
+	"company_id": {
+		label: "ID компании", code: "COMPANY_ID", kind: kindText,
+		raw: func(d repo.DealRow) any { return int64OrEmpty(d.CompanyID) },
+	},
+	"company_title": {
+		label: "Компания", kind: kindText,
+		raw: func(d repo.DealRow) any { return strOrEmpty(d.CompanyTitle) },
+	},
+	"opportunity": {
+		label: "Сумма", code: "OPPORTUNITY", kind: kindText,
+		raw: func(d repo.DealRow) any { return decimalOrEmpty(d.Opportunity) },
+	},
+	"currency_id": {
+		label: "Валюта", code: "CURRENCY_ID", kind: kindText,
+		raw: func(d repo.DealRow) any { return strOrEmpty(d.CurrencyID) },
+	},
+	"closed": {
+		label: "Сделка закрыта", code: "CLOSED", kind: kindText,
+		raw: func(d repo.DealRow) any {
+			if d.Closed == nil {
+				return ""
+			}
+			return *d.Closed
+		},
+	},
+	"close_date": {
+		label: "Дата закрытия", code: "CLOSEDATE", kind: kindDate,
+		time: func(d repo.DealRow) *time.Time { return d.CloseDate },
+	},
+	"begin_date": {
+		label: "Дата начала", code: "BEGINDATE", kind: kindDate,
+		time: func(d repo.DealRow) *time.Time { return d.BeginDate },
+	},
+	"activity_count": {
+		label: "Дел всего", kind: kindText, activities: true,
+		raw: func(d repo.DealRow) any { return d.ActivityCount },
+	},
+	"call_count": {
+		label: "Звонков", kind: kindText, activities: true,
+		raw: func(d repo.DealRow) any { return d.CallCount },
+	},
+	"email_count": {
+		label: "Писем", kind: kindText, activities: true,
+		raw: func(d repo.DealRow) any { return d.EmailCount },
+	},
+	"task_count": {
+		label: "Задач", kind: kindText, activities: true,
+		raw: func(d repo.DealRow) any { return d.TaskCount },
+	},
+	"first_activity_at": {
+		label: "Первое дело", kind: kindDateTime, activities: true,
+		time: func(d repo.DealRow) *time.Time { return d.FirstActivityAt },
+	},
+	"last_activity_at": {
+		label: "Последнее дело", kind: kindDateTime, activities: true,
+		time: func(d repo.DealRow) *time.Time { return d.LastActivityAt },
+	},
+	"hours_to_first_activity": {
+		label: "Часов до первого дела", kind: kindText, activities: true,
+		raw: func(d repo.DealRow) any {
+			if d.FirstActivityAt == nil {
+				return ""
+			}
+			return math.Round(d.FirstActivityAt.Sub(d.DateCreate).Hours()*10) / 10
+		},
+	},
+	"lead_id": {
+		label: "ID лида", code: "LEAD_ID", kind: kindText,
+		raw: func(d repo.DealRow) any { return int64OrEmpty(d.LeadID) },
+	},
+	"quality_violations": {
+		label: "Нарушения качества", kind: kindText, violations: true,
+		raw: func(d repo.DealRow) any { return joinValues(d.QualityViolations) },
+	},
+}
+
+// decimalOrEmpty keeps the exact decimal text while still encoding it as a
+// JSON number.
+func decimalOrEmpty(v *string) any {
+	if v == nil {
+		return ""
+	}
+	return json.Number(*v)
+}
+
+func int64OrEmpty(v *int64) any {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+// defaultSheetProfile reproduces the original /deals/sheets layout.
+func defaultSheetProfile() SheetProfile {
+	fields := []string{
+		"category_id", "stage_id", "assigned_by_id", "source_id", "date_create",
+		"utm_source", "uf_coop_type", "utm_campaign", "uf_client_type",
+		"uf_crm_1650279712660_date", "uf_crm_1699841388494", "uf_crm_1699863367472_date",
+		"uf_crm_1752578793696_date", "uf_crm_1753169789836_at", "uf_crm_1771313479555_date", "id",
+	}
+	p := SheetProfile{Name: defaultProfileName}
+	for _, f := range fields {
+		p.Columns = append(p.Columns, ProfileColumn{Field: f})
+	}
+	_ = p.normalize()
+	return p
+}
+
+var profileNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+func LoadSheetProfiles(path string) ([]SheetProfile, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read sheet profiles: %w", err)
+	}
+
+	var profiles []SheetProfile
+	if err := json.Unmarshal(raw, &profiles); err != nil {
+		return nil, fmt.Errorf("parse sheet profiles %s: %w", path, err)
+	}
+
+	seen := make(map[string]struct{})
+	for i := range profiles {
+		if err := profiles[i].normalize(); err != nil {
+			return nil, fmt.Errorf("sheet profile %q: %w", profiles[i].Name, err)
+		}
+		if profiles[i].Name == defaultProfileName {
+			return nil, fmt.Errorf("sheet profile name %q is reserved for /deals/sheets", defaultProfileName)
+		}
+		if _, ok := seen[profiles[i].Name]; ok {
+			return nil, fmt.Errorf("duplicate sheet profile %q", profiles[i].Name)
+		}
+		seen[profiles[i].Name] = struct{}{}
+	}
+	return profiles, nil
+}
+
+func WithSheetProfiles(profiles []SheetProfile) Option {
+	return func(s *Server) {
+		for _, p := range profiles {
+			s.profiles[p.Name] = p
+		}
+	}
+}
+
+func (p *SheetProfile) normalize() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if !profileNameRe.MatchString(p.Name) {
+		return fmt.Errorf("invalid name (use lowercase letters, digits, _ and -)")
+	}
+	if len(p.Columns) == 0 {
+		return fmt.Errorf("no columns")
+	}
+
+	for i := range p.Columns {
+		c := &p.Columns[i]
+		c.Field = strings.TrimSpace(c.Field)
+		def, ok := dealColumns[c.Field]
+		if !ok {
+			return fmt.Errorf("unknown field %q", c.Field)
+		}
+		c.customLabel = c.Label != ""
+		if c.Label == "" {
+			c.Label = def.label
+		}
+		switch def.kind {
+		case kindMapped:
+			if c.Format == "" {
+				c.Format = formatName
+			}
+			if c.Format != formatName && c.Format != formatRaw {
+				return fmt.Errorf("field %s: format must be %s or %s", c.Field, formatName, formatRaw)
+			}
+		case kindDate, kindDateTime:
+			if c.Format == "" {
+				c.Format = formatSerial
+			}
+			if c.Format != formatSerial && c.Format != formatISO {
+				return fmt.Errorf("field %s: format must be %s or %s", c.Field, formatSerial, formatISO)
+			}
+		default:
+			if c.Format != "" && c.Format != formatRaw {
+				return fmt.Errorf("field %s: only %s format is supported", c.Field, formatRaw)
+			}
+			c.Format = formatRaw
+		}
+	}
+
+	switch p.HeaderLabels = strings.TrimSpace(p.HeaderLabels); p.HeaderLabels {
+	case "", "ru", "en":
+	default:
+		return fmt.Errorf("header_labels must be ru or en")
+	}
+
+	for _, s := range p.Sort {
+		if !repo.IsSortableDealColumn(s.Column) {
+			return fmt.Errorf("sort column %q is not sortable (use: %s)", s.Column, strings.Join(repo.SortableDealColumns(), ", "))
+		}
+	}
+	if _, err := parseDateIn(p.Filters.DateCreateFrom, time.UTC); err != nil {
+		return fmt.Errorf("date_create_from: %w", err)
+	}
+	if _, err := parseDateIn(p.Filters.DateCreateTo, time.UTC); err != nil {
+		return fmt.Errorf("date_create_to: %w", err)
+	}
+	return nil
+}
+
+func (p SheetProfile) headers() []string {
+	out := make([]string, len(p.Columns))
+	for i, c := range p.Columns {
+		out[i] = c.Label
+	}
+	return out
+}
+
+func (s *Server) profileRow(p SheetProfile, maps dealMappings, d repo.DealRow) []any {
+	row := make([]any, len(p.Columns))
+	for i, c := range p.Columns {
+		def := dealColumns[c.Field]
+		switch def.kind {
+		case kindMapped:
+			if c.Format == formatName {
+				row[i] = def.named(maps, d)
+			} else {
+				row[i] = def.raw(d)
+			}
+		case kindDate:
+			if c.Format == formatISO {
+				row[i] = isoDate(def.time(d))
+			} else {
+				row[i] = toSheetsDateSerialPtr(def.time(d))
+			}
+		case kindDateTime:
+			if c.Format == formatISO {
+				row[i] = isoDateTime(def.time(d), s.sheetsLoc)
+			} else {
+				row[i] = toSheetsDateTimeSerialPtrInLocation(def.time(d), s.sheetsLoc)
+			}
+		default:
+			row[i] = def.raw(d)
+		}
+	}
+	return row
+}
+
+// dealQuery combines the profile defaults with request overrides
+// (category_id, stage_id, assigned_by_id, date_from, date_to). Plain dates
+// are midnight in loc, the business timezone, as in the reports.
+func (p SheetProfile) dealQuery(overrides map[string][]string, loc *time.Location) (repo.DealQuery, error) {
+	f := p.Filters
+	q := repo.DealQuery{Sort: p.Sort}
+
+	q.Filter.CategoryIDs = f.CategoryIDs
+	q.Filter.StageIDs = f.StageIDs
+	q.Filter.AssignedByIDs = f.AssignedByIDs
+	q.Filter.WithViolations = f.WithQualityViolations
+	for _, c := range p.Columns {
+		def := dealColumns[c.Field]
+		q.WithActivities = q.WithActivities || def.activities
+		q.WithViolationRules = q.WithViolationRules || def.violations
+	}
+	from, to := f.DateCreateFrom, f.DateCreateTo
+
+	if v := overrides["category_id"]; len(v) > 0 {
+		ids, err := parseIntList[int](v)
+		if err != nil {
+			return repo.DealQuery{}, fmt.Errorf("category_id: %w", err)
+		}
+		q.Filter.CategoryIDs = ids
+	}
+	if v := overrides["stage_id"]; len(v) > 0 {
+		q.Filter.StageIDs = splitList(v)
+	}
+	if v := overrides["assigned_by_id"]; len(v) > 0 {
+		ids, err := parseIntList[int64](v)
+		if err != nil {
+			return repo.DealQuery{}, fmt.Errorf("assigned_by_id: %w", err)
+		}
+		q.Filter.AssignedByIDs = ids
+	}
+	if v := overrides["date_from"]; len(v) > 0 {
+		from = v[0]
+	}
+	if v := overrides["date_to"]; len(v) > 0 {
+		to = v[0]
+	}
+
+	var err error
+	if q.Filter.DateCreateFrom, err = parseDateIn(from, loc); err != nil {
+		return repo.DealQuery{}, fmt.Errorf("date_from: %w", err)
+	}
+	if q.Filter.DateCreateTo, err = parseDateIn(to, loc); err != nil {
+		return repo.DealQuery{}, fmt.Errorf("date_to: %w", err)
+	}
+	return q, nil
+}
+
+func splitList(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+func parseIntList[T int | int64](values []string) ([]T, error) {
+	parts := splitList(values)
+	out := make([]T, 0, len(parts))
+	for _, p := range parts {
+		var n T
+		if _, err := fmt.Sscan(p, &n); err != nil {
+			return nil, fmt.Errorf("invalid id %q", p)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func isoDate(v *time.Time) any {
+	if v == nil || v.IsZero() {
+		return ""
+	}
+	return v.Format("2006-01-02")
+}
+
+func isoDateTime(v *time.Time, loc *time.Location) any {
+	if v == nil || v.IsZero() {
+		return ""
+	}
+	if loc != nil {
+		return v.In(loc).Format(time.RFC3339)
+	}
+	return v.UTC().Format(time.RFC3339)
+}
+
+// ProfileLayout returns the headers of a profile and the index of its id
+// column, which row-addressed exports need to find a deal's row.
+func (s *Server) ProfileLayout(ctx context.Context, name string) ([]string, int, error) {
+	p, ok := s.profiles[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown sheet profile %q", name)
+	}
+	for i, c := range p.Columns {
+		if c.Field == "id" {
+			return s.profileHeaders(ctx, p), i, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("sheet profile %q has no id column", name)
+}
+
+// RenderProfileRows renders the profile's rows, restricted to ids when it is
+// not empty, with the same mappings and formats as /sheets/{profile}.
+func (s *Server) RenderProfileRows(ctx context.Context, name string, ids []int64, fn func(id int64, row []any) error) error {
+	p, ok := s.profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown sheet profile %q", name)
+	}
+	q, err := p.dealQuery(nil, s.sheetsLoc)
+	if err != nil {
+		return err
+	}
+	q.Filter.IDs = ids
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		return err
+	}
+	maps := s.loadMappings(ctx, refs)
+	return s.repo.StreamDeals(ctx, q, func(d repo.DealRow) error {
+		return fn(d.ID, s.profileRow(p, maps, d))
+	})
+}
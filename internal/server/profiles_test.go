@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfileSheetsFiltersAndFormats(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(context.Background(), []bitrix.Deal{
+		{ID: "1", CategoryID: "1", StageID: "C1:NEW", DateCreate: "2026-02-01T09:00:00Z", UFCRM1650279712660: bitrix.Value{"2026-02-03T00:00:00+05:00"}},
+		{ID: "2", CategoryID: "1", StageID: "C1:WON", DateCreate: "2026-03-05T09:00:00Z"},
+		{ID: "3", CategoryID: "2", StageID: "C2:NEW", DateCreate: "2026-03-06T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := SheetProfile{
+		Name: "recruiting",
+		Columns: []ProfileColumn{
+			{Field: "id"},
+			{Field: "stage_id", Format: "raw", Label: "Стадия"},
+			{Field: "date_create", Format: "iso"},
+			{Field: "uf_crm_1650279712660_date", Format: "iso"},
+		},
+		Filters: ProfileFilters{CategoryIDs: []int{1}},
+		Sort:    []repo.DealSort{{Column: "date_create"}},
+	}
+	if err := profile.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync", WithSheetProfiles([]SheetProfile{profile})).routes()
+
+	get := func(target string) dealsSheetsResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body.String())
+		}
+		var resp dealsSheetsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/sheets/recruiting")
+	if len(resp.Headers) != 4 || resp.Headers[1] != "Стадия" || resp.Headers[2] != "Дата создания" {
+		t.Fatalf("headers = %v", resp.Headers)
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(resp.Rows))
+	}
+	first := resp.Rows[0]
+	if first[0] != float64(1) || first[1] != "C1:NEW" || first[2] != "2026-02-01T14:00:00+05:00" || first[3] != "2026-02-03" {
+		t.Fatalf("first row = %v", first)
+	}
+
+	resp = get("/sheets/recruiting?date_from=2026-03-01")
+	if len(resp.Rows) != 1 || resp.Rows[0][0] != float64(2) {
+		t.Fatalf("date_from override: rows = %v", resp.Rows)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sheets/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown profile: status %d, want 404", rec.Code)
+	}
+}
+
+func TestSheetProfileValidation(t *testing.T) {
+	cases := []SheetProfile{
+		{Name: "Bad Name", Columns: []ProfileColumn{{Field: "id"}}},
+		{Name: "x", Columns: []ProfileColumn{{Field: "nope"}}},
+		{Name: "x", Columns: []ProfileColumn{{Field: "date_create", Format: "name"}}},
+		{Name: "x", Columns: []ProfileColumn{{Field: "id"}}, Sort: []repo.DealSort{{Column: "uf_coop_type"}}},
+	}
+	for _, p := range cases {
+		if err := p.normalize(); err == nil {
+			t.Errorf("profile %+v: expected validation error", p)
+		}
+	}
+}
+
+func TestLoadSheetProfilesRejectsDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "default", "columns": [{"field": "id"}]}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSheetProfiles(path); err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Fatalf("err = %v, want reserved name error", err)
+	}
+}
+
+func TestProfileDatesUseBusinessTimezone(t *testing.T) {
+	loc := time.FixedZone("ALMT", 5*3600)
+	p := SheetProfile{Name: "x", Columns: []ProfileColumn{{Field: "id"}}, Filters: ProfileFilters{DateCreateFrom: "2026-03-01"}}
+	if err := p.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	q, err := p.dealQuery(map[string][]string{"date_to": {"2026-04-01"}}, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := q.Filter.DateCreateFrom; from == nil || !from.Equal(time.Date(2026, 2, 28, 19, 0, 0, 0, time.UTC)) {
+		t.Fatalf("date_create_from = %v", from)
+	}
+	if to := q.Filter.DateCreateTo; to == nil || !to.Equal(time.Date(2026, 3, 31, 19, 0, 0, 0, time.UTC)) {
+		t.Fatalf("date_to = %v", to)
+	}
+}
+
+func TestProfileJoinsAggregatesOnlyForTheirColumns(t *testing.T) {
+	for _, tc := range []struct {
+		field                  string
+		activities, violations bool
+	}{
+		{field: "stage_id"},
+		{field: "hours_to_first_activity", activities: true},
+		{field: "quality_violations", violations: true},
+	} {
+		p := SheetProfile{Name: "x", Columns: []ProfileColumn{{Field: "id"}, {Field: tc.field}}}
+		if err := p.normalize(); err != nil {
+			t.Fatal(err)
+		}
+		q, err := p.dealQuery(nil, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.WithActivities != tc.activities || q.WithViolationRules != tc.violations {
+			t.Fatalf("%s: activities=%v violations=%v", tc.field, q.WithActivities, q.WithViolationRules)
+		}
+	}
+}
+
+func TestProfileActivityColumns(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.UpsertDeals(ctx, []bitrix.Deal{{ID: "1", DateCreate: "2026-03-01T09:00:00Z"}, {ID: "2", DateCreate: "2026-03-01T09:00:00Z"}}); err != nil {
+		t.Fatal(err)
+	}
+	err := store.UpsertActivities(ctx, []bitrix.Activity{
+		{ID: "100", OwnerTypeID: "2", OwnerID: "1", TypeID: "2", Created: "2026-03-01T10:30:00Z"},
+		{ID: "101", OwnerTypeID: "2", OwnerID: "1", TypeID: "4", Created: "2026-03-02T08:00:00Z"},
+		{ID: "102", OwnerTypeID: "1", OwnerID: "1", TypeID: "2", Created: "2026-03-03T08:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := SheetProfile{
+		Name: "activity",
+		Columns: []ProfileColumn{
+			{Field: "id"},
+			{Field: "activity_count"},
+			{Field: "call_count"},
+			{Field: "last_activity_at", Format: "iso"},
+			{Field: "hours_to_first_activity"},
+		},
+		Sort: []repo.DealSort{{Column: "id"}},
+	}
+	if err := profile.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync", WithSheetProfiles([]SheetProfile{profile})).routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sheets/activity", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp dealsSheetsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	withActivity, without := resp.Rows[0], resp.Rows[1]
+	if withActivity[1] != float64(2) || withActivity[2] != float64(1) || withActivity[3] != "2026-03-02T13:00:00+05:00" || withActivity[4] != 1.5 {
+		t.Fatalf("deal with activities = %v", withActivity)
+	}
+	if without[1] != float64(0) || without[3] != "" || without[4] != "" {
+		t.Fatalf("deal without activities = %v", without)
+	}
+}
+
+func TestProfileHeadersUseBitrixLabels(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	err := store.ReplaceDealFields(ctx, []repo.DealField{
+		{Code: "STAGE_ID", Type: "crm_status", Title: "Стадия"},
+		{Code: "UF_CRM_1699841388494", Type: "enumeration", Title: "Источник 1", LabelRU: "Источник (анкета)", LabelEN: "Source"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := SheetProfile{
+		Name:         "labels",
+		HeaderLabels: "en",
+		Columns: []ProfileColumn{
+			{Field: "id", Label: "Deal"},
+			{Field: "stage_id"},
+			{Field: "uf_crm_1699841388494"},
+			{Field: "contact_name"},
+		},
+	}
+	if err := profile.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(store, nil, "deals_sync", WithSheetProfiles([]SheetProfile{profile}), WithFields(store))
+
+	headers, idCol, err := srv.ProfileLayout(ctx, "labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Deal", "Стадия", "Source", "Контакт"}
+	if idCol != 0 || len(headers) != len(want) {
+		t.Fatalf("headers = %v, id column %d", headers, idCol)
+	}
+	for i := range want {
+		if headers[i] != want[i] {
+			t.Fatalf("headers = %v, want %v", headers, want)
+		}
+	}
+
+	bad := SheetProfile{Name: "bad", HeaderLabels: "de", Columns: []ProfileColumn{{Field: "id"}}}
+	if err := bad.normalize(); err == nil {
+		t.Fatal("expected header_labels error")
+	}
+}
+
+func TestProfileRowJoinsMultipleEnumLabels(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(context.Background(), []bitrix.Deal{
+		{ID: "1", DateCreate: "2026-02-01T09:00:00Z", UFCRM1699841388494: bitrix.Value{"45", "99", "46"}, UFCoopType: bitrix.Value{"7"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row repo.DealRow
+	if err := store.StreamDeals(context.Background(), repo.DealQuery{}, func(d repo.DealRow) error {
+		row = d
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	profile := SheetProfile{Name: "multi", Columns: []ProfileColumn{
+		{Field: "uf_crm_1699841388494"},
+		{Field: "uf_crm_1699841388494", Format: "raw"},
+		{Field: "uf_coop_type"},
+	}}
+	if err := profile.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	maps := dealMappings{
+		source1Names:  map[string]string{"45": "Сайт", "46": "Рекомендация"},
+		coopTypeNames: map[string]string{"7": "Партнёр"},
+	}
+	got := (&Server{}).profileRow(profile, maps, row)
+	want := []any{"Сайт, Рекомендация", "45, 99, 46", "Партнёр"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("row = %v, want %v", got, want)
+		}
+	}
+}
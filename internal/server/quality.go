@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"slices"
+)
+
+const qualityProfileName = "quality"
+
+type QualityStore interface {
+	ListQualityViolations(ctx context.Context) ([]repo.QualityViolation, error)
+}
+
+// WithQuality enables GET /quality/violations and the built-in "quality"
+// sheet profile, unless a profile of that name is configured.
+func WithQuality(store QualityStore) Option {
+	return func(s *Server) {
+		s.quality = store
+		if _, ok := s.profiles[qualityProfileName]; !ok {
+			s.profiles[qualityProfileName] = qualitySheetProfile()
+		}
+	}
+}
+
+// qualitySheetProfile lists the deals failing data quality rules.
+func qualitySheetProfile() SheetProfile {
+	fields := []string{
+		"id", "category_id", "stage_id", "assigned_by_id", "date_create",
+		"uf_crm_1699863367472_date", "uf_crm_1650279712660_date",
+		"uf_crm_1752578793696_date", "uf_crm_1753169789836_at", "quality_violations",
+	}
+	p := SheetProfile{Name: qualityProfileName, Filters: ProfileFilters{WithQualityViolations: true}}
+	for _, f := range fields {
+		p.Columns = append(p.Columns, ProfileColumn{Field: f})
+	}
+	_ = p.normalize()
+	return p
+}
+
+type qualityViolationJSON struct {
+	repo.QualityViolation
+	Category   string `json:"category"`
+	Stage      string `json:"stage"`
+	AssignedBy string `json:"assigned_by"`
+}
+
+type qualityViolationsResponse struct {
+	Violations []qualityViolationJSON `json:"violations"`
+}
+
+// handleQualityViolations lists the open violations, optionally filtered by
+// rule, category_id, stage_id and assigned_by_id.
+func (s *Server) handleQualityViolations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.quality == nil {
+		http.Error(w, "quality validation is not configured", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	var categoryIDs []int
+	if v := q["category_id"]; len(v) > 0 {
+		ids, err := parseIntList[int](v)
+		if err != nil {
+			http.Error(w, "category_id: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		categoryIDs = ids
+	}
+	var assignedIDs []int64
+	if v := q["assigned_by_id"]; len(v) > 0 {
+		ids, err := parseIntList[int64](v)
+		if err != nil {
+			http.Error(w, "assigned_by_id: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		assignedIDs = ids
+	}
+	rules := splitList(q["rule"])
+	stageIDs := splitList(q["stage_id"])
+
+	violations, err := s.quality.ListQualityViolations(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maps := s.loadMappings(ctx, refs)
+
+	resp := qualityViolationsResponse{Violations: make([]qualityViolationJSON, 0, len(violations))}
+	for _, v := range violations {
+		if len(rules) > 0 && !slices.Contains(rules, v.Rule) {
+			continue
+		}
+		if len(categoryIDs) > 0 && !slices.Contains(categoryIDs, v.CategoryID) {
+			continue
+		}
+		if len(stageIDs) > 0 && !slices.Contains(stageIDs, v.StageID) {
+			continue
+		}
+		if len(assignedIDs) > 0 && !slices.Contains(assignedIDs, v.AssignedByID) {
+			continue
+		}
+		resp.Violations = append(resp.Violations, qualityViolationJSON{
+			QualityViolation: v,
+			Category:         mapInt(maps.categoryNames, v.CategoryID),
+			Stage:            mapString(maps.stageNames, v.StageID),
+			AssignedBy:       mapInt64(maps.assignedNames, v.AssignedByID),
+		})
+	}
+
+	writeJSON(w, resp)
+}
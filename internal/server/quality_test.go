@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQualityViolationsAndSheet(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(ctx, []bitrix.Deal{
+		{ID: "1", CategoryID: "1", StageID: "C1:NEW", DateCreate: "2026-03-01T09:00:00Z"},
+		{ID: "2", CategoryID: "1", StageID: "C2:NEW", DateCreate: "2026-03-01T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.SyncQualityViolations(ctx, []int64{1, 2}, []repo.QualityViolation{
+		{DealID: 2, Rule: "assigned_by_missing", Message: "assigned_by_id is empty", CategoryID: 1, StageID: "C2:NEW"},
+		{DealID: 2, Rule: "stage_outside_category", Message: "stage C2:NEW does not belong to category 1", CategoryID: 1, StageID: "C2:NEW"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync", WithQuality(store)).routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quality/violations?rule=stage_outside_category", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp qualityViolationsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Violations) != 1 || resp.Violations[0].DealID != 2 || resp.Violations[0].Category != "1" {
+		t.Fatalf("violations = %+v", resp.Violations)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sheets/quality?format=csv", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sheet status %d: %s", rec.Code, rec.Body.String())
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0][9] != "Нарушения качества" {
+		t.Fatalf("sheet = %q", records)
+	}
+	if records[1][0] != "2" || records[1][9] != "assigned_by_missing, stage_outside_category" {
+		t.Fatalf("sheet row = %q", records[1])
+	}
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	stageInProgress = "in_progress"
+	stageWon        = "won"
+	stageLost       = "lost"
+)
+
+// stageGroup classifies a stage by its Bitrix semantics. Stages the portal
+// did not describe fall back to the standard WON / LOSE / APOLOGY suffixes.
+func stageGroup(maps dealMappings, stageID string) string {
+	switch maps.stageSemantics[stageID] {
+	case "success", "s":
+		return stageWon
+	case "failure", "f":
+		return stageLost
+	case "process", "p":
+		return stageInProgress
+	}
+
+	id := strings.ToUpper(stageID)
+	if i := strings.LastIndex(id, ":"); i >= 0 {
+		id = id[i+1:]
+	}
+	switch id {
+	case "WON":
+		return stageWon
+	case "LOSE", "APOLOGY":
+		return stageLost
+	default:
+		return stageInProgress
+	}
+}
+
+type reportWindow struct {
+	From        *time.Time
+	To          *time.Time
+	CategoryIDs []int
+}
+
+// parseReportWindow reads date_from / date_to (date_to is exclusive) in the
+// business timezone and the category_id filter.
+func (s *Server) parseReportWindow(q url.Values) (reportWindow, error) {
+	var w reportWindow
+	var err error
+	if w.From, err = parseDateIn(q.Get("date_from"), s.sheetsLoc); err != nil {
+		return w, fmt.Errorf("date_from: %w", err)
+	}
+	if w.To, err = parseDateIn(q.Get("date_to"), s.sheetsLoc); err != nil {
+		return w, fmt.Errorf("date_to: %w", err)
+	}
+	if v := q["category_id"]; len(v) > 0 {
+		if w.CategoryIDs, err = parseIntList[int](v); err != nil {
+			return w, fmt.Errorf("category_id: %w", err)
+		}
+	}
+	return w, nil
+}
+
+func (w reportWindow) dealQuery() repo.DealQuery {
+	return repo.DealQuery{Filter: repo.DealFilter{
+		CategoryIDs:    w.CategoryIDs,
+		DateCreateFrom: w.From,
+		DateCreateTo:   w.To,
+	}}
+}
+
+func (w reportWindow) echo() reportWindowJSON {
+	out := reportWindowJSON{CategoryIDs: w.CategoryIDs}
+	if w.From != nil {
+		out.DateFrom = w.From.Format("2006-01-02")
+	}
+	if w.To != nil {
+		out.DateTo = w.To.Format("2006-01-02")
+	}
+	return out
+}
+
+type reportWindowJSON struct {
+	DateFrom    string `json:"date_from,omitempty"`
+	DateTo      string `json:"date_to,omitempty"`
+	CategoryIDs []int  `json:"category_ids,omitempty"`
+}
+
+func parseDateIn(s string, loc *time.Location) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return &t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+	return nil, fmt.Errorf("unsupported date %q (use YYYY-MM-DD or RFC3339)", s)
+}
+
+type managerStats struct {
+	AssignedByID        int64    `json:"assigned_by_id,omitempty"`
+	Name                string   `json:"name,omitempty"`
+	Created             int      `json:"created"`
+	InProgress          int      `json:"in_progress"`
+	Won                 int      `json:"won"`
+	Lost                int      `json:"lost"`
+	InterviewHeld       int      `json:"interview_held"`
+	InterviewHeldShare  float64  `json:"interview_held_share"`
+	Meetings            int      `json:"meetings"`
+	MedianDaysToMeeting *float64 `json:"median_days_to_meeting"`
+
+	daysToMeeting []float64
+}
+
+type managersReport struct {
+	reportWindowJSON
+	Managers []*managerStats `json:"managers"`
+	Totals   *managerStats   `json:"totals"`
+}
+
+func (m *managerStats) add(maps dealMappings, d repo.DealRow, loc *time.Location) {
+	m.Created++
+	switch stageGroup(maps, d.StageID) {
+	case stageWon:
+		m.Won++
+	case stageLost:
+		m.Lost++
+	default:
+		m.InProgress++
+	}
+	if d.UFCRM1650279712660Date != nil {
+		m.InterviewHeld++
+	}
+	if d.UFCRM1752578793696Date != nil {
+		m.Meetings++
+		m.daysToMeeting = append(m.daysToMeeting, daysBetween(d.DateCreate, *d.UFCRM1752578793696Date, loc))
+	}
+}
+
+func (m *managerStats) finish() {
+	if m.Created > 0 {
+		m.InterviewHeldShare = float64(m.InterviewHeld) / float64(m.Created)
+	}
+	m.MedianDaysToMeeting = median(m.daysToMeeting)
+}
+
+func (s *Server) handleManagersReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	window, err := s.parseReportWindow(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maps := s.loadMappings(ctx, refs)
+
+	byManager := make(map[int64]*managerStats)
+	totals := &managerStats{}
+	err = s.repo.StreamDeals(ctx, window.dealQuery(), func(d repo.DealRow) error {
+		m, ok := byManager[d.AssignedByID]
+		if !ok {
+			m = &managerStats{AssignedByID: d.AssignedByID, Name: mapInt64(maps.assignedNames, d.AssignedByID)}
+			byManager[d.AssignedByID] = m
+		}
+		m.add(maps, d, s.sheetsLoc)
+		totals.add(maps, d, s.sheetsLoc)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := managersReport{reportWindowJSON: window.echo(), Managers: make([]*managerStats, 0, len(byManager)), Totals: totals}
+	for _, m := range byManager {
+		m.finish()
+		resp.Managers = append(resp.Managers, m)
+	}
+	totals.finish()
+	slices.SortFunc(resp.Managers, func(a, b *managerStats) int {
+		if c := cmp.Compare(b.Created, a.Created); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.AssignedByID, b.AssignedByID)
+	})
+
+	writeJSON(w, resp)
+}
+
+// daysBetween counts calendar days between the creation moment, taken in the
+// business timezone, and a date-only field.
+func daysBetween(created, date time.Time, loc *time.Location) float64 {
+	c := created.In(loc)
+	start := time.Date(c.Year(), c.Month(), c.Day(), 0, 0, 0, 0, time.UTC)
+	y, m, d := date.Date()
+	end := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return end.Sub(start).Hours() / 24
+}
+
+func median(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	v := sorted[mid]
+	if len(sorted)%2 == 0 {
+		v = (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return &v
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var attributionDimensions = map[string]func(m dealMappings, d repo.DealRow) string{
+	"source":       func(m dealMappings, d repo.DealRow) string { return mapString(m.sourceNames, d.SourceID) },
+	"utm_source":   func(m dealMappings, d repo.DealRow) string { return strOrEmpty(d.UTMSource) },
+	"utm_campaign": func(m dealMappings, d repo.DealRow) string { return strOrEmpty(d.UTMCampaign) },
+	// A deal with several Источник1 values is counted once, under the labels
+	// joined as in the sheets.
+	"source1": func(m dealMappings, d repo.DealRow) string {
+		return mapEnumValuesStrict(m.source1Names, ufValues(d, ufSource1, d.UFCRM1699841388494))
+	},
+}
+
+type attributionRow struct {
+	Bucket        string            `json:"bucket,omitempty"`
+	Dimensions    map[string]string `json:"dimensions"`
+	Deals         int               `json:"deals"`
+	InterviewHeld int               `json:"interview_held"`
+	MeetingHeld   int               `json:"meeting_held"`
+	Won           int               `json:"won"`
+	InterviewRate float64           `json:"interview_rate"`
+	MeetingRate   float64           `json:"meeting_rate"`
+	WonRate       float64           `json:"won_rate"`
+
+	key string
+}
+
+type attributionReport struct {
+	reportWindowJSON
+	GroupBy []string          `json:"group_by"`
+	Bucket  string            `json:"bucket"`
+	Rows    []*attributionRow `json:"rows"`
+}
+
+func (s *Server) handleAttributionReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	window, err := s.parseReportWindow(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := []string{"source"}
+	if v := q["group_by"]; len(v) > 0 {
+		groupBy = splitList(v)
+	}
+	for _, dim := range groupBy {
+		if _, ok := attributionDimensions[dim]; !ok {
+			http.Error(w, fmt.Sprintf("group_by: unknown dimension %q (use: source, utm_source, utm_campaign, source1)", dim), http.StatusBadRequest)
+			return
+		}
+	}
+	bucket := strings.ToLower(strings.TrimSpace(q.Get("bucket")))
+	switch bucket {
+	case "":
+		bucket = "none"
+	case "none", "week", "month":
+	default:
+		http.Error(w, "bucket must be none, week or month", http.StatusBadRequest)
+		return
+	}
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maps := s.loadMappings(ctx, refs)
+
+	rows := make(map[string]*attributionRow)
+	err = s.repo.StreamDeals(ctx, window.dealQuery(), func(d repo.DealRow) error {
+		row := &attributionRow{Bucket: s.bucketOf(d.DateCreate, bucket), Dimensions: make(map[string]string, len(groupBy))}
+		var key strings.Builder
+		key.WriteString(row.Bucket)
+		for _, dim := range groupBy {
+			v := attributionDimensions[dim](maps, d)
+			row.Dimensions[dim] = v
+			key.WriteString("\x00" + v)
+		}
+		row.key = key.String()
+
+		if existing, ok := rows[row.key]; ok {
+			row = existing
+		} else {
+			rows[row.key] = row
+		}
+		row.Deals++
+		if d.UFCRM1650279712660Date != nil {
+			row.InterviewHeld++
+		}
+		if d.UFCRM1753169789836At != nil {
+			row.MeetingHeld++
+		}
+		if stageGroup(maps, d.StageID) == stageWon {
+			row.Won++
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := attributionReport{reportWindowJSON: window.echo(), GroupBy: groupBy, Bucket: bucket, Rows: make([]*attributionRow, 0, len(rows))}
+	for _, row := range rows {
+		n := float64(row.Deals)
+		row.InterviewRate = float64(row.InterviewHeld) / n
+		row.MeetingRate = float64(row.MeetingHeld) / n
+		row.WonRate = float64(row.Won) / n
+		resp.Rows = append(resp.Rows, row)
+	}
+	slices.SortFunc(resp.Rows, func(a, b *attributionRow) int {
+		if c := cmp.Compare(a.Bucket, b.Bucket); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.Deals, a.Deals); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.key, b.key)
+	})
+
+	writeJSON(w, resp)
+}
+
+// bucketOf labels the creation time with its ISO week start (Monday) or month
+// in the business timezone.
+func (s *Server) bucketOf(t time.Time, bucket string) string {
+	local := t.In(s.sheetsLoc)
+	switch bucket {
+	case "week":
+		offset := (int(local.Weekday()) + 6) % 7
+		return local.AddDate(0, 0, -offset).Format("2006-01-02")
+	case "month":
+		return local.Format("2006-01")
+	default:
+		return ""
+	}
+}
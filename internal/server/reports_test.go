@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestManagersReport(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(context.Background(), []bitrix.Deal{
+		{ID: "1", CategoryID: "1", AssignedByID: "7", StageID: "C1:NEW", DateCreate: "2026-02-01T09:00:00Z",
+			UFCRM1650279712660: bitrix.Value{"2026-02-03T00:00:00+05:00"}, UFCRM1752578793696: bitrix.Value{"2026-02-05T00:00:00+05:00"}},
+		{ID: "2", CategoryID: "1", AssignedByID: "7", StageID: "C1:WON", DateCreate: "2026-02-02T09:00:00Z",
+			UFCRM1752578793696: bitrix.Value{"2026-02-04T00:00:00+05:00"}},
+		{ID: "3", CategoryID: "1", AssignedByID: "8", StageID: "C1:LOSE", DateCreate: "2026-02-10T09:00:00Z"},
+		{ID: "4", CategoryID: "2", AssignedByID: "8", StageID: "C2:NEW", DateCreate: "2026-02-10T09:00:00Z"},
+		{ID: "5", CategoryID: "1", AssignedByID: "8", StageID: "C1:NEW", DateCreate: "2026-03-01T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync").routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports/managers?category_id=1&date_from=2026-02-01&date_to=2026-03-01", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp managersReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Managers) != 2 {
+		t.Fatalf("got %d managers, want 2", len(resp.Managers))
+	}
+	m := resp.Managers[0]
+	if m.AssignedByID != 7 || m.Created != 2 || m.Won != 1 || m.InProgress != 1 || m.InterviewHeld != 1 {
+		t.Fatalf("manager 7 = %+v", m)
+	}
+	if m.InterviewHeldShare != 0.5 || m.MedianDaysToMeeting == nil || *m.MedianDaysToMeeting != 3 {
+		t.Fatalf("manager 7 share/median = %v / %v", m.InterviewHeldShare, m.MedianDaysToMeeting)
+	}
+	if lost := resp.Managers[1]; lost.AssignedByID != 8 || lost.Lost != 1 || lost.MedianDaysToMeeting != nil {
+		t.Fatalf("manager 8 = %+v", lost)
+	}
+	if resp.Totals.Created != 3 {
+		t.Fatalf("totals created = %d, want 3", resp.Totals.Created)
+	}
+}
+
+func TestAttributionReportBucketsInBusinessTimezone(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(context.Background(), []bitrix.Deal{
+		// 2026-02-28T20:00Z is already March 1st in Asia/Almaty.
+		{ID: "1", StageID: "C1:WON", UTMSource: "instagram", DateCreate: "2026-02-28T20:00:00Z",
+			UFCRM1650279712660: bitrix.Value{"2026-03-02T00:00:00+05:00"}, UFCRM1753169789836: bitrix.Value{"2026-03-03T12:00:00+05:00"}},
+		{ID: "2", StageID: "C1:NEW", UTMSource: "instagram", DateCreate: "2026-03-10T09:00:00Z"},
+		{ID: "3", StageID: "C1:NEW", UTMSource: "google", DateCreate: "2026-02-10T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync").routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports/attribution?group_by=utm_source&bucket=month", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp attributionReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("got %d rows, want 2: %+v", len(resp.Rows), resp.Rows)
+	}
+	feb, mar := resp.Rows[0], resp.Rows[1]
+	if feb.Bucket != "2026-02" || feb.Dimensions["utm_source"] != "google" || feb.Deals != 1 {
+		t.Fatalf("february row = %+v", feb)
+	}
+	if mar.Bucket != "2026-03" || mar.Deals != 2 || mar.InterviewHeld != 1 || mar.MeetingHeld != 1 || mar.Won != 1 || mar.WonRate != 0.5 {
+		t.Fatalf("march row = %+v", mar)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports/attribution?group_by=nope", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown dimension: status %d, want 400", rec.Code)
+	}
+}
+
+func TestAttributionSource1JoinsMultipleValues(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(context.Background(), []bitrix.Deal{
+		{ID: "1", DateCreate: "2026-03-01T09:00:00Z", UFCRM1699841388494: bitrix.Value{"45", "46"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row repo.DealRow
+	if err := store.StreamDeals(context.Background(), repo.DealQuery{}, func(d repo.DealRow) error {
+		row = d
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	maps := dealMappings{source1Names: map[string]string{"45": "Сайт", "46": "Рекомендация"}}
+	if got := attributionDimensions["source1"](maps, row); got != "Сайт, Рекомендация" {
+		t.Fatalf("source1 = %q", got)
+	}
+}
+
+func TestLeadConversionReport(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	err := store.UpsertLeads(ctx, []bitrix.Lead{
+		{ID: "1", StatusID: "CONVERTED", StatusSemanticID: "S", UTMSource: "instagram", DateCreate: "2026-03-01T09:00:00Z"},
+		{ID: "2", StatusID: "JUNK", StatusSemanticID: "F", UTMSource: "instagram", DateCreate: "2026-03-02T09:00:00Z"},
+		{ID: "3", StatusID: "NEW", UTMSource: "google", DateCreate: "2026-03-03T09:00:00Z"},
+		{ID: "4", StatusID: "NEW", UTMSource: "google", DateCreate: "2026-01-03T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.UpsertDeals(ctx, []bitrix.Deal{
+		{ID: "10", LeadID: "1", StageID: "C1:WON", DateCreate: "2026-03-01T10:00:00Z"},
+		{ID: "11", StageID: "C1:NEW", DateCreate: "2026-03-01T10:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync", WithLeads(store)).routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports/leads?group_by=utm_source&date_from=2026-03-01", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp leadConversionReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("got %d rows, want 2: %+v", len(resp.Rows), resp.Rows)
+	}
+	insta := resp.Rows[0]
+	if insta.Dimensions["utm_source"] != "instagram" {
+		insta = resp.Rows[1]
+	}
+	if insta.Leads != 2 || insta.Converted != 1 || insta.Junk != 1 || insta.WithDeal != 1 || insta.WonDeals != 1 || insta.ConversionRate != 0.5 {
+		t.Fatalf("instagram row = %+v", insta)
+	}
+	if resp.Totals.Leads != 3 || resp.Totals.InWork != 1 || resp.Totals.Deals != 1 {
+		t.Fatalf("totals = %+v", resp.Totals)
+	}
+}
+
+func TestRevenueReportSumsExactDecimals(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(context.Background(), []bitrix.Deal{
+		{ID: "1", StageID: "C1:WON", Opportunity: "0.10", CurrencyID: "KZT", CloseDate: "2026-03-02T00:00:00+05:00", DateCreate: "2026-01-01T09:00:00Z"},
+		{ID: "2", StageID: "C1:WON", Opportunity: "0.20", CurrencyID: "KZT", CloseDate: "2026-03-20T00:00:00+05:00", DateCreate: "2026-01-01T09:00:00Z"},
+		{ID: "3", StageID: "C1:WON", Opportunity: "99.99", CurrencyID: "USD", CloseDate: "2026-03-05T00:00:00+05:00", DateCreate: "2026-01-01T09:00:00Z"},
+		{ID: "4", StageID: "C1:NEW", Opportunity: "1000", CurrencyID: "KZT", CloseDate: "2026-03-05T00:00:00+05:00", DateCreate: "2026-01-01T09:00:00Z"},
+		{ID: "5", StageID: "C1:WON", Opportunity: "5", CurrencyID: "KZT", CloseDate: "2026-04-01T00:00:00+05:00", DateCreate: "2026-01-01T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync").routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports/revenue?date_from=2026-03-01&date_to=2026-04-01", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp revenueReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("got %d rows, want 2: %+v", len(resp.Rows), resp.Rows)
+	}
+	kzt, usd := resp.Rows[0], resp.Rows[1]
+	if kzt.Bucket != "2026-03" || kzt.Currency != "KZT" || kzt.WonDeals != 2 || kzt.Revenue != "0.30" || kzt.Average != "0.15" {
+		t.Fatalf("KZT row = %+v", kzt)
+	}
+	if usd.Currency != "USD" || usd.Revenue != "99.99" {
+		t.Fatalf("USD row = %+v", usd)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"cmp"
+	"freedom_bitrix/internal/repo"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type revenueRow struct {
+	Bucket   string `json:"bucket"`
+	Currency string `json:"currency"`
+	WonDeals int    `json:"won_deals"`
+	Revenue  string `json:"revenue"`
+	Average  string `json:"average"`
+
+	sum *big.Rat
+}
+
+type revenueReport struct {
+	reportWindowJSON
+	Basis  string        `json:"basis"`
+	Bucket string        `json:"bucket"`
+	Rows   []*revenueRow `json:"rows"`
+}
+
+// handleRevenueReport sums OPPORTUNITY of won deals per period and currency.
+// Amounts are added as exact decimals and returned as strings.
+func (s *Server) handleRevenueReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	window, err := s.parseReportWindow(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bucket := strings.ToLower(strings.TrimSpace(q.Get("bucket")))
+	switch bucket {
+	case "":
+		bucket = "month"
+	case "day", "week", "month":
+	default:
+		http.Error(w, "bucket must be day, week or month", http.StatusBadRequest)
+		return
+	}
+	basis := strings.ToLower(strings.TrimSpace(q.Get("basis")))
+	switch basis {
+	case "":
+		basis = "close_date"
+	case "close_date", "date_create":
+	default:
+		http.Error(w, "basis must be close_date or date_create", http.StatusBadRequest)
+		return
+	}
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maps := s.loadMappings(ctx, refs)
+
+	query := window.dealQuery()
+	if basis == "close_date" {
+		// The window applies to the close date, checked below.
+		query.Filter.DateCreateFrom, query.Filter.DateCreateTo = nil, nil
+	}
+
+	rows := make(map[[2]string]*revenueRow)
+	err = s.repo.StreamDeals(ctx, query, func(d repo.DealRow) error {
+		if stageGroup(maps, d.StageID) != stageWon || d.Opportunity == nil {
+			return nil
+		}
+		amount, ok := new(big.Rat).SetString(*d.Opportunity)
+		if !ok {
+			return nil
+		}
+		at := d.DateCreate
+		if basis == "close_date" {
+			if d.CloseDate == nil {
+				return nil
+			}
+			y, m, day := d.CloseDate.Date()
+			at = time.Date(y, m, day, 0, 0, 0, 0, s.sheetsLoc)
+			if (window.From != nil && at.Before(*window.From)) || (window.To != nil && !at.Before(*window.To)) {
+				return nil
+			}
+		}
+
+		key := [2]string{s.revenueBucket(at, bucket), strOrEmpty(d.CurrencyID)}
+		row, ok := rows[key]
+		if !ok {
+			row = &revenueRow{Bucket: key[0], Currency: key[1], sum: new(big.Rat)}
+			rows[key] = row
+		}
+		row.WonDeals++
+		row.sum.Add(row.sum, amount)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := revenueReport{reportWindowJSON: window.echo(), Basis: basis, Bucket: bucket, Rows: make([]*revenueRow, 0, len(rows))}
+	for _, row := range rows {
+		row.Revenue = row.sum.FloatString(2)
+		avg := new(big.Rat).Quo(row.sum, big.NewRat(int64(row.WonDeals), 1))
+		row.Average = avg.FloatString(2)
+		resp.Rows = append(resp.Rows, row)
+	}
+	slices.SortFunc(resp.Rows, func(a, b *revenueRow) int {
+		if c := cmp.Compare(a.Bucket, b.Bucket); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Currency, b.Currency)
+	})
+
+	writeJSON(w, resp)
+}
+
+func (s *Server) revenueBucket(t time.Time, bucket string) string {
+	if bucket == "day" {
+		return t.In(s.sheetsLoc).Format("2006-01-02")
+	}
+	return s.bucketOf(t, bucket)
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/repo"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxCachedSheetsBytes bounds a cached body; with its compressed copies the
+// cache stays within a few tens of MB.
+const maxCachedSheetsBytes = 8 << 20
+
+type dealsSheetsResponse struct {
+	Headers []string `json:"headers"`
+	Rows    [][]any  `json:"rows"`
+}
+
+func (s *Server) handleDealsSheets(w http.ResponseWriter, r *http.Request) {
+	s.serveSheet(w, r, s.profiles[defaultProfileName])
+}
+
+func (s *Server) handleProfileSheets(w http.ResponseWriter, r *http.Request) {
+	profile, ok := s.profiles[r.PathValue("profile")]
+	if !ok {
+		http.Error(w, "unknown sheet profile", http.StatusNotFound)
+		return
+	}
+	s.serveSheet(w, r, profile)
+}
+
+func (s *Server) serveSheet(w http.ResponseWriter, r *http.Request, profile SheetProfile) {
+	ctx := r.Context()
+
+	format := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format")))
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+	dq, err := profile.dealQuery(r.URL.Query(), s.sheetsLoc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := s.repo.GetSheetsVersion(ctx, s.syncStateKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	headers := s.profileHeaders(ctx, profile)
+	query := profile.Name + "?" + cacheQuery(r.URL.Query())
+	if profile.HeaderLabels != "" {
+		// Bitrix labels can change without a new sync.
+		query += "#" + strings.Join(headers, "\x00")
+	}
+
+	if !s.mappingsStale() {
+		if s.serveCachedSheets(w, r, sheetsETag(version, s.currentMappingVersion(), s.sheets.currentGeneration(), query), format) {
+			return
+		}
+	}
+
+	refs, err := s.repo.ListDealRefs(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maps := s.loadMappings(ctx, refs)
+
+	etag := sheetsETag(version, s.currentMappingVersion(), s.sheets.currentGeneration(), query)
+	if s.serveCachedSheets(w, r, etag, format) {
+		return
+	}
+
+	setRevalidateHeaders(w, etag)
+	w.Header().Set("Content-Type", sheetsContentType(format))
+	w.WriteHeader(http.StatusOK)
+
+	// The body is streamed to the client and, up to a limit, teed into the
+	// rendered-response cache.
+	buf := &cappedBuffer{limit: maxCachedSheetsBytes}
+	sw := newSheetWriter(io.MultiWriter(w, buf), format)
+
+	if err := s.writeSheet(ctx, profile, headers, dq, maps, sw); err != nil {
+		if !errors.Is(err, ctx.Err()) {
+			logging.FromContext(ctx).Error("stream sheet", "profile", profile.Name, "err", err)
+		}
+		// The 200 is already sent: abort the connection so that the client
+		// sees a failed transfer rather than a complete-looking short sheet.
+		panic(http.ErrAbortHandler)
+	}
+
+	if !buf.overflow {
+		s.sheets.put(etag, buf.Bytes())
+	}
+}
+
+// writeSheet renders the rows selected by q through the profile's columns.
+func (s *Server) writeSheet(ctx context.Context, profile SheetProfile, headers []string, q repo.DealQuery, maps dealMappings, sw sheetWriter) error {
+	if err := sw.WriteHeaders(headers); err != nil {
+		return err
+	}
+	err := s.repo.StreamDeals(ctx, q, func(d repo.DealRow) error {
+		return sw.WriteRow(s.profileRow(profile, maps, d))
+	})
+	if err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+func sheetsContentType(format string) string {
+	if format == "csv" {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/json"
+}
+
+type sheetWriter interface {
+	WriteHeaders(headers []string) error
+	WriteRow(row []any) error
+	Close() error
+}
+
+func newSheetWriter(w io.Writer, format string) sheetWriter {
+	if format == "csv" {
+		return &csvSheetWriter{w: csv.NewWriter(w)}
+	}
+	return &jsonSheetWriter{w: w}
+}
+
+// jsonSheetWriter produces the same document as encoding dealsSheetsResponse
+// with json.Encoder, one row at a time.
+type jsonSheetWriter struct {
+	w    io.Writer
+	rows int
+}
+
+func (j *jsonSheetWriter) WriteHeaders(headers []string) error {
+	b, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(j.w, `{"headers":`); err != nil {
+		return err
+	}
+	if _, err := j.w.Write(b); err != nil {
+		return err
+	}
+	_, err = io.WriteString(j.w, `,"rows":[`)
+	return err
+}
+
+func (j *jsonSheetWriter) WriteRow(row []any) error {
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if j.rows > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.rows++
+	_, err = j.w.Write(b)
+	return err
+}
+
+func (j *jsonSheetWriter) Close() error {
+	_, err := io.WriteString(j.w, "]}\n")
+	return err
+}
+
+type csvSheetWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (c *csvSheetWriter) WriteHeaders(headers []string) error {
+	return c.w.Write(headers)
+}
+
+func (c *csvSheetWriter) WriteRow(row []any) error {
+	c.record = c.record[:0]
+	for _, v := range row {
+		c.record = append(c.record, csvCell(v))
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvSheetWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvCell(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
+
+type cappedBuffer struct {
+	bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.overflow {
+		return len(p), nil
+	}
+	if c.Len()+len(p) > c.limit {
+		c.overflow = true
+		c.Reset()
+		return len(p), nil
+	}
+	return c.Buffer.Write(p)
+}
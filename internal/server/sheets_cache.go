@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxSheetsCacheEntries = 4
+
+// sheetsCache keeps the last few rendered sheets responses together with their
+// compressed variants, keyed by the strong ETag of the data they were built from.
+// generation is part of the ETag and grows with every invalidation, so data
+// the stored version does not cover (links, quality violations) still
+// changes the ETag after a sync.
+type sheetsCache struct {
+	mu         sync.Mutex
+	entries    map[string]*sheetsCacheEntry
+	generation uint64
+}
+
+type sheetsCacheEntry struct {
+	body    []byte
+	encoded map[string][]byte
+	addedAt time.Time
+}
+
+func (c *sheetsCache) put(etag string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*sheetsCacheEntry)
+	}
+	for len(c.entries) >= maxSheetsCacheEntries {
+		var oldest string
+		for k, e := range c.entries {
+			if oldest == "" || e.addedAt.Before(c.entries[oldest].addedAt) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[etag] = &sheetsCacheEntry{body: body, encoded: make(map[string][]byte), addedAt: time.Now()}
+}
+
+// get returns the cached body for etag in the requested encoding, compressing
+// it on first use. The returned encoding is empty when the body is sent as is.
+func (c *sheetsCache) get(etag, encoding string) ([]byte, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[etag]
+	if !ok {
+		return nil, "", false
+	}
+	if encoding == "" || len(e.body) < minCompressSize {
+		return e.body, "", true
+	}
+	if b, ok := e.encoded[encoding]; ok {
+		return b, encoding, true
+	}
+
+	var buf bytes.Buffer
+	enc := newEncoder(&buf, encoding)
+	if _, err := enc.Write(e.body); err != nil {
+		return e.body, "", true
+	}
+	if err := enc.Close(); err != nil {
+		return e.body, "", true
+	}
+	e.encoded[encoding] = buf.Bytes()
+	return e.encoded[encoding], encoding, true
+}
+
+func (c *sheetsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.generation++
+}
+
+func (c *sheetsCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (s *Server) InvalidateSheetsCache() {
+	s.sheets.invalidate()
+}
+
+func sheetsETag(v repo.SheetsVersion, mappingVersion, generation uint64, query string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%d|%d|%d|%d|%d|%d|%s",
+		fmtVersionTime(v.Watermark), fmtVersionTime(v.MaxUpdatedAt), v.Rows,
+		v.Violations, v.DealContacts, v.DealProducts, mappingVersion, generation, query)
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+func fmtVersionTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// cacheQuery normalizes the query string for the ETag. The api_key parameter
+// is dropped so that every consumer shares the same cached representation.
+func cacheQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if k == "api_key" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			b.WriteString(url.QueryEscape(k))
+			b.WriteByte('=')
+			b.WriteString(url.QueryEscape(v))
+			b.WriteByte('&')
+		}
+	}
+	return b.String()
+}
+
+func etagMatches(r *http.Request, etag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveCachedSheets(w http.ResponseWriter, r *http.Request, etag, format string) bool {
+	setRevalidateHeaders(w, etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	body, encoding, ok := s.sheets.get(etag, negotiateEncoding(r))
+	if !ok {
+		return false
+	}
+
+	w.Header().Set("Content-Type", sheetsContentType(format))
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+	return true
+}
+
+func setRevalidateHeaders(w http.ResponseWriter, etag string) {
+	// Clients may keep a copy but must revalidate it with If-None-Match every time.
+	w.Header().Set("Cache-Control", "no-cache, must-revalidate, max-age=0")
+	w.Header().Set("ETag", etag)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/metrics"
+	"freedom_bitrix/internal/repo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDealsSheetsConditionalGet(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	deals := make([]bitrix.Deal, 0, 40)
+	for i := 1; i <= 40; i++ {
+		deals = append(deals, bitrix.Deal{
+			ID:         fmt.Sprint(i),
+			CategoryID: "1",
+			StageID:    "C1:NEW",
+			DateCreate: "2026-02-01T09:00:00Z",
+			DateModify: "2026-02-01T09:00:00Z",
+			UTMSource:  "instagram",
+		})
+	}
+	if err := store.UpsertDeals(context.Background(), deals); err != nil {
+		t.Fatal(err)
+	}
+	handler := New(store, nil, "deals_sync").routes()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/deals/sheets", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip response, got %q", rec.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp dealsSheetsResponse
+	if err := json.NewDecoder(zr).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rows) != 40 {
+		t.Fatalf("got %d rows, want 40", len(resp.Rows))
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/deals/sheets?api_key=ignored", nil)
+	req.Header.Set("If-None-Match", etag)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional GET: status %d, want 304", rec.Code)
+	}
+
+	if err := store.UpsertDeals(context.Background(), deals[:1]); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/deals/sheets", nil)
+	req.Header.Set("If-None-Match", etag)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Fatalf("after upsert: status %d etag %s, want fresh 200", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestDealsSheetsETagFollowsViolationsAndInvalidation(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	deal := bitrix.Deal{ID: "1", CategoryID: "1", StageID: "C1:NEW", DateCreate: "2026-02-01T09:00:00Z", DateModify: "2026-02-01T09:00:00Z"}
+	if err := store.UpsertDeals(ctx, []bitrix.Deal{deal}); err != nil {
+		t.Fatal(err)
+	}
+	violation := repo.QualityViolation{DealID: 1, Rule: "not_future", CategoryID: 1, StageID: "C1:NEW"}
+	if _, _, err := store.SyncQualityViolations(ctx, []int64{1}, []repo.QualityViolation{violation}); err != nil {
+		t.Fatal(err)
+	}
+	srv := New(store, nil, "deals_sync")
+	handler := srv.routes()
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/deals/sheets", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	etag := get("").Header().Get("ETag")
+	if _, _, err := store.SyncQualityViolations(ctx, []int64{1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rec := get(etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Fatalf("after clearing a violation: status %d, want fresh 200", rec.Code)
+	}
+
+	etag = rec.Header().Get("ETag")
+	if rec := get(etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("unchanged data: status %d, want 304", rec.Code)
+	}
+	srv.InvalidateSheetsCache()
+	if rec := get(etag); rec.Code != http.StatusOK {
+		t.Fatalf("after invalidation: status %d, want 200", rec.Code)
+	}
+}
+
+func TestSheetWritersMatchBufferedShape(t *testing.T) {
+	rows := [][]any{
+		{"Воронка", 46000.5, int64(7), "<b>&"},
+		{"", "", int64(8), ""},
+	}
+
+	var streamed bytes.Buffer
+	sw := newSheetWriter(&streamed, "json")
+	if err := sw.WriteHeaders(defaultSheetProfile().headers()); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := sw.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buffered bytes.Buffer
+	if err := json.NewEncoder(&buffered).Encode(dealsSheetsResponse{Headers: defaultSheetProfile().headers(), Rows: rows}); err != nil {
+		t.Fatal(err)
+	}
+	if streamed.String() != buffered.String() {
+		t.Fatalf("streamed JSON differs:\n got %s\nwant %s", streamed.String(), buffered.String())
+	}
+
+	var csvOut bytes.Buffer
+	cw := newSheetWriter(&csvOut, "csv")
+	_ = cw.WriteHeaders([]string{"a", "b", "c", "d"})
+	for _, row := range rows {
+		_ = cw.WriteRow(row)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "a,b,c,d\nВоронка,46000.5,7,<b>&\n,,8,\n"; csvOut.String() != want {
+		t.Fatalf("csv = %q, want %q", csvOut.String(), want)
+	}
+}
+
+// failingStream fails after the first streamed row.
+type failingStream struct {
+	*repo.MemoryRepository
+}
+
+func (f failingStream) StreamDeals(ctx context.Context, q repo.DealQuery, fn func(repo.DealRow) error) error {
+	err := f.MemoryRepository.StreamDeals(ctx, q, fn)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("cursor broke")
+}
+
+func TestDealsSheetsAbortsOnStreamError(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	if err := store.UpsertDeals(context.Background(), []bitrix.Deal{{ID: "1", CategoryID: "1", DateCreate: "2026-02-01T09:00:00Z"}}); err != nil {
+		t.Fatal(err)
+	}
+	handler := New(failingStream{store}, nil, "deals_sync").routes()
+	aborted := metrics.HTTPRequests.WithLabelValues("/deals/sheets", "500")
+	before := testutil.ToFloat64(aborted)
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want http.ErrAbortHandler", p)
+		}
+		if got := testutil.ToFloat64(aborted) - before; got != 1 {
+			t.Fatalf("aborted requests counted %v times, want 1", got)
+		}
+	}()
+	req := httptest.NewRequest(http.MethodGet, "/deals/sheets", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	t.Fatal("handler finished a broken stream normally")
+}
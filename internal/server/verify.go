@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"freedom_bitrix/internal/verify"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Verifier interface {
+	Run(ctx context.Context, opts verify.Options, now time.Time) (verify.Report, error)
+}
+
+func WithVerify(v Verifier) Option {
+	return func(s *Server) {
+		s.verifier = v
+	}
+}
+
+// handleVerify compares bitrix_deals with Bitrix and, with resync=1, queues
+// a reload of the mismatching ranges for the next delta run.
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if s.verifier == nil {
+		http.Error(w, "verification is not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	opts := verify.Options{Months: verify.DefaultMonths, Sample: verify.DefaultSample}
+	if v := q.Get("months"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > verify.MaxMonths {
+			http.Error(w, "months must be between 1 and "+strconv.Itoa(verify.MaxMonths), http.StatusBadRequest)
+			return
+		}
+		opts.Months = n
+	}
+	if v := q.Get("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > verify.MaxSample {
+			http.Error(w, "sample must be between 0 and "+strconv.Itoa(verify.MaxSample), http.StatusBadRequest)
+			return
+		}
+		opts.Sample = n
+	}
+	if v := q.Get("resync"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "resync must be a boolean", http.StatusBadRequest)
+			return
+		}
+		opts.Resync = b
+	}
+
+	// One run at a time: each makes a crm.item.list call per category and
+	// month.
+	if !s.verifying.TryLock() {
+		http.Error(w, "verification is already running", http.StatusConflict)
+		return
+	}
+	defer s.verifying.Unlock()
+
+	rep, err := s.verifier.Run(r.Context(), opts, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, rep)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"freedom_bitrix/internal/repo"
+	"freedom_bitrix/internal/verify"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeVerifier struct {
+	opts verify.Options
+}
+
+func (f *fakeVerifier) Run(ctx context.Context, opts verify.Options, now time.Time) (verify.Report, error) {
+	f.opts = opts
+	return verify.Report{
+		Cells:  2,
+		Counts: []verify.CountMismatch{{CategoryID: 1, Month: "2026-03", Bitrix: 5, Local: 4}},
+	}, nil
+}
+
+func TestVerifyEndpointParsesOptions(t *testing.T) {
+	v := &fakeVerifier{}
+	handler := New(repo.NewMemoryRepository(), nil, "deals_sync", WithVerify(v)).routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/deals/verify?months=3&sample=0&resync=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if want := (verify.Options{Months: 3, Sample: 0, Resync: true}); v.opts != want {
+		t.Fatalf("options = %+v, want %+v", v.opts, want)
+	}
+	var rep verify.Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.OK() || len(rep.Counts) != 1 || rep.Counts[0].Bitrix != 5 {
+		t.Fatalf("report = %+v", rep)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/deals/verify", nil))
+	if want := (verify.Options{Months: verify.DefaultMonths, Sample: verify.DefaultSample}); v.opts != want {
+		t.Fatalf("default options = %+v", v.opts)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/deals/verify?months=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("months=0 status %d", rec.Code)
+	}
+}
@@ -0,0 +1,98 @@
+package sla
+
+import (
+	"context"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"freedom_bitrix/internal/repo"
+	"time"
+)
+
+type Store interface {
+	ListDealStageStates(ctx context.Context, stageIDs []string) ([]repo.DealStageState, error)
+	SyncSLABreaches(ctx context.Context, current []repo.SLABreach) ([]repo.SLABreach, int, error)
+}
+
+type Evaluator struct {
+	store Store
+	rules []Rule
+}
+
+type Result struct {
+	Open    int
+	Opened  []repo.SLABreach
+	Cleared int
+}
+
+func NewEvaluator(store Store, rules []Rule) *Evaluator {
+	return &Evaluator{store: store, rules: rules}
+}
+
+// Evaluate checks every deal in a ruled stage against now and replaces the
+// stored breaches. Deals that left the stage or became active again are
+// cleared.
+func (e *Evaluator) Evaluate(ctx context.Context, now time.Time) (Result, error) {
+	if len(e.rules) == 0 {
+		return Result{}, nil
+	}
+
+	stages := make([]string, 0, len(e.rules))
+	for _, r := range e.rules {
+		stages = append(stages, r.StageID)
+	}
+	states, err := e.store.ListDealStageStates(ctx, stages)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var current []repo.SLABreach
+	for _, st := range states {
+		for _, r := range e.rules {
+			if r.breached(st, now) {
+				current = append(current, repo.SLABreach{
+					DealID:       st.DealID,
+					Rule:         r.Name,
+					CategoryID:   st.CategoryID,
+					StageID:      st.StageID,
+					AssignedByID: st.AssignedByID,
+					EnteredAt:    st.EnteredAt,
+					LastModify:   st.DateModify,
+				})
+			}
+		}
+	}
+
+	opened, cleared, err := e.store.SyncSLABreaches(ctx, current)
+	if err != nil {
+		return Result{}, err
+	}
+
+	metrics.SLABreachesOpen.Set(float64(len(current)))
+	res := Result{Open: len(current), Opened: opened, Cleared: cleared}
+	if len(opened) > 0 || cleared > 0 {
+		logging.FromContext(ctx).Info("sla evaluated", "open", res.Open, "opened", len(opened), "cleared", cleared)
+	}
+	return res, nil
+}
+
+func (r Rule) breached(st repo.DealStageState, now time.Time) bool {
+	if st.StageID != r.StageID {
+		return false
+	}
+	if r.CategoryID != nil && st.CategoryID != *r.CategoryID {
+		return false
+	}
+	if r.MaxInStage > 0 && now.Sub(st.EnteredAt) <= time.Duration(r.MaxInStage) {
+		return false
+	}
+	if r.MaxIdle > 0 {
+		last := st.EnteredAt
+		if st.DateModify != nil {
+			last = *st.DateModify
+		}
+		if now.Sub(last) <= time.Duration(r.MaxIdle) {
+			return false
+		}
+	}
+	return true
+}
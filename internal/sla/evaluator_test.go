@@ -0,0 +1,78 @@
+package sla
+
+import (
+	"context"
+	"encoding/json"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"testing"
+	"time"
+)
+
+func TestEvaluateOpensAndClearsBreaches(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	err := store.UpsertDeals(ctx, []bitrix.Deal{
+		{ID: "1", CategoryID: "1", StageID: "C1:PREPARATION", DateModify: "2026-03-01T09:00:00Z", MovedTime: "2026-03-01T09:00:00Z"},
+		{ID: "2", CategoryID: "1", StageID: "C1:PREPARATION", DateModify: "2026-03-04T08:00:00Z", MovedTime: "2026-03-01T09:00:00Z"},
+		{ID: "3", CategoryID: "2", StageID: "C1:PREPARATION", DateModify: "2026-03-01T09:00:00Z", MovedTime: "2026-03-01T09:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal([]byte(`[{"name":"stuck-interview","category_id":1,"stage_id":"C1:PREPARATION","max_in_stage":"3d","max_idle":"72h"}]`), &rules); err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEvaluator(store, rules)
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	res, err := ev.Evaluate(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deal 2 was modified recently and deal 3 is in another category.
+	if res.Open != 1 || len(res.Opened) != 1 || res.Opened[0].DealID != 1 {
+		t.Fatalf("first evaluation = %+v", res)
+	}
+
+	res, err = ev.Evaluate(ctx, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Open != 1 || len(res.Opened) != 0 {
+		t.Fatalf("repeated evaluation reopened breaches: %+v", res)
+	}
+
+	// The deal moves on to the next stage.
+	err = store.UpsertDeals(ctx, []bitrix.Deal{
+		{ID: "1", CategoryID: "1", StageID: "C1:EXECUTING", DateModify: "2026-03-04T13:00:00Z", MovedTime: "2026-03-04T13:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = ev.Evaluate(ctx, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Open != 0 || res.Cleared != 1 {
+		t.Fatalf("after stage change = %+v", res)
+	}
+	if open, _ := store.ListSLABreaches(ctx); len(open) != 0 {
+		t.Fatalf("breaches left: %+v", open)
+	}
+}
+
+func TestLoadRulesValidation(t *testing.T) {
+	var r Rule
+	if err := json.Unmarshal([]byte(`{"name":"x","stage_id":"NEW"}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.validate(); err == nil {
+		t.Fatal("rule without thresholds should be rejected")
+	}
+	if d, err := ParseDuration("3d"); err != nil || d != 72*time.Hour {
+		t.Fatalf("ParseDuration(3d) = %v, %v", d, err)
+	}
+}
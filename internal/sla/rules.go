@@ -0,0 +1,99 @@
+package sla
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule flags deals that stay in StageID (optionally only in CategoryID) for
+// longer than MaxInStage and/or go without modification for longer than
+// MaxIdle. Both thresholds must be exceeded when both are set.
+type Rule struct {
+	Name       string   `json:"name"`
+	CategoryID *int     `json:"category_id,omitempty"`
+	StageID    string   `json:"stage_id"`
+	MaxInStage Duration `json:"max_in_stage,omitempty"`
+	MaxIdle    Duration `json:"max_idle,omitempty"`
+}
+
+// Duration accepts Go durations ("36h", "90m") and whole days ("3d").
+type Duration time.Duration
+
+var daysRe = regexp.MustCompile(`^(\d+)d$`)
+
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if m := daysRe.FindStringSubmatch(s); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"72h\" or \"3d\"")
+	}
+	v, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func LoadRules(path string) ([]Rule, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read sla rules: %w", err)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("parse sla rules %s: %w", path, err)
+	}
+
+	seen := make(map[string]struct{}, len(rules))
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("sla rule %q: %w", rules[i].Name, err)
+		}
+		if _, ok := seen[rules[i].Name]; ok {
+			return nil, fmt.Errorf("duplicate sla rule %q", rules[i].Name)
+		}
+		seen[rules[i].Name] = struct{}{}
+	}
+	return rules, nil
+}
+
+func (r *Rule) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.StageID = strings.TrimSpace(r.StageID)
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.StageID == "" {
+		return fmt.Errorf("stage_id is required")
+	}
+	if r.MaxInStage <= 0 && r.MaxIdle <= 0 {
+		return fmt.Errorf("set max_in_stage and/or max_idle")
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"time"
+)
+
+// listPage is one page of a Bitrix list method.
+type listPage[T any] struct {
+	items []T
+	next  *int
+	total *int
+}
+
+// fetchFunc loads the page that starts at start.
+type fetchFunc[T any] func(ctx context.Context, start int) (listPage[T], error)
+
+// listFetcher pages a classic crm.*.list method.
+func listFetcher[T any](s *Service, method string, payload map[string]any) fetchFunc[T] {
+	return func(ctx context.Context, start int) (listPage[T], error) {
+		payload["start"] = start
+		var page bitrix.ListResponse[T]
+		err := callWithRetry(ctx, s.retryCount, func(c context.Context) error {
+			reqCtx, cancel := context.WithTimeout(c, 25*time.Second)
+			defer cancel()
+			return s.bitrix.Call(reqCtx, method, payload, &page)
+		})
+		if err != nil {
+			return listPage[T]{}, fmt.Errorf("bitrix %s start=%d: %w", method, start, err)
+		}
+		return listPage[T]{items: page.Result, next: page.Next, total: page.Total}, nil
+	}
+}
+
+// itemFetcher pages crm.item.list; the payload carries entityTypeId.
+func itemFetcher(s *Service, payload map[string]any) fetchFunc[bitrix.Item] {
+	return func(ctx context.Context, start int) (listPage[bitrix.Item], error) {
+		payload["start"] = start
+		var page bitrix.ItemListResponse
+		err := callWithRetry(ctx, s.retryCount, func(c context.Context) error {
+			reqCtx, cancel := context.WithTimeout(c, 25*time.Second)
+			defer cancel()
+			return s.bitrix.Call(reqCtx, "crm.item.list", payload, &page)
+		})
+		if err != nil {
+			return listPage[bitrix.Item]{}, fmt.Errorf("bitrix crm.item.list entityTypeId=%v start=%d: %w", payload["entityTypeId"], start, err)
+		}
+		return listPage[bitrix.Item]{items: page.Result.Items, next: page.Next, total: page.Total}, nil
+	}
+}
+
+// upsertFunc stores a page of a run.
+type upsertFunc[T any] func(ctx context.Context, run *syncRun, items []T) error
+
+// storeFunc adapts a store method that does not need the run.
+func storeFunc[T any](fn func(context.Context, []T) error) upsertFunc[T] {
+	return func(ctx context.Context, _ *syncRun, items []T) error { return fn(ctx, items) }
+}
+
+type walkSpec[T any] struct {
+	fetch      fetchFunc[T]
+	upsert     upsertFunc[T]
+	dateModify func(T) string
+}
+
+// walk pages through a list until Bitrix reports no next page or a stop is
+// requested between pages. Every page is upserted before the next one is
+// requested; maxModify is the newest modification time seen, at least from.
+func walk[T any](ctx context.Context, s *Service, run *syncRun, from time.Time, spec walkSpec[T]) (maxModify time.Time, stopped bool, err error) {
+	maxModify = from
+	start := 0
+	for pageNum := 1; ; pageNum++ {
+		page, err := spec.fetch(ctx, start)
+		if err != nil {
+			return maxModify, false, fmt.Errorf("page %d: %w", pageNum, err)
+		}
+
+		if len(page.items) > 0 {
+			if err := spec.upsert(ctx, run, page.items); err != nil {
+				return maxModify, false, fmt.Errorf("upsert page %d: %w", pageNum, err)
+			}
+		}
+		run.page(len(page.items))
+
+		for _, item := range page.items {
+			tm, err := parseRFC3339(spec.dateModify(item))
+			if err == nil && tm.After(maxModify) {
+				maxModify = tm
+			}
+		}
+
+		nextVal, total := -1, -1
+		if page.next != nil {
+			nextVal = *page.next
+		}
+		if page.total != nil {
+			total = *page.total
+		}
+		run.logger.Info("sync page",
+			"entity", run.entity, "page", pageNum, "got", len(page.items), "start", start, "next", nextVal,
+			"total", total, "collected", run.items, "watermark_now", formatWatermark(maxModify))
+
+		if page.next == nil {
+			return maxModify, false, nil
+		}
+		if stopRequested(ctx) {
+			run.logger.Warn("sync stopping after committed page", "page", pageNum)
+			return maxModify, true, nil
+		}
+		start = *page.next
+		time.Sleep(s.requestWait)
+	}
+}
+
+// deltaSpec describes an incremental sync: everything modified since the
+// entity's own watermark (minus the overlap), or everything without one.
+type deltaSpec[T any] struct {
+	entity   string
+	stateKey string
+	// fetch builds the page loader for the lower modification bound, nil
+	// when there is no watermark yet.
+	fetch      func(from *time.Time) fetchFunc[T]
+	upsert     upsertFunc[T]
+	dateModify func(T) string
+	// primary marks the deal sync: it needs the watermark of a full sync
+	// and warns when the watermark stops moving.
+	primary bool
+}
+
+func syncDelta[T any](ctx context.Context, s *Service, spec deltaSpec[T]) (err error) {
+	ctx, logger := s.runLogger(ctx, spec.stateKey, "delta")
+	logger.Info("entity sync start", "entity", spec.entity)
+	run := s.beginRun(logger, spec.stateKey, spec.entity, "delta")
+	defer func() { s.finishRun(ctx, run, err) }()
+
+	wm, err := s.watermarks.GetWatermark(ctx, spec.stateKey)
+	if err != nil {
+		return fmt.Errorf("get watermark: %w", err)
+	}
+	if wm.IsZero() && spec.primary {
+		return ErrNoWatermark
+	}
+	run.watermark = wm
+
+	var from *time.Time
+	if !wm.IsZero() {
+		f := wm.Add(-s.overlap)
+		from = &f
+		logger.Info("entity sync range", "entity", spec.entity,
+			"watermark", formatWatermark(wm), "from", formatWatermark(f), "overlap", s.overlap.String())
+	}
+
+	// Pages are ordered by modification time, so the watermark of the
+	// committed pages is kept also when a later page fails.
+	maxModify, stopped, err := walk(ctx, s, run, wm, walkSpec[T]{
+		fetch:      spec.fetch(from),
+		upsert:     spec.upsert,
+		dateModify: spec.dateModify,
+	})
+	if maxModify.After(wm) {
+		if setErr := s.watermarks.SetWatermark(ctx, spec.stateKey, maxModify); setErr != nil {
+			return errors.Join(err, fmt.Errorf("set watermark: %w", setErr))
+		}
+		run.watermark = maxModify
+	} else if err == nil && spec.primary && !wm.IsZero() {
+		if age := time.Since(wm); age > s.staleAfter {
+			logger.Warn("delta sync: nothing newer than the watermark", "entity", spec.entity,
+				"age", age.Round(time.Minute).String(), "watermark", formatWatermark(wm))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return ErrStopped
+	}
+
+	logger.Info("entity sync end", "entity", spec.entity, "pages", run.pages, "updated", run.items)
+	return nil
+}
+
+// fullSpec describes a full load of an entity, every page of fetch.
+type fullSpec[T any] struct {
+	entity     string
+	stateKey   string
+	fetch      fetchFunc[T]
+	upsert     upsertFunc[T]
+	dateModify func(T) string
+}
+
+// syncFull loads every page and then moves the watermark to the newest
+// modification seen. A full load is not ordered by modification time, so a
+// failed or stopped run keeps the watermark; it also never moves back, since
+// deltas may have stored newer items meanwhile.
+func syncFull[T any](ctx context.Context, s *Service, spec fullSpec[T]) (err error) {
+	ctx, logger := s.runLogger(ctx, spec.stateKey, "full")
+	logger.Info("full sync start", "entity", spec.entity)
+	run := s.beginRun(logger, spec.stateKey, spec.entity, "full")
+	defer func() { s.finishRun(ctx, run, err) }()
+
+	wm, err := s.watermarks.GetWatermark(ctx, spec.stateKey)
+	if err != nil {
+		return fmt.Errorf("get watermark: %w", err)
+	}
+
+	maxModify, stopped, err := walk(ctx, s, run, time.Time{}, walkSpec[T]{
+		fetch:      spec.fetch,
+		upsert:     spec.upsert,
+		dateModify: spec.dateModify,
+	})
+	if err != nil {
+		return fmt.Errorf("%s full sync: %w", spec.entity, err)
+	}
+	if stopped {
+		logger.Warn("full sync stopped before completion, watermark not updated", "entity", spec.entity, "pages", run.pages)
+		return ErrStopped
+	}
+
+	if maxModify.After(wm) {
+		if err := s.watermarks.SetWatermark(ctx, spec.stateKey, maxModify); err != nil {
+			return fmt.Errorf("set watermark: %w", err)
+		}
+		logger.Info("full sync watermark set", "entity", spec.entity, "watermark", formatWatermark(maxModify))
+		run.watermark = maxModify
+	}
+
+	logger.Info("full sync end", "entity", spec.entity, "pages", run.pages, "collected", run.items)
+	return nil
+}
+
+// listPayload builds a classic list request ordered by modifyField.
+func listPayload(fields []string, base map[string]any, modifyField string, from *time.Time) map[string]any {
+	filter := make(map[string]any, len(base)+1)
+	for k, v := range base {
+		filter[k] = v
+	}
+	if from != nil {
+		filter[">="+modifyField] = from.UTC().Format(time.RFC3339)
+	}
+	return map[string]any{
+		"SELECT": fields,
+		"FILTER": filter,
+		"ORDER": map[string]any{
+			modifyField: "ASC",
+			"ID":        "ASC",
+		},
+	}
+}
+
+func formatWatermark(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
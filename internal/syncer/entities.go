@@ -0,0 +1,238 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// EntityTypeDeal is the crm entityTypeId of deals.
+const EntityTypeDeal = 2
+
+// DefaultItemsTable stores crm.item.list entities without an own table.
+const DefaultItemsTable = "bitrix_items"
+
+// Entity configures the sync of one crm entity type loaded with
+// crm.item.list. Select and Filter use its camelCase field names (stageId,
+// ufCrm5_1700000000); upper-case names (STAGE_ID, UF_CRM_5_1700000000) are
+// converted. Items are stored in Table. Deals (entity_type_id 2) always go to
+// bitrix_deals under the deal state key, so for them only Select and Filter
+// apply; extra deal fields get no typed column, user fields land in
+// uf_values and the rest only in raw.
+type Entity struct {
+	Name         string         `json:"name"`
+	EntityTypeID int            `json:"entity_type_id"`
+	StateKey     string         `json:"state_key,omitempty"`
+	Select       []string       `json:"select,omitempty"`
+	Filter       map[string]any `json:"filter,omitempty"`
+	Table        string         `json:"table,omitempty"`
+}
+
+type ItemStore interface {
+	UpsertItems(ctx context.Context, table string, entityTypeID int, items []bitrix.Item) error
+}
+
+// itemBaseFields are always selected from crm.item.list: the engine needs id
+// and updatedTime, the store fills its typed columns from the rest.
+var itemBaseFields = []string{"id", "title", "categoryId", "stageId", "assignedById", "createdTime", "updatedTime"}
+
+var (
+	entityNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+	tableNameRe  = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+)
+
+// LoadEntities reads the entity list from a JSON file; an empty path means no
+// extra entities.
+func LoadEntities(path string) ([]Entity, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read entities: %w", err)
+	}
+
+	var entities []Entity
+	if err := json.Unmarshal(raw, &entities); err != nil {
+		return nil, fmt.Errorf("parse entities %s: %w", path, err)
+	}
+
+	names := make(map[string]struct{}, len(entities))
+	keys := make(map[string]struct{}, len(entities))
+	for i := range entities {
+		e := &entities[i]
+		if err := e.normalize(); err != nil {
+			return nil, fmt.Errorf("entity %q: %w", e.Name, err)
+		}
+		if _, ok := names[e.Name]; ok {
+			return nil, fmt.Errorf("duplicate entity %q", e.Name)
+		}
+		names[e.Name] = struct{}{}
+		if e.EntityTypeID == EntityTypeDeal {
+			continue
+		}
+		if _, ok := keys[e.StateKey]; ok {
+			return nil, fmt.Errorf("entity %q: duplicate state_key %q", e.Name, e.StateKey)
+		}
+		keys[e.StateKey] = struct{}{}
+	}
+	return entities, nil
+}
+
+func (e *Entity) normalize() error {
+	e.Name = strings.TrimSpace(e.Name)
+	if !entityNameRe.MatchString(e.Name) {
+		return fmt.Errorf("invalid name (use lowercase letters, digits and _)")
+	}
+	if e.EntityTypeID <= 0 {
+		return fmt.Errorf("entity_type_id must be positive")
+	}
+	if e.EntityTypeID == EntityTypeDeal {
+		return nil
+	}
+	e.StateKey = strings.TrimSpace(e.StateKey)
+	if e.StateKey == "" {
+		e.StateKey = e.Name + "_sync"
+	}
+	e.Table = strings.TrimSpace(e.Table)
+	if e.Table == "" {
+		e.Table = DefaultItemsTable
+	}
+	if !tableNameRe.MatchString(e.Table) {
+		return fmt.Errorf("invalid table %q", e.Table)
+	}
+	return nil
+}
+
+// WithItems enables the sync of the given entities. A deal entity does not
+// add a sync of its own, it replaces the deal filter and adds its select
+// fields to the deal sync.
+func WithItems(store ItemStore, entities ...Entity) Option {
+	return func(s *Service) {
+		s.items = store
+		s.deal.Filter = DealFilter(entities)
+		for _, e := range entities {
+			if e.EntityTypeID != EntityTypeDeal {
+				s.entities = append(s.entities, e)
+				continue
+			}
+			for _, f := range e.Select {
+				if f = bitrix.ItemFieldName(f); !slices.Contains(s.deal.Select, f) {
+					s.deal.Select = append(s.deal.Select, f)
+				}
+			}
+		}
+	}
+}
+
+// ItemTables returns the custom tables of the crm.item.list entities, those
+// other than DefaultItemsTable, once each.
+func ItemTables(entities []Entity) []string {
+	var tables []string
+	for _, e := range entities {
+		if e.EntityTypeID == EntityTypeDeal || e.Table == DefaultItemsTable || slices.Contains(tables, e.Table) {
+			continue
+		}
+		tables = append(tables, e.Table)
+	}
+	return tables
+}
+
+// DealFilter returns the crm.item.list filter deals are synced with: the
+// filter of the last deal entity that sets one, or the default categories.
+func DealFilter(entities []Entity) map[string]any {
+	filter := defaultDealFilter()
+	for _, e := range entities {
+		if e.EntityTypeID == EntityTypeDeal && e.Filter != nil {
+			filter = bitrix.ItemFilter(e.Filter)
+		}
+	}
+	return filter
+}
+
+// SyncItems loads the items of e modified since its watermark through
+// crm.item.list. Without a watermark every item is loaded.
+func (s *Service) SyncItems(ctx context.Context, e Entity) error {
+	if s.items == nil {
+		return fmt.Errorf("%s sync: item store is not configured", e.Name)
+	}
+	return syncDelta(ctx, s, deltaSpec[bitrix.Item]{
+		entity:   e.Name,
+		stateKey: e.StateKey,
+		fetch: func(from *time.Time) fetchFunc[bitrix.Item] {
+			return itemFetcher(s, itemPayload(e, from))
+		},
+		dateModify: itemUpdatedTime,
+		upsert:     s.itemUpsert(e),
+	})
+}
+
+// FullSyncItems loads every item of e, whatever its watermark, and moves the
+// watermark forward to the newest item.
+func (s *Service) FullSyncItems(ctx context.Context, e Entity) error {
+	if s.items == nil {
+		return fmt.Errorf("%s sync: item store is not configured", e.Name)
+	}
+	return syncFull(ctx, s, fullSpec[bitrix.Item]{
+		entity:     e.Name,
+		stateKey:   e.StateKey,
+		fetch:      itemFetcher(s, itemListPayload(e, nil, map[string]any{"id": "ASC"})),
+		dateModify: itemUpdatedTime,
+		upsert:     s.itemUpsert(e),
+	})
+}
+
+func (s *Service) itemUpsert(e Entity) upsertFunc[bitrix.Item] {
+	return func(ctx context.Context, _ *syncRun, items []bitrix.Item) error {
+		return s.items.UpsertItems(ctx, e.Table, e.EntityTypeID, items)
+	}
+}
+
+func itemUpdatedTime(it bitrix.Item) string { return it.String("updatedTime") }
+
+// itemPayload builds a crm.item.list request for the items modified since
+// from, ordered by updatedTime.
+func itemPayload(e Entity, from *time.Time) map[string]any {
+	var extra map[string]any
+	if from != nil {
+		extra = map[string]any{">=updatedTime": from.UTC().Format(time.RFC3339)}
+	}
+	return itemListPayload(e, extra, map[string]any{
+		"updatedTime": "ASC",
+		"id":          "ASC",
+	})
+}
+
+// itemListPayload builds a crm.item.list request for e with extra added to
+// its filter.
+func itemListPayload(e Entity, extra, order map[string]any) map[string]any {
+	fields := []string{"*"}
+	if len(e.Select) > 0 {
+		fields = slices.Clone(itemBaseFields)
+		for _, f := range e.Select {
+			if f = bitrix.ItemFieldName(f); !slices.Contains(fields, f) {
+				fields = append(fields, f)
+			}
+		}
+	}
+	filter := bitrix.ItemFilter(e.Filter)
+	if filter == nil {
+		filter = make(map[string]any, len(extra))
+	}
+	for k, v := range extra {
+		filter[k] = v
+	}
+	return map[string]any{
+		"entityTypeId": e.EntityTypeID,
+		"select":       fields,
+		"filter":       filter,
+		"order":        order,
+	}
+}
@@ -0,0 +1,145 @@
+package syncer
+
+import (
+	"context"
+	"freedom_bitrix/internal/repo"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSyncItemsWalksItemListByUpdatedTime(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.SetWatermark(ctx, "onboarding_sync", time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.item.list": `{"result":{"items":[
+			{"id":41,"title":"Онбординг","categoryId":12,"stageId":"DT1036_12:NEW","assignedById":5,"updatedTime":"2026-03-01T18:00:00+05:00","ufCrm5_1700000000":"Алматы"}
+		]},"total":1}`,
+	}}
+	entity := Entity{Name: "onboarding", EntityTypeID: 1036, StateKey: "onboarding_sync", Select: []string{"ufCrm5_1700000000"}, Table: DefaultItemsTable}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithItems(store, entity))
+	if err := svc.SyncRelated(ctx); err != nil {
+		t.Fatalf("sync related: %v", err)
+	}
+
+	payload := source.payloads["crm.item.list"]
+	if payload["entityTypeId"] != 1036 {
+		t.Fatalf("entityTypeId = %v", payload["entityTypeId"])
+	}
+	if filter := payload["filter"].(map[string]any); filter[">=updatedTime"] != "2026-03-01T11:50:00Z" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+	if sel := payload["select"].([]string); !slices.Contains(sel, "updatedTime") || !slices.Contains(sel, "ufCrm5_1700000000") {
+		t.Fatalf("unexpected select: %v", sel)
+	}
+
+	it, ok := store.Item(DefaultItemsTable, 1036, 41)
+	if !ok || it.String("ufCrm5_1700000000") != "Алматы" || it.String("stageId") != "DT1036_12:NEW" {
+		t.Fatalf("unexpected item: %v (found %v)", it, ok)
+	}
+	got, _ := store.GetWatermark(ctx, "onboarding_sync")
+	if want := time.Date(2026, 3, 1, 13, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+}
+
+func TestSyncRelatedFullReloadsItems(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	wm := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.SetWatermark(ctx, "onboarding_sync", wm); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.item.list": `{"result":{"items":[
+			{"id":40,"updatedTime":"2026-02-01T10:00:00+05:00"},
+			{"id":41,"updatedTime":"2026-03-01T18:00:00+05:00"}
+		]},"total":2}`,
+	}}
+	entity := Entity{Name: "onboarding", EntityTypeID: 1036, StateKey: "onboarding_sync", Table: DefaultItemsTable}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithItems(store, entity))
+	if err := svc.SyncRelatedFull(ctx); err != nil {
+		t.Fatalf("full sync: %v", err)
+	}
+
+	payload := source.payloads["crm.item.list"]
+	if filter := payload["filter"].(map[string]any); len(filter) != 0 {
+		t.Fatalf("full sync must not filter by the watermark: %v", filter)
+	}
+	if _, ok := store.Item(DefaultItemsTable, 1036, 40); !ok {
+		t.Fatal("item older than the watermark was not loaded")
+	}
+	got, _ := store.GetWatermark(ctx, "onboarding_sync")
+	if want := time.Date(2026, 3, 1, 13, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+}
+
+func TestWithItemsDealEntityConfiguresDealSync(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.SetWatermark(ctx, "deals_sync", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.item.list": `{"result":{"items":[]}}`,
+	}}
+	// Upper-case names are converted to the crm.item.list ones.
+	deal := Entity{Name: "deal", EntityTypeID: EntityTypeDeal, Select: []string{"UF_CRM_1", "ID"}, Filter: map[string]any{"CATEGORY_ID": 7}}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithItems(store, deal))
+	if err := svc.DeltaSync(ctx); err != nil {
+		t.Fatalf("delta sync: %v", err)
+	}
+
+	payload := source.payloads["crm.item.list"]
+	if payload["entityTypeId"] != EntityTypeDeal {
+		t.Fatalf("entityTypeId = %v", payload["entityTypeId"])
+	}
+	filter := payload["filter"].(map[string]any)
+	if filter["categoryId"] != 7 || filter["@categoryId"] != nil {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+	sel := payload["select"].([]string)
+	if !slices.Contains(sel, "ufCrm_1") || !slices.Contains(sel, "stageId") || slices.Contains(sel, "ID") {
+		t.Fatalf("unexpected select: %v", sel)
+	}
+	if err := svc.SyncRelated(ctx); err != nil {
+		t.Fatalf("deal entity must not add an item sync: %v", err)
+	}
+}
+
+func TestLoadEntitiesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entities.json")
+	body := `[{"name":"onboarding","entity_type_id":1036},{"name":"trips","entity_type_id":1040,"table":"bitrix_trips"}]`
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	entities, err := LoadEntities(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entities[0]; e.StateKey != "onboarding_sync" || e.Table != DefaultItemsTable {
+		t.Fatalf("unexpected defaults: %+v", e)
+	}
+	if entities[1].Table != "bitrix_trips" {
+		t.Fatalf("unexpected table: %+v", entities[1])
+	}
+	if tables := ItemTables(entities); !slices.Equal(tables, []string{"bitrix_trips"}) {
+		t.Fatalf("item tables = %v", tables)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"name":"x","entity_type_id":1036,"table":"bad; drop"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadEntities(path); err == nil {
+		t.Fatal("expected an invalid table error")
+	}
+}
@@ -0,0 +1,253 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/logging"
+	"strconv"
+	"time"
+)
+
+// State keys of the related entity watermarks.
+const (
+	ContactsStateKey   = "contacts_sync"
+	CompaniesStateKey  = "companies_sync"
+	LeadsStateKey      = "leads_sync"
+	ActivitiesStateKey = "activities_sync"
+)
+
+// batchLimit is the maximum number of commands Bitrix accepts in one batch call.
+const batchLimit = 50
+
+type RelatedStore interface {
+	UpsertContacts(ctx context.Context, contacts []bitrix.Contact) error
+	UpsertCompanies(ctx context.Context, companies []bitrix.Company) error
+	ReplaceDealContacts(ctx context.Context, links map[int64][]bitrix.DealContact) error
+}
+
+type LeadStore interface {
+	UpsertLeads(ctx context.Context, leads []bitrix.Lead) error
+}
+
+// WithLeads enables the lead sync.
+func WithLeads(store LeadStore) Option {
+	return func(s *Service) {
+		s.leads = store
+	}
+}
+
+type ActivityStore interface {
+	UpsertActivities(ctx context.Context, activities []bitrix.Activity) error
+}
+
+// WithActivities enables the sync of deal activities.
+func WithActivities(store ActivityStore) Option {
+	return func(s *Service) {
+		s.activities = store
+	}
+}
+
+type ProductStore interface {
+	ReplaceDealProducts(ctx context.Context, products map[int64][]bitrix.ProductRow) error
+}
+
+// WithProducts refreshes the product rows of every synced deal page.
+func WithProducts(store ProductStore) Option {
+	return func(s *Service) {
+		s.products = store
+	}
+}
+
+// WithRelated enables contact and company syncs and refreshes the deal-contact
+// links of every synced deal page.
+func WithRelated(store RelatedStore) Option {
+	return func(s *Service) {
+		s.related = store
+	}
+}
+
+// SyncContacts loads contacts modified since the contacts watermark. Without
+// a watermark every contact is loaded.
+func (s *Service) SyncContacts(ctx context.Context) error {
+	if s.related == nil {
+		return fmt.Errorf("contact sync: related store is not configured")
+	}
+	fields := []string{
+		"ID", "NAME", "LAST_NAME", "SECOND_NAME", "COMPANY_ID", "ASSIGNED_BY_ID",
+		"DATE_CREATE", "DATE_MODIFY", "PHONE", "EMAIL",
+	}
+	return syncDelta(ctx, s, deltaSpec[bitrix.Contact]{
+		entity:   EntityContact,
+		stateKey: ContactsStateKey,
+		fetch: func(from *time.Time) fetchFunc[bitrix.Contact] {
+			return listFetcher[bitrix.Contact](s, "crm.contact.list", listPayload(fields, nil, "DATE_MODIFY", from))
+		},
+		dateModify: func(c bitrix.Contact) string { return c.DateModify },
+		upsert:     storeFunc(s.related.UpsertContacts),
+	})
+}
+
+// SyncCompanies loads companies modified since the companies watermark.
+func (s *Service) SyncCompanies(ctx context.Context) error {
+	if s.related == nil {
+		return fmt.Errorf("company sync: related store is not configured")
+	}
+	fields := []string{"ID", "TITLE", "ASSIGNED_BY_ID", "DATE_CREATE", "DATE_MODIFY", "PHONE", "EMAIL"}
+	return syncDelta(ctx, s, deltaSpec[bitrix.Company]{
+		entity:   EntityCompany,
+		stateKey: CompaniesStateKey,
+		fetch: func(from *time.Time) fetchFunc[bitrix.Company] {
+			return listFetcher[bitrix.Company](s, "crm.company.list", listPayload(fields, nil, "DATE_MODIFY", from))
+		},
+		dateModify: func(c bitrix.Company) string { return c.DateModify },
+		upsert:     storeFunc(s.related.UpsertCompanies),
+	})
+}
+
+// SyncLeads loads leads modified since the leads watermark.
+func (s *Service) SyncLeads(ctx context.Context) error {
+	if s.leads == nil {
+		return fmt.Errorf("lead sync: lead store is not configured")
+	}
+	fields := []string{
+		"ID", "TITLE", "STATUS_ID", "STATUS_SEMANTIC_ID", "SOURCE_ID", "ASSIGNED_BY_ID",
+		"CONTACT_ID", "COMPANY_ID", "DATE_CREATE", "DATE_MODIFY", "DATE_CLOSED",
+		"UTM_SOURCE", "UTM_CAMPAIGN",
+	}
+	return syncDelta(ctx, s, deltaSpec[bitrix.Lead]{
+		entity:   EntityLead,
+		stateKey: LeadsStateKey,
+		fetch: func(from *time.Time) fetchFunc[bitrix.Lead] {
+			return listFetcher[bitrix.Lead](s, "crm.lead.list", listPayload(fields, nil, "DATE_MODIFY", from))
+		},
+		dateModify: func(l bitrix.Lead) string { return l.DateModify },
+		upsert:     storeFunc(s.leads.UpsertLeads),
+	})
+}
+
+// SyncActivities loads deal activities (OWNER_TYPE_ID=2) updated since the
+// activities watermark. Activities have no DATE_MODIFY, LAST_UPDATED is used.
+func (s *Service) SyncActivities(ctx context.Context) error {
+	if s.activities == nil {
+		return fmt.Errorf("activity sync: activity store is not configured")
+	}
+	fields := []string{
+		"ID", "OWNER_TYPE_ID", "OWNER_ID", "TYPE_ID", "PROVIDER_ID", "DIRECTION", "SUBJECT",
+		"COMPLETED", "RESPONSIBLE_ID", "CREATED", "LAST_UPDATED", "START_TIME", "END_TIME", "DEADLINE",
+	}
+	return syncDelta(ctx, s, deltaSpec[bitrix.Activity]{
+		entity:   EntityActivity,
+		stateKey: ActivitiesStateKey,
+		fetch: func(from *time.Time) fetchFunc[bitrix.Activity] {
+			base := map[string]any{"OWNER_TYPE_ID": EntityTypeDeal}
+			return listFetcher[bitrix.Activity](s, "crm.activity.list", listPayload(fields, base, "LAST_UPDATED", from))
+		},
+		dateModify: func(a bitrix.Activity) string { return a.LastUpdated },
+		upsert:     storeFunc(s.activities.UpsertActivities),
+	})
+}
+
+// SyncRelated runs the configured entity syncs (contacts and companies with
+// WithRelated, leads with WithLeads, activities with WithActivities, then the
+// WithItems entities) one after another. A failed entity does not keep the
+// next ones from running; the errors are joined. A stop ends the list.
+func (s *Service) SyncRelated(ctx context.Context) error {
+	return s.syncRelated(ctx, s.SyncItems)
+}
+
+// SyncRelatedFull is SyncRelated with a full load of the WithItems entities.
+// Contacts, companies, leads and activities have no full mode: they load
+// everything when their watermark is missing.
+func (s *Service) SyncRelatedFull(ctx context.Context) error {
+	return s.syncRelated(ctx, s.FullSyncItems)
+}
+
+func (s *Service) syncRelated(ctx context.Context, items func(context.Context, Entity) error) error {
+	var syncs []func(context.Context) error
+	if s.related != nil {
+		syncs = append(syncs, s.SyncContacts, s.SyncCompanies)
+	}
+	if s.leads != nil {
+		syncs = append(syncs, s.SyncLeads)
+	}
+	if s.activities != nil {
+		syncs = append(syncs, s.SyncActivities)
+	}
+	for _, e := range s.entities {
+		syncs = append(syncs, func(ctx context.Context) error { return items(ctx, e) })
+	}
+
+	var errs []error
+	for _, fn := range syncs {
+		err := fn(ctx)
+		if errors.Is(err, ErrStopped) {
+			return errors.Join(append(errs, err)...)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncDealContacts replaces the contact links of the given deals.
+func (s *Service) syncDealContacts(ctx context.Context, deals []bitrix.Deal) error {
+	links, err := batchPerDeal[[]bitrix.DealContact](ctx, s, deals, "crm.deal.contact.items.get")
+	if err != nil {
+		return fmt.Errorf("bitrix deal contacts: %w", err)
+	}
+	if err := s.related.ReplaceDealContacts(ctx, links); err != nil {
+		return fmt.Errorf("store deal contacts: %w", err)
+	}
+	return nil
+}
+
+// syncDealProducts replaces the product rows of the given deals.
+func (s *Service) syncDealProducts(ctx context.Context, deals []bitrix.Deal) error {
+	products, err := batchPerDeal[[]bitrix.ProductRow](ctx, s, deals, "crm.deal.productrows.get")
+	if err != nil {
+		return fmt.Errorf("bitrix deal products: %w", err)
+	}
+	if err := s.products.ReplaceDealProducts(ctx, products); err != nil {
+		return fmt.Errorf("store deal products: %w", err)
+	}
+	return nil
+}
+
+// batchPerDeal calls method?id=<deal id> for every deal through the batch
+// method, batchLimit commands per call, and returns the results by deal ID.
+// Deals whose command failed are logged and left out of the result.
+func batchPerDeal[T any](ctx context.Context, s *Service, deals []bitrix.Deal, method string) (map[int64]T, error) {
+	out := make(map[int64]T, len(deals))
+	for i := 0; i < len(deals); i += batchLimit {
+		chunk := deals[i:min(i+batchLimit, len(deals))]
+		cmd := make(map[string]string, len(chunk))
+		for _, d := range chunk {
+			cmd["d"+d.ID] = method + "?id=" + d.ID
+		}
+
+		var resp bitrix.BatchResponse[T]
+		err := callWithRetry(ctx, s.retryCount, func(c context.Context) error {
+			reqCtx, cancel := context.WithTimeout(c, 25*time.Second)
+			defer cancel()
+			return s.bitrix.Call(reqCtx, "batch", map[string]any{"halt": 0, "cmd": cmd}, &resp)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("batch %s: %w", method, err)
+		}
+
+		for key, v := range resp.Result.Result {
+			id, err := strconv.ParseInt(key[1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			out[id] = v
+		}
+		for key, cmdErr := range resp.Result.ResultError {
+			logging.FromContext(ctx).Warn("batch command failed", "method", method, "cmd", key, "err", cmdErr)
+		}
+	}
+	return out, nil
+}
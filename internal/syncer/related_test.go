@@ -0,0 +1,208 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRelatedSource answers every method with a canned JSON body.
+type fakeRelatedSource struct {
+	responses map[string]string
+	payloads  map[string]map[string]any
+}
+
+func (f *fakeRelatedSource) Call(ctx context.Context, method string, payload any, out any) error {
+	body, ok := f.responses[method]
+	if !ok {
+		return fmt.Errorf("unexpected method %s", method)
+	}
+	if f.payloads == nil {
+		f.payloads = make(map[string]map[string]any)
+	}
+	f.payloads[method] = payload.(map[string]any)
+	return json.Unmarshal([]byte(body), out)
+}
+
+func TestSyncContactsUsesOwnWatermark(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.SetWatermark(ctx, ContactsStateKey, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.contact.list": `{"result":[
+			{"ID":"7","NAME":"Айгерим","LAST_NAME":"Садыкова","DATE_MODIFY":"2026-03-01T17:30:00+05:00","PHONE":[{"VALUE_TYPE":"WORK","VALUE":"+77010000000"}]}
+		]}`,
+	}}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithRelated(store))
+	if err := svc.SyncContacts(ctx); err != nil {
+		t.Fatalf("sync contacts: %v", err)
+	}
+
+	filter := source.payloads["crm.contact.list"]["FILTER"].(map[string]any)
+	if got := filter[">=DATE_MODIFY"]; got != "2026-03-01T11:50:00Z" {
+		t.Fatalf("unexpected filter start: %v", got)
+	}
+	got, err := store.GetWatermark(ctx, ContactsStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+	if dealsWM, _ := store.GetWatermark(ctx, "deals_sync"); !dealsWM.IsZero() {
+		t.Fatalf("deals watermark changed: %v", dealsWM)
+	}
+}
+
+func TestDeltaSyncStoresDealContacts(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.SetWatermark(ctx, "deals_sync", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpsertContacts(ctx, []bitrix.Contact{{ID: "7", Name: "Айгерим", LastName: "Садыкова"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.item.list": `{"result":{"items":[{"id":10,"contactId":7,"createdTime":"2026-03-01T09:00:00Z","updatedTime":"2026-03-01T10:00:00Z"}]}}`,
+		"batch":         `{"result":{"result":{"d10":[{"CONTACT_ID":7,"SORT":10,"IS_PRIMARY":"Y"},{"CONTACT_ID":"8","SORT":"20","IS_PRIMARY":"N"}]},"result_error":[]}}`,
+	}}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithRelated(store))
+	if err := svc.DeltaSync(ctx); err != nil {
+		t.Fatalf("delta sync: %v", err)
+	}
+
+	cmd := source.payloads["batch"]["cmd"].(map[string]string)
+	if got := cmd["d10"]; got != "crm.deal.contact.items.get?id=10" {
+		t.Fatalf("unexpected batch command: %q", got)
+	}
+	links := store.DealContacts(10)
+	if len(links) != 2 || links[0].ContactID != 7 || links[0].IsPrimary != "Y" || links[1].ContactID != 8 {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+
+	var row repo.DealRow
+	if err := store.StreamDeals(ctx, repo.DealQuery{}, func(d repo.DealRow) error { row = d; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if row.ContactName == nil || *row.ContactName != "Садыкова Айгерим" {
+		t.Fatalf("contact name = %v", row.ContactName)
+	}
+}
+
+func TestDeltaSyncStoresDealProducts(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.SetWatermark(ctx, "deals_sync", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.item.list": `{"result":{"items":[{"id":10,"opportunity":150000,"currencyId":"KZT","closed":"Y","updatedTime":"2026-03-01T10:00:00Z"}]}}`,
+		"batch":         `{"result":{"result":{"d10":[{"ID":5,"PRODUCT_ID":3,"PRODUCT_NAME":"Курс","PRICE":75000.5,"QUANTITY":2,"SORT":10}]},"result_error":{}}}`,
+	}}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithProducts(store))
+	if err := svc.DeltaSync(ctx); err != nil {
+		t.Fatalf("delta sync: %v", err)
+	}
+
+	cmd := source.payloads["batch"]["cmd"].(map[string]string)
+	if got := cmd["d10"]; got != "crm.deal.productrows.get?id=10" {
+		t.Fatalf("unexpected batch command: %q", got)
+	}
+	rows := store.DealProducts(10)
+	if len(rows) != 1 || rows[0].Price != "75000.5" || rows[0].Quantity != "2" || rows[0].ProductName != "Курс" {
+		t.Fatalf("unexpected product rows: %+v", rows)
+	}
+}
+
+func TestDeltaSyncKeepsDealsWhenLinksFail(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.SetWatermark(ctx, "deals_sync", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	// No batch response: the contact and product refreshes fail.
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.item.list": `{"result":{"items":[{"id":10,"updatedTime":"2026-03-01T10:00:00Z"}]}}`,
+	}}
+	var res Result
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute,
+		WithRelated(store), WithProducts(store),
+		WithAfterSync(func(ctx context.Context, r Result) { res = r }))
+	if err := svc.DeltaSync(ctx); err != nil {
+		t.Fatalf("delta sync: %v", err)
+	}
+	if len(res.DealIDs) != 1 || res.DealIDs[0] != 10 || res.Deals != 1 {
+		t.Fatalf("result = %+v", res)
+	}
+	got, _ := store.GetWatermark(ctx, "deals_sync")
+	if want := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+}
+
+func TestSyncRelatedRunsEveryEntity(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+
+	// No crm.contact.list response: the contact sync fails.
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.company.list": `{"result":[{"ID":"3","TITLE":"ТОО Ромашка","DATE_MODIFY":"2026-03-01T10:00:00Z"}]}`,
+		"crm.lead.list":    `{"result":[{"ID":"4","TITLE":"Заявка","DATE_MODIFY":"2026-03-01T11:00:00Z"}]}`,
+	}}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithRelated(store), WithLeads(store))
+	err := svc.SyncRelated(ctx)
+	if err == nil || !strings.Contains(err.Error(), "crm.contact.list") {
+		t.Fatalf("err = %v, want the contact sync error", err)
+	}
+
+	for key, want := range map[string]time.Time{
+		CompaniesStateKey: time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC),
+		LeadsStateKey:     time.Date(2026, 3, 1, 11, 0, 0, 0, time.UTC),
+	} {
+		got, _ := store.GetWatermark(ctx, key)
+		if !got.Equal(want) {
+			t.Fatalf("%s watermark = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestSyncActivitiesFiltersDealOwnersByLastUpdated(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	if err := store.SetWatermark(ctx, ActivitiesStateKey, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeRelatedSource{responses: map[string]string{
+		"crm.activity.list": `{"result":[{"ID":"100","OWNER_TYPE_ID":"2","OWNER_ID":"10","TYPE_ID":"2","LAST_UPDATED":"2026-03-01T13:00:00Z"}]}`,
+	}}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute, WithActivities(store))
+	if err := svc.SyncActivities(ctx); err != nil {
+		t.Fatalf("sync activities: %v", err)
+	}
+
+	payload := source.payloads["crm.activity.list"]
+	filter := payload["FILTER"].(map[string]any)
+	if filter["OWNER_TYPE_ID"] != 2 || filter[">=LAST_UPDATED"] != "2026-03-01T11:50:00Z" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+	if order := payload["ORDER"].(map[string]any); order["LAST_UPDATED"] != "ASC" {
+		t.Fatalf("unexpected order: %v", order)
+	}
+	got, _ := store.GetWatermark(ctx, ActivitiesStateKey)
+	if want := time.Date(2026, 3, 1, 13, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+}
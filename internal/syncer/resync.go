@@ -0,0 +1,97 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"maps"
+	"time"
+)
+
+// resyncBatch bounds the requests taken from the queue per ProcessResyncs.
+const resyncBatch = 20
+
+type ResyncStore interface {
+	PendingResyncs(ctx context.Context, limit int) ([]repo.ResyncRequest, error)
+	FinishResync(ctx context.Context, id int64, runErr error) error
+}
+
+// WithResyncQueue makes ProcessResyncs reload the deals of queued requests.
+func WithResyncQueue(store ResyncStore) Option {
+	return func(s *Service) {
+		s.resyncs = store
+	}
+}
+
+// ProcessResyncs reloads the deals of pending resync requests. Runs use mode
+// "resync" and their own state key, so they neither move the deal watermark
+// nor count as deal syncs in the health checks. A failed request is finished
+// with its error; a stopped one stays pending.
+func (s *Service) ProcessResyncs(ctx context.Context) error {
+	if s.resyncs == nil {
+		return nil
+	}
+	reqs, err := s.resyncs.PendingResyncs(ctx, resyncBatch)
+	if err != nil {
+		return fmt.Errorf("pending resyncs: %w", err)
+	}
+	for _, req := range reqs {
+		err := s.resync(ctx, req)
+		if errors.Is(err, ErrStopped) || ctx.Err() != nil {
+			return err
+		}
+		if finErr := s.resyncs.FinishResync(ctx, req.ID, err); finErr != nil {
+			return fmt.Errorf("finish resync %d: %w", req.ID, finErr)
+		}
+	}
+	return nil
+}
+
+func (s *Service) resync(ctx context.Context, req repo.ResyncRequest) (err error) {
+	stateKey := s.stateKey + "_resync"
+	ctx, logger := s.runLogger(ctx, stateKey, "resync")
+	logger.Info("deal resync start", "request_id", req.ID, "reason", req.Reason)
+	run := s.beginRun(logger, stateKey, EntityDeal, "resync")
+	defer func() { s.finishRun(ctx, run, err) }()
+
+	e := s.deal
+	e.Filter = resyncFilter(s.deal.Filter, req)
+	_, stopped, err := walk(ctx, s, run, time.Time{}, walkSpec[bitrix.Item]{
+		fetch:      itemFetcher(s, itemListPayload(e, nil, map[string]any{"id": "ASC"})),
+		upsert:     s.upsertDealItems,
+		dateModify: itemUpdatedTime,
+	})
+	if err != nil {
+		return fmt.Errorf("resync %d: %w", req.ID, err)
+	}
+	if stopped {
+		return ErrStopped
+	}
+
+	logger.Info("deal resync end", "request_id", req.ID, "pages", run.pages, "updated", run.items)
+	return nil
+}
+
+// resyncFilter narrows the deal filter to the requested deals, or to one
+// category and a createdTime range.
+func resyncFilter(base map[string]any, req repo.ResyncRequest) map[string]any {
+	filter := maps.Clone(base)
+	if filter == nil {
+		filter = make(map[string]any)
+	}
+	if len(req.DealIDs) > 0 {
+		filter["@id"] = req.DealIDs
+		return filter
+	}
+	delete(filter, "@categoryId")
+	filter["categoryId"] = req.CategoryID
+	if req.DateFrom != nil {
+		filter[">=createdTime"] = req.DateFrom.UTC().Format(time.RFC3339)
+	}
+	if req.DateTo != nil {
+		filter["<createdTime"] = req.DateTo.UTC().Format(time.RFC3339)
+	}
+	return filter
+}
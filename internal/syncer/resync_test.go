@@ -0,0 +1,69 @@
+package syncer
+
+import (
+	"context"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProcessResyncsReloadsQueuedRanges(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	wm := time.Date(2026, 3, 20, 10, 0, 0, 0, time.UTC)
+	if err := store.SetWatermark(ctx, "deals_sync", wm); err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 2, 28, 19, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 3, 31, 19, 0, 0, 0, time.UTC)
+	if _, err := store.EnqueueResyncs(ctx, []repo.ResyncRequest{
+		{CategoryID: 31, DateFrom: &from, DateTo: &to, Reason: "test"},
+		{DealIDs: []int64{7}, Reason: "test"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeDealSource{pages: []dealPage{
+		{items: []bitrix.Item{{"id": 5.0, "categoryId": 31.0, "createdTime": "2026-03-02T09:00:00Z", "updatedTime": "2026-03-02T09:00:00Z"}}},
+		{items: []bitrix.Item{{"id": 7.0, "categoryId": 1.0, "createdTime": "2026-01-02T09:00:00Z", "updatedTime": "2026-01-05T09:00:00Z"}}},
+	}}
+	var results []Result
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute,
+		WithResyncQueue(store),
+		WithAfterSync(func(ctx context.Context, res Result) { results = append(results, res) }))
+	svc.requestWait = 0
+
+	if err := svc.ProcessResyncs(ctx); err != nil {
+		t.Fatalf("process resyncs: %v", err)
+	}
+
+	filter := source.payloads[0]["filter"].(map[string]any)
+	if _, ok := filter["@categoryId"]; ok || filter["categoryId"] != 31 ||
+		filter[">=createdTime"] != "2026-02-28T19:00:00Z" || filter["<createdTime"] != "2026-03-31T19:00:00Z" {
+		t.Fatalf("range filter = %v", filter)
+	}
+	filter = source.payloads[1]["filter"].(map[string]any)
+	if ids, _ := filter["@id"].([]int64); !slices.Equal(ids, []int64{7}) || filter["@categoryId"] == nil {
+		t.Fatalf("deal filter = %v", filter)
+	}
+
+	if len(results) != 2 || results[0].Mode != "resync" || results[0].StateKey != "deals_sync_resync" || !slices.Equal(results[1].DealIDs, []int64{7}) {
+		t.Fatalf("results = %+v", results)
+	}
+	got, err := store.GetWatermark(ctx, "deals_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(wm) {
+		t.Fatalf("watermark moved to %v", got)
+	}
+	pending, err := store.PendingResyncs(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("pending = %+v", pending)
+	}
+}
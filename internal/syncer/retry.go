@@ -3,6 +3,7 @@ package syncer
 import (
 	"context"
 	"errors"
+	"freedom_bitrix/internal/metrics"
 	"net"
 	"strings"
 	"time"
@@ -31,6 +32,9 @@ func callWithRetry(ctx context.Context, attempts int, fn func(context.Context) e
 			return err
 		}
 
+		if i < attempts {
+			metrics.SyncRetries.Inc()
+		}
 		time.Sleep(backoff)
 		backoff *= 2
 	}
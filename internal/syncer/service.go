@@ -2,226 +2,319 @@ package syncer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"freedom_bitrix/internal/bitrix"
-	"freedom_bitrix/internal/repo"
-	"log"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"log/slog"
+	"strconv"
 	"time"
 )
 
+type DealSource interface {
+	Call(ctx context.Context, method string, payload any, out any) error
+}
+
+type DealStore interface {
+	UpsertDeals(ctx context.Context, deals []bitrix.Deal) error
+}
+
+type WatermarkStore interface {
+	GetWatermark(ctx context.Context, key string) (time.Time, error)
+	SetWatermark(ctx context.Context, key string, wm time.Time) error
+}
+
+type RunStore interface {
+	RecordSyncRun(ctx context.Context, key, mode string, runErr error) error
+}
+
+// Entity values reported in Result.
+const (
+	EntityDeal     = "deal"
+	EntityContact  = "contact"
+	EntityCompany  = "company"
+	EntityLead     = "lead"
+	EntityActivity = "activity"
+)
+
+type Result struct {
+	StateKey  string
+	Entity    string
+	Mode      string
+	Err       error
+	Pages     int
+	Deals     int
+	Items     int
+	DealIDs   []int64
+	Watermark time.Time
+	Duration  time.Duration
+}
+
+type AfterSyncFunc func(ctx context.Context, res Result)
+
+type Option func(*Service)
+
+// WithAfterSync registers a hook that runs after every finished sync run,
+// successful or not. Runs stopped by ErrStopped are reported with that error.
+func WithAfterSync(fn AfterSyncFunc) Option {
+	return func(s *Service) {
+		s.afterSync = append(s.afterSync, fn)
+	}
+}
+
+func WithRunStore(runs RunStore) Option {
+	return func(s *Service) {
+		s.runs = runs
+	}
+}
+
 type Service struct {
-	bitrix      *bitrix.Client
-	repo        *repo.DealsRepository
+	bitrix      DealSource
+	deals       DealStore
+	watermarks  WatermarkStore
+	runs        RunStore
+	related     RelatedStore
+	leads       LeadStore
+	products    ProductStore
+	activities  ActivityStore
+	afterSync   []AfterSyncFunc
 	stateKey    string
 	overlap     time.Duration
 	staleAfter  time.Duration
-	categories  []int
+	deal        Entity
+	items       ItemStore
+	entities    []Entity
+	resyncs     ResyncStore
 	retryCount  int
 	requestWait time.Duration
 }
 
-func NewService(bitrixClient *bitrix.Client, repository *repo.DealsRepository, stateKey string, overlap time.Duration) *Service {
-	return &Service{
-		bitrix:      bitrixClient,
-		repo:        repository,
-		stateKey:    stateKey,
-		overlap:     overlap,
-		staleAfter:  2 * time.Hour,
-		categories:  []int{1, 31, 29},
+func NewService(source DealSource, deals DealStore, watermarks WatermarkStore, stateKey string, overlap time.Duration, opts ...Option) *Service {
+	s := &Service{
+		bitrix:     source,
+		deals:      deals,
+		watermarks: watermarks,
+		stateKey:   stateKey,
+		overlap:    overlap,
+		staleAfter: 2 * time.Hour,
+		deal: Entity{
+			Name:         EntityDeal,
+			EntityTypeID: EntityTypeDeal,
+			StateKey:     stateKey,
+			Select:       dealSelectFields(),
+			Filter:       defaultDealFilter(),
+			Table:        "bitrix_deals",
+		},
 		retryCount:  3,
 		requestWait: 300 * time.Millisecond,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
+// FullSyncFrom is the first day of deal creation, in the portal timezone, a
+// full sync loads. Older deals are never stored.
+const FullSyncFrom = "2024-01-01"
+
+// FullSync loads every deal created since FullSyncFrom, newest first.
 func (s *Service) FullSync(ctx context.Context) error {
-	log.Println("FULL SYNC START")
+	payload := itemListPayload(s.deal, map[string]any{">=createdTime": FullSyncFrom}, map[string]any{
+		"createdTime": "DESC",
+		"id":          "DESC",
+	})
+	return syncFull(ctx, s, fullSpec[bitrix.Item]{
+		entity:     EntityDeal,
+		stateKey:   s.stateKey,
+		fetch:      itemFetcher(s, payload),
+		upsert:     s.upsertDealItems,
+		dateModify: itemUpdatedTime,
+	})
+}
 
-	payload := map[string]any{
-		"SELECT": dealSelectFields(),
-		"FILTER": map[string]any{
-			">=DATE_CREATE": "2024-01-01",
-			"@CATEGORY_ID":  s.categories,
-		},
-		"ORDER": map[string]any{
-			"DATE_CREATE": "DESC",
-			"ID":          "DESC",
+// DeltaSync loads the deals modified since the deal watermark minus the
+// overlap. It needs the watermark of a full sync, ErrNoWatermark otherwise.
+func (s *Service) DeltaSync(ctx context.Context) error {
+	return syncDelta(ctx, s, deltaSpec[bitrix.Item]{
+		entity:   EntityDeal,
+		stateKey: s.stateKey,
+		fetch: func(from *time.Time) fetchFunc[bitrix.Item] {
+			return itemFetcher(s, itemPayload(s.deal, from))
 		},
-	}
-
-	start := 0
-	pageNum := 0
-	total := -1
-	collected := 0
-	var maxModify time.Time
-
-	for {
-		pageNum++
-		payload["start"] = start
+		upsert:     s.upsertDealItems,
+		dateModify: itemUpdatedTime,
+		primary:    true,
+	})
+}
 
-		var page bitrix.ListResponse[bitrix.Deal]
-		err := callWithRetry(ctx, s.retryCount, func(c context.Context) error {
-			reqCtx, cancel := context.WithTimeout(c, 25*time.Second)
-			defer cancel()
-			return s.bitrix.Call(reqCtx, "crm.deal.list", payload, &page)
-		})
+// upsertDealItems maps a page of crm.item.list deals onto the typed deal
+// columns and stores it.
+func (s *Service) upsertDealItems(ctx context.Context, run *syncRun, items []bitrix.Item) error {
+	deals := make([]bitrix.Deal, 0, len(items))
+	for _, it := range items {
+		d, err := bitrix.DealFromItem(it)
 		if err != nil {
-			return fmt.Errorf("bitrix page %d start=%d: %w", pageNum, start, err)
-		}
-
-		if page.Total != nil {
-			total = *page.Total
-		}
-
-		if err := s.repo.UpsertDeals(ctx, page.Result); err != nil {
-			return fmt.Errorf("upsert deals page %d: %w", pageNum, err)
+			return err
 		}
+		deals = append(deals, d)
+	}
+	return s.upsertPage(ctx, run, deals)
+}
 
-		for _, d := range page.Result {
-			tm, err := parseRFC3339(d.DateModify)
-			if err == nil && tm.After(maxModify) {
-				maxModify = tm
-			}
-		}
+func (s *Service) runLogger(ctx context.Context, stateKey, mode string) (context.Context, *slog.Logger) {
+	return logging.With(ctx, "run_id", logging.NewID(), "mode", mode, "state_key", stateKey)
+}
 
-		collected += len(page.Result)
-		nextVal := -1
-		if page.Next != nil {
-			nextVal = *page.Next
-		}
-		log.Printf("page=%d got=%d start=%d next=%d total=%d collected=%d",
-			pageNum, len(page.Result), start, nextVal, total, collected)
+// upsertPage stores a page of deals and refreshes their contact links and
+// product rows. The deals count as synced once stored: a failed link or
+// product refresh is logged and counted, it does not fail the run.
+func (s *Service) upsertPage(ctx context.Context, run *syncRun, deals []bitrix.Deal) error {
+	started := time.Now()
+	err := s.deals.UpsertDeals(ctx, deals)
+	metrics.UpsertDuration.WithLabelValues(s.stateKey).Observe(time.Since(started).Seconds())
+	if err != nil {
+		return err
+	}
+	run.addDeals(deals)
 
-		if page.Next == nil {
-			break
+	if s.related != nil {
+		if err := s.syncDealContacts(ctx, deals); err != nil {
+			run.logger.Error("deal contacts refresh failed", "deals", len(deals), "err", err)
+			metrics.SyncDealLinkErrors.WithLabelValues(run.stateKey, "contacts").Inc()
 		}
-		start = *page.Next
-		time.Sleep(s.requestWait)
 	}
-
-	if !maxModify.IsZero() {
-		if err := s.repo.SetWatermark(ctx, s.stateKey, maxModify); err != nil {
-			return fmt.Errorf("set watermark: %w", err)
+	if s.products != nil {
+		if err := s.syncDealProducts(ctx, deals); err != nil {
+			run.logger.Error("deal products refresh failed", "deals", len(deals), "err", err)
+			metrics.SyncDealLinkErrors.WithLabelValues(run.stateKey, "products").Inc()
 		}
-		log.Printf("FULL SYNC watermark=%s", maxModify.UTC().Format(time.RFC3339))
 	}
-
-	log.Println("FULL SYNC END")
 	return nil
 }
 
-func (s *Service) DeltaSync(ctx context.Context) error {
-	log.Println("DELTA SYNC START")
-
-	wm, err := s.repo.GetWatermark(ctx, s.stateKey)
-	if err != nil {
-		return fmt.Errorf("get watermark: %w", err)
-	}
-
-	if wm.IsZero() {
-		log.Println("no watermark found -> run: go run . full")
-		return nil
-	}
+type syncRun struct {
+	logger    *slog.Logger
+	stateKey  string
+	entity    string
+	mode      string
+	started   time.Time
+	pages     int
+	deals     int
+	items     int
+	dealIDs   []int64
+	watermark time.Time
+}
 
-	from := wm.Add(-s.overlap)
-	fromStr := from.UTC().Format(time.RFC3339)
-	log.Printf("DELTA SYNC range: watermark=%s from=%s overlap=%s",
-		wm.UTC().Format(time.RFC3339), fromStr, s.overlap)
+func (s *Service) beginRun(logger *slog.Logger, stateKey, entity, mode string) *syncRun {
+	return &syncRun{logger: logger, stateKey: stateKey, entity: entity, mode: mode, started: time.Now()}
+}
 
-	payload := map[string]any{
-		"SELECT": dealSelectFields(),
-		"FILTER": map[string]any{
-			">=DATE_MODIFY": fromStr,
-			"@CATEGORY_ID":  s.categories,
-		},
-		"ORDER": map[string]any{
-			"DATE_MODIFY": "ASC",
-			"ID":          "ASC",
-		},
+func (r *syncRun) page(n int) {
+	r.pages++
+	r.items += n
+	metrics.SyncPages.WithLabelValues(r.stateKey, r.mode).Inc()
+	if r.entity != EntityDeal {
+		metrics.SyncEntities.WithLabelValues(r.stateKey, r.entity).Add(float64(n))
 	}
+}
 
-	start := 0
-	pageNum := 0
-	updated := 0
-	maxModify := wm
-
-	for {
-		pageNum++
-		payload["start"] = start
-
-		var page bitrix.ListResponse[bitrix.Deal]
-		err := callWithRetry(ctx, s.retryCount, func(c context.Context) error {
-			reqCtx, cancel := context.WithTimeout(c, 25*time.Second)
-			defer cancel()
-			return s.bitrix.Call(reqCtx, "crm.deal.list", payload, &page)
-		})
-		if err != nil {
-			return fmt.Errorf("bitrix delta page %d start=%d: %w", pageNum, start, err)
+func (r *syncRun) addDeals(deals []bitrix.Deal) {
+	r.deals += len(deals)
+	for _, d := range deals {
+		if id, err := strconv.ParseInt(d.ID, 10, 64); err == nil {
+			r.dealIDs = append(r.dealIDs, id)
 		}
+	}
+	metrics.SyncDeals.WithLabelValues(r.stateKey, r.mode).Add(float64(len(deals)))
+}
 
-		if len(page.Result) > 0 {
-			if err := s.repo.UpsertDeals(ctx, page.Result); err != nil {
-				return fmt.Errorf("upsert delta page %d: %w", pageNum, err)
-			}
+func (s *Service) finishRun(ctx context.Context, r *syncRun, err error) {
+	if s.runs != nil && !errors.Is(err, ErrStopped) {
+		recCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		if recErr := s.runs.RecordSyncRun(recCtx, r.stateKey, r.mode, err); recErr != nil {
+			r.logger.Warn("record sync run", "err", recErr)
 		}
+		cancel()
+	}
 
-		for _, d := range page.Result {
-			tm, err := parseRFC3339(d.DateModify)
-			if err == nil && tm.After(maxModify) {
-				maxModify = tm
-			}
-		}
+	defer s.runAfterSync(ctx, r, err)
 
-		updated += len(page.Result)
-		nextVal := -1
-		if page.Next != nil {
-			nextVal = *page.Next
-		}
-		log.Printf("delta page=%d got=%d start=%d next=%d updated=%d watermark_now=%s",
-			pageNum, len(page.Result), start, nextVal, updated, maxModify.UTC().Format(time.RFC3339))
+	metrics.SyncDuration.WithLabelValues(r.stateKey, r.mode).Observe(time.Since(r.started).Seconds())
+	metrics.SyncLastRunPages.WithLabelValues(r.stateKey, r.mode).Set(float64(r.pages))
+	if r.entity == EntityDeal {
+		metrics.SyncLastRunDeals.WithLabelValues(r.stateKey, r.mode).Set(float64(r.deals))
+	}
 
-		if page.Next == nil {
-			break
-		}
-		start = *page.Next
-		time.Sleep(s.requestWait)
+	if err != nil {
+		metrics.SyncRuns.WithLabelValues(r.stateKey, r.mode, "error").Inc()
+		r.logger.Error("sync failed", "err", err, "duration", time.Since(r.started).String(), "pages", r.pages)
+		return
+	}
+	metrics.SyncRuns.WithLabelValues(r.stateKey, r.mode, "success").Inc()
+	metrics.SyncLastSuccess.WithLabelValues(r.stateKey).SetToCurrentTime()
+	if !r.watermark.IsZero() {
+		metrics.WatermarkLag.WithLabelValues(r.stateKey).Set(time.Since(r.watermark).Seconds())
 	}
+}
 
-	if maxModify.After(wm) {
-		if err := s.repo.SetWatermark(ctx, s.stateKey, maxModify); err != nil {
-			return fmt.Errorf("set watermark: %w", err)
-		}
-		log.Printf("DELTA SYNC watermark=%s", maxModify.UTC().Format(time.RFC3339))
-	} else if !wm.IsZero() {
-		age := time.Since(wm)
-		if age > s.staleAfter {
-			log.Printf("WARN delta sync: no newer deals for %s (watermark=%s)",
-				age.Round(time.Minute), wm.UTC().Format(time.RFC3339))
-		}
+func (s *Service) runAfterSync(ctx context.Context, r *syncRun, err error) {
+	if len(s.afterSync) == 0 {
+		return
 	}
+	res := Result{
+		StateKey:  r.stateKey,
+		Entity:    r.entity,
+		Mode:      r.mode,
+		Err:       err,
+		Pages:     r.pages,
+		Deals:     r.deals,
+		Items:     r.items,
+		DealIDs:   r.dealIDs,
+		Watermark: r.watermark,
+		Duration:  time.Since(r.started),
+	}
+	hookCtx := context.WithoutCancel(ctx)
+	for _, fn := range s.afterSync {
+		fn(hookCtx, res)
+	}
+}
 
-	log.Println("DELTA SYNC END")
-	return nil
+func defaultDealFilter() map[string]any {
+	return map[string]any{"@categoryId": []int{1, 31, 29}}
 }
 
+// dealSelectFields are the crm.item.list names of the typed bitrix_deals
+// columns.
 func dealSelectFields() []string {
 	return []string{
-		"CATEGORY_ID",
-		"STAGE_ID",
-		"ASSIGNED_BY_ID",
-		"SOURCE_ID",
-		"DATE_CREATE",
-		"DATE_MODIFY",
-		"UTM_SOURCE",
-		"UTM_CAMPAIGN",
-		"UF_CRM_1740477560309",
-		"UF_CRM_1647265424537",
-		"UF_CRM_1650279712660",
-		"UF_CRM_1699841388494",
-		"UF_CRM_1699863367472",
-		"UF_CRM_1752578793696",
-		"UF_CRM_1753169789836",
-		"UF_CRM_1771313479555",
-		"ID",
+		"categoryId",
+		"stageId",
+		"assignedById",
+		"sourceId",
+		"createdTime",
+		"updatedTime",
+		"movedTime",
+		"contactId",
+		"companyId",
+		"leadId",
+		"opportunity",
+		"currencyId",
+		"closed",
+		"closedate",
+		"begindate",
+		"utmSource",
+		"utmCampaign",
+		"ufCrm_1740477560309",
+		"ufCrm_1647265424537",
+		"ufCrm_1650279712660",
+		"ufCrm_1699841388494",
+		"ufCrm_1699863367472",
+		"ufCrm_1752578793696",
+		"ufCrm_1753169789836",
+		"ufCrm_1771313479555",
+		"id",
 	}
 }
 
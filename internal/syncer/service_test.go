@@ -1,6 +1,14 @@
 package syncer
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"testing"
+	"time"
+)
 
 func TestParseRFC3339(t *testing.T) {
 	t.Run("valid", func(t *testing.T) {
@@ -20,3 +28,168 @@ func TestParseRFC3339(t *testing.T) {
 		}
 	})
 }
+
+// dealPage is one crm.item.list page of deals.
+type dealPage struct {
+	items []bitrix.Item
+	next  *int
+}
+
+type fakeDealSource struct {
+	pages    []dealPage
+	payloads []map[string]any
+}
+
+func (f *fakeDealSource) Call(ctx context.Context, method string, payload any, out any) error {
+	p := payload.(map[string]any)
+	if method != "crm.item.list" || p["entityTypeId"] != EntityTypeDeal {
+		return fmt.Errorf("unexpected method %s", method)
+	}
+	f.payloads = append(f.payloads, p)
+	if len(f.pages) == 0 {
+		return errors.New("bitrix unavailable")
+	}
+	page := f.pages[0]
+	f.pages = f.pages[1:]
+	resp := out.(*bitrix.ItemListResponse)
+	resp.Result.Items = page.items
+	resp.Next = page.next
+	return nil
+}
+
+func TestDeltaSyncAdvancesWatermark(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	wm := time.Date(2026, 2, 24, 10, 0, 0, 0, time.UTC)
+	if err := store.SetWatermark(ctx, "deals_sync", wm); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeDealSource{pages: []dealPage{{
+		items: []bitrix.Item{
+			{"id": 1.0, "categoryId": 1.0, "createdTime": "2026-02-01T09:00:00Z", "updatedTime": "2026-02-24T10:05:00Z"},
+			{"id": 2.0, "categoryId": 31.0, "createdTime": "2026-02-02T09:00:00Z", "updatedTime": "2026-02-24T11:30:00Z"},
+		},
+	}}}
+
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute)
+	if err := svc.DeltaSync(ctx); err != nil {
+		t.Fatalf("delta sync: %v", err)
+	}
+
+	filter := source.payloads[0]["filter"].(map[string]any)
+	if got := filter[">=updatedTime"]; got != "2026-02-24T09:50:00Z" {
+		t.Fatalf("unexpected delta filter start: %v", got)
+	}
+	if filter["@categoryId"] == nil {
+		t.Fatalf("default categories missing: %v", filter)
+	}
+
+	got, err := store.GetWatermark(ctx, "deals_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 2, 24, 11, 30, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+
+	deals, err := store.ListDeals(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deals) != 2 || deals[0].ID != 2 || deals[1].ID != 1 {
+		t.Fatalf("unexpected stored deals: %+v", deals)
+	}
+}
+
+func TestDeltaSyncStopsAfterCommittedPage(t *testing.T) {
+	store := repo.NewMemoryRepository()
+	wm := time.Date(2026, 2, 24, 10, 0, 0, 0, time.UTC)
+	if err := store.SetWatermark(context.Background(), "deals_sync", wm); err != nil {
+		t.Fatal(err)
+	}
+
+	next := 50
+	source := &fakeDealSource{pages: []dealPage{
+		{items: []bitrix.Item{{"id": 1.0, "updatedTime": "2026-02-24T10:05:00Z"}}, next: &next},
+		{items: []bitrix.Item{{"id": 2.0, "updatedTime": "2026-02-24T10:15:00Z"}}},
+	}}
+
+	parent, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute)
+	if err := svc.DeltaSync(StopAfterPage(parent)); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+	if len(source.payloads) != 1 {
+		t.Fatalf("expected exactly one page request, got %d", len(source.payloads))
+	}
+
+	got, _ := store.GetWatermark(context.Background(), "deals_sync")
+	if want := time.Date(2026, 2, 24, 10, 5, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+}
+
+func TestDeltaSyncKeepsWatermarkOfCommittedPagesOnError(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	wm := time.Date(2026, 2, 24, 10, 0, 0, 0, time.UTC)
+	if err := store.SetWatermark(ctx, "deals_sync", wm); err != nil {
+		t.Fatal(err)
+	}
+
+	next := 50
+	source := &fakeDealSource{pages: []dealPage{
+		{items: []bitrix.Item{{"id": 1.0, "updatedTime": "2026-02-24T10:05:00Z"}}, next: &next},
+	}}
+	var res Result
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute,
+		WithAfterSync(func(ctx context.Context, r Result) { res = r }))
+	svc.requestWait = 0
+	if err := svc.DeltaSync(ctx); err == nil {
+		t.Fatal("expected the failed second page to fail the run")
+	}
+
+	got, _ := store.GetWatermark(ctx, "deals_sync")
+	if want := time.Date(2026, 2, 24, 10, 5, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("watermark = %v, want %v", got, want)
+	}
+	if res.Err == nil || len(res.DealIDs) != 1 || res.DealIDs[0] != 1 {
+		t.Fatalf("result = %+v", res)
+	}
+}
+
+func TestFullSyncKeepsNewerWatermark(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryRepository()
+	wm := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	if err := store.SetWatermark(ctx, "deals_sync", wm); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeDealSource{pages: []dealPage{{
+		items: []bitrix.Item{{"id": 1.0, "categoryId": 1.0, "createdTime": "2026-02-01T09:00:00Z", "updatedTime": "2026-02-24T10:05:00Z"}},
+	}}}
+	svc := NewService(source, store, store, "deals_sync", 10*time.Minute)
+	if err := svc.FullSync(ctx); err != nil {
+		t.Fatalf("full sync: %v", err)
+	}
+
+	payload := source.payloads[0]
+	if filter := payload["filter"].(map[string]any); filter[">=createdTime"] != FullSyncFrom {
+		t.Fatalf("full sync filter = %v", filter)
+	}
+	if order := payload["order"].(map[string]any); order["createdTime"] != "DESC" {
+		t.Fatalf("full sync order = %v", order)
+	}
+
+	got, err := store.GetWatermark(ctx, "deals_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(wm) {
+		t.Fatalf("watermark = %v, want %v", got, wm)
+	}
+}
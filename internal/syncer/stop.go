@@ -0,0 +1,33 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrStopped = errors.New("sync stopped after committed page")
+
+// ErrNoWatermark is returned by DeltaSync before the first full sync.
+var ErrNoWatermark = errors.New("no watermark found, run: go run ./cmd full")
+
+type stopKey struct{}
+
+// StopAfterPage detaches ctx from its cancellation so that an in-flight page
+// (Bitrix call + upsert transaction) is never interrupted. Cancellation of the
+// original ctx is still observed by the sync loops between pages.
+func StopAfterPage(ctx context.Context) context.Context {
+	return context.WithValue(context.WithoutCancel(ctx), stopKey{}, ctx.Done())
+}
+
+func stopRequested(ctx context.Context) bool {
+	done, ok := ctx.Value(stopKey{}).(<-chan struct{})
+	if !ok {
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,416 @@
+package verify
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/logging"
+	"freedom_bitrix/internal/metrics"
+	"freedom_bitrix/internal/repo"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultMonths = 12
+	DefaultSample = 50
+	MaxMonths     = 36
+	MaxSample     = 1000
+)
+
+// Sample mismatch problems.
+const (
+	ProblemMissingInBitrix   = "missing_in_bitrix"
+	ProblemDateModifyDiffers = "date_modify_differs"
+)
+
+// Count mismatch problems. Deals missing locally are reloaded by a resync;
+// deals deleted in Bitrix (or moved out of the synced filter) are only
+// reported, a resync never deletes.
+const (
+	ProblemMissingLocally  = "missing_locally"
+	ProblemDeletedInBitrix = "deleted_in_bitrix"
+)
+
+// idChunk is the page size of crm.item.list, so one call per chunk of IDs.
+const idChunk = 50
+
+// dealEntityTypeID is the crm.item.list entityTypeId of deals.
+const dealEntityTypeID = 2
+
+type Source interface {
+	Call(ctx context.Context, method string, payload any, out any) error
+}
+
+type Store interface {
+	CountDealsByMonth(ctx context.Context, from, to time.Time, loc *time.Location) ([]repo.MonthCount, error)
+	SampleDeals(ctx context.Context, n int) ([]repo.DealStamp, error)
+	EnqueueResyncs(ctx context.Context, reqs []repo.ResyncRequest) ([]repo.ResyncRequest, error)
+}
+
+// Verifier compares bitrix_deals with Bitrix.
+type Verifier struct {
+	source Source
+	store  Store
+	filter map[string]any
+	since  time.Time
+	loc    *time.Location
+	times  repo.TimeParser
+	wait   time.Duration
+}
+
+// Options select what Run checks. Months counts calendar months back from
+// the current one; Sample is the number of random deals whose DATE_MODIFY is
+// compared, 0 to skip. Resync queues a reload of every mismatching range.
+type Options struct {
+	Months int
+	Sample int
+	Resync bool
+}
+
+type Report struct {
+	CheckedAt   time.Time            `json:"checked_at"`
+	From        time.Time            `json:"from"`
+	To          time.Time            `json:"to"`
+	Categories  []int                `json:"categories"`
+	Cells       int                  `json:"cells"`
+	BitrixTotal int                  `json:"bitrix_total"`
+	LocalTotal  int                  `json:"local_total"`
+	Counts      []CountMismatch      `json:"count_mismatches"`
+	Sampled     int                  `json:"sampled"`
+	Samples     []SampleMismatch     `json:"sample_mismatches"`
+	Resyncs     []repo.ResyncRequest `json:"resyncs,omitempty"`
+}
+
+// OK reports whether no mismatch was found.
+func (r Report) OK() bool {
+	return len(r.Counts) == 0 && len(r.Samples) == 0
+}
+
+// CountMismatch is a category and month of DATE_CREATE for which the
+// crm.item.list total differs from the number of stored deals.
+type CountMismatch struct {
+	CategoryID int       `json:"category_id"`
+	Month      string    `json:"month"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Bitrix     int       `json:"bitrix"`
+	Local      int       `json:"local"`
+	Problem    string    `json:"problem"`
+}
+
+// SampleMismatch is a sampled deal that is gone from Bitrix or whose stored
+// DATE_MODIFY differs from the one in Bitrix.
+type SampleMismatch struct {
+	DealID  int64      `json:"deal_id"`
+	Problem string     `json:"problem"`
+	Local   *time.Time `json:"local_date_modify"`
+	Bitrix  *time.Time `json:"bitrix_date_modify,omitempty"`
+}
+
+// NewVerifier checks the deals selected by filter, the crm.item.list filter
+// deals are synced with, created at or after since, the start of the full
+// sync; a zero since checks every month. Months of DATE_CREATE are taken in
+// loc, the portal timezone.
+func NewVerifier(source Source, store Store, filter map[string]any, since time.Time, loc *time.Location) *Verifier {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &Verifier{
+		source: source,
+		store:  store,
+		filter: filter,
+		since:  since,
+		loc:    loc,
+		times:  repo.NewTimeParser(loc),
+		wait:   300 * time.Millisecond,
+	}
+}
+
+// Run compares the crm.item.list total with the stored deal count per
+// category and month and the DATE_MODIFY of sampled deals.
+func (v *Verifier) Run(ctx context.Context, opts Options, now time.Time) (Report, error) {
+	if opts.Months < 1 || opts.Months > MaxMonths {
+		return Report{}, fmt.Errorf("months must be between 1 and %d", MaxMonths)
+	}
+	if opts.Sample < 0 || opts.Sample > MaxSample {
+		return Report{}, fmt.Errorf("sample must be between 0 and %d", MaxSample)
+	}
+
+	local := now.In(v.loc)
+	to := time.Date(local.Year(), local.Month()+1, 1, 0, 0, 0, 0, v.loc)
+	from := to.AddDate(0, -opts.Months, 0)
+	if start := v.firstMonth(); from.Before(start) {
+		// Older deals are never synced, their months would always differ.
+		from = start
+	}
+	rep := Report{CheckedAt: now, From: from, To: to}
+
+	if err := v.compareCounts(ctx, &rep); err != nil {
+		return rep, err
+	}
+	if err := v.compareSample(ctx, &rep, opts.Sample); err != nil {
+		return rep, err
+	}
+
+	metrics.VerifyMismatches.WithLabelValues("count").Set(float64(len(rep.Counts)))
+	metrics.VerifyMismatches.WithLabelValues("sample").Set(float64(len(rep.Samples)))
+
+	if opts.Resync {
+		queued, err := v.store.EnqueueResyncs(ctx, resyncRequests(rep))
+		if err != nil {
+			return rep, fmt.Errorf("enqueue resyncs: %w", err)
+		}
+		rep.Resyncs = queued
+	}
+
+	logging.FromContext(ctx).Info("deals verified",
+		"cells", rep.Cells, "count_mismatches", len(rep.Counts),
+		"sampled", rep.Sampled, "sample_mismatches", len(rep.Samples), "resyncs", len(rep.Resyncs))
+	return rep, nil
+}
+
+// firstMonth is the first whole month of DATE_CREATE a full sync loads.
+func (v *Verifier) firstMonth() time.Time {
+	if v.since.IsZero() {
+		return time.Time{}
+	}
+	since := v.since.In(v.loc)
+	start := time.Date(since.Year(), since.Month(), 1, 0, 0, 0, 0, v.loc)
+	if start.Before(since) {
+		start = start.AddDate(0, 1, 0)
+	}
+	return start
+}
+
+func (v *Verifier) compareCounts(ctx context.Context, rep *Report) error {
+	counts, err := v.store.CountDealsByMonth(ctx, rep.From, rep.To, v.loc)
+	if err != nil {
+		return fmt.Errorf("count local deals: %w", err)
+	}
+	type cell struct {
+		category int
+		month    time.Time
+	}
+	localCounts := make(map[cell]int, len(counts))
+	for _, c := range counts {
+		localCounts[cell{c.CategoryID, c.Month}] = c.Deals
+	}
+
+	rep.Categories = filterCategories(v.filter)
+	if len(rep.Categories) == 0 {
+		for _, c := range counts {
+			if !slices.Contains(rep.Categories, c.CategoryID) {
+				rep.Categories = append(rep.Categories, c.CategoryID)
+			}
+		}
+	}
+	slices.Sort(rep.Categories)
+
+	for _, category := range rep.Categories {
+		for month := rep.From; month.Before(rep.To); month = month.AddDate(0, 1, 0) {
+			next := month.AddDate(0, 1, 0)
+			remote, err := v.bitrixCount(ctx, category, month, next)
+			if err != nil {
+				return err
+			}
+			stored := localCounts[cell{category, month}]
+			rep.Cells++
+			rep.BitrixTotal += remote
+			rep.LocalTotal += stored
+			if remote != stored {
+				problem := ProblemMissingLocally
+				if stored > remote {
+					problem = ProblemDeletedInBitrix
+				}
+				rep.Counts = append(rep.Counts, CountMismatch{
+					CategoryID: category,
+					Month:      month.Format("2006-01"),
+					From:       month,
+					To:         next,
+					Bitrix:     remote,
+					Local:      stored,
+					Problem:    problem,
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// bitrixCount returns the crm.item.list total of a category for deals
+// created in [from, to).
+func (v *Verifier) bitrixCount(ctx context.Context, category int, from, to time.Time) (int, error) {
+	filter := maps.Clone(v.filter)
+	if filter == nil {
+		filter = make(map[string]any)
+	}
+	delete(filter, "@categoryId")
+	filter["categoryId"] = category
+	filter[">=createdTime"] = from.Format(time.RFC3339)
+	filter["<createdTime"] = to.Format(time.RFC3339)
+
+	var page bitrix.ItemListResponse
+	if err := v.call(ctx, map[string]any{
+		"entityTypeId": dealEntityTypeID,
+		"select":       []string{"id"},
+		"filter":       filter,
+		"order":        map[string]any{"id": "ASC"},
+		"start":        0,
+	}, &page); err != nil {
+		return 0, fmt.Errorf("bitrix crm.item.list category=%d month=%s: %w", category, from.Format("2006-01"), err)
+	}
+	if page.Total != nil {
+		return *page.Total, nil
+	}
+	return len(page.Result.Items), nil
+}
+
+func (v *Verifier) compareSample(ctx context.Context, rep *Report, n int) error {
+	if n == 0 {
+		return nil
+	}
+	sample, err := v.store.SampleDeals(ctx, n)
+	if err != nil {
+		return fmt.Errorf("sample local deals: %w", err)
+	}
+	rep.Sampled = len(sample)
+
+	for chunk := range slices.Chunk(sample, idChunk) {
+		ids := make([]int64, len(chunk))
+		for i, s := range chunk {
+			ids[i] = s.ID
+		}
+		var page bitrix.ItemListResponse
+		if err := v.call(ctx, map[string]any{
+			"entityTypeId": dealEntityTypeID,
+			"select":       []string{"id", "updatedTime"},
+			"filter":       map[string]any{"@id": ids},
+			"start":        0,
+		}, &page); err != nil {
+			return fmt.Errorf("bitrix crm.item.list sample: %w", err)
+		}
+
+		remote := make(map[int64]bitrix.Item, len(page.Result.Items))
+		for _, it := range page.Result.Items {
+			if id := it.Int("id"); id != 0 {
+				remote[id] = it
+			}
+		}
+		for _, s := range chunk {
+			it, ok := remote[s.ID]
+			if !ok {
+				rep.Samples = append(rep.Samples, SampleMismatch{DealID: s.ID, Problem: ProblemMissingInBitrix, Local: s.DateModify})
+				continue
+			}
+			var modified *time.Time
+			if t, err := v.times.DateTime(it.String("updatedTime")); err == nil && !t.IsZero() {
+				modified = &t
+			}
+			if !sameTime(s.DateModify, modified) {
+				rep.Samples = append(rep.Samples, SampleMismatch{DealID: s.ID, Problem: ProblemDateModifyDiffers, Local: s.DateModify, Bitrix: modified})
+			}
+		}
+	}
+	slices.SortFunc(rep.Samples, func(a, b SampleMismatch) int { return cmp.Compare(a.DealID, b.DealID) })
+	return nil
+}
+
+// call runs crm.item.list, pausing first so that a long verification stays
+// under the Bitrix request rate.
+func (v *Verifier) call(ctx context.Context, payload map[string]any, out any) error {
+	if v.wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(v.wait):
+		}
+	}
+	return v.source.Call(ctx, "crm.item.list", payload, out)
+}
+
+// resyncRequests reloads every category and month with deals missing
+// locally and the sampled deals with a different DATE_MODIFY. Deals gone
+// from Bitrix are only reported: a resync never deletes.
+func resyncRequests(rep Report) []repo.ResyncRequest {
+	var out []repo.ResyncRequest
+	for _, c := range rep.Counts {
+		if c.Problem != ProblemMissingLocally {
+			continue
+		}
+		from, to := c.From, c.To
+		out = append(out, repo.ResyncRequest{
+			CategoryID: c.CategoryID,
+			DateFrom:   &from,
+			DateTo:     &to,
+			Reason:     fmt.Sprintf("verify: category %d %s bitrix=%d local=%d", c.CategoryID, c.Month, c.Bitrix, c.Local),
+		})
+	}
+	var ids []int64
+	for _, s := range rep.Samples {
+		if s.Problem == ProblemDateModifyDiffers {
+			ids = append(ids, s.DealID)
+		}
+	}
+	if len(ids) > 0 {
+		out = append(out, repo.ResyncRequest{
+			DealIDs: ids,
+			Reason:  fmt.Sprintf("verify: DATE_MODIFY differs for %d sampled deals", len(ids)),
+		})
+	}
+	return out
+}
+
+// filterCategories returns the categories a deal filter is limited to by
+// @categoryId or categoryId; none means every category.
+func filterCategories(filter map[string]any) []int {
+	var out []int
+	for _, key := range []string{"@categoryId", "categoryId"} {
+		switch v := filter[key].(type) {
+		case []int:
+			out = append(out, v...)
+		case []any:
+			for _, x := range v {
+				if n, ok := toInt(x); ok {
+					out = append(out, n)
+				}
+			}
+		default:
+			if n, ok := toInt(v); ok {
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
+
+// toInt reads a category ID as it appears in a filter from Go code or from
+// the ENTITIES_FILE JSON.
+func toInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	case string:
+		i, err := strconv.Atoi(n)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,145 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"freedom_bitrix/internal/bitrix"
+	"freedom_bitrix/internal/repo"
+	"testing"
+	"time"
+)
+
+// fakeBitrix answers crm.item.list with totals per category and month of
+// createdTime, or with the updatedTime of the requested IDs.
+type fakeBitrix struct {
+	totals   map[string]int
+	modified map[string]string
+}
+
+func (f *fakeBitrix) Call(ctx context.Context, method string, payload any, out any) error {
+	if method != "crm.item.list" || payload.(map[string]any)["entityTypeId"] != dealEntityTypeID {
+		return fmt.Errorf("unexpected method %s", method)
+	}
+	filter := payload.(map[string]any)["filter"].(map[string]any)
+	page := out.(*bitrix.ItemListResponse)
+	if ids, ok := filter["@id"].([]int64); ok {
+		for _, id := range ids {
+			if m, ok := f.modified[fmt.Sprint(id)]; ok {
+				page.Result.Items = append(page.Result.Items, bitrix.Item{"id": float64(id), "updatedTime": m})
+			}
+		}
+		return nil
+	}
+	if _, ok := filter["@categoryId"]; ok {
+		return fmt.Errorf("category list left in count filter")
+	}
+	total := f.totals[fmt.Sprintf("%v/%s", filter["categoryId"], filter[">=createdTime"])]
+	page.Total = &total
+	return nil
+}
+
+func TestRunReportsMismatchesAndQueuesResyncs(t *testing.T) {
+	ctx := context.Background()
+	loc := time.FixedZone("ALMT", 5*3600)
+	store := repo.NewMemoryRepository(repo.WithLocation(loc))
+	err := store.UpsertDeals(ctx, []bitrix.Deal{
+		// 1 Feb 01:00 in the portal timezone is still January in UTC.
+		{ID: "1", CategoryID: "1", DateCreate: "2026-02-01 01:00:00", DateModify: "2026-02-10 10:00:00"},
+		{ID: "2", CategoryID: "1", DateCreate: "2026-03-05 09:00:00", DateModify: "2026-03-05 09:00:00"},
+		{ID: "3", CategoryID: "31", DateCreate: "2026-03-06 09:00:00", DateModify: "2026-03-06 09:00:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeBitrix{
+		totals: map[string]int{
+			"1/2026-02-01T00:00:00+05:00": 1,
+			"1/2026-03-01T00:00:00+05:00": 2,
+			// Deal 3 was deleted in Bitrix.
+			"31/2026-03-01T00:00:00+05:00": 0,
+		},
+		modified: map[string]string{
+			"1": "2026-02-10T10:00:00+05:00",
+			"2": "2026-03-07T12:00:00+05:00",
+		},
+	}
+	v := NewVerifier(source, store, map[string]any{"@categoryId": []int{1, 31}}, time.Time{}, loc)
+	v.wait = 0
+
+	now := time.Date(2026, 3, 20, 12, 0, 0, 0, time.UTC)
+	rep, err := v.Run(ctx, Options{Months: 2, Sample: 10, Resync: true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.Cells != 4 || rep.BitrixTotal != 3 || rep.LocalTotal != 3 {
+		t.Fatalf("cells=%d bitrix=%d local=%d", rep.Cells, rep.BitrixTotal, rep.LocalTotal)
+	}
+	if len(rep.Counts) != 2 {
+		t.Fatalf("count mismatches = %+v", rep.Counts)
+	}
+	if c := rep.Counts[0]; c.CategoryID != 1 || c.Month != "2026-03" || c.Bitrix != 2 || c.Local != 1 || c.Problem != ProblemMissingLocally {
+		t.Fatalf("count mismatch = %+v", c)
+	}
+	if c := rep.Counts[1]; c.CategoryID != 31 || c.Month != "2026-03" || c.Bitrix != 0 || c.Local != 1 || c.Problem != ProblemDeletedInBitrix {
+		t.Fatalf("count mismatch = %+v", c)
+	}
+
+	if rep.Sampled != 3 || len(rep.Samples) != 2 {
+		t.Fatalf("sampled=%d mismatches=%+v", rep.Sampled, rep.Samples)
+	}
+	if s := rep.Samples[0]; s.DealID != 2 || s.Problem != ProblemDateModifyDiffers || s.Bitrix == nil {
+		t.Fatalf("sample mismatch = %+v", s)
+	}
+	if s := rep.Samples[1]; s.DealID != 3 || s.Problem != ProblemMissingInBitrix {
+		t.Fatalf("sample mismatch = %+v", s)
+	}
+
+	// The cell with the deleted deal is only reported, not resynced.
+	if len(rep.Resyncs) != 2 {
+		t.Fatalf("resyncs = %+v", rep.Resyncs)
+	}
+	r := rep.Resyncs[0]
+	if r.CategoryID != 1 || !r.DateFrom.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, loc)) || !r.DateTo.Equal(time.Date(2026, 4, 1, 0, 0, 0, 0, loc)) {
+		t.Fatalf("range resync = %+v", r)
+	}
+	if ids := rep.Resyncs[1].DealIDs; len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("deal resync = %+v", rep.Resyncs[1])
+	}
+
+	// A second run does not queue the still pending requests again.
+	rep, err = v.Run(ctx, Options{Months: 2, Sample: 10, Resync: true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Resyncs) != 0 {
+		t.Fatalf("requeued = %+v", rep.Resyncs)
+	}
+}
+
+func TestRunSkipsMonthsBeforeFullSync(t *testing.T) {
+	loc := time.FixedZone("ALMT", 5*3600)
+	store := repo.NewMemoryRepository(repo.WithLocation(loc))
+	// Bitrix has deals in every month; only those from February are synced.
+	source := &fakeBitrix{totals: map[string]int{
+		"1/2026-01-01T00:00:00+05:00": 5,
+		"1/2026-02-01T00:00:00+05:00": 0,
+		"1/2026-03-01T00:00:00+05:00": 0,
+	}}
+	since := time.Date(2026, 2, 1, 0, 0, 0, 0, loc)
+	v := NewVerifier(source, store, map[string]any{"categoryId": 1}, since, loc)
+	v.wait = 0
+
+	now := time.Date(2026, 3, 20, 12, 0, 0, 0, time.UTC)
+	rep, err := v.Run(context.Background(), Options{Months: 12, Resync: true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.From.Equal(since) || rep.Cells != 2 {
+		t.Fatalf("from=%v cells=%d, want from %v and 2 cells", rep.From, rep.Cells, since)
+	}
+	if !rep.OK() || len(rep.Resyncs) != 0 {
+		t.Fatalf("counts=%+v resyncs=%+v", rep.Counts, rep.Resyncs)
+	}
+}